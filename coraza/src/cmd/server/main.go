@@ -1,19 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 
 	"mamotama/internal/cacheconf"
 	"mamotama/internal/config"
+	"mamotama/internal/geoip"
 	"mamotama/internal/handler"
 	"mamotama/internal/middleware"
+	"mamotama/internal/proxyproto"
+	"mamotama/internal/tlsconf"
+	"mamotama/internal/tracing"
 	"mamotama/internal/waf"
 )
 
+// shutdownTimeout bounds how long in-flight requests may drain after
+// SIGTERM; it stays under docker-compose's stop_grace_period.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	config.LoadEnv()
 	if err := handler.InitLogsStatsStoreWithBackend(
@@ -29,6 +46,9 @@ func main() {
 	} else {
 		log.Printf("[DB][INIT] storage backend=%s", config.StorageBackend)
 	}
+	if err := handler.InitEventSinks(config.EventSinksFile); err != nil {
+		log.Printf("[EVENT_SINK][INIT][ERR] %v (path=%s, fallback=direct file append)", err, config.EventSinksFile)
+	}
 	if err := handler.SyncRuleFilesStorage(); err != nil {
 		log.Printf("[RULES][DB][WARN] sync failed (fallback=file): %v", err)
 	}
@@ -47,6 +67,18 @@ func main() {
 		}
 		log.Printf("[COUNTRY_BLOCK][INIT] loaded %d countries", len(handler.GetBlockedCountries()))
 	}
+	if err := handler.InitRateLimitCounterStore(
+		config.RateLimitBackend,
+		config.RateLimitRedisAddr,
+		config.RateLimitRedisPassword,
+		config.RateLimitRedisDB,
+		config.RateLimitRedisPrefix,
+		config.RateLimitRedisTimeout,
+	); err != nil {
+		log.Printf("[RATE_LIMIT][BACKEND][WARN] failed to initialize %s counter backend (fallback=memory): %v", config.RateLimitBackend, err)
+	} else {
+		log.Printf("[RATE_LIMIT][BACKEND] counter backend=%s", handler.GetRateLimitBackend())
+	}
 	if err := handler.InitRateLimit(config.RateLimitFile); err != nil {
 		log.Printf("[RATE_LIMIT][INIT][ERR] %v (path=%s)", err, config.RateLimitFile)
 	} else {
@@ -71,23 +103,94 @@ func main() {
 		}
 		log.Printf("[SEMANTIC][INIT] loaded")
 	}
+	if err := handler.InitResponseTemplates(config.ResponseTemplatesFile); err != nil {
+		log.Printf("[RESPONSE_TEMPLATES][INIT][ERR] %v (path=%s)", err, config.ResponseTemplatesFile)
+	} else {
+		if err := handler.SyncResponseTemplatesStorage(); err != nil {
+			log.Printf("[RESPONSE_TEMPLATES][DB][WARN] sync failed (fallback=file): %v", err)
+		}
+		log.Printf("[RESPONSE_TEMPLATES][INIT] loaded")
+	}
+	if err := handler.InitRoutes(config.RoutesFile); err != nil {
+		log.Printf("[ROUTES][INIT][ERR] %v (path=%s, fallback=WAF_APP_URL)", err, config.RoutesFile)
+	} else {
+		if err := handler.SyncRoutesStorage(); err != nil {
+			log.Printf("[ROUTES][DB][WARN] sync failed (fallback=file): %v", err)
+		}
+		log.Printf("[ROUTES][INIT] loaded")
+	}
+
+	handler.ConfigureCountryResolution(config.GeoIPMode, config.GeoIPHeader)
+	if config.GeoIPMode != "header" {
+		if config.GeoIPDBPath == "" {
+			log.Printf("[GEOIP][WARN] WAF_GEOIP_MODE=%s but WAF_GEOIP_DB_PATH is empty; countries resolve to UNKNOWN", config.GeoIPMode)
+		} else if stopGeoIP, err := geoip.Watch(config.GeoIPDBPath); err != nil {
+			log.Printf("[GEOIP][WARN] watch disabled: %v", err)
+		} else {
+			defer stopGeoIP()
+		}
+	}
+	log.Printf("[GEOIP] country source mode=%s header=%s", config.GeoIPMode, config.GeoIPHeader)
+
+	if err := handler.ConfigureTrustedProxies(config.TrustedProxies, config.ClientIPHeader, config.ClientIPDebug); err != nil {
+		log.Fatalf("[CLIENT_IP][ERR] invalid WAF_TRUSTED_PROXIES or WAF_CLIENT_IP_HEADER: %v", err)
+	}
+	log.Printf("[CLIENT_IP] trusted proxies=%v header=%s proxy_protocol=%t debug=%t", handler.GetTrustedProxies(), handler.GetClientIPHeader(), config.ProxyProtocol, config.ClientIPDebug)
+
+	stopTracing, err := tracing.Configure(tracing.Config{
+		Exporter:    config.TracingExporter,
+		Endpoint:    config.TracingOTLPEndpoint,
+		Headers:     config.TracingOTLPHeaders,
+		SampleRatio: config.TracingSampleRatio,
+		ServiceName: config.TracingServiceName,
+	})
+	if err != nil {
+		log.Printf("[TRACING][WARN] %v (tracing disabled)", err)
+	} else {
+		defer stopTracing()
+		log.Printf("[TRACING] exporter=%s sample_ratio=%g", config.TracingExporter, config.TracingSampleRatio)
+	}
 
 	log.Println("[INFO] WAF upstream target:", config.AppURL)
 
 	r := gin.Default()
 
-	// Never trust client-sent forwarding headers unless explicitly configured.
+	// Client IPs are resolved by the handler against WAF_TRUSTED_PROXIES;
+	// gin's own forwarding-header handling stays off.
 	if err := r.SetTrustedProxies(nil); err != nil {
 		log.Fatalf("failed to configure trusted proxies: %v", err)
 	}
 
+	// With WAF_ADMIN_LISTEN_ADDR the API, /healthz and /metrics get their own engine
+	// and listener; otherwise they share the public one.
+	admin := r
+	if config.AdminListenAddr != "" {
+		admin = gin.Default()
+		if err := admin.SetTrustedProxies(nil); err != nil {
+			log.Fatalf("failed to configure trusted proxies: %v", err)
+		}
+	}
+
 	// Lightweight unauthenticated probe for container health checks.
-	r.GET("/healthz", func(c *gin.Context) {
+	admin.GET("/healthz", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Prometheus scrape endpoint. It reveals route names and rule ids, so
+	// it takes the API key unless WAF_METRICS_REQUIRE_API_KEY=false.
+	if config.MetricsEnabled {
+		metricsAuth := []gin.HandlerFunc{middleware.AdminClientCert()}
+		if config.MetricsRequireAPIKey {
+			metricsAuth = append(metricsAuth, middleware.APIKeyAuth())
+		}
+		admin.GET("/metrics", append(metricsAuth, handler.MetricsHandler)...)
+	}
+
+	// Challenge pages post solved proof-of-work puzzles here.
+	r.POST(handler.PowChallengeVerifyPath, handler.VerifyPoWChallenge)
+
 	if len(config.APICORSOrigins) > 0 {
-		r.Use(cors.New(cors.Config{
+		admin.Use(cors.New(cors.Config{
 			AllowOrigins: config.APICORSOrigins,
 			AllowMethods: []string{"GET", "POST", "PUT", "OPTIONS"},
 			AllowHeaders: []string{"Origin", "Content-Type", "Accept", "X-API-Key"},
@@ -97,7 +200,7 @@ func main() {
 		log.Println("[SECURITY] CORS disabled (same-origin only)")
 	}
 
-	api := r.Group(config.APIBasePath, middleware.APIKeyAuth())
+	api := admin.Group(config.APIBasePath, middleware.AdminClientCert(), middleware.APIKeyAuth())
 	{
 		api.GET("/", func(c *gin.Context) {
 			c.JSON(200, gin.H{
@@ -111,13 +214,17 @@ func main() {
 					config.APIBasePath + "/cache-rules",
 					config.APIBasePath + "/country-block-rules",
 					config.APIBasePath + "/rate-limit-rules",
+					config.APIBasePath + "/rate-limit/counters",
 					config.APIBasePath + "/bot-defense-rules",
 					config.APIBasePath + "/semantic-rules",
+					config.APIBasePath + "/response-templates",
+					config.APIBasePath + "/routes",
 					config.APIBasePath + "/fp-tuner/propose",
 					config.APIBasePath + "/fp-tuner/apply",
 					config.APIBasePath + "/logs/read",
 					config.APIBasePath + "/logs/stats",
 					config.APIBasePath + "/logs/download",
+					config.APIBasePath + "/events/stream",
 				},
 			})
 		})
@@ -126,6 +233,7 @@ func main() {
 		api.GET("/logs/read", handler.LogsRead)
 		api.GET("/logs/stats", handler.LogsStats)
 		api.GET("/logs/download", handler.LogsDownload)
+		api.GET("/events/stream", handler.EventsStream)
 		api.GET("/rules", handler.RulesHandler)
 		api.POST("/rules:validate", handler.ValidateRules)
 		api.PUT("/rules", handler.PutRules)
@@ -144,12 +252,19 @@ func main() {
 		api.GET("/rate-limit-rules", handler.GetRateLimitRules)
 		api.POST("/rate-limit-rules:validate", handler.ValidateRateLimitRules)
 		api.PUT("/rate-limit-rules", handler.PutRateLimitRules)
+		api.GET("/rate-limit/counters", handler.GetRateLimitCounters)
 		api.GET("/bot-defense-rules", handler.GetBotDefenseRules)
 		api.POST("/bot-defense-rules:validate", handler.ValidateBotDefenseRules)
 		api.PUT("/bot-defense-rules", handler.PutBotDefenseRules)
 		api.GET("/semantic-rules", handler.GetSemanticRules)
 		api.POST("/semantic-rules:validate", handler.ValidateSemanticRules)
 		api.PUT("/semantic-rules", handler.PutSemanticRules)
+		api.GET("/response-templates", handler.GetResponseTemplates)
+		api.POST("/response-templates:validate", handler.ValidateResponseTemplates)
+		api.PUT("/response-templates", handler.PutResponseTemplates)
+		api.GET("/routes", handler.GetRoutes)
+		api.POST("/routes:validate", handler.ValidateRoutes)
+		api.PUT("/routes", handler.PutRoutes)
 		api.POST("/fp-tuner/propose", handler.ProposeFPTuning)
 		api.POST("/fp-tuner/apply", handler.ApplyFPTuning)
 	}
@@ -181,5 +296,79 @@ func main() {
 		defer stopWatch()
 	}
 
-	r.Run(":9090")
+	var tlsConfig *tls.Config
+	if config.TLSCertDir != "" {
+		tlsConfig, err = tlsconf.ServerConfig(config.TLSMinVersion, config.TLSCipherSuites, config.TLSAdminClientCAFile)
+		if err != nil {
+			log.Fatalf("[TLS][ERR] %v", err)
+		}
+		stopTLS, err := tlsconf.Watch(config.TLSCertDir)
+		if err != nil {
+			log.Fatalf("[TLS][ERR] load certificates from %s: %v", config.TLSCertDir, err)
+		}
+		defer stopTLS()
+		log.Printf("[TLS] https enabled cert_dir=%s min_version=%s admin_client_ca=%t", config.TLSCertDir, config.TLSMinVersion, config.TLSAdminClientCAFile != "")
+	} else if config.TLSAdminClientCAFile != "" {
+		log.Fatalf("[TLS][ERR] WAF_TLS_ADMIN_CLIENT_CA_FILE requires WAF_TLS_CERT_DIR")
+	}
+
+	// SIGTERM and Interrupt stop accepting connections and drain the ones
+	// in flight; main then returns so the deferred stops run.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+
+	var servers []*http.Server
+	if config.AdminListenAddr != "" {
+		adminLn, err := net.Listen("tcp", config.AdminListenAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on admin address: %v", err)
+		}
+		if tlsConfig != nil {
+			adminLn = tls.NewListener(adminLn, tlsConfig)
+		}
+		adminSrv := &http.Server{Handler: admin.Handler()}
+		adminSrv.RegisterOnShutdown(handler.CloseEventStreams)
+		servers = append(servers, adminSrv)
+		go func() {
+			if err := adminSrv.Serve(adminLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("[ADMIN][ERR] admin listener stopped: %v", err)
+			}
+		}()
+		log.Printf("[ADMIN] api=%s, /healthz and /metrics listening on %s (public listener does not serve them)", config.APIBasePath, config.AdminListenAddr)
+	}
+
+	ln, err := net.Listen("tcp", ":9090")
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	if config.ProxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Trusted: handler.IsTrustedProxy}
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	srv := &http.Server{Handler: r.Handler()}
+	srv.RegisterOnShutdown(handler.CloseEventStreams)
+	servers = append(servers, srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("[SERVER][ERR] listener stopped: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stopSignals()
+	log.Printf("[SHUTDOWN] draining connections (timeout=%s)", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[SHUTDOWN][WARN] %v", err)
+		}
+	}
+	// Events logged while draining are still queued; write them out.
+	if err := handler.CloseEventSinks(); err != nil {
+		log.Printf("[EVENT_SINK][WARN] close: %v", err)
+	}
+	log.Printf("[SHUTDOWN] done")
 }
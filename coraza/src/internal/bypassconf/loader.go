@@ -10,6 +10,8 @@ import (
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
+
+	"mamotama/internal/metrics"
 )
 
 var (
@@ -40,24 +42,43 @@ func Get() []Entry {
 }
 
 func Match(reqPath string) MatchResult {
-	p := normalize(reqPath)
 	mu.RLock()
 	defer mu.RUnlock()
+	return MatchEntries(entries, reqPath)
+}
+
+// MatchEntries applies the same rules as Match to a list that did not come
+// from the bypass file, such as a route override.
+func MatchEntries(entries []Entry, reqPath string) MatchResult {
+	p := normalize(reqPath)
 	bypassHit := false
+	monitor := false
+	extraRule := ""
 	for _, e := range entries {
 		if !pathMatches(p, e.Path) {
 			continue
 		}
+		if e.Monitor {
+			monitor = true
+		}
 		if e.ExtraRule != "" {
-			return MatchResult{Action: ACTION_RULE, ExtraRule: e.ExtraRule}
+			if extraRule == "" {
+				extraRule = e.ExtraRule
+			}
+			continue
+		}
+		if !e.Monitor {
+			bypassHit = true
 		}
-		bypassHit = true
+	}
+	if extraRule != "" {
+		return MatchResult{Action: ACTION_RULE, ExtraRule: extraRule, Monitor: monitor}
 	}
 	if bypassHit {
 		return MatchResult{Action: ACTION_BYPASS}
 	}
 
-	return MatchResult{Action: ACTION_NONE}
+	return MatchResult{Action: ACTION_NONE, Monitor: monitor}
 }
 
 func pathMatches(reqPath, rulePath string) bool {
@@ -69,7 +90,9 @@ func pathMatches(reqPath, rulePath string) bool {
 	return strings.HasSuffix(normalizedRulePath, "/") && strings.HasPrefix(reqPath, normalizedRulePath)
 }
 
-func reload() error {
+func reload() (err error) {
+	defer func() { metrics.ObserveReload("bypass", err) }()
+
 	b, err := os.ReadFile(confPath)
 	if err != nil {
 		return err
@@ -108,14 +131,19 @@ func Parse(s string) ([]Entry, error) {
 		if len(parts) == 0 {
 			continue
 		}
+		monitor := false
+		if len(parts) > 1 && strings.EqualFold(parts[len(parts)-1], MonitorKeyword) {
+			monitor = true
+			parts = parts[:len(parts)-1]
+		}
 		if len(parts) > 2 {
-			return nil, fmt.Errorf("line %d: expected '<path>' or '<path> <rule.conf>'", lineNo)
+			return nil, fmt.Errorf("line %d: expected '<path> [rule.conf] [monitor]'", lineNo)
 		}
 		if !strings.HasPrefix(parts[0], "/") {
 			return nil, fmt.Errorf("line %d: path must start with '/'", lineNo)
 		}
 
-		e := Entry{Path: normalize(parts[0])}
+		e := Entry{Path: normalize(parts[0]), Monitor: monitor}
 		if len(parts) == 2 {
 			rule := strings.TrimSpace(parts[1])
 			if !strings.HasSuffix(strings.ToLower(rule), ".conf") {
@@ -40,6 +40,36 @@ func TestParseInvalid(t *testing.T) {
 	}
 }
 
+func TestParseMonitor(t *testing.T) {
+	got, err := Parse("/beta/ monitor\n/api/ rules/api.conf MONITOR\n")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(got) != 2 || !got[0].Monitor || got[0].ExtraRule != "" || !got[1].Monitor || got[1].ExtraRule != "rules/api.conf" {
+		t.Fatalf("Parse() = %+v", got)
+	}
+}
+
+func TestMatchMonitorDoesNotBypass(t *testing.T) {
+	mu.Lock()
+	entries = []Entry{
+		{Path: "/beta/", Monitor: true},
+		{Path: "/beta/admin"},
+		{Path: "/api/", ExtraRule: "rules/api.conf", Monitor: true},
+	}
+	mu.Unlock()
+
+	if got := Match("/beta/page"); got.Action != ACTION_NONE || !got.Monitor {
+		t.Fatalf("Match(/beta/page) = %+v, want monitored inspection", got)
+	}
+	if got := Match("/beta/admin"); got.Action != ACTION_BYPASS {
+		t.Fatalf("Match(/beta/admin) = %+v, want bypass", got)
+	}
+	if got := Match("/api/v1"); got.Action != ACTION_RULE || !got.Monitor {
+		t.Fatalf("Match(/api/v1) = %+v, want monitored extra rule", got)
+	}
+}
+
 func TestMatchPrefersRuleOverBypass(t *testing.T) {
 	mu.Lock()
 	entries = []Entry{
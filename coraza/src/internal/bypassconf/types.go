@@ -8,12 +8,18 @@ const (
 	ACTION_RULE
 )
 
+// MonitorKeyword as the last token of a line puts matching paths in
+// detection-only mode instead of bypassing them.
+const MonitorKeyword = "monitor"
+
 type Entry struct {
 	Path      string
 	ExtraRule string
+	Monitor   bool
 }
 
 type MatchResult struct {
 	Action    Action
 	ExtraRule string
+	Monitor   bool
 }
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+
+	"mamotama/internal/metrics"
 )
 
 func Watch(target string, onReload func(*Ruleset)) (func() error, error) {
@@ -42,6 +44,7 @@ func Watch(target string, onReload func(*Ruleset)) (func() error, error) {
 		var timer *time.Timer
 		fire := func() {
 			rs, err := Load(abs)
+			metrics.ObserveReload("cache", err)
 			if err != nil {
 				log.Printf("[CACHE] reload failed: %v (keeping previous rules)", err)
 				return
@@ -11,24 +11,28 @@ import (
 )
 
 var (
-	AppURL           string
-	RulesFile        string
-	BypassFile       string
-	CountryBlockFile string
-	RateLimitFile    string
-	BotDefenseFile   string
-	SemanticFile     string
-	LogFile          string
-	StrictOverride   bool
-	APIBasePath      string
-	APIKeyPrimary    string
-	APIKeySecondary  string
-	APIAuthDisable   bool
-	APICORSOrigins   []string
-	CRSEnable        bool
-	CRSSetupFile     string
-	CRSRulesDir      string
-	CRSDisabledFile  string
+	AppURL                string
+	RulesFile             string
+	BypassFile            string
+	CountryBlockFile      string
+	RateLimitFile         string
+	BotDefenseFile        string
+	SemanticFile          string
+	ResponseTemplatesFile string
+	RoutesFile            string
+	LogFile               string
+	StrictOverride        bool
+	APIBasePath           string
+	APIKeyPrimary         string
+	APIKeySecondary       string
+	APIAuthDisable        bool
+	APICORSOrigins        []string
+	CRSEnable             bool
+	CRSSetupFile          string
+	CRSRulesDir           string
+	CRSDisabledFile       string
+	CRSMonitorFile        string
+	MonitorMode           bool
 
 	AllowInsecureDefaults bool
 
@@ -49,6 +53,43 @@ var (
 	DBPath          string
 	DBRetentionDays int
 	DBSyncInterval  time.Duration
+
+	RateLimitBackend       string
+	RateLimitRedisAddr     string
+	RateLimitRedisPassword string
+	RateLimitRedisDB       int
+	RateLimitRedisPrefix   string
+	RateLimitRedisTimeout  time.Duration
+
+	GeoIPMode   string
+	GeoIPDBPath string
+	GeoIPHeader string
+
+	TrustedProxies []string
+	ClientIPHeader string
+	ProxyProtocol  bool
+	ClientIPDebug  bool
+
+	ResponseInspectMaxBytes int64
+
+	AdminListenAddr string
+
+	MetricsEnabled       bool
+	MetricsRequireAPIKey bool
+
+	EventStreamMaxSubscribers int
+	EventSinksFile            string
+
+	TracingExporter     string
+	TracingOTLPEndpoint string
+	TracingOTLPHeaders  map[string]string
+	TracingSampleRatio  float64
+	TracingServiceName  string
+
+	TLSCertDir           string
+	TLSMinVersion        string
+	TLSCipherSuites      []string
+	TLSAdminClientCAFile string
 )
 
 func LoadEnv() {
@@ -73,6 +114,14 @@ func LoadEnv() {
 	if SemanticFile == "" {
 		SemanticFile = "conf/semantic.conf"
 	}
+	ResponseTemplatesFile = strings.TrimSpace(os.Getenv("WAF_RESPONSE_TEMPLATES_FILE"))
+	if ResponseTemplatesFile == "" {
+		ResponseTemplatesFile = "conf/response-templates.conf"
+	}
+	RoutesFile = strings.TrimSpace(os.Getenv("WAF_ROUTES_FILE"))
+	if RoutesFile == "" {
+		RoutesFile = "conf/routes.conf"
+	}
 	LogFile = os.Getenv("WAF_LOG_FILE")
 	StrictOverride = os.Getenv("WAF_STRICT_OVERRIDE") == "true"
 
@@ -105,6 +154,11 @@ func LoadEnv() {
 	if CRSDisabledFile == "" {
 		CRSDisabledFile = "conf/crs-disabled.conf"
 	}
+	CRSMonitorFile = strings.TrimSpace(os.Getenv("WAF_CRS_MONITOR_FILE"))
+	if CRSMonitorFile == "" {
+		CRSMonitorFile = "conf/crs-monitor.conf"
+	}
+	MonitorMode = isTruthy(os.Getenv("WAF_MONITOR_MODE"))
 
 	FPTunerMode = strings.ToLower(strings.TrimSpace(os.Getenv("WAF_FP_TUNER_MODE")))
 	if FPTunerMode == "" {
@@ -151,6 +205,75 @@ func LoadEnv() {
 	dbSyncSec := parseDBSyncIntervalSec(os.Getenv("WAF_DB_SYNC_INTERVAL_SEC"))
 	DBSyncInterval = time.Duration(dbSyncSec) * time.Second
 
+	RateLimitBackend = parseRateLimitBackend(os.Getenv("WAF_RATE_LIMIT_BACKEND"))
+	RateLimitRedisAddr = strings.TrimSpace(os.Getenv("WAF_RATE_LIMIT_REDIS_ADDR"))
+	RateLimitRedisPassword = os.Getenv("WAF_RATE_LIMIT_REDIS_PASSWORD")
+	RateLimitRedisDB = parseIntDefault(os.Getenv("WAF_RATE_LIMIT_REDIS_DB"), 0)
+	if RateLimitRedisDB < 0 {
+		RateLimitRedisDB = 0
+	}
+	RateLimitRedisPrefix = strings.TrimSpace(os.Getenv("WAF_RATE_LIMIT_REDIS_PREFIX"))
+	if RateLimitRedisPrefix == "" {
+		RateLimitRedisPrefix = "mamotama:rl:"
+	}
+	redisTimeoutMS := parseIntDefault(os.Getenv("WAF_RATE_LIMIT_REDIS_TIMEOUT_MS"), 200)
+	if redisTimeoutMS < 10 || redisTimeoutMS > 10000 {
+		redisTimeoutMS = 200
+	}
+	RateLimitRedisTimeout = time.Duration(redisTimeoutMS) * time.Millisecond
+
+	GeoIPMode = parseGeoIPMode(os.Getenv("WAF_GEOIP_MODE"))
+	GeoIPDBPath = strings.TrimSpace(os.Getenv("WAF_GEOIP_DB_PATH"))
+	GeoIPHeader = strings.TrimSpace(os.Getenv("WAF_GEOIP_HEADER"))
+	if GeoIPHeader == "" {
+		GeoIPHeader = "X-Country-Code"
+	}
+
+	TrustedProxies = parseTrustedProxies(os.Getenv("WAF_TRUSTED_PROXIES"))
+	ClientIPHeader = strings.TrimSpace(os.Getenv("WAF_CLIENT_IP_HEADER"))
+	if ClientIPHeader == "" {
+		ClientIPHeader = "X-Forwarded-For"
+	}
+	ProxyProtocol = isTruthy(os.Getenv("WAF_PROXY_PROTOCOL"))
+	ClientIPDebug = isTruthy(os.Getenv("WAF_CLIENT_IP_DEBUG"))
+
+	ResponseInspectMaxBytes = int64(parseIntDefault(os.Getenv("WAF_RESPONSE_INSPECT_MAX_BYTES"), 1048576))
+	if ResponseInspectMaxBytes < 0 {
+		ResponseInspectMaxBytes = 0
+	}
+
+	AdminListenAddr = strings.TrimSpace(os.Getenv("WAF_ADMIN_LISTEN_ADDR"))
+
+	MetricsEnabled = !isFalsy(os.Getenv("WAF_METRICS_ENABLED"))
+	MetricsRequireAPIKey = !isFalsy(os.Getenv("WAF_METRICS_REQUIRE_API_KEY"))
+
+	EventStreamMaxSubscribers = parseIntDefault(os.Getenv("WAF_EVENT_STREAM_MAX_SUBSCRIBERS"), 64)
+	if EventStreamMaxSubscribers < 1 {
+		EventStreamMaxSubscribers = 64
+	}
+
+	EventSinksFile = strings.TrimSpace(os.Getenv("WAF_EVENT_SINKS_FILE"))
+	if EventSinksFile == "" {
+		EventSinksFile = "conf/event-sinks.conf"
+	}
+
+	TracingExporter = parseTracingExporter(os.Getenv("WAF_TRACING_EXPORTER"))
+	TracingOTLPEndpoint = strings.TrimSpace(os.Getenv("WAF_TRACING_OTLP_ENDPOINT"))
+	if TracingOTLPEndpoint == "" {
+		TracingOTLPEndpoint = "http://localhost:4318/v1/traces"
+	}
+	TracingOTLPHeaders = parseHeaderPairs(os.Getenv("WAF_TRACING_OTLP_HEADERS"))
+	TracingSampleRatio = parseSampleRatio(os.Getenv("WAF_TRACING_SAMPLE_RATIO"))
+	TracingServiceName = strings.TrimSpace(os.Getenv("WAF_TRACING_SERVICE_NAME"))
+	if TracingServiceName == "" {
+		TracingServiceName = "mamotama"
+	}
+
+	TLSCertDir = strings.TrimSpace(os.Getenv("WAF_TLS_CERT_DIR"))
+	TLSMinVersion = parseTLSMinVersion(os.Getenv("WAF_TLS_MIN_VERSION"))
+	TLSCipherSuites = parseCSV(os.Getenv("WAF_TLS_CIPHER_SUITES"))
+	TLSAdminClientCAFile = strings.TrimSpace(os.Getenv("WAF_TLS_ADMIN_CLIENT_CA_FILE"))
+
 	AllowInsecureDefaults = isTruthy(os.Getenv("WAF_ALLOW_INSECURE_DEFAULTS"))
 	enforceSecureDefaults()
 }
@@ -274,3 +397,103 @@ func parseDBSyncIntervalSec(v string) int {
 	}
 	return n
 }
+
+func parseRateLimitBackend(v string) string {
+	s := strings.ToLower(strings.TrimSpace(v))
+	switch s {
+	case "":
+		return "memory"
+	case "memory", "db", "redis":
+		return s
+	default:
+		log.Printf("[CONFIG][WARN] unsupported WAF_RATE_LIMIT_BACKEND=%q, fallback=memory", s)
+		return "memory"
+	}
+}
+
+func parseTLSMinVersion(v string) string {
+	s := strings.TrimSpace(v)
+	switch s {
+	case "1.2", "1.3":
+		return s
+	case "":
+		return "1.2"
+	default:
+		log.Printf("[CONFIG][WARN] unsupported WAF_TLS_MIN_VERSION=%q, fallback=1.2", s)
+		return "1.2"
+	}
+}
+
+func parseTracingExporter(v string) string {
+	s := strings.ToLower(strings.TrimSpace(v))
+	switch s {
+	case "":
+		return "none"
+	case "none", "otlp", "stdout":
+		return s
+	default:
+		log.Printf("[CONFIG][WARN] unsupported WAF_TRACING_EXPORTER=%q, fallback=none", s)
+		return "none"
+	}
+}
+
+// parseHeaderPairs reads "key=value,key=value", as OTEL_EXPORTER_OTLP_HEADERS.
+func parseHeaderPairs(v string) map[string]string {
+	out := map[string]string{}
+	for _, pair := range parseCSV(v) {
+		k, val, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			log.Printf("[CONFIG][WARN] ignoring header %q in WAF_TRACING_OTLP_HEADERS (want key=value)", pair)
+			continue
+		}
+		out[k] = strings.TrimSpace(val)
+	}
+	return out
+}
+
+func parseSampleRatio(v string) float64 {
+	s := strings.TrimSpace(v)
+	if s == "" {
+		return 1
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		log.Printf("[CONFIG][WARN] invalid WAF_TRACING_SAMPLE_RATIO=%q, fallback=1", s)
+		return 1
+	}
+	return f
+}
+
+func parseGeoIPMode(v string) string {
+	s := strings.ToLower(strings.TrimSpace(v))
+	switch s {
+	case "":
+		return "header"
+	case "header", "mmdb", "auto":
+		return s
+	default:
+		log.Printf("[CONFIG][WARN] unsupported WAF_GEOIP_MODE=%q, fallback=header", s)
+		return "header"
+	}
+}
+
+// defaultTrustedProxies covers loopback only. Private ranges are not
+// trusted by default: VPC peers and Docker's userland proxy also connect
+// from them, so the proxy in front must be listed explicitly.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+}
+
+func parseTrustedProxies(v string) []string {
+	s := strings.TrimSpace(v)
+	switch strings.ToLower(s) {
+	case "":
+		return append([]string(nil), defaultTrustedProxies...)
+	case "none":
+		return []string{}
+	default:
+		return parseCSV(s)
+	}
+}
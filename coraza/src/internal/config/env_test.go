@@ -117,3 +117,127 @@ func TestParseDBSyncIntervalSec(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRateLimitBackend(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "memory"},
+		{in: "memory", want: "memory"},
+		{in: "DB", want: "db"},
+		{in: "redis", want: "redis"},
+		{in: "memcached", want: "memory"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.in+"->"+tc.want, func(t *testing.T) {
+			if got := parseRateLimitBackend(tc.in); got != tc.want {
+				t.Fatalf("parseRateLimitBackend(%q)=%q want=%q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseGeoIPMode(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "header"},
+		{in: "header", want: "header"},
+		{in: "MMDB", want: "mmdb"},
+		{in: "auto", want: "auto"},
+		{in: "cloudflare", want: "header"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.in+"->"+tc.want, func(t *testing.T) {
+			if got := parseGeoIPMode(tc.in); got != tc.want {
+				t.Fatalf("parseGeoIPMode(%q)=%q want=%q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTLSMinVersion(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "1.2"},
+		{in: "1.2", want: "1.2"},
+		{in: " 1.3 ", want: "1.3"},
+		{in: "1.0", want: "1.2"},
+		{in: "tls13", want: "1.2"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.in+"->"+tc.want, func(t *testing.T) {
+			if got := parseTLSMinVersion(tc.in); got != tc.want {
+				t.Fatalf("parseTLSMinVersion(%q)=%q want=%q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTracingExporter(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "none"},
+		{in: "OTLP", want: "otlp"},
+		{in: " stdout ", want: "stdout"},
+		{in: "jaeger", want: "none"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.in+"->"+tc.want, func(t *testing.T) {
+			if got := parseTracingExporter(tc.in); got != tc.want {
+				t.Fatalf("parseTracingExporter(%q)=%q want=%q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseHeaderPairs(t *testing.T) {
+	got := parseHeaderPairs(" Authorization=Bearer abc , x-scope= tenant-1,broken,=empty")
+	if len(got) != 2 || got["Authorization"] != "Bearer abc" || got["x-scope"] != "tenant-1" {
+		t.Fatalf("parseHeaderPairs()=%v", got)
+	}
+}
+
+func TestParseSampleRatio(t *testing.T) {
+	cases := []struct {
+		in   string
+		want float64
+	}{
+		{in: "", want: 1},
+		{in: "0", want: 0},
+		{in: "0.25", want: 0.25},
+		{in: "1.5", want: 1},
+		{in: "half", want: 1},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			if got := parseSampleRatio(tc.in); got != tc.want {
+				t.Fatalf("parseSampleRatio(%q)=%v want=%v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if got := parseTrustedProxies(""); len(got) != 2 || got[0] != "127.0.0.0/8" || got[1] != "::1/128" {
+		t.Fatalf("parseTrustedProxies(\"\")=%v want loopback only", got)
+	}
+	if got := parseTrustedProxies(" none "); len(got) != 0 {
+		t.Fatalf("parseTrustedProxies(none)=%v want empty", got)
+	}
+	got := parseTrustedProxies("10.0.0.0/8, 203.0.113.7 ,")
+	if len(got) != 2 || got[0] != "10.0.0.0/8" || got[1] != "203.0.113.7" {
+		t.Fatalf("parseTrustedProxies(csv)=%v", got)
+	}
+}
@@ -42,6 +42,12 @@ func LoadDisabledFile(path string) (map[string]struct{}, error) {
 	return ParseDisabled(string(b)), nil
 }
 
+// LoadMonitorFile reads the CRS files that run in detection-only mode. The
+// format is the same as the disabled list: one filename per line.
+func LoadMonitorFile(path string) (map[string]struct{}, error) {
+	return LoadDisabledFile(path)
+}
+
 func FilterEnabledPaths(paths []string, disabled map[string]struct{}) []string {
 	if len(disabled) == 0 {
 		out := make([]string, len(paths))
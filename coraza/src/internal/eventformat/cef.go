@@ -0,0 +1,119 @@
+package eventformat
+
+import (
+	"strconv"
+	"strings"
+)
+
+// cefField is one extension key. Custom string and number keys carry a
+// label naming the native field.
+type cefField struct {
+	key   string
+	label string
+	value string
+}
+
+// toCEF renders an event as a CEF:0 line. The device event class id is
+// the event type. Only the fields listed in the mapping are carried; CEF
+// has no place for arbitrary keys.
+func toCEF(evt map[string]any) string {
+	s := summarize(evt)
+	f := newFields(evt)
+
+	act := ""
+	switch s.disposition {
+	case dispositionBlocked:
+		act = "blocked"
+	case dispositionChallenged:
+		act = "challenged"
+	case dispositionDetected:
+		act = "detected"
+	}
+	ext := []cefField{
+		{key: "cat", value: s.category},
+		{key: "act", value: act},
+		{key: "src", value: f.str("ip")},
+		{key: "requestMethod", value: f.str("method")},
+		{key: "request", value: f.str("path")},
+		{key: "externalId", value: f.str("req_id")},
+		{key: "msg", value: f.str("msg")},
+		{key: "cs1", label: "ruleId", value: f.str(s.ruleKey)},
+		{key: "cs2", label: "rules", value: f.str("rules")},
+		{key: "cs3", label: "country", value: f.country()},
+		{key: "cs4", label: "traceId", value: f.str("trace_id")},
+		{key: "cn1", label: "status", value: f.str("status")},
+	}
+	if !s.time.IsZero() {
+		ext = append([]cefField{{key: "rt", value: strconv.FormatInt(s.time.UnixMilli(), 10)}}, ext...)
+	}
+
+	// cs5, cs6, cn2 and cn3 depend on the event type.
+	slot := func(key, nativeKey string) {
+		ext = append(ext, cefField{key: key, label: cefLabels[nativeKey], value: f.str(nativeKey)})
+	}
+	switch s.category {
+	case "waf":
+		slot("cs5", "matched_variable")
+		slot("cs6", "phase")
+	case "rate_limit":
+		slot("cs5", "algorithm")
+		slot("cs6", "rl_key_hash")
+		slot("cn2", "limit")
+		slot("cn3", "window_sec")
+	case "bot_defense":
+		slot("cs5", "signals")
+		slot("cs6", "mode")
+		slot("cn2", "score")
+		slot("cn3", "difficulty")
+	case "semantic":
+		slot("cs5", "reasons")
+		slot("cn2", "score")
+	}
+
+	var b strings.Builder
+	b.WriteString("CEF:0|")
+	for _, h := range []string{productName, productName, productVersion(), s.event, s.name, strconv.Itoa(s.severity)} {
+		b.WriteString(cefHeader(h))
+		b.WriteByte('|')
+	}
+	first := true
+	for _, x := range ext {
+		if x.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(x.key)
+		b.WriteByte('=')
+		b.WriteString(cefValue(x.value))
+		if x.label != "" {
+			b.WriteString(" " + x.key + "Label=" + cefValue(x.label))
+		}
+	}
+	return b.String()
+}
+
+// cefLabels names the event-specific custom fields.
+var cefLabels = map[string]string{
+	"matched_variable": "matchedVariable",
+	"phase":            "phase",
+	"algorithm":        "algorithm",
+	"rl_key_hash":      "rlKeyHash",
+	"limit":            "limit",
+	"window_sec":       "windowSec",
+	"signals":          "signals",
+	"mode":             "mode",
+	"score":            "score",
+	"difficulty":       "difficulty",
+	"reasons":          "reasons",
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func cefHeader(v string) string { return cefHeaderEscaper.Replace(v) }
+func cefValue(v string) string  { return cefValueEscaper.Replace(v) }
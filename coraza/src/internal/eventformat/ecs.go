@@ -0,0 +1,91 @@
+package eventformat
+
+import "strings"
+
+const ecsVersion = "8.11.0"
+
+// toECS maps an event to Elastic Common Schema. Fields without an ECS
+// counterpart are kept under "mamotama" with their native names.
+func toECS(evt map[string]any) map[string]any {
+	s := summarize(evt)
+	f := newFields(evt)
+	doc := map[string]any{
+		"ecs":      map[string]any{"version": ecsVersion},
+		"observer": map[string]any{"vendor": productName, "product": productName, "type": "waf", "version": productVersion()},
+	}
+	f.use("ts", "event")
+	if !s.time.IsZero() {
+		doc["@timestamp"] = s.time.Format("2006-01-02T15:04:05.000000000Z07:00")
+	}
+
+	kind := "event"
+	types := []string{"info"}
+	switch s.disposition {
+	case dispositionBlocked, dispositionChallenged:
+		kind, types = "alert", []string{"access", "denied"}
+	case dispositionDetected:
+		kind, types = "alert", []string{"access", "allowed"}
+	}
+	categories := []string{"web"}
+	if s.category == "waf" || s.category == "semantic" || s.category == "bot_defense" {
+		categories = append(categories, "intrusion_detection")
+	}
+	setPath(doc, "event.kind", kind)
+	setPath(doc, "event.category", categories)
+	setPath(doc, "event.type", types)
+	setPath(doc, "event.action", s.event)
+	setPath(doc, "event.severity", s.severity)
+	setPath(doc, "event.dataset", "mamotama.events")
+	reqID := f.str("req_id")
+	setPath(doc, "event.id", reqID)
+
+	msg := f.str("msg")
+	message := s.name
+	if msg != "" {
+		message += ": " + msg
+	}
+	doc["message"] = message
+	switch s.event {
+	case "semantic_anomaly":
+		setPath(doc, "event.reason", f.str("reasons"))
+	case "bot_challenge":
+		setPath(doc, "event.reason", f.str("signals"))
+	default:
+		setPath(doc, "event.reason", msg)
+	}
+
+	setPath(doc, "log.level", strings.ToLower(f.str("level")))
+	setPath(doc, "service.name", f.str("service"))
+	setPath(doc, "trace.id", f.str("trace_id"))
+
+	if ip := f.str("ip"); ip != "" {
+		setPath(doc, "source.ip", ip)
+		setPath(doc, "related.ip", []string{ip})
+	}
+	setPath(doc, "source.geo.country_iso_code", f.country())
+	setPath(doc, "url.path", f.str("path"))
+	setPath(doc, "http.request.id", reqID)
+	setPath(doc, "http.request.method", f.str("method"))
+	if status, ok := f.int("status"); ok {
+		setPath(doc, "http.response.status_code", status)
+	}
+
+	if s.category != "" {
+		setPath(doc, "rule.category", s.category)
+	}
+	if s.ruleKey != "" {
+		setPath(doc, "rule.id", f.str(s.ruleKey))
+		setPath(doc, "rule.name", msg)
+	} else if s.event == "waf_hit_allow" {
+		setPath(doc, "rule.id", splitList(f.str("rules")))
+	}
+	if tags, ok := evt["tags"]; ok {
+		f.use("tags")
+		setPath(doc, "tags", tags)
+	}
+
+	if rest := f.rest(); len(rest) > 0 {
+		doc[productName] = rest
+	}
+	return doc
+}
@@ -0,0 +1,323 @@
+// Package eventformat renders proxy events in the schemas SIEMs ingest:
+// Elastic Common Schema, ArcSight CEF and OCSF HTTP Activity.
+package eventformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats. Native is the event as the proxy writes it.
+const (
+	Native = "native"
+	ECS    = "ecs"
+	CEF    = "cef"
+	OCSF   = "ocsf"
+)
+
+const productName = "mamotama"
+
+// Parse returns the canonical format name. Empty selects Native.
+func Parse(name string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(name)); f {
+	case "":
+		return Native, nil
+	case Native, ECS, CEF, OCSF:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown event format %q (want %s, %s, %s or %s)", name, Native, ECS, CEF, OCSF)
+}
+
+// Encoder returns a function rendering one event in the named format. ECS,
+// OCSF and native events are JSON objects; CEF events are single lines.
+func Encoder(name string) (func(map[string]any) ([]byte, error), error) {
+	f, err := Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	switch f {
+	case ECS:
+		return func(evt map[string]any) ([]byte, error) { return json.Marshal(toECS(evt)) }, nil
+	case OCSF:
+		return func(evt map[string]any) ([]byte, error) { return json.Marshal(toOCSF(evt)) }, nil
+	case CEF:
+		return func(evt map[string]any) ([]byte, error) { return []byte(toCEF(evt)), nil }, nil
+	}
+	return func(evt map[string]any) ([]byte, error) { return json.Marshal(evt) }, nil
+}
+
+// ContentType is the media type of a stream of events in format f.
+func ContentType(f string) string {
+	if f == CEF {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// disposition is what the proxy did with the request.
+type disposition int
+
+const (
+	dispositionUnknown disposition = iota
+	dispositionBlocked
+	dispositionChallenged
+	// dispositionDetected marks a match that was only logged.
+	dispositionDetected
+)
+
+// summary holds what every format derives from an event the same way.
+type summary struct {
+	event       string
+	category    string
+	name        string
+	disposition disposition
+	// severity is on the CEF scale, 0 to 10.
+	severity int
+	// ruleKey is the native key holding the rule or policy id.
+	ruleKey string
+	time    time.Time
+}
+
+func summarize(evt map[string]any) summary {
+	s := summary{event: stringValue(evt["event"])}
+	if t, err := time.Parse(time.RFC3339Nano, stringValue(evt["ts"])); err == nil {
+		s.time = t.UTC()
+	}
+	action := stringValue(evt["action"])
+
+	switch s.event {
+	case "waf_block":
+		s.category, s.name, s.disposition = "waf", "WAF blocked request", dispositionBlocked
+	case "waf_would_block":
+		s.category, s.name, s.disposition = "waf", "WAF would block request", dispositionDetected
+	case "waf_hit_allow":
+		s.category, s.name, s.disposition = "waf", "WAF rules matched", dispositionDetected
+	case "country_block":
+		s.category, s.name, s.disposition = "country_block", "Country blocked", dispositionBlocked
+	case "rate_limited":
+		s.category, s.name, s.disposition = "rate_limit", "Rate limit exceeded", dispositionBlocked
+		s.ruleKey = "policy_id"
+	case "bot_challenge":
+		s.category, s.name, s.disposition = "bot_defense", "Bot challenge", dispositionChallenged
+		if action == "log_only" {
+			s.name, s.disposition = "Bot signals detected", dispositionDetected
+		}
+	case "semantic_anomaly":
+		s.category, s.name = "semantic", "Semantic anomaly"
+		switch action {
+		case "block":
+			s.disposition = dispositionBlocked
+		case "challenge":
+			s.disposition = dispositionChallenged
+		default:
+			s.disposition = dispositionDetected
+		}
+	default:
+		s.name = s.event
+		if s.name == "" {
+			s.name = "event"
+		}
+	}
+	if s.category == "waf" {
+		// matched_rule_id is the detection rule; rule_id may be the CRS
+		// evaluation rule that interrupted. waf_hit_allow has neither.
+		for _, k := range []string{"matched_rule_id", "rule_id"} {
+			if stringValue(evt[k]) != "" {
+				s.ruleKey = k
+				break
+			}
+		}
+	}
+
+	switch s.disposition {
+	case dispositionBlocked:
+		s.severity = 7
+	case dispositionChallenged:
+		s.severity = 5
+	case dispositionDetected:
+		s.severity = 3
+	default:
+		switch strings.ToUpper(stringValue(evt["level"])) {
+		case "ERROR":
+			s.severity = 6
+		case "WARN":
+			s.severity = 4
+		default:
+			s.severity = 1
+		}
+	}
+	return s
+}
+
+// fields tracks which native keys a format has mapped, so that the rest
+// can be carried along unchanged.
+type fields struct {
+	evt  map[string]any
+	used map[string]bool
+}
+
+func newFields(evt map[string]any) *fields {
+	return &fields{evt: evt, used: map[string]bool{}}
+}
+
+// str marks key as mapped and returns its value as a string.
+func (f *fields) str(key string) string {
+	if key == "" {
+		return ""
+	}
+	f.used[key] = true
+	return stringValue(f.evt[key])
+}
+
+// int marks key as mapped and returns its value if it is an integer.
+func (f *fields) int(key string) (int64, bool) {
+	f.used[key] = true
+	return intValue(f.evt[key])
+}
+
+func (f *fields) use(keys ...string) {
+	for _, k := range keys {
+		f.used[k] = true
+	}
+}
+
+// rest returns the keys no format field took. Comma-separated lists
+// become arrays.
+func (f *fields) rest() map[string]any {
+	out := map[string]any{}
+	for k, v := range f.evt {
+		if f.used[k] || v == nil || v == "" {
+			continue
+		}
+		if listKeys[k] {
+			if s, ok := v.(string); ok {
+				v = splitList(s)
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// listKeys are native fields holding comma-separated values.
+var listKeys = map[string]bool{"rules": true, "signals": true, "reasons": true}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// country returns the ISO code of the client country. UNKNOWN is left
+// for rest.
+func (f *fields) country() string {
+	c := knownCountry(stringValue(f.evt["country"]))
+	if c != "" {
+		f.use("country")
+	}
+	return c
+}
+
+// knownCountry drops the placeholder used when no country is resolved.
+func knownCountry(c string) string {
+	if len(c) != 2 {
+		return ""
+	}
+	return strings.ToUpper(c)
+}
+
+func stringValue(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case bool:
+		return strconv.FormatBool(x)
+	case json.Number:
+		return x.String()
+	case []string:
+		return strings.Join(x, ",")
+	case []any:
+		parts := make([]string, 0, len(x))
+		for _, p := range x {
+			parts = append(parts, stringValue(p))
+		}
+		return strings.Join(parts, ",")
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+func intValue(v any) (int64, bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), true
+	case int64:
+		return x, true
+	case float64:
+		if x == float64(int64(x)) {
+			return int64(x), true
+		}
+	case json.Number:
+		n, err := x.Int64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// setPath sets m[a][b]...= v, creating nested maps. Empty values are
+// skipped so that documents only carry what the event had.
+func setPath(m map[string]any, path string, v any) {
+	switch x := v.(type) {
+	case nil:
+		return
+	case string:
+		if x == "" {
+			return
+		}
+	case []string:
+		if len(x) == 0 {
+			return
+		}
+	}
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+var productVersion = sync.OnceValue(func() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+})
@@ -0,0 +1,224 @@
+package eventformat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Events as the proxy writes them, one per type.
+func sampleEventsForTest() map[string]map[string]any {
+	base := func(event, level string) map[string]any {
+		return map[string]any{
+			"ts": "2026-05-06T07:08:09.123456789Z", "service": "coraza", "level": level, "event": event,
+			"req_id": "req-1", "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+			"ip": "203.0.113.7", "country": "JP", "country_source": "header", "path": "/login",
+		}
+	}
+	waf := base("waf_block", "WARN")
+	for k, v := range map[string]any{
+		"phase": "request", "method": "POST", "rule_id": 949110, "status": 403, "action": "deny",
+		"matched_rule_id": 942100, "msg": "SQL Injection Attack Detected via libinjection",
+		"rules": "942100,949110", "severity": "CRITICAL", "tags": []string{"attack-sqli"},
+		"matched_variable": "ARGS:q", "matched_value": "1' or '1'='1",
+	} {
+		waf[k] = v
+	}
+	rl := base("rate_limited", "WARN")
+	for k, v := range map[string]any{
+		"status": 429, "policy_id": "login", "limit": 10, "window_sec": 60, "algorithm": "sliding_window", "rl_key_hash": "ab12cd34",
+	} {
+		rl[k] = v
+	}
+	bot := base("bot_challenge", "WARN")
+	for k, v := range map[string]any{"status": 429, "mode": "suspicious", "action": "challenge", "score": 4, "signals": "ua_missing,no_accept"} {
+		bot[k] = v
+	}
+	sem := base("semantic_anomaly", "WARN")
+	for k, v := range map[string]any{"action": "log_only", "score": 5, "reasons": "sqli_keyword,comment"} {
+		sem[k] = v
+	}
+	cb := base("country_block", "WARN")
+	cb["status"] = 403
+	cb["country"] = "UNKNOWN"
+	allow := base("waf_hit_allow", "INFO")
+	allow["rules"] = "920350,932100"
+	allow["status"] = 200
+	return map[string]map[string]any{
+		"waf_block": waf, "rate_limited": rl, "bot_challenge": bot,
+		"semantic_anomaly": sem, "country_block": cb, "waf_hit_allow": allow,
+	}
+}
+
+// lookupForTest follows a dotted path through decoded JSON.
+func lookupForTest(doc map[string]any, path string) any {
+	var cur any = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[k]
+	}
+	return cur
+}
+
+func encodeJSONForTest(t *testing.T, format string, evt map[string]any) map[string]any {
+	t.Helper()
+	enc, err := Encoder(format)
+	if err != nil {
+		t.Fatalf("Encoder(%s): %v", format, err)
+	}
+	b, err := enc(evt)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("decode %s: %v", b, err)
+	}
+	return doc
+}
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]string{"": Native, "ECS": ECS, " cef ": CEF, "ocsf": OCSF, "native": Native} {
+		if got, err := Parse(in); err != nil || got != want {
+			t.Fatalf("Parse(%q)=%q,%v want %q", in, got, err, want)
+		}
+	}
+	if _, err := Parse("leef"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestECS(t *testing.T) {
+	events := sampleEventsForTest()
+	tests := []struct {
+		event string
+		want  map[string]any
+	}{
+		{"waf_block", map[string]any{
+			"@timestamp": "2026-05-06T07:08:09.123456789Z", "event.kind": "alert", "event.action": "waf_block",
+			"event.severity": 7.0, "event.id": "req-1", "source.ip": "203.0.113.7", "source.geo.country_iso_code": "JP",
+			"url.path": "/login", "http.request.method": "POST", "http.response.status_code": 403.0,
+			"rule.id": "942100", "rule.category": "waf", "trace.id": "4bf92f3577b34da6a3ce929d0e0e4736",
+			"mamotama.rule_id": 949110.0, "mamotama.matched_variable": "ARGS:q", "mamotama.country_source": "header",
+		}},
+		{"rate_limited", map[string]any{
+			"rule.id": "login", "rule.category": "rate_limit", "http.response.status_code": 429.0,
+			"mamotama.rl_key_hash": "ab12cd34", "mamotama.limit": 10.0, "mamotama.window_sec": 60.0,
+		}},
+		{"bot_challenge", map[string]any{"event.reason": "ua_missing,no_accept", "mamotama.score": 4.0, "mamotama.mode": "suspicious"}},
+		{"semantic_anomaly", map[string]any{"event.kind": "alert", "event.severity": 3.0, "event.reason": "sqli_keyword,comment"}},
+		{"country_block", map[string]any{"source.geo.country_iso_code": nil, "mamotama.country": "UNKNOWN", "rule.category": "country_block"}},
+		{"waf_hit_allow", map[string]any{"log.level": "info", "http.response.status_code": 200.0}},
+	}
+	for _, tt := range tests {
+		doc := encodeJSONForTest(t, ECS, events[tt.event])
+		for path, want := range tt.want {
+			if got := lookupForTest(doc, path); got != want {
+				t.Fatalf("%s: %s=%#v want %#v", tt.event, path, got, want)
+			}
+		}
+	}
+
+	doc := encodeJSONForTest(t, ECS, events["waf_block"])
+	if types := lookupForTest(doc, "event.type").([]any); len(types) != 2 || types[1] != "denied" {
+		t.Fatalf("event.type=%v", types)
+	}
+	if rules := lookupForTest(doc, "mamotama.rules").([]any); len(rules) != 2 || rules[0] != "942100" {
+		t.Fatalf("mamotama.rules=%v", rules)
+	}
+	doc = encodeJSONForTest(t, ECS, events["waf_hit_allow"])
+	if ids := lookupForTest(doc, "rule.id").([]any); len(ids) != 2 || ids[1] != "932100" {
+		t.Fatalf("rule.id=%v", ids)
+	}
+}
+
+func TestOCSF(t *testing.T) {
+	events := sampleEventsForTest()
+	tests := []struct {
+		event string
+		want  map[string]any
+	}{
+		{"waf_block", map[string]any{
+			"class_uid": 4002.0, "activity_id": 6.0, "type_uid": 400206.0, "time": 1778051289123.0,
+			"severity_id": 4.0, "action_id": 2.0, "disposition_id": 2.0, "metadata.uid": "req-1",
+			"metadata.event_code": "waf_block", "metadata.correlation_uid": "4bf92f3577b34da6a3ce929d0e0e4736",
+			"src_endpoint.ip": "203.0.113.7", "src_endpoint.location.country": "JP",
+			"http_request.url.path": "/login", "http_response.code": 403.0,
+			"firewall_rule.uid": "942100", "firewall_rule.type": "waf",
+			"unmapped.matched_variable": "ARGS:q",
+		}},
+		{"rate_limited", map[string]any{"activity_id": 0.0, "firewall_rule.uid": "login", "unmapped.rl_key_hash": "ab12cd34"}},
+		{"bot_challenge", map[string]any{"disposition_id": 99.0, "disposition": "Challenged", "firewall_rule.desc": "ua_missing,no_accept"}},
+		{"semantic_anomaly", map[string]any{"action_id": 1.0, "disposition_id": 15.0, "severity_id": 2.0}},
+		{"country_block", map[string]any{"src_endpoint.location": nil, "action": "Denied"}},
+		{"waf_hit_allow", map[string]any{"firewall_rule.uid": "920350,932100", "disposition": "Detected"}},
+	}
+	for _, tt := range tests {
+		doc := encodeJSONForTest(t, OCSF, events[tt.event])
+		for path, want := range tt.want {
+			if got := lookupForTest(doc, path); got != want {
+				t.Fatalf("%s: %s=%#v want %#v", tt.event, path, got, want)
+			}
+		}
+	}
+}
+
+func TestCEF(t *testing.T) {
+	events := sampleEventsForTest()
+	enc, err := Encoder(CEF)
+	if err != nil {
+		t.Fatalf("Encoder: %v", err)
+	}
+	tests := []struct {
+		event  string
+		prefix string
+		want   []string
+	}{
+		{"waf_block", "CEF:0|mamotama|mamotama|dev|waf_block|WAF blocked request|7|", []string{
+			"rt=1778051289123 ", "cat=waf ", "act=blocked ", "src=203.0.113.7 ", "requestMethod=POST ", "request=/login ",
+			"externalId=req-1 ", "msg=SQL Injection Attack Detected via libinjection ",
+			"cs1=942100 cs1Label=ruleId ", "cs2=942100,949110 cs2Label=rules ", "cs3=JP cs3Label=country ",
+			"cn1=403 cn1Label=status ", "cs5=ARGS:q cs5Label=matchedVariable ",
+		}},
+		{"rate_limited", "CEF:0|mamotama|mamotama|dev|rate_limited|Rate limit exceeded|7|", []string{
+			"cs1=login cs1Label=ruleId", "cs6=ab12cd34 cs6Label=rlKeyHash", "cn2=10 cn2Label=limit", "cn3=60 cn3Label=windowSec",
+		}},
+		{"bot_challenge", "CEF:0|mamotama|mamotama|dev|bot_challenge|Bot challenge|5|", []string{
+			"act=challenged", "cs5=ua_missing,no_accept cs5Label=signals", "cn2=4 cn2Label=score",
+		}},
+		{"semantic_anomaly", "CEF:0|mamotama|mamotama|dev|semantic_anomaly|Semantic anomaly|3|", []string{"cs5=sqli_keyword,comment cs5Label=reasons"}},
+		{"country_block", "CEF:0|mamotama|mamotama|dev|country_block|Country blocked|7|", []string{"cat=country_block"}},
+		{"waf_hit_allow", "CEF:0|mamotama|mamotama|dev|waf_hit_allow|WAF rules matched|3|", []string{"cs2=920350,932100 cs2Label=rules"}},
+	}
+	for _, tt := range tests {
+		b, err := enc(events[tt.event])
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		line := string(b)
+		if !strings.HasPrefix(line, tt.prefix) {
+			t.Fatalf("%s: line=%s", tt.event, line)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(line, w) {
+				t.Fatalf("%s: line=%s\nmissing %q", tt.event, line, w)
+			}
+		}
+	}
+	if b, _ := enc(events["country_block"]); strings.Contains(string(b), "cs3=") {
+		t.Fatal("UNKNOWN country should be omitted")
+	}
+}
+
+func TestCEFEscaping(t *testing.T) {
+	line := toCEF(map[string]any{"event": "a|b", "path": `/x=1\y`, "msg": "line1\nline2"})
+	if !strings.HasPrefix(line, `CEF:0|mamotama|mamotama|dev|a\|b|a\|b|1|`) {
+		t.Fatalf("header=%s", line)
+	}
+	if !strings.Contains(line, `request=/x\=1\\y`) || !strings.Contains(line, `msg=line1\nline2`) {
+		t.Fatalf("extension=%s", line)
+	}
+}
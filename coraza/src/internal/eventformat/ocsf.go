@@ -0,0 +1,136 @@
+package eventformat
+
+import "strings"
+
+const (
+	ocsfVersion = "1.1.0"
+
+	ocsfClassHTTPActivity = 4002
+	ocsfCategoryNetwork   = 4
+)
+
+// HTTP Activity activity ids by request method.
+var ocsfActivities = map[string]struct {
+	id   int
+	name string
+}{
+	"CONNECT": {1, "Connect"},
+	"DELETE":  {2, "Delete"},
+	"GET":     {3, "Get"},
+	"HEAD":    {4, "Head"},
+	"OPTIONS": {5, "Options"},
+	"POST":    {6, "Post"},
+	"PUT":     {7, "Put"},
+	"TRACE":   {8, "Trace"},
+}
+
+// toOCSF maps an event to the OCSF HTTP Activity class with the security
+// control profile. Fields without an OCSF attribute go to "unmapped".
+func toOCSF(evt map[string]any) map[string]any {
+	s := summarize(evt)
+	f := newFields(evt)
+	f.use("ts", "event", "level", "service")
+
+	activityID, activityName := 0, "Unknown"
+	method := strings.ToUpper(f.str("method"))
+	if a, ok := ocsfActivities[method]; ok {
+		activityID, activityName = a.id, a.name
+	} else if method != "" {
+		activityID, activityName = 99, "Other"
+	}
+	severityID, severityName := ocsfSeverity(s.severity)
+
+	doc := map[string]any{
+		"class_uid":     ocsfClassHTTPActivity,
+		"class_name":    "HTTP Activity",
+		"category_uid":  ocsfCategoryNetwork,
+		"category_name": "Network Activity",
+		"activity_id":   activityID,
+		"activity_name": activityName,
+		"type_uid":      ocsfClassHTTPActivity*100 + activityID,
+		"type_name":     "HTTP Activity: " + activityName,
+		"severity_id":   severityID,
+		"severity":      severityName,
+		"metadata": map[string]any{
+			"version":  ocsfVersion,
+			"profiles": []string{"security_control"},
+			"product": map[string]any{
+				"name":        productName,
+				"vendor_name": productName,
+				"version":     productVersion(),
+			},
+			"event_code": s.event,
+		},
+	}
+	if !s.time.IsZero() {
+		doc["time"] = s.time.UnixMilli()
+	}
+
+	msg := f.str("msg")
+	message := s.name
+	if msg != "" {
+		message += ": " + msg
+	}
+	doc["message"] = message
+
+	switch s.disposition {
+	case dispositionBlocked:
+		doc["action_id"], doc["action"] = 2, "Denied"
+		doc["disposition_id"], doc["disposition"] = 2, "Blocked"
+	case dispositionChallenged:
+		doc["action_id"], doc["action"] = 2, "Denied"
+		doc["disposition_id"], doc["disposition"] = 99, "Challenged"
+	case dispositionDetected:
+		doc["action_id"], doc["action"] = 1, "Allowed"
+		doc["disposition_id"], doc["disposition"] = 15, "Detected"
+	}
+
+	reqID := f.str("req_id")
+	setPath(doc, "metadata.uid", reqID)
+	setPath(doc, "metadata.correlation_uid", f.str("trace_id"))
+	setPath(doc, "src_endpoint.ip", f.str("ip"))
+	setPath(doc, "src_endpoint.location.country", f.country())
+	setPath(doc, "http_request.uid", reqID)
+	setPath(doc, "http_request.http_method", method)
+	setPath(doc, "http_request.url.path", f.str("path"))
+	if status, ok := f.int("status"); ok {
+		setPath(doc, "http_response.code", status)
+	}
+
+	if s.category != "" {
+		setPath(doc, "firewall_rule.type", s.category)
+	}
+	if s.ruleKey != "" {
+		setPath(doc, "firewall_rule.uid", f.str(s.ruleKey))
+		setPath(doc, "firewall_rule.name", msg)
+	} else if s.event == "waf_hit_allow" {
+		setPath(doc, "firewall_rule.uid", f.str("rules"))
+	}
+	switch s.event {
+	case "semantic_anomaly":
+		setPath(doc, "firewall_rule.desc", f.str("reasons"))
+	case "bot_challenge":
+		setPath(doc, "firewall_rule.desc", f.str("signals"))
+	}
+
+	if rest := f.rest(); len(rest) > 0 {
+		doc["unmapped"] = rest
+	}
+	return doc
+}
+
+// ocsfSeverity converts the CEF scale to OCSF severity_id.
+func ocsfSeverity(cef int) (int, string) {
+	switch {
+	case cef <= 1:
+		return 1, "Informational"
+	case cef <= 3:
+		return 2, "Low"
+	case cef <= 5:
+		return 3, "Medium"
+	case cef <= 8:
+		return 4, "High"
+	default:
+		return 5, "Critical"
+	}
+}
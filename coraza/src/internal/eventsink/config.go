@@ -0,0 +1,245 @@
+package eventsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"mamotama/internal/eventformat"
+)
+
+// Sink types accepted in the config file.
+const (
+	TypeFile    = "file"
+	TypeSyslog  = "syslog"
+	TypeWebhook = "webhook"
+	TypeKafka   = "kafka"
+)
+
+// Config is the event sink file. File tunes the primary event file, whose
+// path comes from WAF_EVENTS_FILE and which always holds native events;
+// Sinks adds more destinations.
+type Config struct {
+	File  FileRotationConfig `json:"file"`
+	Sinks []SinkConfig       `json:"sinks,omitempty"`
+}
+
+type FileRotationConfig struct {
+	MaxSizeMB             int  `json:"max_size_mb,omitempty"`
+	RotateIntervalSeconds int  `json:"rotate_interval_seconds,omitempty"`
+	MaxBackups            int  `json:"max_backups,omitempty"`
+	Compress              bool `json:"compress,omitempty"`
+	QueueConfig
+}
+
+// QueueConfig holds the queue, batching and retry settings every sink
+// takes. Zero values take the defaults of the sink type.
+type QueueConfig struct {
+	QueueSize       int    `json:"queue_size,omitempty"`
+	DropPolicy      string `json:"drop_policy,omitempty"`
+	BlockTimeoutMS  int    `json:"block_timeout_ms,omitempty"`
+	BatchSize       int    `json:"batch_size,omitempty"`
+	FlushIntervalMS int    `json:"flush_interval_ms,omitempty"`
+	MaxRetries      *int   `json:"max_retries,omitempty"`
+	RetryBackoffMS  int    `json:"retry_backoff_ms,omitempty"`
+	TimeoutMS       int    `json:"timeout_ms,omitempty"`
+}
+
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Format is native (default), ecs, cef or ocsf.
+	Format string `json:"format,omitempty"`
+
+	// file
+	Path string `json:"path,omitempty"`
+	FileRotationConfig
+
+	// syslog
+	Network  string `json:"network,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Facility string `json:"facility,omitempty"`
+	AppName  string `json:"app_name,omitempty"`
+
+	// webhook
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// kafka
+	Brokers  []string `json:"brokers,omitempty"`
+	Topic    string   `json:"topic,omitempty"`
+	ClientID string   `json:"client_id,omitempty"`
+	Acks     *int     `json:"acks,omitempty"`
+}
+
+// ParseConfig decodes and validates raw. Empty input is the default
+// config: the primary file without rotation and no other sinks.
+func ParseConfig(raw []byte) (Config, error) {
+	var cfg Config
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return cfg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c Config) validate() error {
+	if err := c.File.validate(); err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+	seen := map[string]bool{"file": true}
+	for i, s := range c.Sinks {
+		name := strings.TrimSpace(s.Name)
+		if name == "" {
+			return fmt.Errorf("sinks[%d]: name is required", i)
+		}
+		if seen[name] {
+			return fmt.Errorf("sinks[%d]: duplicate name %q", i, name)
+		}
+		seen[name] = true
+		if _, _, err := s.build(); err != nil {
+			return fmt.Errorf("sinks[%d] (%s): %w", i, name, err)
+		}
+	}
+	return nil
+}
+
+func (r FileRotationConfig) validate() error {
+	if r.MaxSizeMB < 0 || r.RotateIntervalSeconds < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("rotation settings must not be negative")
+	}
+	return r.QueueConfig.validate()
+}
+
+func (q QueueConfig) validate() error {
+	switch q.DropPolicy {
+	case "", DropNewest, DropOldest, Block:
+	default:
+		return fmt.Errorf("drop_policy must be %s, %s or %s", DropNewest, DropOldest, Block)
+	}
+	if q.QueueSize < 0 || q.BlockTimeoutMS < 0 || q.BatchSize < 0 || q.FlushIntervalMS < 0 ||
+		q.RetryBackoffMS < 0 || q.TimeoutMS < 0 || (q.MaxRetries != nil && *q.MaxRetries < 0) {
+		return fmt.Errorf("queue settings must not be negative")
+	}
+	return nil
+}
+
+// options applies q over the defaults of a sink type.
+func (q QueueConfig) options(name string, defaults Options) Options {
+	o := defaults
+	o.Name = name
+	if q.QueueSize > 0 {
+		o.QueueSize = q.QueueSize
+	}
+	if q.DropPolicy != "" {
+		o.DropPolicy = q.DropPolicy
+	}
+	if q.BlockTimeoutMS > 0 {
+		o.BlockTimeout = time.Duration(q.BlockTimeoutMS) * time.Millisecond
+	}
+	if q.BatchSize > 0 {
+		o.BatchSize = q.BatchSize
+	}
+	if q.FlushIntervalMS > 0 {
+		o.FlushInterval = time.Duration(q.FlushIntervalMS) * time.Millisecond
+	}
+	if q.MaxRetries != nil {
+		o.MaxRetries = *q.MaxRetries
+	}
+	if q.RetryBackoffMS > 0 {
+		o.RetryBackoff = time.Duration(q.RetryBackoffMS) * time.Millisecond
+	}
+	if q.TimeoutMS > 0 {
+		o.WriteTimeout = time.Duration(q.TimeoutMS) * time.Millisecond
+	}
+	return o
+}
+
+// fileConfig returns the rotation settings for a file at path.
+func (r FileRotationConfig) fileConfig(path string) FileConfig {
+	return FileConfig{
+		Path:           path,
+		MaxBytes:       int64(r.MaxSizeMB) << 20,
+		RotateInterval: time.Duration(r.RotateIntervalSeconds) * time.Second,
+		MaxBackups:     r.MaxBackups,
+		Compress:       r.Compress,
+	}
+}
+
+// Files write as soon as events arrive; network sinks batch and retry.
+var typeDefaults = map[string]Options{
+	TypeFile:    {},
+	TypeSyslog:  {MaxRetries: 2},
+	TypeWebhook: {BatchSize: 100, FlushInterval: time.Second, MaxRetries: 3},
+	TypeKafka:   {BatchSize: 100, FlushInterval: 500 * time.Millisecond, MaxRetries: 3},
+}
+
+func (s SinkConfig) build() (Sink, Options, error) {
+	name := strings.TrimSpace(s.Name)
+	if err := s.FileRotationConfig.validate(); err != nil {
+		return nil, Options{}, err
+	}
+	defaults, ok := typeDefaults[s.Type]
+	if !ok {
+		return nil, Options{}, fmt.Errorf("unknown type %q", s.Type)
+	}
+	opts := s.QueueConfig.options(name, defaults)
+	encode, err := eventformat.Encoder(s.Format)
+	if err != nil {
+		return nil, Options{}, err
+	}
+	opts.Encode = encode
+
+	var sink Sink
+	switch s.Type {
+	case TypeFile:
+		sink, err = NewFileSink(s.FileRotationConfig.fileConfig(strings.TrimSpace(s.Path)))
+	case TypeSyslog:
+		sink, err = NewSyslogSink(SyslogConfig{Network: s.Network, Address: s.Address, Facility: s.Facility, AppName: s.AppName})
+	case TypeWebhook:
+		sink, err = NewWebhookSink(WebhookConfig{URL: s.URL, Headers: s.Headers})
+	case TypeKafka:
+		acks := 1
+		if s.Acks != nil {
+			acks = *s.Acks
+		}
+		sink, err = NewKafkaSink(KafkaConfig{Brokers: s.Brokers, Topic: s.Topic, ClientID: s.ClientID, Acks: acks})
+	}
+	if err != nil {
+		return nil, Options{}, err
+	}
+	return sink, opts, nil
+}
+
+// Build creates a pipeline with the primary event file at primaryPath
+// followed by the configured sinks. wrapRotate, if set, runs around each
+// rotation of the primary file.
+func Build(cfg Config, primaryPath string, wrapRotate func(rotate func() error) error) (*Pipeline, error) {
+	fc := cfg.File.fileConfig(primaryPath)
+	fc.WrapRotate = wrapRotate
+	primary, err := NewFileSink(fc)
+	if err != nil {
+		return nil, err
+	}
+
+	p := New()
+	p.Add(primary, cfg.File.QueueConfig.options("file", typeDefaults[TypeFile]))
+	for i, sc := range cfg.Sinks {
+		sink, opts, err := sc.build()
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("sinks[%d] (%s): %w", i, sc.Name, err)
+		}
+		p.Add(sink, opts)
+	}
+	return p, nil
+}
@@ -0,0 +1,93 @@
+package eventsink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "empty", raw: ""},
+		{name: "rotation only", raw: `{"file":{"max_size_mb":100,"rotate_interval_seconds":86400,"max_backups":7,"compress":true}}`},
+		{name: "all types", raw: `{"sinks":[
+			{"name":"archive","type":"file","path":"/tmp/a.ndjson","max_size_mb":10},
+			{"name":"siem","type":"syslog","network":"tcp","address":"127.0.0.1:6514","facility":"local4","format":"cef"},
+			{"name":"hook","type":"webhook","url":"https://example.com/in","headers":{"Authorization":"Bearer x"},"drop_policy":"drop_oldest"},
+			{"name":"bus","type":"kafka","brokers":["127.0.0.1:9092"],"topic":"waf","acks":-1,"max_retries":0,"format":"ocsf"}
+		]}`},
+		{name: "unknown field", raw: `{"file":{"max_size":1}}`, wantErr: "unknown field"},
+		{name: "negative rotation", raw: `{"file":{"max_backups":-1}}`, wantErr: "must not be negative"},
+		{name: "bad drop policy", raw: `{"file":{"drop_policy":"later"}}`, wantErr: "drop_policy"},
+		{name: "missing name", raw: `{"sinks":[{"type":"webhook","url":"http://x"}]}`, wantErr: "name is required"},
+		{name: "reserved name", raw: `{"sinks":[{"name":"file","type":"webhook","url":"http://x"}]}`, wantErr: "duplicate name"},
+		{name: "duplicate name", raw: `{"sinks":[{"name":"a","type":"webhook","url":"http://x"},{"name":"a","type":"webhook","url":"http://y"}]}`, wantErr: "duplicate name"},
+		{name: "unknown format", raw: `{"sinks":[{"name":"a","type":"webhook","url":"http://x","format":"leef"}]}`, wantErr: "unknown event format"},
+		{name: "unknown type", raw: `{"sinks":[{"name":"a","type":"mqtt"}]}`, wantErr: "unknown type"},
+		{name: "invalid sink", raw: `{"sinks":[{"name":"a","type":"kafka","topic":"waf"}]}`, wantErr: "brokers"},
+		{name: "negative retries", raw: `{"sinks":[{"name":"a","type":"webhook","url":"http://x","max_retries":-1}]}`, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.raw))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err=%v want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueConfigOptions(t *testing.T) {
+	zero := 0
+	q := QueueConfig{QueueSize: 10, DropPolicy: Block, FlushIntervalMS: 250, MaxRetries: &zero}
+	o := q.options("hook", typeDefaults[TypeWebhook])
+	if o.Name != "hook" || o.QueueSize != 10 || o.DropPolicy != Block || o.FlushInterval != 250*time.Millisecond {
+		t.Fatalf("options=%+v", o)
+	}
+	if o.MaxRetries != 0 || o.BatchSize != 100 {
+		t.Fatalf("explicit zero retries or type default batch lost: %+v", o)
+	}
+}
+
+func TestBuild_PrimaryFileFirst(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := ParseConfig([]byte(`{"sinks":[{"name":"copy","type":"file","format":"cef","path":"` + filepath.Join(dir, "copy.ndjson") + `"}]}`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	primary := filepath.Join(dir, "events.ndjson")
+	p, err := Build(cfg, primary, nil)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if len(p.workers) != 2 || p.workers[0].opts.Name != "file" || p.workers[1].opts.Name != "copy" {
+		t.Fatal("unexpected sink order")
+	}
+	_ = p.Publish(map[string]any{"event": "waf_block"})
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// The primary file stays native; the copy takes the sink format.
+	if b, err := os.ReadFile(primary); err != nil || string(b) != `{"event":"waf_block"}`+"\n" {
+		t.Fatalf("primary=%q err=%v", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "copy.ndjson")); err != nil || !strings.HasPrefix(string(b), "CEF:0|mamotama|mamotama|") {
+		t.Fatalf("copy=%q err=%v", b, err)
+	}
+}
@@ -0,0 +1,229 @@
+package eventsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// FileConfig describes a newline-delimited event file. A file is rotated
+// when the next write would take it past MaxBytes, or when it was opened
+// in an earlier RotateInterval period (periods are aligned to UTC, so 24h
+// rotates at midnight). Zero disables either trigger.
+type FileConfig struct {
+	Path           string
+	MaxBytes       int64
+	RotateInterval time.Duration
+	// MaxBackups keeps that many rotated files; zero keeps all.
+	MaxBackups int
+	Compress   bool
+	// WrapRotate, when set, runs around the rename of the file, for
+	// readers that track an offset into it. It must call rotate.
+	WrapRotate func(rotate func() error) error
+}
+
+// FileSink appends records to a file it keeps open between writes.
+type FileSink struct {
+	cfg FileConfig
+	now func() time.Time
+
+	f        *os.File
+	size     int64
+	periodAt time.Time
+
+	// compressing tracks background gzip of rotated files.
+	compressing sync.WaitGroup
+}
+
+func NewFileSink(cfg FileConfig) (*FileSink, error) {
+	if strings.TrimSpace(cfg.Path) == "" {
+		return nil, fmt.Errorf("file sink path is empty")
+	}
+	if cfg.MaxBytes < 0 || cfg.RotateInterval < 0 || cfg.MaxBackups < 0 {
+		return nil, fmt.Errorf("file sink rotation settings must not be negative")
+	}
+	return &FileSink{cfg: cfg, now: time.Now}, nil
+}
+
+func (s *FileSink) Write(_ context.Context, records []Record) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r.Data)
+		buf.WriteByte('\n')
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.shouldRotate(int64(buf.Len())) {
+		if err := s.rotate(); err != nil {
+			log.Printf("[EVENT_SINK][FILE][WARN] rotate %s failed: %v", s.cfg.Path, err)
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		// Reopen on the next write, in case the file was removed.
+		_ = s.f.Close()
+		s.f = nil
+	}
+	return err
+}
+
+func (s *FileSink) open() error {
+	if s.f != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.cfg.Path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	// An existing file belongs to the period it was last written in.
+	s.periodAt = s.now()
+	if fi.Size() > 0 {
+		s.periodAt = fi.ModTime()
+	}
+	return nil
+}
+
+func (s *FileSink) shouldRotate(next int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.cfg.MaxBytes > 0 && s.size+next > s.cfg.MaxBytes {
+		return true
+	}
+	if d := s.cfg.RotateInterval; d > 0 {
+		return !s.now().UTC().Truncate(d).Equal(s.periodAt.UTC().Truncate(d))
+	}
+	return false
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		log.Printf("[EVENT_SINK][FILE][WARN] close %s: %v", s.cfg.Path, err)
+	}
+	s.f = nil
+
+	backup := s.cfg.Path + "." + s.now().UTC().Format(backupTimeFormat)
+	rename := func() error { return os.Rename(s.cfg.Path, backup) }
+	var err error
+	if s.cfg.WrapRotate != nil {
+		err = s.cfg.WrapRotate(rename)
+	} else {
+		err = rename()
+	}
+	if err != nil {
+		return err
+	}
+	if s.cfg.Compress {
+		s.compressing.Add(1)
+		go func() {
+			defer s.compressing.Done()
+			if err := gzipFile(backup); err != nil {
+				log.Printf("[EVENT_SINK][FILE][WARN] compress %s: %v", backup, err)
+			}
+			s.prune()
+		}()
+		return nil
+	}
+	s.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond MaxBackups. Backup names sort
+// by rotation time.
+func (s *FileSink) prune() {
+	if s.cfg.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(s.cfg.Path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	prefix := s.cfg.Path + "."
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	// A backup being compressed shows up twice; count rotations, not files.
+	seen := map[string]bool{}
+	var unique []string
+	for i := len(backups) - 1; i >= 0; i-- {
+		key := strings.TrimSuffix(backups[i], ".gz")
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	for _, old := range unique[min(len(unique), s.cfg.MaxBackups):] {
+		_ = os.Remove(old)
+		_ = os.Remove(old + ".gz")
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *FileSink) Close() error {
+	s.compressing.Wait()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
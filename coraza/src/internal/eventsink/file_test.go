@@ -0,0 +1,158 @@
+package eventsink
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recordsForTest(lines ...string) []Record {
+	out := make([]Record, 0, len(lines))
+	for _, l := range lines {
+		out = append(out, Record{Data: []byte(l)})
+	}
+	return out
+}
+
+func backupsForTest(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func readFileForTest(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip %s: %v", path, err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(b)
+}
+
+func TestFileSink_RotatesBySizeAndPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "events.ndjson")
+	wraps := 0
+	s, err := NewFileSink(FileConfig{
+		Path:       path,
+		MaxBytes:   10,
+		MaxBackups: 1,
+		WrapRotate: func(rotate func() error) error {
+			wraps++
+			return rotate()
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	clock := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for _, line := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		if err := s.Write(context.Background(), recordsForTest(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Two lines of five bytes fit in ten bytes.
+	if got := readFileForTest(t, path); got != "eeee\n" {
+		t.Fatalf("current file=%q", got)
+	}
+	backups := backupsForTest(t, path)
+	if len(backups) != 1 {
+		t.Fatalf("backups=%v", backups)
+	}
+	if got := readFileForTest(t, backups[0]); got != "cccc\ndddd\n" {
+		t.Fatalf("kept backup=%q", got)
+	}
+	if wraps != 2 {
+		t.Fatalf("WrapRotate calls=%d want=2", wraps)
+	}
+}
+
+func TestFileSink_RotatesByIntervalWithGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	s, err := NewFileSink(FileConfig{Path: path, RotateInterval: 24 * time.Hour, Compress: true})
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	now := time.Date(2026, 1, 2, 23, 59, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	if err := s.Write(context.Background(), recordsForTest("day1-a", "day1-b")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Opening an empty file starts the period at the sink clock, so the
+	// next write on the same day appends.
+	if err := s.Write(context.Background(), recordsForTest("day1-c")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := s.Write(context.Background(), recordsForTest("day2-a")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := readFileForTest(t, path); got != "day2-a\n" {
+		t.Fatalf("current file=%q", got)
+	}
+	backups := backupsForTest(t, path)
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+		t.Fatalf("backups=%v", backups)
+	}
+	if got := readFileForTest(t, backups[0]); got != "day1-a\nday1-b\nday1-c\n" {
+		t.Fatalf("backup=%q", got)
+	}
+}
+
+func TestFileSink_AppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	s, err := NewFileSink(FileConfig{Path: path})
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	if err := s.Write(context.Background(), recordsForTest("new")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_ = s.Close()
+	if got := readFileForTest(t, path); got != "old\nnew\n" {
+		t.Fatalf("file=%q", got)
+	}
+
+	if _, err := NewFileSink(FileConfig{}); err == nil {
+		t.Fatal("expected an error for an empty path")
+	}
+}
@@ -0,0 +1,474 @@
+package eventsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka API keys and the versions this producer speaks. Produce v3 needs
+// brokers from 0.11 on, which introduced record batches (magic 2).
+const (
+	kafkaAPIProduce       = 0
+	kafkaAPIMetadata      = 3
+	kafkaProduceVersion   = 3
+	kafkaMetadataVersion  = 1
+	kafkaMaxResponseBytes = 16 << 20
+)
+
+// Kafka error codes that retrying cannot fix.
+var kafkaPermanentErrors = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	10: "MESSAGE_TOO_LARGE",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaConfig describes a topic on a Kafka-protocol cluster. Brokers are
+// bootstrap addresses; partition leaders come from cluster metadata. Acks
+// is 0 (no response), 1 (leader) or -1 (all in-sync replicas). Only
+// plaintext listeners without SASL are supported.
+type KafkaConfig struct {
+	Brokers  []string
+	Topic    string
+	ClientID string
+	Acks     int
+	Timeout  time.Duration
+}
+
+// KafkaSink produces each batch as one uncompressed record batch to one
+// partition, rotating partitions between batches. Records have no key.
+type KafkaSink struct {
+	brokers  []string
+	topic    string
+	clientID string
+	acks     int16
+	timeout  time.Duration
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+
+	correlationID int32
+	partitions    []kafkaPartition
+	leaders       map[int32]string
+	conns         map[string]*kafkaConn
+	next          int
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+type kafkaConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewKafkaSink(cfg KafkaConfig) (*KafkaSink, error) {
+	var brokers []string
+	for _, b := range cfg.Brokers {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return nil, fmt.Errorf("invalid kafka broker %q: %w", b, err)
+		}
+		brokers = append(brokers, b)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers are empty")
+	}
+	topic := strings.TrimSpace(cfg.Topic)
+	if topic == "" || len(topic) > 249 {
+		return nil, fmt.Errorf("invalid kafka topic %q", cfg.Topic)
+	}
+	if cfg.Acks < -1 || cfg.Acks > 1 {
+		return nil, fmt.Errorf("kafka acks must be -1, 0 or 1")
+	}
+	clientID := strings.TrimSpace(cfg.ClientID)
+	if clientID == "" {
+		clientID = "mamotama"
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var d net.Dialer
+	return &KafkaSink{
+		brokers:  brokers,
+		topic:    topic,
+		clientID: clientID,
+		acks:     int16(cfg.Acks),
+		timeout:  timeout,
+		dial:     d.DialContext,
+		conns:    map[string]*kafkaConn{},
+	}, nil
+}
+
+func (s *KafkaSink) Write(ctx context.Context, records []Record) error {
+	if len(s.partitions) == 0 {
+		if err := s.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	p := s.partitions[s.next%len(s.partitions)]
+	s.next++
+	addr, ok := s.leaders[p.leader]
+	if !ok {
+		s.reset()
+		return fmt.Errorf("kafka partition %d has no known leader", p.id)
+	}
+
+	err := s.produce(ctx, addr, p.id, records)
+	if err != nil && !isPermanent(err) {
+		// Leaders may have moved; ask again on the next attempt.
+		s.reset()
+	}
+	return err
+}
+
+func (s *KafkaSink) produce(ctx context.Context, addr string, partition int32, records []Record) error {
+	var body kafkaEncoder
+	body.nullableString(nil)
+	body.int16(s.acks)
+	body.int32(int32(s.timeout / time.Millisecond))
+	body.int32(1)
+	body.string(s.topic)
+	body.int32(1)
+	body.int32(partition)
+	body.bytes(encodeRecordBatch(records, time.Now()))
+
+	resp, err := s.roundTrip(ctx, addr, kafkaAPIProduce, kafkaProduceVersion, body.buf, s.acks != 0)
+	if err != nil || s.acks == 0 {
+		return err
+	}
+
+	d := kafkaDecoder{buf: resp}
+	for range d.arrayLen() {
+		_ = d.string()
+		for range d.arrayLen() {
+			_ = d.int32()
+			code := d.int16()
+			_ = d.int64()
+			_ = d.int64()
+			if d.err == nil && code != 0 {
+				return kafkaError(code)
+			}
+		}
+	}
+	return d.err
+}
+
+func (s *KafkaSink) refreshMetadata(ctx context.Context) error {
+	var body kafkaEncoder
+	body.int32(1)
+	body.string(s.topic)
+
+	var lastErr error
+	for _, addr := range s.brokers {
+		resp, err := s.roundTrip(ctx, addr, kafkaAPIMetadata, kafkaMetadataVersion, body.buf, true)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		leaders, partitions, err := decodeMetadata(resp, s.topic)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.leaders = leaders
+		s.partitions = partitions
+		return nil
+	}
+	return fmt.Errorf("kafka metadata: %w", lastErr)
+}
+
+func decodeMetadata(resp []byte, topic string) (map[int32]string, []kafkaPartition, error) {
+	d := kafkaDecoder{buf: resp}
+	leaders := map[int32]string{}
+	for range d.arrayLen() {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		_ = d.string() // rack, nullable
+		leaders[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	_ = d.int32()
+
+	var partitions []kafkaPartition
+	var topicErr int16
+	for range d.arrayLen() {
+		code := d.int16()
+		name := d.string()
+		_ = d.int8()
+		for range d.arrayLen() {
+			pcode := d.int16()
+			id := d.int32()
+			leader := d.int32()
+			for range d.arrayLen() {
+				_ = d.int32()
+			}
+			for range d.arrayLen() {
+				_ = d.int32()
+			}
+			if name == topic && pcode == 0 && leader >= 0 {
+				partitions = append(partitions, kafkaPartition{id: id, leader: leader})
+			}
+		}
+		if name == topic {
+			topicErr = code
+		}
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	if topicErr != 0 {
+		return nil, nil, kafkaError(topicErr)
+	}
+	if len(partitions) == 0 {
+		return nil, nil, fmt.Errorf("topic %q has no available partitions", topic)
+	}
+	return leaders, partitions, nil
+}
+
+// roundTrip sends one request and, when wantResponse is set, returns the
+// response body after the correlation id.
+func (s *KafkaSink) roundTrip(ctx context.Context, addr string, apiKey, version int16, body []byte, wantResponse bool) ([]byte, error) {
+	conn, err := s.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	s.correlationID++
+	id := s.correlationID
+	var req kafkaEncoder
+	req.int32(0)
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(id)
+	req.string(s.clientID)
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	if _, err := conn.Write(req.buf); err != nil {
+		s.closeConn(addr)
+		return nil, err
+	}
+	if !wantResponse {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn.r, size[:]); err != nil {
+		s.closeConn(addr)
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponseBytes {
+		s.closeConn(addr)
+		return nil, fmt.Errorf("kafka response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn.r, resp); err != nil {
+		s.closeConn(addr)
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(resp)); got != id {
+		s.closeConn(addr)
+		return nil, fmt.Errorf("kafka correlation id %d, want %d", got, id)
+	}
+	return resp[4:], nil
+}
+
+func (s *KafkaSink) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c, ok := s.conns[addr]; ok {
+		return c, nil
+	}
+	c, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	kc := &kafkaConn{Conn: c, r: bufio.NewReader(c)}
+	s.conns[addr] = kc
+	return kc, nil
+}
+
+func (s *KafkaSink) closeConn(addr string) {
+	if c, ok := s.conns[addr]; ok {
+		_ = c.Close()
+		delete(s.conns, addr)
+	}
+}
+
+func (s *KafkaSink) reset() {
+	for addr := range s.conns {
+		s.closeConn(addr)
+	}
+	s.partitions = nil
+	s.leaders = nil
+}
+
+func (s *KafkaSink) Close() error {
+	s.reset()
+	return nil
+}
+
+func kafkaError(code int16) error {
+	if name, ok := kafkaPermanentErrors[code]; ok {
+		return Permanent(fmt.Errorf("kafka error %d (%s)", code, name))
+	}
+	return fmt.Errorf("kafka error %d", code)
+}
+
+// encodeRecordBatch builds an uncompressed v2 record batch with no
+// producer id, as an idempotence-free producer sends it.
+func encodeRecordBatch(records []Record, now time.Time) []byte {
+	ts := now.UnixMilli()
+	var recs kafkaEncoder
+	for i, r := range records {
+		var rec kafkaEncoder
+		rec.int8(0)
+		rec.varint(0)
+		rec.varint(int64(i))
+		rec.varint(-1)
+		rec.varint(int64(len(r.Data)))
+		rec.buf = append(rec.buf, r.Data...)
+		rec.varint(0)
+		recs.varint(int64(len(rec.buf)))
+		recs.buf = append(recs.buf, rec.buf...)
+	}
+
+	// Everything after the CRC field is covered by it.
+	var tail kafkaEncoder
+	tail.int16(0)
+	tail.int32(int32(len(records) - 1))
+	tail.int64(ts)
+	tail.int64(ts)
+	tail.int64(-1)
+	tail.int16(-1)
+	tail.int32(-1)
+	tail.int32(int32(len(records)))
+	tail.buf = append(tail.buf, recs.buf...)
+
+	var b kafkaEncoder
+	b.int64(0)
+	b.int32(int32(4 + 1 + 4 + len(tail.buf)))
+	b.int32(-1)
+	b.int8(2)
+	b.int32(int32(crc32.Checksum(tail.buf, crc32c)))
+	b.buf = append(b.buf, tail.buf...)
+	return b.buf
+}
+
+type kafkaEncoder struct{ buf []byte }
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+func (e *kafkaEncoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *kafkaEncoder) nullableString(v *string) {
+	if v == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// kafkaDecoder reads big-endian fields and remembers the first short read.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+var errKafkaShort = errors.New("kafka response is truncated")
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errKafkaShort
+		d.buf = nil
+		return nil
+	}
+	out := d.buf[:n]
+	d.buf = d.buf[n:]
+	return out
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// arrayLen returns an array length, or 0 for null arrays and after errors.
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if d.err != nil || n < 0 {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = errKafkaShort
+		return 0
+	}
+	return int(n)
+}
@@ -0,0 +1,309 @@
+package eventsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKafkaBroker answers Metadata v1 and Produce v3 for one topic whose
+// partitions are all led by itself.
+type fakeKafkaBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	topic      string
+	partitions int
+
+	mu            sync.Mutex
+	produceErrors []int16
+	metadataCalls int
+	produced      map[int32][][]string
+	clientIDs     []string
+}
+
+func newFakeKafkaBroker(t *testing.T, topic string, partitions int) *fakeKafkaBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &fakeKafkaBroker{t: t, ln: ln, topic: topic, partitions: partitions, produced: map[int32][][]string{}}
+	go b.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *fakeKafkaBroker) addr() string { return b.ln.Addr().String() }
+
+func (b *fakeKafkaBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeKafkaBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{buf: req}
+		apiKey, version, id := d.int16(), d.int16(), d.int32()
+		clientID := d.string()
+
+		var resp kafkaEncoder
+		resp.int32(0)
+		resp.int32(id)
+		switch {
+		case apiKey == kafkaAPIMetadata && version == kafkaMetadataVersion:
+			b.metadata(&d, &resp)
+		case apiKey == kafkaAPIProduce && version == kafkaProduceVersion:
+			if !b.produce(&d, &resp, clientID) {
+				continue
+			}
+		default:
+			b.t.Errorf("unexpected api %d v%d", apiKey, version)
+			return
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := conn.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeKafkaBroker) metadata(d *kafkaDecoder, resp *kafkaEncoder) {
+	b.mu.Lock()
+	b.metadataCalls++
+	b.mu.Unlock()
+	for range d.arrayLen() {
+		if got := d.string(); got != b.topic {
+			b.t.Errorf("metadata for topic %q", got)
+		}
+	}
+	host, port, _ := net.SplitHostPort(b.addr())
+	p, _ := strconv.Atoi(port)
+
+	resp.int32(1)
+	resp.int32(7)
+	resp.string(host)
+	resp.int32(int32(p))
+	resp.nullableString(nil)
+	resp.int32(7)
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(b.topic)
+	resp.int8(0)
+	resp.int32(int32(b.partitions))
+	for i := range b.partitions {
+		resp.int16(0)
+		resp.int32(int32(i))
+		resp.int32(7)
+		resp.int32(1)
+		resp.int32(7)
+		resp.int32(1)
+		resp.int32(7)
+	}
+}
+
+// produce records the batch and reports whether a response is expected.
+func (b *fakeKafkaBroker) produce(d *kafkaDecoder, resp *kafkaEncoder, clientID string) bool {
+	_ = d.string() // transactional id
+	acks := d.int16()
+	_ = d.int32()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clientIDs = append(b.clientIDs, clientID)
+	code := int16(0)
+	if len(b.produceErrors) > 0 {
+		code, b.produceErrors = b.produceErrors[0], b.produceErrors[1:]
+	}
+
+	resp.int32(1)
+	for range d.arrayLen() {
+		topic := d.string()
+		resp.string(topic)
+		n := d.arrayLen()
+		resp.int32(int32(n))
+		for range n {
+			partition := d.int32()
+			batch := d.take(int(d.int32()))
+			values, err := decodeRecordBatchForTest(batch)
+			if err != nil {
+				b.t.Errorf("record batch: %v", err)
+			}
+			if code == 0 {
+				b.produced[partition] = append(b.produced[partition], values)
+			}
+			resp.int32(partition)
+			resp.int16(code)
+			resp.int64(0)
+			resp.int64(-1)
+		}
+	}
+	resp.int32(0)
+	return acks != 0
+}
+
+func decodeRecordBatchForTest(batch []byte) ([]string, error) {
+	d := kafkaDecoder{buf: batch}
+	_ = d.int64()
+	if n := int(d.int32()); n != len(d.buf) {
+		return nil, errKafkaShort
+	}
+	_ = d.int32()
+	if magic := d.int8(); magic != 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	crc := uint32(d.int32())
+	if crc32.Checksum(d.buf, crc32c) != crc {
+		return nil, io.ErrUnexpectedEOF
+	}
+	_ = d.int16()
+	_ = d.int32()
+	_, _, _ = d.int64(), d.int64(), d.int64()
+	_, _ = d.int16(), d.int32()
+	count := int(d.int32())
+
+	varint := func() int64 {
+		v, n := binary.Varint(d.buf)
+		if n <= 0 {
+			d.err = errKafkaShort
+			return 0
+		}
+		d.buf = d.buf[n:]
+		return v
+	}
+	var values []string
+	for range count {
+		_ = varint()
+		_ = d.int8()
+		_, _ = varint(), varint()
+		if key := varint(); key != -1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		values = append(values, string(d.take(int(varint()))))
+		_ = varint()
+	}
+	return values, d.err
+}
+
+func TestKafkaSink_ProducesRoundRobin(t *testing.T) {
+	b := newFakeKafkaBroker(t, "waf-events", 2)
+	s, err := NewKafkaSink(KafkaConfig{Brokers: []string{b.addr()}, Topic: "waf-events", ClientID: "edge-1", Acks: 1})
+	if err != nil {
+		t.Fatalf("NewKafkaSink: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Write(ctx, recordsForTest(`{"a":1}`, `{"a":2}`)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Write(ctx, recordsForTest(`{"a":3}`)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.produced[0]) != 1 || len(b.produced[1]) != 1 {
+		t.Fatalf("produced=%v", b.produced)
+	}
+	if got := b.produced[0][0]; len(got) != 2 || got[0] != `{"a":1}` || got[1] != `{"a":2}` {
+		t.Fatalf("partition 0 values=%q", got)
+	}
+	if got := b.produced[1][0]; len(got) != 1 || got[0] != `{"a":3}` {
+		t.Fatalf("partition 1 values=%q", got)
+	}
+	if b.metadataCalls != 1 || b.clientIDs[0] != "edge-1" {
+		t.Fatalf("metadata calls=%d client ids=%v", b.metadataCalls, b.clientIDs)
+	}
+}
+
+func TestKafkaSink_ErrorCodes(t *testing.T) {
+	b := newFakeKafkaBroker(t, "waf-events", 1)
+	// NOT_LEADER_OR_FOLLOWER is retryable; MESSAGE_TOO_LARGE is not.
+	b.produceErrors = []int16{6, 10}
+	s, err := NewKafkaSink(KafkaConfig{Brokers: []string{b.addr()}, Topic: "waf-events", Acks: -1})
+	if err != nil {
+		t.Fatalf("NewKafkaSink: %v", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Write(ctx, recordsForTest("x")); err == nil || isPermanent(err) {
+		t.Fatalf("error 6 should be retryable: %v", err)
+	}
+	if err := s.Write(ctx, recordsForTest("x")); !isPermanent(err) {
+		t.Fatalf("error 10 should be permanent: %v", err)
+	}
+	if err := s.Write(ctx, recordsForTest("y")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// The retryable error dropped the cached metadata.
+	if b.metadataCalls != 2 {
+		t.Fatalf("metadata calls=%d want=2", b.metadataCalls)
+	}
+	if got := b.produced[0]; len(got) != 1 || got[0][0] != "y" {
+		t.Fatalf("produced=%v", got)
+	}
+}
+
+func TestKafkaSink_AcksZeroSendsWithoutResponse(t *testing.T) {
+	b := newFakeKafkaBroker(t, "waf-events", 1)
+	s, err := NewKafkaSink(KafkaConfig{Brokers: []string{b.addr()}, Topic: "waf-events", Acks: 0})
+	if err != nil {
+		t.Fatalf("NewKafkaSink: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(context.Background(), recordsForTest("fire")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		n := len(b.produced[0])
+		b.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch not received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewKafkaSink_Validates(t *testing.T) {
+	for _, cfg := range []KafkaConfig{
+		{Topic: "t"},
+		{Brokers: []string{"no-port"}, Topic: "t"},
+		{Brokers: []string{"127.0.0.1:9092"}},
+		{Brokers: []string{"127.0.0.1:9092"}, Topic: "t", Acks: 2},
+	} {
+		if _, err := NewKafkaSink(cfg); err == nil {
+			t.Fatalf("expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Package eventsink delivers security events to files and remote
+// collectors without blocking the request path.
+//
+// A Pipeline fans every published event out to its sinks. Each sink has
+// its own bounded queue and worker, so a slow collector only delays
+// itself. When a queue is full the sink's drop policy decides whether the
+// new event, the oldest queued event, or nothing (after a bounded wait) is
+// dropped.
+package eventsink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mamotama/internal/metrics"
+)
+
+// Drop policies applied when a sink's queue is full.
+const (
+	DropNewest = "drop_newest"
+	DropOldest = "drop_oldest"
+	Block      = "block"
+)
+
+const (
+	defaultQueueSize    = 4096
+	defaultBatchSize    = 100
+	defaultBlockTimeout = 100 * time.Millisecond
+	defaultRetryBackoff = 500 * time.Millisecond
+	defaultWriteTimeout = 10 * time.Second
+	maxRetryBackoff     = 30 * time.Second
+)
+
+var (
+	ErrDropped = errors.New("event dropped: sink queue is full")
+	ErrClosed  = errors.New("event pipeline is closed")
+)
+
+var (
+	eventsTotal = metrics.NewCounterVec(
+		"mamotama_event_sink_events_total",
+		"Events handled by each sink by result (written, dropped when the queue was full, or failed after retries).",
+		"sink", "result",
+	)
+	retriesTotal = metrics.NewCounterVec(
+		"mamotama_event_sink_retries_total",
+		"Batch writes retried by each sink.",
+		"sink",
+	)
+	writeDuration = metrics.NewHistogramVec(
+		"mamotama_event_sink_write_duration_seconds",
+		"Time to write one batch, including retries.",
+		metrics.DefaultBuckets,
+		"sink",
+	)
+)
+
+// Record is one event as a sink receives it.
+type Record struct {
+	Event map[string]any
+	// Data is the event encoded by the sink's Encoder.
+	Data []byte
+}
+
+// Sink writes batches of records. Write is only called from the sink's
+// worker, never concurrently.
+type Sink interface {
+	Write(ctx context.Context, records []Record) error
+	Close() error
+}
+
+// Encoder turns an event into the bytes a sink writes.
+type Encoder func(evt map[string]any) ([]byte, error)
+
+// JSON encodes an event as one JSON object.
+func JSON(evt map[string]any) ([]byte, error) { return json.Marshal(evt) }
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a write error that retrying cannot fix, such as a
+// rejected request.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// Options control the queue and batching of one sink. Zero values take
+// the defaults. FlushInterval zero writes whatever is queued as soon as
+// the worker picks it up; otherwise a batch waits until it is full or the
+// interval passes.
+type Options struct {
+	Name          string
+	QueueSize     int
+	DropPolicy    string
+	BlockTimeout  time.Duration
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+	WriteTimeout  time.Duration
+	Encode        Encoder
+}
+
+func (o Options) withDefaults() Options {
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultQueueSize
+	}
+	switch o.DropPolicy {
+	case DropOldest, Block:
+	default:
+		o.DropPolicy = DropNewest
+	}
+	if o.BlockTimeout <= 0 {
+		o.BlockTimeout = defaultBlockTimeout
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = defaultRetryBackoff
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = defaultWriteTimeout
+	}
+	if o.Encode == nil {
+		o.Encode = JSON
+	}
+	return o
+}
+
+// Pipeline fans events out to its sinks.
+type Pipeline struct {
+	workers []*worker
+	closed  atomic.Bool
+	once    sync.Once
+}
+
+func New() *Pipeline { return &Pipeline{} }
+
+// Add starts a worker for s. Add every sink before the first Publish.
+func (p *Pipeline) Add(s Sink, o Options) {
+	w := &worker{
+		sink:     s,
+		opts:     o.withDefaults(),
+		flushReq: make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	w.queue = make(chan map[string]any, w.opts.QueueSize)
+	p.workers = append(p.workers, w)
+	registerWorker(w)
+	go w.run()
+}
+
+// Publish queues evt for every sink. It returns ErrDropped when at least
+// one sink dropped it. evt must not be modified afterwards.
+func (p *Pipeline) Publish(evt map[string]any) error {
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	var err error
+	for _, w := range p.workers {
+		if !w.enqueue(evt) {
+			err = ErrDropped
+		}
+	}
+	return err
+}
+
+// Flush waits until every event published before the call was handed to
+// its sink.
+func (p *Pipeline) Flush(ctx context.Context) error {
+	for _, w := range p.workers {
+		done := make(chan struct{})
+		select {
+		case w.flushReq <- done:
+		case <-w.done:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close writes what is still queued and closes every sink.
+func (p *Pipeline) Close() error {
+	var errs []error
+	p.once.Do(func() {
+		p.closed.Store(true)
+		for _, w := range p.workers {
+			close(w.stop)
+		}
+		for _, w := range p.workers {
+			<-w.done
+			unregisterWorker(w)
+			if err := w.sink.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+type worker struct {
+	sink     Sink
+	opts     Options
+	queue    chan map[string]any
+	flushReq chan chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (w *worker) enqueue(evt map[string]any) bool {
+	select {
+	case w.queue <- evt:
+		return true
+	default:
+	}
+
+	switch w.opts.DropPolicy {
+	case Block:
+		t := time.NewTimer(w.opts.BlockTimeout)
+		defer t.Stop()
+		select {
+		case w.queue <- evt:
+			return true
+		case <-t.C:
+		}
+	case DropOldest:
+		for {
+			select {
+			case <-w.queue:
+				eventsTotal.Inc(w.opts.Name, "dropped")
+			default:
+			}
+			select {
+			case w.queue <- evt:
+				return true
+			default:
+			}
+		}
+	}
+	eventsTotal.Inc(w.opts.Name, "dropped")
+	return false
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	var tick <-chan time.Time
+	if w.opts.FlushInterval > 0 {
+		ticker := time.NewTicker(w.opts.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([]map[string]any, 0, w.opts.BatchSize)
+	for {
+		select {
+		case evt := <-w.queue:
+			batch = append(batch, evt)
+			batch = w.fill(batch)
+			if len(batch) >= w.opts.BatchSize || w.opts.FlushInterval <= 0 {
+				batch = w.write(batch)
+			}
+		case <-tick:
+			batch = w.write(batch)
+		case done := <-w.flushReq:
+			batch = w.write(w.drain(batch))
+			close(done)
+		case <-w.stop:
+			w.write(w.drain(batch))
+			return
+		}
+	}
+}
+
+// fill adds queued events until the batch is full or the queue is empty.
+func (w *worker) fill(batch []map[string]any) []map[string]any {
+	for len(batch) < w.opts.BatchSize {
+		select {
+		case evt := <-w.queue:
+			batch = append(batch, evt)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// drain writes full batches until the queue is empty and returns the rest.
+func (w *worker) drain(batch []map[string]any) []map[string]any {
+	for {
+		batch = w.fill(batch)
+		if len(batch) < w.opts.BatchSize {
+			return batch
+		}
+		batch = w.write(batch)
+	}
+}
+
+// write hands the batch to the sink, retrying with exponential backoff,
+// and returns the emptied batch.
+func (w *worker) write(batch []map[string]any) []map[string]any {
+	if len(batch) == 0 {
+		return batch
+	}
+	records := make([]Record, 0, len(batch))
+	for _, evt := range batch {
+		data, err := w.opts.Encode(evt)
+		if err != nil {
+			log.Printf("[EVENT_SINK][%s][WARN] encode failed: %v", w.opts.Name, err)
+			eventsTotal.Inc(w.opts.Name, "failed")
+			continue
+		}
+		records = append(records, Record{Event: evt, Data: data})
+	}
+	clear(batch)
+	batch = batch[:0]
+	if len(records) == 0 {
+		return batch
+	}
+
+	start := time.Now()
+	backoff := w.opts.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), w.opts.WriteTimeout)
+		err = w.sink.Write(ctx, records)
+		cancel()
+		if err == nil || isPermanent(err) || attempt >= w.opts.MaxRetries {
+			break
+		}
+		retriesTotal.Inc(w.opts.Name)
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+			// Shutting down: one last try without waiting.
+			attempt = w.opts.MaxRetries - 1
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+	writeDuration.Observe(time.Since(start).Seconds(), w.opts.Name)
+	if err != nil {
+		log.Printf("[EVENT_SINK][%s][WARN] dropped %d events: %v", w.opts.Name, len(records), err)
+		eventsTotal.Add(float64(len(records)), w.opts.Name, "failed")
+	} else {
+		eventsTotal.Add(float64(len(records)), w.opts.Name, "written")
+	}
+	return batch
+}
+
+// Queue gauges are read at scrape time from the live workers.
+var (
+	workersMu sync.Mutex
+	workers   = map[*worker]struct{}{}
+)
+
+func init() {
+	metrics.RegisterCollector(queueSamples)
+}
+
+func registerWorker(w *worker) {
+	workersMu.Lock()
+	workers[w] = struct{}{}
+	workersMu.Unlock()
+}
+
+func unregisterWorker(w *worker) {
+	workersMu.Lock()
+	delete(workers, w)
+	workersMu.Unlock()
+}
+
+func queueSamples() []metrics.Sample {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	var out []metrics.Sample
+	for w := range workers {
+		labels := map[string]string{"sink": w.opts.Name}
+		out = append(out,
+			metrics.Sample{Name: "mamotama_event_sink_queue_depth", Help: "Events waiting in each sink queue.", Labels: labels, Value: float64(len(w.queue))},
+			metrics.Sample{Name: "mamotama_event_sink_queue_capacity", Help: "Size of each sink queue.", Labels: labels, Value: float64(cap(w.queue))},
+		)
+	}
+	return out
+}
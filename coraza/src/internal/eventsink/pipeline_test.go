@@ -0,0 +1,233 @@
+package eventsink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink records batches. Write waits until gate, if set, is closed.
+type memorySink struct {
+	mu      sync.Mutex
+	batches [][]string
+	gate    chan struct{}
+	fail    []error
+	closed  bool
+}
+
+func (m *memorySink) Write(_ context.Context, records []Record) error {
+	if m.gate != nil {
+		<-m.gate
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.fail) > 0 {
+		err := m.fail[0]
+		m.fail = m.fail[1:]
+		if err != nil {
+			return err
+		}
+	}
+	batch := make([]string, 0, len(records))
+	for _, r := range records {
+		batch = append(batch, string(r.Data))
+	}
+	m.batches = append(m.batches, batch)
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySink) written() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, b := range m.batches {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func idEncoder(evt map[string]any) ([]byte, error) {
+	id, _ := evt["id"].(string)
+	if id == "" {
+		return nil, errors.New("no id")
+	}
+	return []byte(id), nil
+}
+
+func TestPipeline_DeliversToEverySink(t *testing.T) {
+	a, b := &memorySink{}, &memorySink{}
+	failed := eventsTotal.Value("test-deliver-a", "failed")
+	written := eventsTotal.Value("test-deliver-b", "written")
+	p := New()
+	p.Add(a, Options{Name: "test-deliver-a", Encode: idEncoder})
+	p.Add(b, Options{Name: "test-deliver-b", Encode: idEncoder, BatchSize: 2, FlushInterval: time.Hour})
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := p.Publish(map[string]any{"id": id}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	if err := p.Publish(map[string]any{}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for name, s := range map[string]*memorySink{"a": a, "b": b} {
+		if got := s.written(); len(got) != 3 || got[0] != "1" || got[2] != "3" {
+			t.Fatalf("sink %s got %v", name, got)
+		}
+	}
+	if got := eventsTotal.Value("test-deliver-a", "failed"); got != failed+1 {
+		t.Fatalf("encode failures=%v want=%v", got, failed+1)
+	}
+	if got := eventsTotal.Value("test-deliver-b", "written"); got != written+3 {
+		t.Fatalf("written=%v want=%v", got, written+3)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !a.closed || !b.closed {
+		t.Fatal("sinks were not closed")
+	}
+	if err := p.Publish(map[string]any{"id": "4"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Publish after Close: %v", err)
+	}
+}
+
+func TestPipeline_DropPolicies(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantWritten []string
+		wantErr     []bool
+	}{
+		// The worker holds "1" while the queue of two fills up.
+		{policy: DropNewest, wantWritten: []string{"1", "2", "3"}, wantErr: []bool{false, false, false, true}},
+		{policy: DropOldest, wantWritten: []string{"1", "3", "4"}, wantErr: []bool{false, false, false, false}},
+		{policy: Block, wantWritten: []string{"1", "2", "3"}, wantErr: []bool{false, false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			name := "test-drop-" + tt.policy
+			gate := make(chan struct{})
+			s := &memorySink{gate: gate}
+			dropped := eventsTotal.Value(name, "dropped")
+			p := New()
+			p.Add(s, Options{Name: name, Encode: idEncoder, QueueSize: 2, BatchSize: 1, DropPolicy: tt.policy, BlockTimeout: 10 * time.Millisecond})
+			defer p.Close()
+
+			publish := func(id string) error { return p.Publish(map[string]any{"id": id}) }
+			if err := publish("1"); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			// Wait until the worker took "1" and blocks in Write.
+			deadline := time.Now().Add(time.Second)
+			for len(p.workers[0].queue) != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("worker did not pick up the first event")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			for i, id := range []string{"2", "3", "4"} {
+				err := publish(id)
+				if (err != nil) != tt.wantErr[i+1] {
+					t.Fatalf("Publish(%s) err=%v", id, err)
+				}
+			}
+			close(gate)
+			if err := p.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			got := s.written()
+			if len(got) != len(tt.wantWritten) {
+				t.Fatalf("written=%v want=%v", got, tt.wantWritten)
+			}
+			for i := range got {
+				if got[i] != tt.wantWritten[i] {
+					t.Fatalf("written=%v want=%v", got, tt.wantWritten)
+				}
+			}
+			if got := eventsTotal.Value(name, "dropped"); got != dropped+1 {
+				t.Fatalf("dropped=%v want=%v", got, dropped+1)
+			}
+		})
+	}
+}
+
+func TestPipeline_RetriesUntilPermanentOrExhausted(t *testing.T) {
+	s := &memorySink{fail: []error{errors.New("temporary"), nil, Permanent(errors.New("rejected")), errors.New("a"), errors.New("b")}}
+	retries := retriesTotal.Value("test-retry")
+	failed := eventsTotal.Value("test-retry", "failed")
+	p := New()
+	p.Add(s, Options{Name: "test-retry", Encode: idEncoder, MaxRetries: 1, RetryBackoff: time.Millisecond})
+	defer p.Close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		_ = p.Publish(map[string]any{"id": id})
+		if err := p.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if got := s.written(); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("written=%v", got)
+	}
+	if got := retriesTotal.Value("test-retry"); got != retries+2 {
+		t.Fatalf("retries=%v want=%v", got, retries+2)
+	}
+	if got := eventsTotal.Value("test-retry", "failed"); got != failed+2 {
+		t.Fatalf("failed=%v want=%v", got, failed+2)
+	}
+}
+
+func TestPipeline_FlushIntervalBatches(t *testing.T) {
+	s := &memorySink{}
+	p := New()
+	p.Add(s, Options{Name: "test-interval", Encode: idEncoder, BatchSize: 10, FlushInterval: 20 * time.Millisecond})
+	defer p.Close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		_ = p.Publish(map[string]any{"id": id})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.written()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("interval flush did not happen: %v", s.written())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.batches) != 1 {
+		t.Fatalf("expected one batch, got %v", s.batches)
+	}
+}
+
+func TestQueueSamples(t *testing.T) {
+	p := New()
+	p.Add(&memorySink{}, Options{Name: "test-queue-samples", QueueSize: 7})
+	found := false
+	for _, s := range queueSamples() {
+		if s.Name == "mamotama_event_sink_queue_capacity" && s.Labels["sink"] == "test-queue-samples" && s.Value == 7 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("queue capacity sample missing")
+	}
+	_ = p.Close()
+	for _, s := range queueSamples() {
+		if s.Labels["sink"] == "test-queue-samples" {
+			t.Fatal("closed sink still reported")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package eventsink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog facilities by name, as in RFC 5424 section 6.2.1.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig describes an RFC 5424 collector. TCP uses octet-counting
+// framing (RFC 6587); UDP sends one message per datagram.
+type SyslogConfig struct {
+	Network  string
+	Address  string
+	Facility string
+	AppName  string
+	Hostname string
+}
+
+// SyslogSink sends each record as the MSG of an RFC 5424 message. The
+// event's level sets the severity and its event type the MSGID.
+type SyslogSink struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+	procID   string
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+
+	conn net.Conn
+}
+
+func NewSyslogSink(cfg SyslogConfig) (*SyslogSink, error) {
+	network := strings.ToLower(strings.TrimSpace(cfg.Network))
+	if network == "" {
+		network = "udp"
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("syslog network must be udp or tcp")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", cfg.Address, err)
+	}
+	facilityName := strings.ToLower(strings.TrimSpace(cfg.Facility))
+	if facilityName == "" {
+		facilityName = "local0"
+	}
+	facility, ok := syslogFacilities[facilityName]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+	}
+	hostname := strings.TrimSpace(cfg.Hostname)
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	appName := strings.TrimSpace(cfg.AppName)
+	if appName == "" {
+		appName = "mamotama"
+	}
+	var d net.Dialer
+	return &SyslogSink{
+		network:  network,
+		address:  cfg.Address,
+		facility: facility,
+		appName:  syslogHeaderField(appName, 48),
+		hostname: syslogHeaderField(hostname, 255),
+		procID:   strconv.Itoa(os.Getpid()),
+		dial:     d.DialContext,
+	}, nil
+}
+
+func (s *SyslogSink) Write(ctx context.Context, records []Record) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx, s.network, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+
+	var err error
+	if s.network == "tcp" {
+		var buf bytes.Buffer
+		for _, r := range records {
+			msg := s.format(r)
+			buf.WriteString(strconv.Itoa(len(msg)))
+			buf.WriteByte(' ')
+			buf.Write(msg)
+		}
+		_, err = s.conn.Write(buf.Bytes())
+	} else {
+		for _, r := range records {
+			if _, err = s.conn.Write(s.format(r)); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// Part of a TCP batch may have been sent; a retry can repeat it.
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// format builds "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG".
+func (s *SyslogSink) format(r Record) []byte {
+	ts := time.Now().UTC()
+	if v, ok := r.Event["ts"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			ts = t.UTC()
+		}
+	}
+	msgID := "-"
+	if v, ok := r.Event["event"].(string); ok && v != "" {
+		msgID = syslogHeaderField(v, 32)
+	}
+	level, _ := r.Event["level"].(string)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s - ",
+		s.facility*8+syslogSeverity(level),
+		ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, s.procID, msgID)
+	b.Write(r.Data)
+	return b.Bytes()
+}
+
+func syslogSeverity(level string) int {
+	switch strings.ToUpper(level) {
+	case "ERROR", "ERR":
+		return 3
+	case "WARN", "WARNING":
+		return 4
+	case "DEBUG":
+		return 7
+	default:
+		return 6
+	}
+}
+
+// syslogHeaderField limits v to printable US-ASCII without spaces, as
+// header fields require, and to max characters.
+func syslogHeaderField(v string, max int) string {
+	out := make([]byte, 0, min(len(v), max))
+	for i := 0; i < len(v) && len(out) < max; i++ {
+		if c := v[i]; c >= 33 && c <= 126 {
+			out = append(out, c)
+		}
+	}
+	if len(out) == 0 {
+		return "-"
+	}
+	return string(out)
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
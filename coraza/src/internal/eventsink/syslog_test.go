@@ -0,0 +1,129 @@
+package eventsink
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func syslogRecordForTest(event, level, msg string) Record {
+	return Record{
+		Event: map[string]any{"event": event, "level": level, "ts": "2026-03-04T05:06:07.123456Z"},
+		Data:  []byte(msg),
+	}
+}
+
+func TestSyslogSink_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	s, err := NewSyslogSink(SyslogConfig{Address: pc.LocalAddr().String(), Hostname: "waf host", AppName: "mamotama"})
+	if err != nil {
+		t.Fatalf("NewSyslogSink: %v", err)
+	}
+	defer s.Close()
+	records := []Record{
+		syslogRecordForTest("waf_block", "WARN", `{"event":"waf_block"}`),
+		syslogRecordForTest("rate_limited", "", `{"event":"rate_limited"}`),
+	}
+	if err := s.Write(context.Background(), records); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	var got []string
+	for range records {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	// local0 (16) * 8 + warning (4) = 132; + informational (6) = 134.
+	want0 := "<132>1 2026-03-04T05:06:07.123456Z wafhost mamotama " + s.procID + ` waf_block - {"event":"waf_block"}`
+	if got[0] != want0 {
+		t.Fatalf("message=%q\nwant=%q", got[0], want0)
+	}
+	if !strings.HasPrefix(got[1], "<134>1 ") || !strings.Contains(got[1], " rate_limited - ") {
+		t.Fatalf("message=%q", got[1])
+	}
+}
+
+func TestSyslogSink_TCPOctetCounting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	frames := make(chan string, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			n, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			size, err := strconv.Atoi(strings.TrimSpace(n))
+			if err != nil {
+				return
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			frames <- string(msg)
+		}
+	}()
+
+	s, err := NewSyslogSink(SyslogConfig{Network: "tcp", Address: ln.Addr().String(), Facility: "auth", Hostname: "h"})
+	if err != nil {
+		t.Fatalf("NewSyslogSink: %v", err)
+	}
+	defer s.Close()
+	records := []Record{
+		syslogRecordForTest("waf_block", "ERROR", "first message"),
+		syslogRecordForTest("", "DEBUG", "second"),
+	}
+	if err := s.Write(context.Background(), records); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for i, want := range []string{"<35>1 ", "<39>1 "} {
+		select {
+		case msg := <-frames:
+			if !strings.HasPrefix(msg, want) {
+				t.Fatalf("frame %d=%q want prefix %q", i, msg, want)
+			}
+			if i == 1 && !strings.HasSuffix(msg, " - - second") {
+				t.Fatalf("frame without event type=%q", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not received", i)
+		}
+	}
+}
+
+func TestNewSyslogSink_Validates(t *testing.T) {
+	for _, cfg := range []SyslogConfig{
+		{Address: "no-port"},
+		{Network: "unix", Address: "127.0.0.1:514"},
+		{Address: "127.0.0.1:514", Facility: "nope"},
+	} {
+		if _, err := NewSyslogSink(cfg); err == nil {
+			t.Fatalf("expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package eventsink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// WebhookConfig describes an HTTP endpoint that receives batches.
+type WebhookConfig struct {
+	URL     string
+	Headers map[string]string
+}
+
+// WebhookSink POSTs each batch as newline-delimited records. 5xx, 429 and
+// transport errors are retried; other statuses are not.
+type WebhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookSink(cfg WebhookConfig) (*WebhookSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", cfg.URL)
+	}
+	return &WebhookSink{url: u.String(), headers: cfg.Headers, client: &http.Client{}}, nil
+}
+
+func (s *WebhookSink) Write(ctx context.Context, records []Record) error {
+	var body bytes.Buffer
+	for _, r := range records {
+		body.Write(r.Data)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return fmt.Errorf("webhook answered %s", res.Status)
+	default:
+		return Permanent(fmt.Errorf("webhook answered %s", res.Status))
+	}
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
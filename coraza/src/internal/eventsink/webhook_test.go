@@ -0,0 +1,102 @@
+package eventsink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink_PostsNDJSONAndRetries(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		bodies  []string
+		replies = []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-ndjson" || r.Header.Get("Authorization") != "Bearer t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		code := http.StatusOK
+		if len(replies) > 0 {
+			code, replies = replies[0], replies[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(WebhookConfig{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer t"}})
+	if err != nil {
+		t.Fatalf("NewWebhookSink: %v", err)
+	}
+	retries := retriesTotal.Value("test-webhook")
+	failed := eventsTotal.Value("test-webhook", "failed")
+	p := New()
+	p.Add(s, Options{Name: "test-webhook", Encode: idEncoder, BatchSize: 2, FlushInterval: time.Hour, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	defer p.Close()
+
+	for _, id := range []string{"1", "2"} {
+		_ = p.Publish(map[string]any{"id": id})
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	_ = p.Publish(map[string]any{"id": "3"})
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 503 is retried with the same batch; 400 is not retried.
+	want := []string{"1\n2\n", "1\n2\n", "3\n"}
+	if len(bodies) != len(want) {
+		t.Fatalf("bodies=%q want=%q", bodies, want)
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Fatalf("bodies=%q want=%q", bodies, want)
+		}
+	}
+	if got := retriesTotal.Value("test-webhook"); got != retries+1 {
+		t.Fatalf("retries=%v want=%v", got, retries+1)
+	}
+	if got := eventsTotal.Value("test-webhook", "failed"); got != failed+1 {
+		t.Fatalf("failed=%v want=%v", got, failed+1)
+	}
+}
+
+func TestWebhookSink_StatusClasses(t *testing.T) {
+	code := http.StatusTooManyRequests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	s, err := NewWebhookSink(WebhookConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("NewWebhookSink: %v", err)
+	}
+	defer s.Close()
+
+	err = s.Write(context.Background(), recordsForTest("x"))
+	if err == nil || isPermanent(err) {
+		t.Fatalf("429 should be retryable: %v", err)
+	}
+	code = http.StatusForbidden
+	err = s.Write(context.Background(), recordsForTest("x"))
+	if !isPermanent(err) {
+		t.Fatalf("403 should be permanent: %v", err)
+	}
+
+	if _, err := NewWebhookSink(WebhookConfig{URL: "ftp://example.com"}); err == nil {
+		t.Fatal("expected an error for a non-http url")
+	}
+}
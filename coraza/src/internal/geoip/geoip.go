@@ -0,0 +1,95 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Resolver maps a client address to an ISO 3166-1 alpha-2 country code.
+type Resolver interface {
+	Country(ip netip.Addr) (string, bool)
+	// Source names the backing data, e.g. "mmdb:GeoLite2-Country".
+	Source() string
+}
+
+// MMDBResolver reads country data from a MaxMind DB file. GeoIP2,
+// GeoLite2 and DB-IP country/city databases share the record layout used here.
+type MMDBResolver struct {
+	reader *maxminddb.Reader
+	dbType string
+}
+
+type mmdbCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// OpenMMDB loads the whole file into memory rather than mapping it, so a
+// reload can swap readers while lookups on the old one are still running.
+func OpenMMDB(path string) (*MMDBResolver, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.OpenBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("open mmdb %s: %w", path, err)
+	}
+
+	dbType := strings.TrimSpace(reader.Metadata.DatabaseType)
+	if dbType == "" {
+		dbType = "unknown"
+	}
+	return &MMDBResolver{reader: reader, dbType: dbType}, nil
+}
+
+func (m *MMDBResolver) Country(ip netip.Addr) (string, bool) {
+	if m == nil || m.reader == nil || !ip.IsValid() {
+		return "", false
+	}
+	var rec mmdbCountryRecord
+	res := m.reader.Lookup(ip.Unmap())
+	if !res.Found() {
+		return "", false
+	}
+	if err := res.Decode(&rec); err != nil {
+		return "", false
+	}
+	code := rec.Country.ISOCode
+	if code == "" {
+		code = rec.RegisteredCountry.ISOCode
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return code, code != ""
+}
+
+func (m *MMDBResolver) Source() string {
+	return "mmdb:" + m.dbType
+}
+
+type holder struct {
+	r Resolver
+}
+
+var current atomic.Value
+
+func Set(r Resolver) {
+	current.Store(holder{r: r})
+}
+
+func Get() Resolver {
+	v := current.Load()
+	if v == nil {
+		return nil
+	}
+	return v.(holder).r
+}
@@ -0,0 +1,126 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func writeTestMMDB(t *testing.T, path, dbType string, networks map[string]mmdbtype.Map) {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, RecordSize: 24})
+	if err != nil {
+		t.Fatalf("mmdbwriter.New: %v", err)
+	}
+	for cidr, rec := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("parse %s: %v", cidr, err)
+		}
+		if err := tree.Insert(network, rec); err != nil {
+			t.Fatalf("insert %s: %v", cidr, err)
+		}
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		t.Fatalf("create mmdb: %v", err)
+	}
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatalf("write mmdb: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close mmdb: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename mmdb: %v", err)
+	}
+}
+
+func countryRecord(code string) mmdbtype.Map {
+	return mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+}
+
+func TestOpenMMDB_LooksUpCountry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestMMDB(t, path, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"1.1.1.0/24":     countryRecord("AU"),
+		"2001:4860::/32": countryRecord("us"),
+		"8.8.8.0/24": {
+			"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("US")},
+		},
+	})
+
+	db, err := OpenMMDB(path)
+	if err != nil {
+		t.Fatalf("OpenMMDB: %v", err)
+	}
+	if got := db.Source(); got != "mmdb:GeoLite2-Country" {
+		t.Fatalf("Source()=%q", got)
+	}
+
+	tests := []struct {
+		ip     string
+		want   string
+		wantOK bool
+	}{
+		{ip: "1.1.1.1", want: "AU", wantOK: true},
+		{ip: "::ffff:1.1.1.1", want: "AU", wantOK: true},
+		{ip: "2001:4860::8888", want: "US", wantOK: true},
+		{ip: "8.8.8.8", want: "US", wantOK: true},
+		{ip: "9.9.9.9", wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := db.Country(netip.MustParseAddr(tt.ip))
+		if got != tt.want || ok != tt.wantOK {
+			t.Fatalf("Country(%s)=(%q,%v) want=(%q,%v)", tt.ip, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("not an mmdb"), 0o644); err != nil {
+		t.Fatalf("write garbage: %v", err)
+	}
+	if _, err := OpenMMDB(path); err == nil {
+		t.Fatal("OpenMMDB should reject a corrupt file")
+	}
+}
+
+func TestWatch_ReloadsReplacedDatabase(t *testing.T) {
+	prev := Get()
+	t.Cleanup(func() { Set(prev) })
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestMMDB(t, path, "DBIP-Country-Lite", map[string]mmdbtype.Map{"1.1.1.0/24": countryRecord("AU")})
+
+	stop, err := Watch(path)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer stop()
+
+	ip := netip.MustParseAddr("1.1.1.1")
+	if got, _ := Get().Country(ip); got != "AU" {
+		t.Fatalf("initial lookup=%q want=AU", got)
+	}
+
+	writeTestMMDB(t, path, "DBIP-Country-Lite", map[string]mmdbtype.Map{"1.1.1.0/24": countryRecord("JP")})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := Get().Country(ip); got == "JP" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("database was not reloaded after replacement")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := Get().Source(); got != "mmdb:DBIP-Country-Lite" {
+		t.Fatalf("Source()=%q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package geoip
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"mamotama/internal/metrics"
+)
+
+// Watch loads the MMDB file at target, installs it with Set and reloads it
+// whenever the file is replaced. A failed reload keeps the previous
+// database. The initial load may fail (for example before the first
+// download); the watcher still starts so the file is picked up once present.
+func Watch(target string) (func() error, error) {
+	abs, _ := filepath.Abs(target)
+	dir := filepath.Dir(abs)
+	file := filepath.Base(abs)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Add(dir); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	if db, err := OpenMMDB(abs); err == nil {
+		Set(db)
+		log.Printf("[GEOIP] loaded %s (initial)", db.Source())
+	} else {
+		log.Printf("[GEOIP][WARN] initial load skipped: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		var timer *time.Timer
+		defer func() {
+			// A pending reload must not swap the database after stop.
+			if timer != nil {
+				timer.Stop()
+			}
+			close(done)
+		}()
+
+		fire := func() {
+			db, err := OpenMMDB(abs)
+			metrics.ObserveReload("geoip", err)
+			if err != nil {
+				log.Printf("[GEOIP][WARN] reload failed: %v (keeping previous database)", err)
+				return
+			}
+
+			Set(db)
+			log.Printf("[GEOIP] reloaded %s", db.Source())
+		}
+
+		schedule := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			// Downloaders usually write a temp file and rename it over the
+			// target; wait for the burst of events to settle.
+			timer = time.AfterFunc(500*time.Millisecond, fire)
+		}
+
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Base(ev.Name) != file {
+					continue
+				}
+
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					schedule()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[GEOIP][WARN] watcher error: %v", err)
+			}
+		}
+	}()
+
+	stop := func() error {
+		_ = w.Close()
+		<-done
+		return nil
+	}
+
+	return stop, nil
+}
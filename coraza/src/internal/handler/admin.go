@@ -27,6 +27,8 @@ func StatusHandler(c *gin.Context) {
 	dbLastIngestOffset := int64(0)
 	dbLastIngestModTime := ""
 	dbLastSyncScannedLines := 0
+	dbSyncLagBytes := int64(0)
+	dbSyncLagSeconds := 0.0
 	dbStatusError := ""
 
 	if store := getLogsStatsStore(); store != nil {
@@ -41,6 +43,8 @@ func StatusHandler(c *gin.Context) {
 				dbLastIngestOffset = snapshot.LastIngestOffset
 				dbLastIngestModTime = snapshot.LastIngestModTime
 				dbLastSyncScannedLines = snapshot.LastSyncScannedLines
+				dbSyncLagBytes = snapshot.SyncLagBytes
+				dbSyncLagSeconds = snapshot.SyncLagSeconds
 			}
 		}
 	}
@@ -54,6 +58,7 @@ func StatusHandler(c *gin.Context) {
 		"rate_limit_file":               config.RateLimitFile,
 		"rate_limit_enabled":            GetRateLimitConfig().Enabled,
 		"rate_limit_rule_count":         len(GetRateLimitConfig().Rules),
+		"rate_limit_backend":            GetRateLimitBackend(),
 		"bot_defense_file":              config.BotDefenseFile,
 		"bot_defense_enabled":           GetBotDefenseConfig().Enabled,
 		"bot_defense_mode":              GetBotDefenseConfig().Mode,
@@ -92,8 +97,11 @@ func StatusHandler(c *gin.Context) {
 		"db_last_ingest_offset":         dbLastIngestOffset,
 		"db_last_ingest_mod_time":       dbLastIngestModTime,
 		"db_last_sync_scanned_lines":    dbLastSyncScannedLines,
+		"db_sync_lag_bytes":             dbSyncLagBytes,
+		"db_sync_lag_seconds":           dbSyncLagSeconds,
 		"db_status_error":               dbStatusError,
 		"allow_insecure_defaults":       config.AllowInsecureDefaults,
+		"upstreams":                     upstreamStatus(),
 	})
 }
 
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	botBehaviorModeEnforce = "enforce"
+	botBehaviorModeLogOnly = "log_only"
+
+	botBehaviorCadenceSamples = 16
+	botBehaviorMinHeadCount   = 5
+	botBehaviorMaxEntries     = 100000
+	botBehaviorSweepEvery     = 1000
+)
+
+// Signal weights. A listed tool or an empty UA alone reaches the default
+// threshold so that enabling scoring keeps the old suspicious-mode verdicts.
+const (
+	botSignalUATool              = "ua_tool"
+	botSignalUAEmpty             = "ua_empty"
+	botSignalNoAccept            = "no_accept"
+	botSignalNoAcceptLanguage    = "no_accept_language"
+	botSignalSecFetchMissing     = "sec_fetch_missing"
+	botSignalClientHintsMismatch = "client_hints_mismatch"
+	botSignalHighRate            = "high_rate"
+	botSignalRegularCadence      = "regular_cadence"
+	botSignalNoCookiesRepeat     = "no_cookies_repeat"
+	botSignalHeadRatio           = "head_ratio"
+	botSignalCrawlerUnverified   = "crawler_unverified"
+)
+
+var botSignalWeights = map[string]int{
+	botSignalUATool:              4,
+	botSignalUAEmpty:             4,
+	botSignalNoAccept:            1,
+	botSignalNoAcceptLanguage:    1,
+	botSignalSecFetchMissing:     2,
+	botSignalClientHintsMismatch: 3,
+	botSignalHighRate:            2,
+	botSignalRegularCadence:      2,
+	botSignalNoCookiesRepeat:     1,
+	botSignalHeadRatio:           2,
+	botSignalCrawlerUnverified:   4,
+}
+
+type botBehaviorConfig struct {
+	Enabled            bool    `json:"enabled"`
+	Mode               string  `json:"mode,omitempty"`
+	ChallengeThreshold int     `json:"challenge_threshold,omitempty"`
+	WindowSeconds      int     `json:"window_seconds,omitempty"`
+	BurstRequests      int     `json:"burst_requests,omitempty"`
+	HeadRatio          float64 `json:"head_ratio,omitempty"`
+	RepeatVisits       int     `json:"repeat_visits,omitempty"`
+}
+
+type botBehaviorScore struct {
+	Score   int
+	Signals []string
+}
+
+func normalizeBotBehaviorConfig(cfg botBehaviorConfig) (botBehaviorConfig, error) {
+	cfg.Mode = strings.ToLower(strings.TrimSpace(cfg.Mode))
+	if cfg.Mode == "" {
+		cfg.Mode = botBehaviorModeEnforce
+	}
+	if cfg.Mode != botBehaviorModeEnforce && cfg.Mode != botBehaviorModeLogOnly {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.mode must be enforce|log_only")
+	}
+	if cfg.ChallengeThreshold == 0 {
+		cfg.ChallengeThreshold = 4
+	}
+	if cfg.ChallengeThreshold < 1 {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.challenge_threshold must be >= 1")
+	}
+	if cfg.WindowSeconds == 0 {
+		cfg.WindowSeconds = 60
+	}
+	if cfg.WindowSeconds < 1 || cfg.WindowSeconds > 3600 {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.window_seconds must be between 1 and 3600")
+	}
+	if cfg.BurstRequests == 0 {
+		cfg.BurstRequests = 120
+	}
+	if cfg.BurstRequests < 1 {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.burst_requests must be >= 1")
+	}
+	if cfg.HeadRatio == 0 {
+		cfg.HeadRatio = 0.5
+	}
+	if cfg.HeadRatio <= 0 || cfg.HeadRatio > 1 {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.head_ratio must be > 0 and <= 1")
+	}
+	if cfg.RepeatVisits == 0 {
+		cfg.RepeatVisits = 5
+	}
+	if cfg.RepeatVisits < 2 {
+		return botBehaviorConfig{}, fmt.Errorf("behavioral.repeat_visits must be >= 2")
+	}
+	return cfg, nil
+}
+
+// scoreBotRequestHeaders scores what a single request says about itself.
+// net/http folds headers into a map, so arrival order is not observable here;
+// presence and cross-header consistency are scored instead.
+func scoreBotRequestHeaders(suspiciousUA []string, r *http.Request) []string {
+	signals := make([]string, 0, 4)
+	ua := strings.TrimSpace(r.UserAgent())
+	switch {
+	case ua == "":
+		signals = append(signals, botSignalUAEmpty)
+	case isSuspiciousUserAgent(suspiciousUA, ua):
+		signals = append(signals, botSignalUATool)
+	}
+
+	if strings.TrimSpace(r.Header.Get("Accept")) == "" {
+		signals = append(signals, botSignalNoAccept)
+	}
+	if strings.TrimSpace(r.Header.Get("Accept-Language")) == "" {
+		signals = append(signals, botSignalNoAcceptLanguage)
+	}
+
+	browser, major := browserFamilyFromUA(ua)
+	if browserSendsSecFetch(browser, major) && r.Header.Get("Sec-Fetch-Mode") == "" && r.Header.Get("Sec-Fetch-Site") == "" {
+		signals = append(signals, botSignalSecFetchMissing)
+	}
+	if clientHintsMismatch(r, ua, browser, major) {
+		signals = append(signals, botSignalClientHintsMismatch)
+	}
+	return signals
+}
+
+// browserFamilyFromUA returns "chromium", "firefox", "safari" or "" along
+// with the major version the UA claims.
+func browserFamilyFromUA(ua string) (string, int) {
+	if !strings.HasPrefix(ua, "Mozilla/") {
+		return "", 0
+	}
+	if v, ok := uaProductMajor(ua, "Firefox/"); ok {
+		return "firefox", v
+	}
+	for _, token := range []string{"Edg/", "OPR/", "Chrome/"} {
+		if v, ok := uaProductMajor(ua, token); ok {
+			return "chromium", v
+		}
+	}
+	if v, ok := uaProductMajor(ua, "Version/"); ok && strings.Contains(ua, "Safari/") {
+		return "safari", v
+	}
+	return "", 0
+}
+
+func uaProductMajor(ua, token string) (int, bool) {
+	idx := strings.Index(ua, token)
+	if idx < 0 {
+		return 0, false
+	}
+	rest := ua[idx+len(token):]
+	end := strings.IndexAny(rest, ". ;)")
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	v, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// browserSendsSecFetch reports whether the claimed browser version always
+// sends Sec-Fetch-* on navigations.
+func browserSendsSecFetch(browser string, major int) bool {
+	switch browser {
+	case "chromium":
+		return major >= 80
+	case "firefox":
+		return major >= 90
+	case "safari":
+		return major >= 17
+	default:
+		return false
+	}
+}
+
+// clientHintsMismatch flags Sec-CH-UA headers that disagree with the
+// User-Agent: hints from a non-Chromium UA, a different Chromium major, or a
+// mobile/platform hint the UA does not back up.
+func clientHintsMismatch(r *http.Request, ua, browser string, major int) bool {
+	hints := r.Header.Get("Sec-CH-UA")
+	if hints == "" {
+		return false
+	}
+	if browser != "chromium" {
+		return true
+	}
+	if hintMajor, ok := chromiumMajorFromClientHints(hints); ok && hintMajor != major {
+		return true
+	}
+	if mobile := strings.TrimSpace(r.Header.Get("Sec-CH-UA-Mobile")); mobile == "?1" && !strings.Contains(ua, "Mobile") {
+		return true
+	}
+	platform := strings.Trim(strings.TrimSpace(r.Header.Get("Sec-CH-UA-Platform")), `"`)
+	switch strings.ToLower(platform) {
+	case "windows":
+		return !strings.Contains(ua, "Windows")
+	case "macos":
+		return !strings.Contains(ua, "Macintosh")
+	case "android":
+		return !strings.Contains(ua, "Android")
+	case "linux":
+		return !strings.Contains(ua, "Linux") || strings.Contains(ua, "Android")
+	}
+	return false
+}
+
+// chromiumMajorFromClientHints reads the "Chromium" brand version from a
+// Sec-CH-UA list such as `"Chromium";v="124", "Not-A.Brand";v="99"`.
+func chromiumMajorFromClientHints(hints string) (int, bool) {
+	for _, item := range strings.Split(hints, ",") {
+		brand, params, ok := strings.Cut(strings.TrimSpace(item), ";")
+		if !ok || strings.Trim(brand, `" `) != "Chromium" {
+			continue
+		}
+		v := strings.TrimSpace(params)
+		if !strings.HasPrefix(v, "v=") {
+			return 0, false
+		}
+		major, err := strconv.Atoi(strings.Trim(v[2:], `"`))
+		return major, err == nil
+	}
+	return 0, false
+}
+
+type botBehaviorState struct {
+	windowStart time.Time
+	lastSeen    time.Time
+	requests    int
+	heads       int
+	gets        int
+	noCookie    int
+	arrivals    [botBehaviorCadenceSamples]int64
+	arrivalN    int
+}
+
+// botBehaviorTracker keeps per-IP request history for the cadence, cookie
+// and HEAD/GET signals. State is process-local and resets on reload.
+type botBehaviorTracker struct {
+	mu      sync.Mutex
+	entries map[string]*botBehaviorState
+	ops     int
+}
+
+func newBotBehaviorTracker() *botBehaviorTracker {
+	return &botBehaviorTracker{entries: map[string]*botBehaviorState{}}
+}
+
+// observe records the request and returns the history signals that apply
+// to it, including the request itself.
+func (t *botBehaviorTracker) observe(cfg botBehaviorConfig, ip string, r *http.Request, now time.Time) []string {
+	if t == nil || ip == "" {
+		return nil
+	}
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ops++
+	if t.ops%botBehaviorSweepEvery == 0 {
+		t.sweepLocked(now, window)
+	}
+
+	st, ok := t.entries[ip]
+	if !ok {
+		if len(t.entries) >= botBehaviorMaxEntries {
+			return nil
+		}
+		st = &botBehaviorState{windowStart: now}
+		t.entries[ip] = st
+	}
+	if now.Sub(st.windowStart) >= window {
+		st.windowStart = now
+		st.requests, st.heads, st.gets, st.noCookie = 0, 0, 0, 0
+	}
+	if now.Sub(st.lastSeen) >= window {
+		st.arrivalN = 0
+	}
+	st.lastSeen = now
+	st.requests++
+	switch r.Method {
+	case http.MethodHead:
+		st.heads++
+	case http.MethodGet:
+		st.gets++
+	}
+	if r.Header.Get("Cookie") == "" {
+		st.noCookie++
+	}
+	st.arrivals[st.arrivalN%botBehaviorCadenceSamples] = now.UnixNano()
+	st.arrivalN++
+
+	signals := make([]string, 0, 4)
+	if st.requests > cfg.BurstRequests {
+		signals = append(signals, botSignalHighRate)
+	}
+	if st.arrivalN >= botBehaviorCadenceSamples && isRegularCadence(st.arrivals[:]) {
+		signals = append(signals, botSignalRegularCadence)
+	}
+	if st.requests >= cfg.RepeatVisits && st.noCookie == st.requests {
+		signals = append(signals, botSignalNoCookiesRepeat)
+	}
+	if st.heads >= botBehaviorMinHeadCount && float64(st.heads)/float64(st.heads+st.gets) >= cfg.HeadRatio {
+		signals = append(signals, botSignalHeadRatio)
+	}
+	return signals
+}
+
+func (t *botBehaviorTracker) sweepLocked(now time.Time, window time.Duration) {
+	for ip, st := range t.entries {
+		if now.Sub(st.lastSeen) > 2*window {
+			delete(t.entries, ip)
+		}
+	}
+}
+
+// isRegularCadence reports machine-like timing: sub-10s intervals whose
+// standard deviation is under a tenth of the mean.
+func isRegularCadence(arrivals []int64) bool {
+	sorted := append([]int64(nil), arrivals...)
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	n := float64(len(sorted) - 1)
+	if n < 1 {
+		return false
+	}
+	mean := float64(sorted[len(sorted)-1]-sorted[0]) / n
+	if mean <= 0 || mean > float64(10*time.Second) {
+		return false
+	}
+	variance := 0.0
+	for i := 1; i < len(sorted); i++ {
+		d := float64(sorted[i]-sorted[i-1]) - mean
+		variance += d * d
+	}
+	return math.Sqrt(variance/n) < mean/10
+}
+
+func sumBotSignals(signals []string) botBehaviorScore {
+	out := botBehaviorScore{Signals: signals}
+	for _, s := range signals {
+		out.Score += botSignalWeights[s]
+	}
+	return out
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testChromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+func newBrowserRequestForTest(method string) *http.Request {
+	req := httptest.NewRequest(method, "http://example.test/", nil)
+	req.Header.Set("User-Agent", testChromeUA)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("Accept-Language", "ja,en;q=0.8")
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Site", "none")
+	req.Header.Set("Sec-CH-UA", `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`)
+	req.Header.Set("Sec-CH-UA-Mobile", "?0")
+	req.Header.Set("Sec-CH-UA-Platform", `"Windows"`)
+	return req
+}
+
+func TestScoreBotRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*http.Request)
+		want   []string
+	}{
+		{name: "consistent browser", mutate: func(*http.Request) {}, want: []string{}},
+		{name: "tool ua", mutate: func(r *http.Request) {
+			r.Header = http.Header{"User-Agent": {"curl/8.0"}}
+		}, want: []string{botSignalUATool, botSignalNoAccept, botSignalNoAcceptLanguage}},
+		{name: "missing sec-fetch", mutate: func(r *http.Request) {
+			r.Header.Del("Sec-Fetch-Mode")
+			r.Header.Del("Sec-Fetch-Site")
+		}, want: []string{botSignalSecFetchMissing}},
+		{name: "hint version mismatch", mutate: func(r *http.Request) {
+			r.Header.Set("Sec-CH-UA", `"Chromium";v="110", "Not-A.Brand";v="99"`)
+		}, want: []string{botSignalClientHintsMismatch}},
+		{name: "hint platform mismatch", mutate: func(r *http.Request) {
+			r.Header.Set("Sec-CH-UA-Platform", `"macOS"`)
+		}, want: []string{botSignalClientHintsMismatch}},
+		{name: "hints from firefox ua", mutate: func(r *http.Request) {
+			r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0")
+		}, want: []string{botSignalClientHintsMismatch}},
+	}
+	for _, tt := range tests {
+		req := newBrowserRequestForTest(http.MethodGet)
+		tt.mutate(req)
+		got := scoreBotRequestHeaders(defaultSuspiciousUserAgents(), req)
+		if !slices.Equal(got, tt.want) {
+			t.Fatalf("%s: signals=%v want=%v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBotBehaviorTracker_HistorySignals(t *testing.T) {
+	cfg, err := normalizeBotBehaviorConfig(botBehaviorConfig{Enabled: true, BurstRequests: 30, RepeatVisits: 3})
+	if err != nil {
+		t.Fatalf("normalizeBotBehaviorConfig: %v", err)
+	}
+	tr := newBotBehaviorTracker()
+	start := time.Unix(1_700_000_000, 0).UTC()
+
+	var got []string
+	for i := 0; i < botBehaviorCadenceSamples; i++ {
+		got = tr.observe(cfg, "10.0.0.1", newBrowserRequestForTest(http.MethodGet), start.Add(time.Duration(i)*time.Second))
+	}
+	if !slices.Contains(got, botSignalRegularCadence) || !slices.Contains(got, botSignalNoCookiesRepeat) {
+		t.Fatalf("metronomic cookieless client signals=%v", got)
+	}
+
+	// Human-like jitter and a cookie jar on another IP.
+	gaps := []int{300, 2100, 900, 4000, 150, 2600, 700, 1800, 5200, 400, 1200, 3300, 650, 2400, 950, 1500}
+	at := start
+	for _, gap := range gaps {
+		at = at.Add(time.Duration(gap) * time.Millisecond)
+		req := newBrowserRequestForTest(http.MethodGet)
+		req.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+		got = tr.observe(cfg, "10.0.0.2", req, at)
+	}
+	if len(got) != 0 {
+		t.Fatalf("human-like client signals=%v want none", got)
+	}
+
+	for i := 0; i < 31; i++ {
+		method := http.MethodHead
+		if i%4 == 0 {
+			method = http.MethodGet
+		}
+		got = tr.observe(cfg, "10.0.0.3", newBrowserRequestForTest(method), start.Add(time.Duration(i*37%53)*time.Millisecond))
+	}
+	if !slices.Contains(got, botSignalHighRate) || !slices.Contains(got, botSignalHeadRatio) {
+		t.Fatalf("head-heavy burst signals=%v", got)
+	}
+}
+
+func TestEvaluateBotDefense_BehavioralScoreDrivesChallenge(t *testing.T) {
+	restore := useBotBehaviorForTest(t, botBehaviorModeEnforce)
+	defer restore()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	if d := EvaluateBotDefense(newBrowserRequestForTest(http.MethodGet), "10.0.0.1", now); !d.Allowed || d.Score != 0 {
+		t.Fatalf("consistent browser should pass with zero score: %+v", d)
+	}
+
+	// Chrome UA with none of the headers Chrome sends: passes the UA list but
+	// scores no_accept + no_accept_language + sec_fetch_missing.
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	req.Header.Set("User-Agent", testChromeUA)
+	d := EvaluateBotDefense(req, "10.0.0.2", now)
+	if d.Allowed || d.Score != 4 {
+		t.Fatalf("spoofed browser should be challenged with score 4: %+v", d)
+	}
+	if !slices.Contains(d.Signals, botSignalSecFetchMissing) {
+		t.Fatalf("signals=%v want %s", d.Signals, botSignalSecFetchMissing)
+	}
+
+	req.AddCookie(&http.Cookie{Name: "__mamotama_bot_ok", Value: d.Token})
+	if d := EvaluateBotDefense(req, "10.0.0.2", now); !d.Allowed {
+		t.Fatalf("challenge cookie should still pass: %+v", d)
+	}
+
+	head := httptest.NewRequest(http.MethodHead, "http://example.test/", nil)
+	if d := EvaluateBotDefense(head, "10.0.0.3", now); !d.Allowed {
+		t.Fatalf("HEAD is observed but never challenged: %+v", d)
+	}
+}
+
+func TestEvaluateBotDefense_BehavioralLogOnly(t *testing.T) {
+	restore := useBotBehaviorForTest(t, botBehaviorModeLogOnly)
+	defer restore()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	d := EvaluateBotDefense(req, "10.0.0.1", time.Unix(1_700_000_000, 0).UTC())
+	if !d.Allowed || !d.LogOnly {
+		t.Fatalf("log_only should allow and flag the request: %+v", d)
+	}
+	if d.Score < 4 || !slices.Contains(d.Signals, botSignalUATool) {
+		t.Fatalf("log_only decision should carry the score: %+v", d)
+	}
+}
+
+func TestValidateBotDefenseRaw_BehavioralValidation(t *testing.T) {
+	for _, raw := range []string{
+		`{"enabled": true, "behavioral": {"enabled": true, "mode": "block"}}`,
+		`{"enabled": true, "behavioral": {"enabled": true, "head_ratio": 1.5}}`,
+		`{"enabled": true, "behavioral": {"enabled": true, "repeat_visits": 1}}`,
+	} {
+		if _, err := ValidateBotDefenseRaw(raw); err == nil {
+			t.Fatalf("expected error for %s", raw)
+		}
+	}
+}
+
+func useBotBehaviorForTest(t *testing.T, mode string) func() {
+	t.Helper()
+	rt, err := ValidateBotDefenseRaw(`{
+  "enabled": true,
+  "mode": "suspicious",
+  "path_prefixes": ["/"],
+  "challenge_secret": "test-bot-defense-secret-12345",
+  "challenge_ttl_seconds": 3600,
+  "challenge_status_code": 429,
+  "behavioral": {"enabled": true, "mode": "` + mode + `", "challenge_threshold": 4}
+}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	restore := saveBotDefenseStateForTest()
+	botDefenseMu.Lock()
+	botDefenseRuntime = rt
+	botDefenseMu.Unlock()
+	return restore
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	verifiedCrawlerLookupTimeout = 2 * time.Second
+	verifiedCrawlerMaxCache      = 50000
+)
+
+type verifiedCrawlerFamily struct {
+	Name         string   `json:"name"`
+	UserAgents   []string `json:"user_agents"`
+	RDNSSuffixes []string `json:"rdns_suffixes,omitempty"`
+	CIDRs        []string `json:"cidrs,omitempty"`
+}
+
+type verifiedCrawlersConfig struct {
+	Enabled                 bool                    `json:"enabled"`
+	CacheTTLSeconds         int                     `json:"cache_ttl_seconds,omitempty"`
+	NegativeCacheTTLSeconds int                     `json:"negative_cache_ttl_seconds,omitempty"`
+	Families                []verifiedCrawlerFamily `json:"families,omitempty"`
+}
+
+type runtimeCrawlerFamily struct {
+	Name         string
+	UserAgents   []string
+	RDNSSuffixes []string
+	Prefixes     []netip.Prefix
+}
+
+// crawlerResolver is the subset of *net.Resolver used for PTR and forward
+// lookups; tests swap verifiedCrawlerResolver for a stub.
+type crawlerResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var verifiedCrawlerResolver crawlerResolver = net.DefaultResolver
+
+type crawlerVerdict struct {
+	Verified bool
+	Expires  time.Time
+}
+
+// verifiedCrawlerCache memoizes verdicts per family and IP so that each
+// crawler address costs at most one PTR + forward lookup per TTL.
+type verifiedCrawlerCache struct {
+	mu      sync.Mutex
+	entries map[string]crawlerVerdict
+}
+
+func newVerifiedCrawlerCache() *verifiedCrawlerCache {
+	return &verifiedCrawlerCache{entries: map[string]crawlerVerdict{}}
+}
+
+func (c *verifiedCrawlerCache) get(key string, now time.Time) (bool, bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	if !ok || now.After(v.Expires) {
+		return false, false
+	}
+	return v.Verified, true
+}
+
+func (c *verifiedCrawlerCache) put(key string, verified bool, ttl time.Duration, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= verifiedCrawlerMaxCache {
+		for k, v := range c.entries {
+			if now.After(v.Expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= verifiedCrawlerMaxCache {
+			return
+		}
+	}
+	c.entries[key] = crawlerVerdict{Verified: verified, Expires: now.Add(ttl)}
+}
+
+func normalizeVerifiedCrawlersConfig(cfg verifiedCrawlersConfig) (verifiedCrawlersConfig, []runtimeCrawlerFamily, error) {
+	if cfg.CacheTTLSeconds <= 0 {
+		cfg.CacheTTLSeconds = 24 * 60 * 60
+	}
+	if cfg.NegativeCacheTTLSeconds <= 0 {
+		cfg.NegativeCacheTTLSeconds = 60 * 60
+	}
+	if len(cfg.Families) == 0 {
+		cfg.Families = defaultVerifiedCrawlerFamilies()
+	}
+
+	families := make([]runtimeCrawlerFamily, 0, len(cfg.Families))
+	seen := map[string]struct{}{}
+	for i, fam := range cfg.Families {
+		fam.Name = strings.ToLower(strings.TrimSpace(fam.Name))
+		if fam.Name == "" {
+			return verifiedCrawlersConfig{}, nil, fmt.Errorf("verified_crawlers.families[%d]: name is required", i)
+		}
+		if _, ok := seen[fam.Name]; ok {
+			return verifiedCrawlersConfig{}, nil, fmt.Errorf("verified_crawlers.families[%d]: duplicate name %q", i, fam.Name)
+		}
+		seen[fam.Name] = struct{}{}
+
+		fam.UserAgents = normalizeLowerStringList(fam.UserAgents)
+		if len(fam.UserAgents) == 0 {
+			return verifiedCrawlersConfig{}, nil, fmt.Errorf("verified_crawlers.families[%d]: user_agents is required", i)
+		}
+		suffixes := normalizeLowerStringList(fam.RDNSSuffixes)
+		for j, suffix := range suffixes {
+			suffix = strings.TrimSuffix(suffix, ".")
+			if !strings.HasPrefix(suffix, ".") {
+				suffix = "." + suffix
+			}
+			if len(suffix) < 4 || !strings.Contains(suffix[1:], ".") {
+				return verifiedCrawlersConfig{}, nil, fmt.Errorf("verified_crawlers.families[%d]: rdns suffix %q must be a registered domain", i, suffix)
+			}
+			suffixes[j] = suffix
+		}
+		fam.RDNSSuffixes = suffixes
+		prefixes, err := normalizeBotDefenseCIDRs(fmt.Sprintf("verified_crawlers.families[%d].cidrs", i), fam.CIDRs)
+		if err != nil {
+			return verifiedCrawlersConfig{}, nil, err
+		}
+		if len(fam.RDNSSuffixes) == 0 && len(prefixes) == 0 {
+			return verifiedCrawlersConfig{}, nil, fmt.Errorf("verified_crawlers.families[%d]: rdns_suffixes or cidrs is required", i)
+		}
+		fam.CIDRs = make([]string, 0, len(prefixes))
+		for _, pfx := range prefixes {
+			fam.CIDRs = append(fam.CIDRs, pfx.String())
+		}
+		cfg.Families[i] = fam
+		families = append(families, runtimeCrawlerFamily{
+			Name:         fam.Name,
+			UserAgents:   fam.UserAgents,
+			RDNSSuffixes: fam.RDNSSuffixes,
+			Prefixes:     prefixes,
+		})
+	}
+	return cfg, families, nil
+}
+
+func defaultVerifiedCrawlerFamilies() []verifiedCrawlerFamily {
+	return []verifiedCrawlerFamily{
+		{Name: "googlebot", UserAgents: []string{"googlebot", "google-inspectiontool", "googleother"}, RDNSSuffixes: []string{".googlebot.com", ".google.com"}},
+		{Name: "bingbot", UserAgents: []string{"bingbot", "adidxbot"}, RDNSSuffixes: []string{".search.msn.com"}},
+		{Name: "applebot", UserAgents: []string{"applebot"}, RDNSSuffixes: []string{".applebot.apple.com"}},
+		{Name: "yandexbot", UserAgents: []string{"yandexbot"}, RDNSSuffixes: []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+		{Name: "baiduspider", UserAgents: []string{"baiduspider"}, RDNSSuffixes: []string{".baidu.com", ".baidu.jp"}},
+	}
+}
+
+// claimedCrawlerFamily returns the family whose UA token appears in ua.
+func claimedCrawlerFamily(families []runtimeCrawlerFamily, ua string) *runtimeCrawlerFamily {
+	v := strings.ToLower(ua)
+	if v == "" {
+		return nil
+	}
+	for i := range families {
+		for _, needle := range families[i].UserAgents {
+			if strings.Contains(v, needle) {
+				return &families[i]
+			}
+		}
+	}
+	return nil
+}
+
+// verifyCrawler checks that ip really belongs to the claimed family: either
+// it is inside a published CIDR, or its PTR name ends in an allowed suffix
+// and that name resolves back to the same address.
+func verifyCrawler(rt *runtimeBotDefenseConfig, fam *runtimeCrawlerFamily, ip string, now time.Time) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, pfx := range fam.Prefixes {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	if len(fam.RDNSSuffixes) == 0 {
+		return false
+	}
+
+	key := fam.Name + "|" + addr.String()
+	if verified, ok := rt.CrawlerCache.get(key, now); ok {
+		return verified
+	}
+
+	cfg := rt.Raw.VerifiedCrawlers
+	verified, err := lookupCrawlerRDNS(fam, addr)
+	if err != nil {
+		// Transient resolver errors are cached briefly so an outage does not
+		// stall every request, but do not pin a negative verdict for long.
+		log.Printf("[BOT_DEFENSE][CRAWLER][WARN] %s verification for %s failed: %v", fam.Name, addr, err)
+		rt.CrawlerCache.put(key, false, time.Minute, now)
+		return false
+	}
+	ttl := time.Duration(cfg.CacheTTLSeconds) * time.Second
+	if !verified {
+		ttl = time.Duration(cfg.NegativeCacheTTLSeconds) * time.Second
+	}
+	rt.CrawlerCache.put(key, verified, ttl, now)
+	return verified
+}
+
+func lookupCrawlerRDNS(fam *runtimeCrawlerFamily, addr netip.Addr) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), verifiedCrawlerLookupTimeout)
+	defer cancel()
+
+	names, err := verifiedCrawlerResolver.LookupAddr(ctx, addr.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, name := range names {
+		host := strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasCrawlerRDNSSuffix(fam.RDNSSuffixes, host) {
+			continue
+		}
+		ips, err := verifiedCrawlerResolver.LookupHost(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, raw := range ips {
+			if fwd, err := netip.ParseAddr(raw); err == nil && fwd.Unmap() == addr {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func hasCrawlerRDNSSuffix(suffixes []string, host string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
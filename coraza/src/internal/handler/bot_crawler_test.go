@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubCrawlerResolver struct {
+	mu      sync.Mutex
+	ptr     map[string][]string
+	hosts   map[string][]string
+	lookups int
+}
+
+func (s *stubCrawlerResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookups++
+	names, ok := s.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func (s *stubCrawlerResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ips, ok := s.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func useVerifiedCrawlersForTest(t *testing.T, resolver crawlerResolver) func() {
+	t.Helper()
+	rt, err := ValidateBotDefenseRaw(`{
+  "enabled": true,
+  "mode": "suspicious",
+  "path_prefixes": ["/"],
+  "suspicious_user_agents": ["bot"],
+  "challenge_secret": "test-bot-defense-secret-12345",
+  "challenge_ttl_seconds": 3600,
+  "challenge_status_code": 429,
+  "verified_crawlers": {
+    "enabled": true,
+    "families": [
+      {"name": "googlebot", "user_agents": ["googlebot"], "rdns_suffixes": ["googlebot.com"]},
+      {"name": "duckduckbot", "user_agents": ["duckduckbot"], "cidrs": ["20.191.45.212/32"]}
+    ]
+  }
+}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	restore := saveBotDefenseStateForTest()
+	prevResolver := verifiedCrawlerResolver
+	verifiedCrawlerResolver = resolver
+	botDefenseMu.Lock()
+	botDefenseRuntime = rt
+	botDefenseMu.Unlock()
+	return func() {
+		verifiedCrawlerResolver = prevResolver
+		restore()
+	}
+}
+
+func TestEvaluateBotDefense_VerifiedCrawlers(t *testing.T) {
+	resolver := &stubCrawlerResolver{
+		ptr: map[string][]string{
+			"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+			"203.0.113.9": {"crawl-203-0-113-9.googlebot.com.evil.example."},
+			"203.0.113.7": {"crawl-fake.googlebot.com."},
+		},
+		hosts: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+			"crawl-fake.googlebot.com":        {"66.249.66.99"},
+		},
+	}
+	restore := useVerifiedCrawlersForTest(t, resolver)
+	defer restore()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	evaluate := func(ua, ip string) botDefenseDecision {
+		req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		req.Header.Set("User-Agent", ua)
+		return EvaluateBotDefense(req, ip, now)
+	}
+	const googlebotUA = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+
+	if d := evaluate(googlebotUA, "66.249.66.1"); !d.Allowed || d.Crawler != "googlebot" {
+		t.Fatalf("verified googlebot should be exempt: %+v", d)
+	}
+	if d := evaluate(googlebotUA, "66.249.66.1"); !d.Allowed {
+		t.Fatalf("cached googlebot should stay exempt: %+v", d)
+	}
+	if resolver.lookups != 1 {
+		t.Fatalf("PTR lookups=%d want=1 (second request should hit the cache)", resolver.lookups)
+	}
+
+	for _, ip := range []string{"203.0.113.9", "203.0.113.7", "198.51.100.1"} {
+		d := evaluate(googlebotUA, ip)
+		if d.Allowed || d.Crawler != "googlebot" {
+			t.Fatalf("spoofed googlebot from %s should be challenged: %+v", ip, d)
+		}
+	}
+
+	if d := evaluate("DuckDuckBot/1.1; (+http://duckduckgo.com/duckduckbot.html)", "20.191.45.212"); !d.Allowed {
+		t.Fatalf("duckduckbot inside published CIDR should be exempt: %+v", d)
+	}
+	if d := evaluate("Mozilla/5.0 (compatible; SomeOtherBot/1.0)", "66.249.66.1"); d.Allowed {
+		t.Fatalf("unlisted bot should still be challenged: %+v", d)
+	}
+}
+
+func TestEvaluateBotDefense_GooglebotRejectsCloudPTR(t *testing.T) {
+	// Any Google Cloud VM can own a PTR under bc.googleusercontent.com that
+	// resolves back to itself, so that suffix must not verify Googlebot.
+	resolver := &stubCrawlerResolver{
+		ptr: map[string][]string{
+			"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+			"34.85.10.20": {"20.10.85.34.bc.googleusercontent.com."},
+			"35.187.1.2":  {"google-proxy-35-187-1-2.google.com."},
+		},
+		hosts: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com":      {"66.249.66.1"},
+			"20.10.85.34.bc.googleusercontent.com": {"34.85.10.20"},
+			"google-proxy-35-187-1-2.google.com":   {"35.187.1.2"},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "bot-defense.conf")
+	if err := ensureBotDefenseFile(path); err != nil {
+		t.Fatalf("ensureBotDefenseFile: %v", err)
+	}
+	seeded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read seeded file: %v", err)
+	}
+	builtin := `{
+  "enabled": true,
+  "mode": "suspicious",
+  "path_prefixes": ["/"],
+  "challenge_secret": "test-bot-defense-secret-12345",
+  "verified_crawlers": {"enabled": true}
+}`
+
+	const googlebotUA = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	now := time.Unix(1_700_000_000, 0).UTC()
+	for name, raw := range map[string]string{"seeded": string(seeded), "builtin": builtin} {
+		t.Run(name, func(t *testing.T) {
+			rt, err := ValidateBotDefenseRaw(raw)
+			if err != nil {
+				t.Fatalf("ValidateBotDefenseRaw: %v", err)
+			}
+			restore := saveBotDefenseStateForTest()
+			defer restore()
+			prevResolver := verifiedCrawlerResolver
+			verifiedCrawlerResolver = resolver
+			defer func() { verifiedCrawlerResolver = prevResolver }()
+			botDefenseMu.Lock()
+			botDefenseRuntime = rt
+			botDefenseMu.Unlock()
+
+			for ip, want := range map[string]bool{"66.249.66.1": true, "35.187.1.2": true, "34.85.10.20": false} {
+				req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+				req.Header.Set("User-Agent", googlebotUA)
+				if d := EvaluateBotDefense(req, ip, now); d.Allowed != want {
+					t.Fatalf("googlebot from %s allowed=%v want=%v: %+v", ip, d.Allowed, want, d)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBotDefenseRaw_VerifiedCrawlersValidation(t *testing.T) {
+	for _, raw := range []string{
+		`{"enabled": true, "verified_crawlers": {"enabled": true, "families": [{"name": "x", "user_agents": ["x"]}]}}`,
+		`{"enabled": true, "verified_crawlers": {"enabled": true, "families": [{"name": "x", "user_agents": ["x"], "rdns_suffixes": ["com"]}]}}`,
+		`{"enabled": true, "verified_crawlers": {"enabled": true, "families": [{"name": "x", "user_agents": ["x"], "cidrs": ["not-an-ip"]}]}}`,
+		`{"enabled": true, "verified_crawlers": {"enabled": true, "families": [{"name": "x", "rdns_suffixes": [".x.com"]}]}}`,
+	} {
+		if _, err := ValidateBotDefenseRaw(raw); err == nil {
+			t.Fatalf("expected error for %s", raw)
+		}
+	}
+
+	rt, err := ValidateBotDefenseRaw(`{"enabled": true, "verified_crawlers": {"enabled": true}}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	if claimedCrawlerFamily(rt.CrawlerFamilies, "Mozilla/5.0 (compatible; bingbot/2.0)") == nil {
+		t.Fatal("default families should include bingbot")
+	}
+}
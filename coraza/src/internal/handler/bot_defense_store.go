@@ -16,6 +16,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"mamotama/internal/metrics"
 )
 
 const (
@@ -24,37 +26,64 @@ const (
 )
 
 type botDefenseConfig struct {
-	Enabled              bool     `json:"enabled"`
-	Mode                 string   `json:"mode"`
-	PathPrefixes         []string `json:"path_prefixes,omitempty"`
-	ExemptCIDRs          []string `json:"exempt_cidrs,omitempty"`
-	SuspiciousUserAgents []string `json:"suspicious_user_agents,omitempty"`
-	ChallengeCookieName  string   `json:"challenge_cookie_name,omitempty"`
-	ChallengeSecret      string   `json:"challenge_secret,omitempty"`
-	ChallengeTTLSeconds  int      `json:"challenge_ttl_seconds"`
-	ChallengeStatusCode  int      `json:"challenge_status_code"`
+	Enabled              bool                   `json:"enabled"`
+	Mode                 string                 `json:"mode"`
+	Methods              []string               `json:"methods,omitempty"`
+	PathPrefixes         []string               `json:"path_prefixes,omitempty"`
+	ExemptCIDRs          []string               `json:"exempt_cidrs,omitempty"`
+	SuspiciousUserAgents []string               `json:"suspicious_user_agents,omitempty"`
+	ChallengeCookieName  string                 `json:"challenge_cookie_name,omitempty"`
+	ChallengeTokenHeader string                 `json:"challenge_token_header,omitempty"`
+	ChallengeSecret      string                 `json:"challenge_secret,omitempty"`
+	ChallengeTTLSeconds  int                    `json:"challenge_ttl_seconds"`
+	ChallengeStatusCode  int                    `json:"challenge_status_code"`
+	ChallengeType        string                 `json:"challenge_type,omitempty"`
+	PoWDifficulty        int                    `json:"pow_difficulty,omitempty"`
+	PoWMaxDifficulty     int                    `json:"pow_max_difficulty,omitempty"`
+	Behavioral           botBehaviorConfig      `json:"behavioral"`
+	VerifiedCrawlers     verifiedCrawlersConfig `json:"verified_crawlers"`
 }
 
 type runtimeBotDefenseConfig struct {
 	Raw             botDefenseConfig
 	Mode            string
+	Methods         map[string]struct{}
 	PathPrefixes    []string
 	ExemptPrefixes  []netip.Prefix
 	SuspiciousUA    []string
 	CookieName      string
+	TokenHeader     string
 	Secret          []byte
 	ChallengeTTL    time.Duration
 	ChallengeStatus int
+	ChallengeType   string
+	PoWDifficulty   int
+	PoWMaxDiff      int
+	Behavior        *botBehaviorTracker
+	CrawlerFamilies []runtimeCrawlerFamily
+	CrawlerCache    *verifiedCrawlerCache
 	EphemeralSecret bool
+	// PassScope is the route name for route overrides and empty for the
+	// global file. Pass tokens are bound to it, so a pass earned on one
+	// route's challenge is not accepted by another.
+	PassScope string
 }
 
 type botDefenseDecision struct {
-	Allowed    bool
-	Status     int
-	Mode       string
-	CookieName string
-	Token      string
-	TTLSeconds int
+	Allowed       bool
+	Status        int
+	Mode          string
+	CookieName    string
+	TokenHeader   string
+	Token         string
+	TTLSeconds    int
+	ChallengeType string
+	PoWChallenge  string
+	PoWDifficulty int
+	Score         int
+	Signals       []string
+	LogOnly       bool
+	Crawler       string
 }
 
 var (
@@ -94,7 +123,9 @@ func GetBotDefenseConfig() botDefenseConfig {
 	return botDefenseRuntime.Raw
 }
 
-func ReloadBotDefense() error {
+func ReloadBotDefense() (err error) {
+	defer func() { metrics.ObserveReload("bot_defense", err) }()
+
 	path := GetBotDefensePath()
 	if path == "" {
 		return fmt.Errorf("bot defense path is empty")
@@ -126,13 +157,24 @@ func ValidateBotDefenseRaw(raw string) (*runtimeBotDefenseConfig, error) {
 
 func EvaluateBotDefense(r *http.Request, clientIP string, now time.Time) botDefenseDecision {
 	rt := currentBotDefenseRuntime()
+	return evaluateBotDefense(rt, rt, r, clientIP, now)
+}
+
+// evaluateBotDefense applies rt to the request. Pass tokens are issued and
+// checked with pass, the global runtime, because there is a single verify
+// endpoint and one cookie for every route.
+func evaluateBotDefense(rt, pass *runtimeBotDefenseConfig, r *http.Request, clientIP string, now time.Time) botDefenseDecision {
 	if rt == nil || !rt.Raw.Enabled {
 		return botDefenseDecision{Allowed: true}
 	}
 	if r == nil || r.URL == nil {
 		return botDefenseDecision{Allowed: true}
 	}
-	if r.Method != http.MethodGet {
+	if pass == nil {
+		pass = rt
+	}
+	_, enforced := rt.Methods[r.Method]
+	if !enforced && r.Method != http.MethodHead {
 		return botDefenseDecision{Allowed: true}
 	}
 
@@ -150,25 +192,97 @@ func EvaluateBotDefense(r *http.Request, clientIP string, now time.Time) botDefe
 	}
 
 	userAgent := r.UserAgent()
-	if rt.Mode == botDefenseModeSuspicious && !isSuspiciousUserAgent(rt.SuspiciousUA, userAgent) {
-		return botDefenseDecision{Allowed: true}
+	// A UA naming a known crawler is either proven by DNS and exempted, or
+	// treated as a spoofed crawler below.
+	claimedCrawler := ""
+	if rt.Raw.VerifiedCrawlers.Enabled {
+		if fam := claimedCrawlerFamily(rt.CrawlerFamilies, userAgent); fam != nil {
+			if verifyCrawler(rt, fam, clientIP, now.UTC()) {
+				return botDefenseDecision{Allowed: true, Crawler: fam.Name}
+			}
+			claimedCrawler = fam.Name
+		}
 	}
-	if hasValidBotDefenseCookie(rt, r, clientIP, userAgent, now.UTC()) {
-		return botDefenseDecision{Allowed: true}
+
+	behavioral := rt.Raw.Behavioral
+	var behavior botBehaviorScore
+	if behavioral.Enabled {
+		signals := scoreBotRequestHeaders(rt.SuspiciousUA, r)
+		if claimedCrawler != "" {
+			signals = append(signals, botSignalCrawlerUnverified)
+		}
+		signals = append(signals, rt.Behavior.observe(behavioral, clientIP, r, now.UTC())...)
+		behavior = sumBotSignals(signals)
+	}
+	// Unlisted HEAD requests only feed the HEAD/GET ratio.
+	if !enforced {
+		return botDefenseDecision{Allowed: true, Score: behavior.Score, Signals: behavior.Signals}
+	}
+
+	if rt.Mode == botDefenseModeSuspicious {
+		suspicious := claimedCrawler != "" || isSuspiciousUserAgent(rt.SuspiciousUA, userAgent)
+		if behavioral.Enabled {
+			suspicious = behavior.Score >= behavioral.ChallengeThreshold
+		}
+		if !suspicious {
+			return botDefenseDecision{Allowed: true, Score: behavior.Score, Signals: behavior.Signals}
+		}
+	}
+	scope := rt.PassScope
+	if hasValidBotDefensePass(pass, scope, r, clientIP, userAgent, now.UTC()) {
+		return botDefenseDecision{Allowed: true, Score: behavior.Score, Signals: behavior.Signals}
+	}
+	if rt.Mode == botDefenseModeSuspicious && behavioral.Enabled && behavioral.Mode == botBehaviorModeLogOnly {
+		return botDefenseDecision{
+			Allowed: true,
+			Mode:    rt.Mode,
+			Score:   behavior.Score,
+			Signals: behavior.Signals,
+			LogOnly: true,
+			Crawler: claimedCrawler,
+		}
 	}
 
-	ttlSeconds := int(rt.ChallengeTTL.Seconds())
+	ttlSeconds := int(pass.ChallengeTTL.Seconds())
 	if ttlSeconds < 1 {
 		ttlSeconds = 1
 	}
-	return botDefenseDecision{
-		Allowed:    false,
-		Status:     rt.ChallengeStatus,
-		Mode:       rt.Mode,
-		CookieName: rt.CookieName,
-		Token:      issueBotDefenseToken(rt, clientIP, userAgent, now.UTC()),
-		TTLSeconds: ttlSeconds,
-	}
+	d := botDefenseDecision{
+		Allowed:       false,
+		Status:        rt.ChallengeStatus,
+		Mode:          rt.Mode,
+		CookieName:    botDefenseCookieName(pass, scope),
+		TokenHeader:   pass.TokenHeader,
+		TTLSeconds:    ttlSeconds,
+		ChallengeType: rt.ChallengeType,
+		Score:         behavior.Score,
+		Signals:       behavior.Signals,
+		Crawler:       claimedCrawler,
+	}
+	if rt.ChallengeType == challengeTypePoW {
+		// The pass token is only issued by VerifyPoWChallenge.
+		d.PoWDifficulty = botDefensePoWDifficulty(rt, userAgent)
+		d.PoWChallenge = issuePoWChallenge(pass.Secret, botDefensePoWScope(scope), d.PoWDifficulty, clientIP, userAgent, now.UTC())
+		return d
+	}
+	d.Token = issueBotDefenseToken(pass, scope, clientIP, userAgent, now.UTC())
+	// API clients cannot run the inline script, so they get a zero-difficulty
+	// puzzle to echo to the verify endpoint in exchange for the token.
+	d.PoWChallenge = issuePoWChallenge(pass.Secret, botDefensePoWScope(scope), 0, clientIP, userAgent, now.UTC())
+	return d
+}
+
+// botDefensePoWDifficulty adds work for clients whose User-Agent looks
+// automated: two bits for a listed tool, four for an empty UA.
+func botDefensePoWDifficulty(rt *runtimeBotDefenseConfig, userAgent string) int {
+	difficulty := rt.PoWDifficulty
+	switch {
+	case strings.TrimSpace(userAgent) == "":
+		difficulty += 4
+	case isSuspiciousUserAgent(rt.SuspiciousUA, userAgent):
+		difficulty += 2
+	}
+	return clampPoWDifficulty(difficulty, rt.PoWDifficulty, rt.PoWMaxDiff)
 }
 
 func WriteBotDefenseChallenge(w http.ResponseWriter, r *http.Request, d botDefenseDecision) {
@@ -180,35 +294,21 @@ func WriteBotDefenseChallenge(w http.ResponseWriter, r *http.Request, d botDefen
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("X-Mamotama-Bot-Challenge", "required")
 
-	if !acceptsHTML(r.Header.Get("Accept")) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(status)
-		_, _ = w.Write([]byte(`{"error":"bot challenge required"}`))
+	// A challenge page cannot replay a request body, so anything but a
+	// browser GET gets the JSON descriptor.
+	if r.Method != http.MethodGet || !acceptsHTML(r.Header.Get("Accept")) {
+		desc := powChallengeDescriptor("bot challenge required", d.PoWChallenge, d.PoWDifficulty)
+		desc["challenge_type"] = d.ChallengeType
+		desc["cookie_name"] = d.CookieName
+		desc["token_header"] = d.TokenHeader
+		writeChallengeDescriptor(w, r, status, desc)
 		return
 	}
-
-	maxAge := d.TTLSeconds
-	if maxAge < 1 {
-		maxAge = 1
-	}
-	html := fmt.Sprintf(`<!doctype html>
-<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
-<title>Challenge Required</title></head>
-<body>
-<p>Verifying browser...</p>
-<script>
-(() => {
-  const token = %q;
-  const cookieName = %q;
-  document.cookie = cookieName + "=" + token + "; Path=/; Max-Age=%d; SameSite=Lax";
-  window.location.replace(window.location.href);
-})();
-</script>
-<noscript>JavaScript is required to continue.</noscript>
-</body></html>`, d.Token, d.CookieName, maxAge)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(status)
-	_, _ = w.Write([]byte(html))
+	if d.ChallengeType == challengeTypePoW {
+		writeChallengeHTML(w, r, status, "Challenge Required", "Verifying browser...", powChallengeScript(d.PoWChallenge, d.PoWDifficulty))
+		return
+	}
+	writeChallengeHTML(w, r, status, "Challenge Required", "Verifying browser...", cookieChallengeScript(d.Token, d.CookieName, d.TTLSeconds))
 }
 
 func currentBotDefenseRuntime() *runtimeBotDefenseConfig {
@@ -233,12 +333,22 @@ func buildBotDefenseRuntimeFromRaw(raw []byte) (*runtimeBotDefenseConfig, error)
 		return nil, fmt.Errorf("mode must be suspicious|always")
 	}
 
+	methods, err := normalizeBotDefenseMethods(cfg.Methods)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Methods = methods
+	methodSet := make(map[string]struct{}, len(methods))
+	for _, m := range methods {
+		methodSet[m] = struct{}{}
+	}
+
 	cfg.PathPrefixes = normalizePathPrefixes(cfg.PathPrefixes)
 	if len(cfg.PathPrefixes) == 0 {
 		cfg.PathPrefixes = []string{"/"}
 	}
 
-	exempt, err := normalizeBotDefenseCIDRs(cfg.ExemptCIDRs)
+	exempt, err := normalizeBotDefenseCIDRs("exempt_cidrs", cfg.ExemptCIDRs)
 	if err != nil {
 		return nil, err
 	}
@@ -259,6 +369,13 @@ func buildBotDefenseRuntimeFromRaw(raw []byte) (*runtimeBotDefenseConfig, error)
 	if !isValidCookieName(cfg.ChallengeCookieName) {
 		return nil, fmt.Errorf("challenge_cookie_name is invalid")
 	}
+	cfg.ChallengeTokenHeader = http.CanonicalHeaderKey(strings.TrimSpace(cfg.ChallengeTokenHeader))
+	if cfg.ChallengeTokenHeader == "" {
+		cfg.ChallengeTokenHeader = "X-Mamotama-Bot-Token"
+	}
+	if !isValidCookieName(cfg.ChallengeTokenHeader) {
+		return nil, fmt.Errorf("challenge_token_header is invalid")
+	}
 
 	if cfg.ChallengeTTLSeconds <= 0 {
 		cfg.ChallengeTTLSeconds = 24 * 60 * 60
@@ -270,6 +387,31 @@ func buildBotDefenseRuntimeFromRaw(raw []byte) (*runtimeBotDefenseConfig, error)
 		return nil, fmt.Errorf("challenge_status_code must be 400-599")
 	}
 
+	challengeType, err := normalizeChallengeType(cfg.ChallengeType)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ChallengeType = challengeType
+	powBase, powMax := 0, 0
+	if cfg.ChallengeType == challengeTypePoW {
+		powBase, powMax, err = normalizePoWDifficulty(cfg.PoWDifficulty, cfg.PoWMaxDifficulty)
+		if err != nil {
+			return nil, err
+		}
+		cfg.PoWDifficulty, cfg.PoWMaxDifficulty = powBase, powMax
+	}
+
+	cfg.Behavioral, err = normalizeBotBehaviorConfig(cfg.Behavioral)
+	if err != nil {
+		return nil, err
+	}
+
+	var crawlerFamilies []runtimeCrawlerFamily
+	cfg.VerifiedCrawlers, crawlerFamilies, err = normalizeVerifiedCrawlersConfig(cfg.VerifiedCrawlers)
+	if err != nil {
+		return nil, err
+	}
+
 	secret := []byte(strings.TrimSpace(cfg.ChallengeSecret))
 	ephemeral := false
 	if len(secret) == 0 {
@@ -283,13 +425,21 @@ func buildBotDefenseRuntimeFromRaw(raw []byte) (*runtimeBotDefenseConfig, error)
 	return &runtimeBotDefenseConfig{
 		Raw:             cfg,
 		Mode:            cfg.Mode,
+		Methods:         methodSet,
 		PathPrefixes:    append([]string(nil), cfg.PathPrefixes...),
 		ExemptPrefixes:  exempt,
 		SuspiciousUA:    append([]string(nil), cfg.SuspiciousUserAgents...),
 		CookieName:      cfg.ChallengeCookieName,
+		TokenHeader:     cfg.ChallengeTokenHeader,
 		Secret:          secret,
 		ChallengeTTL:    time.Duration(cfg.ChallengeTTLSeconds) * time.Second,
 		ChallengeStatus: cfg.ChallengeStatusCode,
+		ChallengeType:   cfg.ChallengeType,
+		PoWDifficulty:   powBase,
+		PoWMaxDiff:      powMax,
+		Behavior:        newBotBehaviorTracker(),
+		CrawlerFamilies: crawlerFamilies,
+		CrawlerCache:    newVerifiedCrawlerCache(),
 		EphemeralSecret: ephemeral,
 	}, nil
 }
@@ -298,6 +448,30 @@ func normalizeBotDefenseMode(v string) string {
 	return strings.ToLower(strings.TrimSpace(v))
 }
 
+// normalizeBotDefenseMethods defaults to GET, POST and PUT. OPTIONS is
+// refused because CORS preflights never carry the pass cookie or header.
+func normalizeBotDefenseMethods(in []string) ([]string, error) {
+	if len(in) == 0 {
+		return []string{http.MethodGet, http.MethodPost, http.MethodPut}, nil
+	}
+	seen := map[string]struct{}{}
+	out := make([]string, 0, len(in))
+	for i, raw := range in {
+		v := strings.ToUpper(strings.TrimSpace(raw))
+		switch v {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return nil, fmt.Errorf("methods[%d]: must be GET|HEAD|POST|PUT|PATCH|DELETE", i)
+		}
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
 func normalizePathPrefixes(in []string) []string {
 	seen := map[string]struct{}{}
 	out := make([]string, 0, len(in))
@@ -335,7 +509,7 @@ func normalizeLowerStringList(in []string) []string {
 	return out
 }
 
-func normalizeBotDefenseCIDRs(in []string) ([]netip.Prefix, error) {
+func normalizeBotDefenseCIDRs(field string, in []string) ([]netip.Prefix, error) {
 	out := make([]netip.Prefix, 0, len(in))
 	seen := map[string]struct{}{}
 	for i, raw := range in {
@@ -355,7 +529,7 @@ func normalizeBotDefenseCIDRs(in []string) ([]netip.Prefix, error) {
 
 		addr, err := netip.ParseAddr(v)
 		if err != nil {
-			return nil, fmt.Errorf("exempt_cidrs[%d]: invalid address/CIDR: %s", i, v)
+			return nil, fmt.Errorf("%s[%d]: invalid address/CIDR: %s", field, i, v)
 		}
 		bits := 32
 		if addr.Is6() {
@@ -433,25 +607,39 @@ func isSuspiciousUserAgent(list []string, ua string) bool {
 	return false
 }
 
-func hasValidBotDefenseCookie(rt *runtimeBotDefenseConfig, r *http.Request, ip, userAgent string, now time.Time) bool {
+// hasValidBotDefensePass accepts the pass token from the token header (API
+// clients) or the challenge cookie (browsers).
+func hasValidBotDefensePass(rt *runtimeBotDefenseConfig, scope string, r *http.Request, ip, userAgent string, now time.Time) bool {
 	if rt == nil || r == nil {
 		return false
 	}
-	c, err := r.Cookie(rt.CookieName)
+	if token := strings.TrimSpace(r.Header.Get(rt.TokenHeader)); token != "" && verifyBotDefenseToken(rt, scope, token, ip, userAgent, now) {
+		return true
+	}
+	c, err := r.Cookie(botDefenseCookieName(rt, scope))
 	if err != nil {
 		return false
 	}
-	return verifyBotDefenseToken(rt, c.Value, ip, userAgent, now)
+	return verifyBotDefenseToken(rt, scope, c.Value, ip, userAgent, now)
 }
 
-func issueBotDefenseToken(rt *runtimeBotDefenseConfig, ip, userAgent string, now time.Time) string {
+// botDefenseCookieName gives each route its own pass cookie, so passes for
+// different routes do not overwrite each other.
+func botDefenseCookieName(rt *runtimeBotDefenseConfig, scope string) string {
+	if scope == "" {
+		return rt.CookieName
+	}
+	return rt.CookieName + "_" + scope
+}
+
+func issueBotDefenseToken(rt *runtimeBotDefenseConfig, scope, ip, userAgent string, now time.Time) string {
 	exp := now.Add(rt.ChallengeTTL).Unix()
 	payload := strconv.FormatInt(exp, 10)
-	sig := signBotDefenseToken(rt, ip, userAgent, payload)
+	sig := signBotDefenseToken(rt, scope, ip, userAgent, payload)
 	return payload + "." + sig
 }
 
-func verifyBotDefenseToken(rt *runtimeBotDefenseConfig, token, ip, userAgent string, now time.Time) bool {
+func verifyBotDefenseToken(rt *runtimeBotDefenseConfig, scope, token, ip, userAgent string, now time.Time) bool {
 	parts := strings.Split(strings.TrimSpace(token), ".")
 	if len(parts) != 2 {
 		return false
@@ -465,12 +653,15 @@ func verifyBotDefenseToken(rt *runtimeBotDefenseConfig, token, ip, userAgent str
 		return false
 	}
 
-	expected := signBotDefenseToken(rt, ip, userAgent, parts[0])
+	expected := signBotDefenseToken(rt, scope, ip, userAgent, parts[0])
 	return subtleConstantTimeHexEqual(parts[1], expected)
 }
 
-func signBotDefenseToken(rt *runtimeBotDefenseConfig, ip, userAgent, payload string) string {
+func signBotDefenseToken(rt *runtimeBotDefenseConfig, scope, ip, userAgent, payload string) string {
 	mac := hmac.New(sha256.New, rt.Secret)
+	if scope != "" {
+		_, _ = mac.Write([]byte("route\n" + scope + "\n"))
+	}
 	_, _ = mac.Write([]byte(strings.TrimSpace(ip)))
 	_, _ = mac.Write([]byte{'\n'})
 	_, _ = mac.Write([]byte(strings.ToLower(strings.TrimSpace(userAgent))))
@@ -493,7 +684,15 @@ func acceptsHTML(rawAccept string) bool {
 	if v == "" {
 		return false
 	}
-	return strings.Contains(v, "text/html") || strings.Contains(v, "*/*")
+	if strings.Contains(v, "text/html") {
+		return true
+	}
+	// API clients commonly send "application/json, */*"; the explicit JSON
+	// preference wins over the wildcard.
+	if strings.Contains(v, "json") {
+		return false
+	}
+	return strings.Contains(v, "*/*")
 }
 
 func pathMatchesAnyPrefix(prefixes []string, path string) bool {
@@ -522,6 +721,7 @@ func ensureBotDefenseFile(path string) error {
 	const defaultRaw = `{
   "enabled": true,
   "mode": "suspicious",
+  "methods": ["GET", "POST", "PUT"],
   "path_prefixes": ["/"],
   "exempt_cidrs": [
     "127.0.0.1/32",
@@ -551,9 +751,44 @@ func ensureBotDefenseFile(path string) error {
     "masscan"
   ],
   "challenge_cookie_name": "__mamotama_bot_ok",
+  "challenge_token_header": "X-Mamotama-Bot-Token",
   "challenge_secret": "",
   "challenge_ttl_seconds": 21600,
-  "challenge_status_code": 429
+  "challenge_status_code": 429,
+  "challenge_type": "cookie",
+  "pow_difficulty": 16,
+  "pow_max_difficulty": 20,
+  "behavioral": {
+    "enabled": false,
+    "mode": "log_only",
+    "challenge_threshold": 4,
+    "window_seconds": 60,
+    "burst_requests": 120,
+    "head_ratio": 0.5,
+    "repeat_visits": 5
+  },
+  "verified_crawlers": {
+    "enabled": true,
+    "cache_ttl_seconds": 86400,
+    "negative_cache_ttl_seconds": 3600,
+    "families": [
+      {
+        "name": "googlebot",
+        "user_agents": ["googlebot", "google-inspectiontool", "googleother"],
+        "rdns_suffixes": [".googlebot.com", ".google.com"]
+      },
+      {
+        "name": "bingbot",
+        "user_agents": ["bingbot", "adidxbot"],
+        "rdns_suffixes": [".search.msn.com"]
+      },
+      {
+        "name": "applebot",
+        "user_agents": ["applebot"],
+        "rdns_suffixes": [".applebot.apple.com"]
+      }
+    ]
+  }
 }
 `
 	return os.WriteFile(path, []byte(defaultRaw), 0o644)
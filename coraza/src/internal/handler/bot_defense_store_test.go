@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -98,6 +99,96 @@ func TestEvaluateBotDefense_ChallengeThenPass(t *testing.T) {
 	}
 }
 
+func TestEvaluateBotDefense_APIClientVerifiesAndSendsTokenHeader(t *testing.T) {
+	rt, err := ValidateBotDefenseRaw(`{
+  "enabled": true,
+  "mode": "always",
+  "path_prefixes": ["/api"],
+  "challenge_secret": "test-bot-defense-secret-12345",
+  "challenge_ttl_seconds": 3600,
+  "challenge_status_code": 429
+}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	restore := saveBotDefenseStateForTest()
+	defer restore()
+	botDefenseMu.Lock()
+	botDefenseRuntime = rt
+	botDefenseMu.Unlock()
+
+	newPost := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://example.test/api/orders", strings.NewReader(`{"item":1}`))
+		req.Header.Set("User-Agent", "MyApp/2.0 (iOS)")
+		req.Header.Set("Accept", "text/html,application/json")
+		return req
+	}
+
+	req := newPost()
+	d := EvaluateBotDefense(req, "10.0.0.1", time.Now().UTC())
+	if d.Allowed {
+		t.Fatalf("POST on protected prefix should be challenged: %+v", d)
+	}
+	w := httptest.NewRecorder()
+	WriteBotDefenseChallenge(w, req, d)
+	var desc struct {
+		ChallengeType string `json:"challenge_type"`
+		Challenge     string `json:"challenge"`
+		Difficulty    int    `json:"difficulty"`
+		VerifyURL     string `json:"verify_url"`
+		TokenHeader   string `json:"token_header"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("POST challenge should be a JSON descriptor even for HTML Accept: %v body=%s", err, w.Body.String())
+	}
+	if desc.ChallengeType != challengeTypeCookie || desc.Challenge == "" || desc.Difficulty != 0 ||
+		desc.VerifyURL != PowChallengeVerifyPath || desc.TokenHeader != "X-Mamotama-Bot-Token" {
+		t.Fatalf("unexpected descriptor: %+v", desc)
+	}
+
+	vw := postPoWVerifyForTest(t, desc.Challenge, "0", "10.0.0.1", "MyApp/2.0 (iOS)")
+	if vw.Code != http.StatusOK {
+		t.Fatalf("verify status=%d body=%s", vw.Code, vw.Body.String())
+	}
+	var verified struct {
+		Token       string `json:"token"`
+		TokenHeader string `json:"token_header"`
+	}
+	if err := json.Unmarshal(vw.Body.Bytes(), &verified); err != nil || verified.Token == "" || verified.TokenHeader != desc.TokenHeader {
+		t.Fatalf("verify response=%s err=%v", vw.Body.String(), err)
+	}
+
+	next := newPost()
+	next.Header.Set(verified.TokenHeader, verified.Token)
+	if d := EvaluateBotDefense(next, "10.0.0.1", time.Now().UTC()); !d.Allowed {
+		t.Fatalf("request with token header should pass: %+v", d)
+	}
+	other := newPost()
+	other.Header.Set(verified.TokenHeader, verified.Token)
+	if d := EvaluateBotDefense(other, "10.0.0.2", time.Now().UTC()); d.Allowed {
+		t.Fatalf("token header must stay bound to the client IP: %+v", d)
+	}
+	if d := EvaluateBotDefense(httptest.NewRequest(http.MethodDelete, "http://example.test/api/orders/1", nil), "10.0.0.1", time.Now().UTC()); !d.Allowed {
+		t.Fatalf("methods outside the default GET/POST/PUT should pass: %+v", d)
+	}
+}
+
+func TestValidateBotDefenseRaw_Methods(t *testing.T) {
+	rt, err := ValidateBotDefenseRaw(`{"enabled": true, "methods": ["get", "PATCH", "GET"]}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	if got := strings.Join(rt.Raw.Methods, ","); got != "GET,PATCH" {
+		t.Fatalf("methods=%s want=GET,PATCH", got)
+	}
+	if _, err := ValidateBotDefenseRaw(`{"enabled": true, "methods": ["OPTIONS"]}`); err == nil {
+		t.Fatal("expected OPTIONS to be rejected")
+	}
+	if _, err := ValidateBotDefenseRaw(`{"enabled": true, "challenge_token_header": "X Bad"}`); err == nil {
+		t.Fatal("expected invalid token header error")
+	}
+}
+
 func TestSyncBotDefenseStorage_SeedsDBFromFileWhenMissingBlob(t *testing.T) {
 	restore := saveBotDefenseStateForTest()
 	defer restore()
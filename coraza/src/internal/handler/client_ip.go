@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// maxForwardedHops bounds how much of a forwarding header is examined so
+// that a client cannot make every request walk an arbitrarily long list.
+const maxForwardedHops = 32
+
+const defaultClientIPHeader = "X-Forwarded-For"
+
+var (
+	clientIPMu       sync.RWMutex
+	trustedProxyPfxs []netip.Prefix
+	clientIPHeader   = defaultClientIPHeader
+	clientIPDebug    bool
+)
+
+// ConfigureTrustedProxies sets the peers whose forwarding headers and PROXY
+// protocol headers are believed, and the one forwarding header that is
+// read from them. An empty list trusts nobody, so the TCP peer is always
+// the client. An empty header means X-Forwarded-For.
+func ConfigureTrustedProxies(cidrs []string, header string, debug bool) error {
+	prefixes, err := normalizeBotDefenseCIDRs("trusted_proxies", cidrs)
+	if err != nil {
+		return err
+	}
+	name, err := normalizeClientIPHeader(header)
+	if err != nil {
+		return err
+	}
+	clientIPMu.Lock()
+	trustedProxyPfxs = prefixes
+	clientIPHeader = name
+	clientIPDebug = debug
+	clientIPMu.Unlock()
+	return nil
+}
+
+// normalizeClientIPHeader accepts Forwarded, X-Forwarded-For and X-Real-IP.
+// Only one of them is read: a proxy that appends to one header passes the
+// others through from the client unchanged.
+func normalizeClientIPHeader(v string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "x-forwarded-for":
+		return defaultClientIPHeader, nil
+	case "forwarded":
+		return "Forwarded", nil
+	case "x-real-ip":
+		return "X-Real-IP", nil
+	default:
+		return "", fmt.Errorf("client_ip_header must be Forwarded, X-Forwarded-For or X-Real-IP, got %q", v)
+	}
+}
+
+func GetClientIPHeader() string {
+	clientIPMu.RLock()
+	defer clientIPMu.RUnlock()
+	return clientIPHeader
+}
+
+func GetTrustedProxies() []string {
+	clientIPMu.RLock()
+	defer clientIPMu.RUnlock()
+	out := make([]string, 0, len(trustedProxyPfxs))
+	for _, pfx := range trustedProxyPfxs {
+		out = append(out, pfx.String())
+	}
+	return out
+}
+
+// IsTrustedProxy reports whether addr is inside a trusted proxy range.
+func IsTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	clientIPMu.RLock()
+	defer clientIPMu.RUnlock()
+	for _, pfx := range trustedProxyPfxs {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP finds the client address by walking the configured
+// forwarding header from the nearest hop outwards and stopping at the first address that is
+// not a trusted proxy. Hops further left were written by that untrusted
+// party and are ignored. The returned chain lists the hops that were
+// considered, nearest last, for debug logging.
+func resolveClientIP(r *http.Request) (string, []string) {
+	if r == nil {
+		return "", nil
+	}
+	peer := remoteAddrHost(r.RemoteAddr)
+	chain := []string{peer}
+	peerAddr, err := netip.ParseAddr(peer)
+	if err != nil || !IsTrustedProxy(peerAddr) {
+		return peer, chain
+	}
+
+	var hops []string
+	switch header := GetClientIPHeader(); header {
+	case "Forwarded":
+		hops = parseForwardedFor(r.Header.Values(header))
+	case "X-Real-IP":
+		if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+			hops = []string{v}
+		}
+	default:
+		hops = parseXForwardedFor(r.Header.Values(header))
+	}
+	if len(hops) > maxForwardedHops {
+		hops = hops[len(hops)-maxForwardedHops:]
+	}
+	chain = append(hops, peer)
+
+	resolved := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// "unknown" or an obfuscated node: the proxy to its right is
+			// the last address we can vouch for.
+			break
+		}
+		resolved = addr.Unmap().String()
+		if !IsTrustedProxy(addr) {
+			break
+		}
+	}
+	return resolved, chain
+}
+
+func logClientIPResolution(reqID string, r *http.Request, resolved string, chain []string) {
+	clientIPMu.RLock()
+	debug := clientIPDebug
+	clientIPMu.RUnlock()
+	if !debug || r == nil {
+		return
+	}
+	log.Printf("[CLIENT_IP][DEBUG] req_id=%s peer=%s chain=%s resolved=%s", reqID, r.RemoteAddr, strings.Join(chain, " -> "), resolved)
+}
+
+func remoteAddrHost(remoteAddr string) string {
+	v := strings.TrimSpace(remoteAddr)
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(v, "[]")); err == nil {
+		return addr.Unmap().String()
+	}
+	return v
+}
+
+func parseXForwardedFor(values []string) []string {
+	out := make([]string, 0, 4)
+	for _, line := range values {
+		for _, part := range strings.Split(line, ",") {
+			if v := strings.TrimSpace(part); v != "" {
+				out = append(out, forwardedNodeIP(v))
+			}
+		}
+	}
+	return out
+}
+
+// parseForwardedFor extracts the for= node of each RFC 7239 element.
+// Elements without for= are kept as "unknown" so that positions still line
+// up with the proxies that appended them.
+func parseForwardedFor(values []string) []string {
+	out := make([]string, 0, 4)
+	for _, line := range values {
+		for _, element := range splitForwardedList(line, ',') {
+			node := "unknown"
+			for _, pair := range splitForwardedList(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				node = forwardedNodeIP(unquoteForwardedValue(strings.TrimSpace(value)))
+			}
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// splitForwardedList splits on sep outside of quoted strings.
+func splitForwardedList(s string, sep byte) []string {
+	var out []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case sep:
+			if !inQuote {
+				if v := strings.TrimSpace(s[start:i]); v != "" {
+					out = append(out, v)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if v := strings.TrimSpace(s[start:]); v != "" {
+		out = append(out, v)
+	}
+	return out
+}
+
+func unquoteForwardedValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// forwardedNodeIP strips ports and IPv6 brackets: "[2001:db8::1]:4711" and
+// "192.0.2.43:47011" both become bare addresses. Anything that is not an
+// address is returned unchanged.
+func forwardedNodeIP(node string) string {
+	v := strings.TrimSpace(node)
+	if strings.HasPrefix(v, "[") {
+		if end := strings.Index(v, "]"); end > 0 {
+			v = v[1:end]
+		}
+	} else if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	if addr, err := netip.ParseAddr(v); err == nil {
+		return addr.Unmap().String()
+	}
+	return v
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func useTrustedProxiesForTest(t *testing.T, cidrs ...string) {
+	t.Helper()
+	useClientIPHeaderForTest(t, "", cidrs...)
+}
+
+func useClientIPHeaderForTest(t *testing.T, header string, cidrs ...string) {
+	t.Helper()
+	clientIPMu.RLock()
+	prevPfxs, prevHeader, prevDebug := trustedProxyPfxs, clientIPHeader, clientIPDebug
+	clientIPMu.RUnlock()
+	t.Cleanup(func() {
+		clientIPMu.Lock()
+		trustedProxyPfxs, clientIPHeader, clientIPDebug = prevPfxs, prevHeader, prevDebug
+		clientIPMu.Unlock()
+	})
+	if err := ConfigureTrustedProxies(cidrs, header, false); err != nil {
+		t.Fatalf("ConfigureTrustedProxies() unexpected error: %v", err)
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipHeader string
+		remote   string
+		headers  map[string]string
+		want     string
+	}{
+		{
+			name:    "untrusted peer ignores headers",
+			remote:  "198.51.100.9:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "5.6.7.8"},
+			want:    "198.51.100.9",
+		},
+		{
+			name:   "trusted peer without headers",
+			remote: "10.0.0.2:5000",
+			want:   "10.0.0.2",
+		},
+		{
+			name:    "xff walks from the right past trusted hops",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 203.0.113.7, 10.1.1.1"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "all hops trusted yields leftmost",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "10.9.9.9, 10.1.1.1"},
+			want:    "10.9.9.9",
+		},
+		{
+			name:    "xff with ports and brackets",
+			remote:  "[2001:db8:ffff::1]:443",
+			headers: map[string]string{"X-Forwarded-For": "[2001:db8::7]:4711, 10.1.1.1:80"},
+			want:    "2001:db8::7",
+		},
+		{
+			name:    "garbage hop stops at the proxy that wrote it",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, not-an-ip, 10.1.1.1"},
+			want:    "10.1.1.1",
+		},
+		{
+			name:     "forwarded when configured",
+			ipHeader: "forwarded",
+			remote:   "10.0.0.2:5000",
+			headers: map[string]string{
+				"Forwarded":       `for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711", for=10.3.3.3`,
+				"X-Forwarded-For": "9.9.9.9",
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:     "forwarded obfuscated node",
+			ipHeader: "Forwarded",
+			remote:   "10.0.0.2:5000",
+			headers:  map[string]string{"Forwarded": `for=192.0.2.60, for=_hidden, for=10.3.3.3`},
+			want:     "10.3.3.3",
+		},
+		{
+			name:     "x-real-ip from trusted peer",
+			ipHeader: "X-Real-IP",
+			remote:   "10.0.0.2:5000",
+			headers:  map[string]string{"X-Real-IP": "203.0.113.8", "X-Forwarded-For": "9.9.9.9"},
+			want:     "203.0.113.8",
+		},
+		{
+			name:    "client forwarded ignored when xff is configured",
+			remote:  "10.0.0.2:5000",
+			headers: map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "203.0.113.9"},
+			want:    "203.0.113.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useClientIPHeaderForTest(t, tt.ipHeader, "10.0.0.0/8", "2001:db8:ffff::/48")
+			req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			got, chain := resolveClientIP(req)
+			if got != tt.want {
+				t.Fatalf("resolveClientIP()=%q want=%q chain=%v", got, tt.want, chain)
+			}
+		})
+	}
+}
+
+func TestConfigureTrustedProxies_RejectsInvalidCIDR(t *testing.T) {
+	useTrustedProxiesForTest(t)
+	if err := ConfigureTrustedProxies([]string{"10.0.0.0/8", "nope"}, "", false); err == nil {
+		t.Fatal("expected error for invalid CIDR")
+	}
+	if err := ConfigureTrustedProxies([]string{"10.0.0.0/8"}, "CF-Connecting-IP", false); err == nil {
+		t.Fatal("expected error for unsupported client IP header")
+	}
+}
+
+// The bundled nginx appends to X-Forwarded-For and passes Forwarded through
+// from the client; a spoofed Forwarded must not win.
+func TestResolveClientIP_TrustedProxyAppendsXFFClientSendsForwarded(t *testing.T) {
+	useTrustedProxiesForTest(t, "172.30.0.10")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	req.RemoteAddr = "172.30.0.10:40000"
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got, chain := resolveClientIP(req); got != "203.0.113.9" {
+		t.Fatalf("resolveClientIP()=%q want=203.0.113.9 chain=%v", got, chain)
+	}
+}
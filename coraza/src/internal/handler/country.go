@@ -1,6 +1,79 @@
 package handler
 
-import "strings"
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"mamotama/internal/geoip"
+)
+
+const (
+	countryModeHeader = "header"
+	countryModeMMDB   = "mmdb"
+	countryModeAuto   = "auto"
+
+	countrySourceHeader = "header"
+	countrySourceNone   = "none"
+)
+
+var (
+	countryResolveMu   sync.RWMutex
+	countryResolveMode = countryModeHeader
+	countryHeaderName  = "X-Country-Code"
+)
+
+// ConfigureCountryResolution selects where ProxyHandler takes the client
+// country from: the trusted header set by the edge ("header"), the local
+// GeoIP database ("mmdb"), or the database with the header as a fallback
+// ("auto").
+func ConfigureCountryResolution(mode, header string) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case countryModeHeader, countryModeMMDB, countryModeAuto:
+	default:
+		mode = countryModeHeader
+	}
+	header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+	if header == "" {
+		header = "X-Country-Code"
+	}
+
+	countryResolveMu.Lock()
+	countryResolveMode = mode
+	countryHeaderName = header
+	countryResolveMu.Unlock()
+}
+
+// resolveRequestCountry returns the normalized country code and the source
+// it came from ("header", the resolver's source such as
+// "mmdb:GeoLite2-Country", or "none").
+func resolveRequestCountry(r *http.Request, clientIP string) (string, string) {
+	countryResolveMu.RLock()
+	mode, header := countryResolveMode, countryHeaderName
+	countryResolveMu.RUnlock()
+
+	if mode != countryModeHeader {
+		if resolver := geoip.Get(); resolver != nil {
+			if ip, err := netip.ParseAddr(normalizeClientIP(clientIP)); err == nil {
+				if code, ok := resolver.Country(ip); ok {
+					return normalizeCountryCode(code), resolver.Source()
+				}
+			}
+		}
+		if mode == countryModeMMDB {
+			return normalizeCountryCode(""), countrySourceNone
+		}
+	}
+
+	if r != nil {
+		if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+			return normalizeCountryCode(v), countrySourceHeader
+		}
+	}
+	return normalizeCountryCode(""), countrySourceNone
+}
 
 func normalizeCountryFilter(raw string) string {
 	v := strings.TrimSpace(strings.ToUpper(raw))
@@ -8,6 +8,8 @@ import (
 	"sort"
 	"strings"
 	"sync"
+
+	"mamotama/internal/metrics"
 )
 
 var (
@@ -60,7 +62,9 @@ func IsCountryBlocked(country string) bool {
 	return ok
 }
 
-func ReloadCountryBlock() error {
+func ReloadCountryBlock() (err error) {
+	defer func() { metrics.ObserveReload("country_block", err) }()
+
 	path := GetCountryBlockPath()
 	if path == "" {
 		return fmt.Errorf("country block path is empty")
@@ -1,12 +1,17 @@
 package handler
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"mamotama/internal/geoip"
 )
 
 func TestParseCountryBlockRaw_Valid(t *testing.T) {
@@ -152,3 +157,53 @@ func saveCountryBlockStateForTest() func() {
 		countryBlockMu.Unlock()
 	}
 }
+
+type stubCountryResolver map[string]string
+
+func (s stubCountryResolver) Country(ip netip.Addr) (string, bool) {
+	code, ok := s[ip.String()]
+	return code, ok
+}
+
+func (s stubCountryResolver) Source() string {
+	return "mmdb:Test-Country"
+}
+
+func TestResolveRequestCountry_Modes(t *testing.T) {
+	prevResolver := geoip.Get()
+	countryResolveMu.RLock()
+	prevMode, prevHeader := countryResolveMode, countryHeaderName
+	countryResolveMu.RUnlock()
+	t.Cleanup(func() {
+		geoip.Set(prevResolver)
+		ConfigureCountryResolution(prevMode, prevHeader)
+	})
+	geoip.Set(stubCountryResolver{"203.0.113.10": "jp"})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("CF-IPCountry", "US")
+
+	tests := []struct {
+		mode, ip    string
+		wantCountry string
+		wantSource  string
+	}{
+		{mode: "header", ip: "203.0.113.10", wantCountry: "US", wantSource: "header"},
+		{mode: "mmdb", ip: "203.0.113.10", wantCountry: "JP", wantSource: "mmdb:Test-Country"},
+		{mode: "mmdb", ip: "198.51.100.1", wantCountry: "UNKNOWN", wantSource: "none"},
+		{mode: "auto", ip: "203.0.113.10", wantCountry: "JP", wantSource: "mmdb:Test-Country"},
+		{mode: "auto", ip: "198.51.100.1", wantCountry: "US", wantSource: "header"},
+	}
+	for _, tt := range tests {
+		ConfigureCountryResolution(tt.mode, "cf-ipcountry")
+		country, source := resolveRequestCountry(req, tt.ip)
+		if country != tt.wantCountry || source != tt.wantSource {
+			t.Fatalf("mode=%s ip=%s got=(%s,%s) want=(%s,%s)", tt.mode, tt.ip, country, source, tt.wantCountry, tt.wantSource)
+		}
+	}
+
+	ConfigureCountryResolution("header", "")
+	if country, source := resolveRequestCountry(httptest.NewRequest(http.MethodGet, "/", nil), "203.0.113.10"); country != "UNKNOWN" || source != "none" {
+		t.Fatalf("missing header got=(%s,%s) want=(UNKNOWN,none)", country, source)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"mamotama/internal/eventsink"
+)
+
+var eventSinks atomic.Pointer[eventsink.Pipeline]
+
+func eventsFilePath() string {
+	if path := os.Getenv("WAF_EVENTS_FILE"); path != "" {
+		return path
+	}
+	return "/app/logs/coraza/waf-events.ndjson"
+}
+
+// InitEventSinks starts the event pipeline: the event file plus the sinks
+// in the config file at path. A missing config file keeps the event file
+// without rotation and adds no sinks.
+func InitEventSinks(path string) error {
+	raw, err := os.ReadFile(strings.TrimSpace(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	cfg, err := eventsink.ParseConfig(raw)
+	if err != nil {
+		return fmt.Errorf("invalid event sink config: %w", err)
+	}
+	p, err := eventsink.Build(cfg, eventsFilePath(), rotateWAFEventsFile)
+	if err != nil {
+		return err
+	}
+	if prev := eventSinks.Swap(p); prev != nil {
+		_ = prev.Close()
+	}
+	log.Printf("[EVENT_SINK][INIT] file=%s sinks=%d", eventsFilePath(), len(cfg.Sinks))
+	return nil
+}
+
+// CloseEventSinks writes queued events and stops the pipeline.
+func CloseEventSinks() error {
+	if p := eventSinks.Swap(nil); p != nil {
+		return p.Close()
+	}
+	return nil
+}
+
+// FlushEventSinks waits until queued events were handed to every sink.
+func FlushEventSinks(ctx context.Context) error {
+	if p := eventSinks.Load(); p != nil {
+		return p.Flush(ctx)
+	}
+	return nil
+}
+
+// rotateWAFEventsFile lets the DB store ingest the tail of the event file
+// before it is rotated away.
+func rotateWAFEventsFile(rotate func() error) error {
+	store := getLogsStatsStore()
+	if store == nil {
+		return rotate()
+	}
+	return store.RotateWAFEvents(resolveLogPath("waf", logFiles["waf"]), rotate)
+}
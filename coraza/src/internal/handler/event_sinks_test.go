@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInitEventSinks_FansOutEvents(t *testing.T) {
+	dir := t.TempDir()
+	eventsPath := filepath.Join(dir, "waf-events.ndjson")
+	t.Setenv("WAF_EVENTS_FILE", eventsPath)
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	confPath := filepath.Join(dir, "event-sinks.conf")
+	conf := `{"file":{"max_size_mb":1},"sinks":[{"name":"hook","type":"webhook","url":"` + hook.URL + `"}]}`
+	if err := os.WriteFile(confPath, []byte(conf), 0o644); err != nil {
+		t.Fatalf("write conf: %v", err)
+	}
+	if err := InitEventSinks(confPath); err != nil {
+		t.Fatalf("InitEventSinks: %v", err)
+	}
+	t.Cleanup(func() { _ = CloseEventSinks() })
+
+	for _, ev := range []string{"waf_block", "rate_limited"} {
+		if err := appendEventToFile(map[string]any{"event": ev}); err != nil {
+			t.Fatalf("appendEventToFile: %v", err)
+		}
+	}
+	if err := FlushEventSinks(context.Background()); err != nil {
+		t.Fatalf("FlushEventSinks: %v", err)
+	}
+
+	events := readEventsForTest(t, eventsPath)
+	if len(events) != 2 || events[0]["event"] != "waf_block" || events[1]["event"] != "rate_limited" {
+		t.Fatalf("event file=%v", events)
+	}
+	mu.Lock()
+	got := strings.Join(bodies, "")
+	mu.Unlock()
+	if got != `{"event":"waf_block"}`+"\n"+`{"event":"rate_limited"}`+"\n" {
+		t.Fatalf("webhook bodies=%q", got)
+	}
+}
+
+func TestInitEventSinks_MissingAndInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(dir, "waf-events.ndjson"))
+
+	if err := InitEventSinks(filepath.Join(dir, "missing.conf")); err != nil {
+		t.Fatalf("missing config should use defaults: %v", err)
+	}
+	if err := CloseEventSinks(); err != nil {
+		t.Fatalf("CloseEventSinks: %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad.conf")
+	if err := os.WriteFile(bad, []byte(`{"sinks":[{"name":"x","type":"nope"}]}`), 0o644); err != nil {
+		t.Fatalf("write conf: %v", err)
+	}
+	if err := InitEventSinks(bad); err == nil {
+		_ = CloseEventSinks()
+		t.Fatal("expected an error for an unknown sink type")
+	}
+	if eventSinks.Load() != nil {
+		t.Fatal("a failed init must leave the synchronous fallback in place")
+	}
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/config"
+	"mamotama/internal/metrics"
+)
+
+// Every event passed to emitJSONLog is also published to the subscribers
+// of GET /events/stream. Publishing never blocks the request: a subscriber
+// whose buffer is full is dropped, and its stream ends with an overflow
+// event so the client can reconnect and catch up through /logs/read.
+const (
+	eventStreamBuffer    = 256
+	eventStreamHeartbeat = 15 * time.Second
+	eventStreamRetryMS   = 3000
+)
+
+var (
+	eventStreamSubscribers = metrics.NewGaugeVec(
+		"mamotama_event_stream_subscribers",
+		"Clients connected to /events/stream.",
+	)
+	eventStreamDroppedTotal = metrics.NewCounterVec(
+		"mamotama_event_stream_dropped_subscribers_total",
+		"Event stream clients disconnected because they fell behind.",
+	)
+)
+
+// eventStreamFilter selects events for one subscriber. Empty sets match
+// everything.
+type eventStreamFilter struct {
+	events     map[string]struct{}
+	countries  map[string]struct{}
+	pathPrefix string
+	ruleIDs    map[string]struct{}
+}
+
+// streamEvent carries the encoded event and the fields filters look at,
+// taken when it was published.
+type streamEvent struct {
+	id      uint64
+	event   string
+	country string
+	path    string
+	ruleIDs []string
+	data    []byte
+}
+
+type eventStreamSubscriber struct {
+	filter eventStreamFilter
+	ch     chan *streamEvent
+}
+
+type eventStreamHub struct {
+	mu     sync.Mutex
+	subs   map[*eventStreamSubscriber]struct{}
+	nextID uint64
+	// active lets publish skip the lock when nobody listens.
+	active atomic.Int64
+	// closed ends every stream when the server shuts down.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var eventHub = &eventStreamHub{subs: map[*eventStreamSubscriber]struct{}{}, closed: make(chan struct{})}
+
+// CloseEventStreams ends every /events/stream response, so a graceful
+// shutdown does not wait for them. Clients reconnect to the next process.
+func CloseEventStreams() {
+	eventHub.closeOnce.Do(func() { close(eventHub.closed) })
+}
+
+func (h *eventStreamHub) subscribe(filter eventStreamFilter, max int) (*eventStreamSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if max > 0 && len(h.subs) >= max {
+		return nil, false
+	}
+	sub := &eventStreamSubscriber{filter: filter, ch: make(chan *streamEvent, eventStreamBuffer)}
+	h.subs[sub] = struct{}{}
+	h.updateCountLocked()
+	return sub, true
+}
+
+func (h *eventStreamHub) unsubscribe(sub *eventStreamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+		h.updateCountLocked()
+	}
+}
+
+func (h *eventStreamHub) updateCountLocked() {
+	h.active.Store(int64(len(h.subs)))
+	eventStreamSubscribers.Set(float64(len(h.subs)))
+}
+
+// publish hands data, the JSON encoding of evt, to every matching
+// subscriber and drops the ones whose buffer is full.
+func (h *eventStreamHub) publish(evt map[string]any, data []byte) {
+	if h.active.Load() == 0 {
+		return
+	}
+	se := &streamEvent{
+		event:   logFieldString(evt["event"]),
+		country: normalizeCountryFromAny(evt["country"]),
+		path:    logFieldString(evt["path"]),
+		ruleIDs: eventRuleIDs(evt),
+		data:    data,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	se.id = h.nextID
+	for sub := range h.subs {
+		if !sub.filter.matches(se) {
+			continue
+		}
+		select {
+		case sub.ch <- se:
+		default:
+			delete(h.subs, sub)
+			close(sub.ch)
+			eventStreamDroppedTotal.Inc()
+		}
+	}
+	h.updateCountLocked()
+}
+
+// eventRuleIDs lists the rule ids an event refers to: rule_id,
+// matched_rule_id and the comma-separated rules of waf_hit_allow.
+func eventRuleIDs(evt map[string]any) []string {
+	var ids []string
+	for _, key := range []string{"rule_id", "matched_rule_id"} {
+		if v, ok := evt[key]; ok && v != nil {
+			if id := strings.TrimSpace(logFieldString(v)); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if rules, ok := evt["rules"].(string); ok {
+		for _, id := range strings.Split(rules, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func (f eventStreamFilter) matches(se *streamEvent) bool {
+	if len(f.events) > 0 {
+		if _, ok := f.events[se.event]; !ok {
+			return false
+		}
+	}
+	if len(f.countries) > 0 {
+		if _, ok := f.countries[se.country]; !ok {
+			return false
+		}
+	}
+	if f.pathPrefix != "" && !strings.HasPrefix(se.path, f.pathPrefix) {
+		return false
+	}
+	if len(f.ruleIDs) > 0 {
+		for _, id := range se.ruleIDs {
+			if _, ok := f.ruleIDs[id]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parseEventStreamFilter reads the event, country, path_prefix and rule_id
+// query parameters. event, country and rule_id take comma-separated lists.
+func parseEventStreamFilter(c *gin.Context) eventStreamFilter {
+	set := func(raw string, normalize func(string) string) map[string]struct{} {
+		out := map[string]struct{}{}
+		for _, v := range strings.Split(raw, ",") {
+			if v = normalize(v); v != "" {
+				out[v] = struct{}{}
+			}
+		}
+		return out
+	}
+	return eventStreamFilter{
+		events:     set(c.Query("event"), strings.TrimSpace),
+		countries:  set(c.Query("country"), normalizeCountryFilter),
+		pathPrefix: strings.TrimSpace(c.Query("path_prefix")),
+		ruleIDs:    set(c.Query("rule_id"), strings.TrimSpace),
+	}
+}
+
+// EventsStream serves security events as Server-Sent Events while they
+// happen. Each message is one event in the JSON form of the event file,
+// with a per-process sequence number as its id.
+func EventsStream(c *gin.Context) {
+	sub, ok := eventHub.subscribe(parseEventStreamFilter(c), config.EventStreamMaxSubscribers)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many event stream subscribers"})
+		return
+	}
+	defer eventHub.unsubscribe(sub)
+
+	h := c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if _, err := fmt.Fprintf(c.Writer, "retry: %d\n\n", eventStreamRetryMS); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(eventStreamHeartbeat)
+	defer ticker.Stop()
+	ctx := c.Request.Context()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-eventHub.closed:
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(c.Writer, ": ping\n\n")
+		case se, ok := <-sub.ch:
+			if !ok {
+				_, _ = fmt.Fprint(c.Writer, "event: overflow\ndata: {\"error\":\"subscriber fell behind\"}\n\n")
+				c.Writer.Flush()
+				return
+			}
+			_, err = fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", se.id, se.data)
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
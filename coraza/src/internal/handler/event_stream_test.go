@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/config"
+)
+
+func TestEventStreamFilter_Matches(t *testing.T) {
+	block := &streamEvent{event: "waf_block", country: "JP", path: "/api/login", ruleIDs: []string{"949110", "942100"}}
+	tests := []struct {
+		name   string
+		filter eventStreamFilter
+		want   bool
+	}{
+		{name: "empty", filter: eventStreamFilter{}, want: true},
+		{name: "event", filter: eventStreamFilter{events: map[string]struct{}{"rate_limited": {}, "waf_block": {}}}, want: true},
+		{name: "other event", filter: eventStreamFilter{events: map[string]struct{}{"rate_limited": {}}}},
+		{name: "country", filter: eventStreamFilter{countries: map[string]struct{}{"JP": {}}}, want: true},
+		{name: "other country", filter: eventStreamFilter{countries: map[string]struct{}{"US": {}}}},
+		{name: "path prefix", filter: eventStreamFilter{pathPrefix: "/api/"}, want: true},
+		{name: "other path prefix", filter: eventStreamFilter{pathPrefix: "/admin"}},
+		{name: "detection rule", filter: eventStreamFilter{ruleIDs: map[string]struct{}{"942100": {}}}, want: true},
+		{name: "other rule", filter: eventStreamFilter{ruleIDs: map[string]struct{}{"930100": {}}}},
+		{
+			name: "all",
+			filter: eventStreamFilter{
+				events:     map[string]struct{}{"waf_block": {}},
+				countries:  map[string]struct{}{"JP": {}},
+				pathPrefix: "/api",
+				ruleIDs:    map[string]struct{}{"949110": {}},
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(block); got != tt.want {
+				t.Fatalf("matches()=%v want=%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventRuleIDs(t *testing.T) {
+	got := eventRuleIDs(map[string]any{"rule_id": 949110, "matched_rule_id": float64(942100), "rules": "942100, 949110,"})
+	want := []string{"949110", "942100", "942100", "949110"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("eventRuleIDs()=%v want=%v", got, want)
+	}
+	if ids := eventRuleIDs(map[string]any{"event": "rate_limited"}); len(ids) != 0 {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+}
+
+func waitForEventSubscribersForTest(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for eventHub.active.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscribers=%d want=%d", eventHub.active.Load(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEventsStream_PushesFilteredEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/events/stream", EventsStream)
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events/stream?event=waf_block,rate_limited&country=jp&path_prefix=/api&rule_id=942100", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status=%d content-type=%q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	waitForEventSubscribersForTest(t, 1)
+
+	emitJSONLog(map[string]any{"event": "waf_block", "country": "US", "path": "/api/a", "rule_id": 942100})
+	emitJSONLog(map[string]any{"event": "waf_block", "country": "JP", "path": "/web", "rule_id": 942100})
+	emitJSONLog(map[string]any{"event": "bot_challenge", "country": "JP", "path": "/api/a", "rule_id": 942100})
+	emitJSONLog(map[string]any{"event": "waf_block", "country": "JP", "path": "/api/a", "matched_rule_id": "930100"})
+	emitJSONLog(map[string]any{"event": "waf_block", "country": "JP", "path": "/api/login", "rule_id": 949110, "matched_rule_id": "942100", "req_id": "want"})
+
+	sc := bufio.NewScanner(res.Body)
+	var data string
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+			data = v
+			break
+		}
+	}
+	var evt map[string]any
+	if err := json.Unmarshal([]byte(data), &evt); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	if evt["req_id"] != "want" {
+		t.Fatalf("unexpected event: %v", evt)
+	}
+
+	cancel()
+	waitForEventSubscribersForTest(t, 0)
+}
+
+func TestEventStreamHub_DropsSlowSubscribers(t *testing.T) {
+	slow, ok := eventHub.subscribe(eventStreamFilter{}, 0)
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+	fast, ok := eventHub.subscribe(eventStreamFilter{events: map[string]struct{}{"rare": {}}}, 0)
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+	defer eventHub.unsubscribe(fast)
+	dropped := eventStreamDroppedTotal.Value()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventStreamBuffer+10; i++ {
+			emitJSONLog(map[string]any{"event": "waf_block", "path": "/"})
+		}
+		emitJSONLog(map[string]any{"event": "rare"})
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("publishing blocked on a slow subscriber")
+	}
+
+	n := 0
+	for range slow.ch {
+		n++
+	}
+	if n != eventStreamBuffer {
+		t.Fatalf("slow subscriber got %d events, want %d before the drop", n, eventStreamBuffer)
+	}
+	if got := eventStreamDroppedTotal.Value(); got != dropped+1 {
+		t.Fatalf("dropped=%v want=%v", got, dropped+1)
+	}
+	eventHub.unsubscribe(slow)
+	if se := <-fast.ch; se.event != "rare" {
+		t.Fatalf("fast subscriber got %q", se.event)
+	}
+	waitForEventSubscribersForTest(t, 1)
+}
+
+func TestEventsStream_LimitsSubscribers(t *testing.T) {
+	prev := config.EventStreamMaxSubscribers
+	config.EventStreamMaxSubscribers = 1
+	t.Cleanup(func() { config.EventStreamMaxSubscribers = prev })
+
+	held, ok := eventHub.subscribe(eventStreamFilter{}, 0)
+	if !ok {
+		t.Fatal("subscribe failed")
+	}
+	defer eventHub.unsubscribe(held)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/events/stream", EventsStream)
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/stream", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status=%d want=503", rec.Code)
+	}
+}
+
+func TestEventsStream_EndsOnServerShutdown(t *testing.T) {
+	prev := eventHub
+	eventHub = &eventStreamHub{subs: map[*eventStreamSubscriber]struct{}{}, closed: make(chan struct{})}
+	t.Cleanup(func() { eventHub = prev })
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/events/stream", EventsStream)
+	ts := httptest.NewUnstartedServer(engine)
+	srv := &http.Server{Handler: engine}
+	srv.RegisterOnShutdown(CloseEventStreams)
+	go srv.Serve(ts.Listener)
+
+	res, err := http.Get("http://" + ts.Listener.Addr().String() + "/events/stream")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer res.Body.Close()
+	waitForEventSubscribersForTest(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown should not wait for open streams: %v", err)
+	}
+	waitForEventSubscribersForTest(t, 0)
+}
@@ -374,7 +374,7 @@ func latestWAFBlockEvent() (fpTunerEventInput, error) {
 			ObservedAt:      anyToString(ln["ts"]),
 			Method:          anyToString(ln["method"]),
 			Path:            anyToString(ln["path"]),
-			RuleID:          anyToInt(ln["rule_id"]),
+			RuleID:          anyToInt(eventDetectionRuleID(ln)),
 			Status:          anyToInt(ln["status"]),
 			MatchedVariable: anyToString(ln["matched_variable"]),
 			MatchedValue:    anyToString(ln["matched_value"]),
@@ -685,8 +685,7 @@ func fpTunerActor(c *gin.Context) string {
 	if key == "" {
 		return "api-key:none"
 	}
-	sum := sha256.Sum256([]byte(key))
-	return fmt.Sprintf("api-key:sha256:%x", sum[:6])
+	return "api-key:sha256:" + shortSHA256Hex(key)
 }
 
 func decodeJSONBodyStrict(c *gin.Context, out any) error {
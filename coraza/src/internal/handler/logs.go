@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"mamotama/internal/eventformat"
 )
 
 var (
@@ -196,18 +197,39 @@ func LogsDownload(c *gin.Context) {
 		to = time.Now().Add(1 * time.Second)
 	}
 	countryFilter := normalizeCountryFilter(c.Query("country"))
+	format, err := eventformat.Parse(c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid format"})
+		return
+	}
+	if format != eventformat.Native && src != "waf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format is only supported for src=waf"})
+		return
+	}
 
-	c.Header("Content-Type", "application/x-ndjson")
-	filename := fmt.Sprintf("%s-%s.ndjson.gz", src, time.Now().Format("20060102"))
+	ext := "ndjson"
+	switch format {
+	case eventformat.ECS, eventformat.OCSF:
+		ext = format + ".ndjson"
+	case eventformat.CEF:
+		ext = "cef"
+	}
+	c.Header("Content-Type", eventformat.ContentType(format))
+	filename := fmt.Sprintf("%s-%s.%s.gz", src, time.Now().Format("20060102"), ext)
 	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
 	c.Header("Content-Encoding", "gzip")
 
 	gw := gzip.NewWriter(c.Writer)
 	defer gw.Close()
+	var out io.Writer = gw
+	if format != eventformat.Native {
+		encode, _ := eventformat.Encoder(format)
+		out = &eventLineWriter{w: gw, encode: encode}
+	}
 
 	if src == "waf" {
 		if store := getLogsStatsStore(); store != nil {
-			if err := store.DownloadWAFLogs(path, gw, from, to, countryFilter); err != nil {
+			if err := store.DownloadWAFLogs(path, out, from, to, countryFilter); err != nil {
 				c.Status(http.StatusInternalServerError)
 			}
 			return
@@ -227,7 +249,7 @@ func LogsDownload(c *gin.Context) {
 			var m map[string]any
 			if json.Unmarshal(b, &m) == nil {
 				if ts, ok := m["ts"].(string); ok && tsInRange(ts, from, to) && countryMatchesFilter(m["country"], countryFilter) {
-					if _, err := gw.Write(b); err != nil {
+					if _, err := out.Write(b); err != nil {
 						break
 					}
 				}
@@ -244,6 +266,37 @@ func LogsDownload(c *gin.Context) {
 	}
 }
 
+// eventLineWriter re-encodes each NDJSON event written to it. Lines that
+// are not JSON objects are skipped.
+type eventLineWriter struct {
+	w      io.Writer
+	encode func(map[string]any) ([]byte, error)
+	buf    []byte
+}
+
+func (lw *eventLineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := lw.buf[:i]
+		var m map[string]any
+		if json.Unmarshal(line, &m) == nil && m != nil {
+			if b, err := lw.encode(m); err == nil {
+				if _, err := lw.w.Write(append(b, '\n')); err != nil {
+					return 0, err
+				}
+			}
+		}
+		lw.buf = lw.buf[i+1:]
+	}
+	// Keep the partial line at the start of the buffer.
+	lw.buf = append(lw.buf[:0:0], lw.buf...)
+	return len(p), nil
+}
+
 func LogsStats(c *gin.Context) {
 	path, ok := logFiles["waf"]
 	if !ok {
@@ -338,7 +391,7 @@ func LogsStats(c *gin.Context) {
 
 		stats.Last24h++
 
-		ruleID := normalizeStatsRuleID(line["rule_id"])
+		ruleID := normalizeStatsRuleID(eventDetectionRuleID(line))
 		pathKey := normalizeStatsPath(line["path"])
 		country := normalizeCountryFromAny(line["country"])
 
@@ -410,6 +463,16 @@ func logFieldString(raw any) string {
 	}
 }
 
+// eventDetectionRuleID prefers the rule that detected the attack over the
+// rule that enforced it. Under CRS anomaly scoring every block comes from
+// the same evaluation rule, which says nothing about what was matched.
+func eventDetectionRuleID(m map[string]any) any {
+	if v, ok := m["matched_rule_id"]; ok && v != nil {
+		return v
+	}
+	return m["rule_id"]
+}
+
 func normalizeStatsRuleID(raw any) string {
 	v := strings.TrimSpace(logFieldString(raw))
 	if v == "" || v == "<nil>" {
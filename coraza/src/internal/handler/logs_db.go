@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -40,7 +41,11 @@ var (
 )
 
 type wafEventStore struct {
-	db            *sql.DB
+	db *sql.DB
+	// rateDB runs the rate limit counters. It never takes mu, so a slow
+	// sync or download cannot stall proxied requests. For SQLite it is a
+	// second handle on the same file; for MySQL it is db.
+	rateDB        *sql.DB
 	dbDriver      string
 	dbPath        string
 	mu            sync.Mutex
@@ -64,6 +69,10 @@ type wafEventStoreStatus struct {
 	LastIngestOffset     int64
 	LastIngestModTime    string
 	LastSyncScannedLines int
+	// SyncLagBytes and SyncLagSeconds describe how far the DB was behind
+	// the event file when the snapshot started, before it synced.
+	SyncLagBytes   int64
+	SyncLagSeconds float64
 }
 
 func InitLogsStatsStore(enabled bool, dbPath string, retentionDays int) error {
@@ -141,7 +150,9 @@ func openWAFEventStoreSQLite(dbPath string, retentionDays int) (*wafEventStore,
 		return nil, fmt.Errorf("mkdir db dir: %w", err)
 	}
 
-	db, err := sql.Open("sqlite", p)
+	// Both handles write to the file, so each waits for the other's
+	// write lock instead of failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", p+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
@@ -186,6 +197,21 @@ func openWAFEventStoreSQLite(dbPath string, retentionDays int) (*wafEventStore,
 			updated_at TEXT NOT NULL
 		);`,
 		`CREATE INDEX IF NOT EXISTS idx_config_blobs_updated_at_unix ON config_blobs(updated_at_unix);`,
+		`CREATE TABLE IF NOT EXISTS rate_limit_counters (
+			counter_key TEXT NOT NULL,
+			window_id INTEGER NOT NULL,
+			hits INTEGER NOT NULL,
+			expires_at_unix INTEGER NOT NULL,
+			PRIMARY KEY (counter_key, window_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_rate_limit_counters_expires ON rate_limit_counters(expires_at_unix);`,
+		`CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			bucket_key TEXT PRIMARY KEY,
+			tokens REAL NOT NULL,
+			updated_at_ns INTEGER NOT NULL,
+			expires_at_unix INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_expires ON rate_limit_buckets(expires_at_unix);`,
 	}
 	for _, stmt := range stmts {
 		if _, err := db.Exec(stmt); err != nil {
@@ -211,11 +237,21 @@ func openWAFEventStoreSQLite(dbPath string, retentionDays int) (*wafEventStore,
 		return nil, err
 	}
 
+	// BEGIN IMMEDIATE takes the write lock up front, so the token bucket
+	// read-modify-write cannot race another writer.
+	rateDB, err := sql.Open("sqlite", p+"?_pragma=busy_timeout(5000)&_txlock=immediate")
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	rateDB.SetMaxOpenConns(1)
+
 	if retentionDays < 0 {
 		retentionDays = 0
 	}
 	return &wafEventStore{
 		db:            db,
+		rateDB:        rateDB,
 		dbDriver:      logStatsDBDriverSQLite,
 		dbPath:        p,
 		retentionDays: retentionDays,
@@ -280,6 +316,21 @@ func openWAFEventStoreMySQL(dbDSN string, retentionDays int) (*wafEventStore, er
 			updated_at VARCHAR(64) NOT NULL,
 			KEY idx_config_blobs_updated_at_unix (updated_at_unix)
 		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;`,
+		`CREATE TABLE IF NOT EXISTS rate_limit_counters (
+			counter_key VARCHAR(255) NOT NULL,
+			window_id BIGINT NOT NULL,
+			hits BIGINT NOT NULL,
+			expires_at_unix BIGINT NOT NULL,
+			PRIMARY KEY (counter_key, window_id),
+			KEY idx_rate_limit_counters_expires (expires_at_unix)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;`,
+		`CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			bucket_key VARCHAR(255) NOT NULL PRIMARY KEY,
+			tokens DOUBLE NOT NULL,
+			updated_at_ns BIGINT NOT NULL,
+			expires_at_unix BIGINT NOT NULL,
+			KEY idx_rate_limit_buckets_expires (expires_at_unix)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;`,
 	}
 	for _, stmt := range stmts {
 		if _, err := db.Exec(stmt); err != nil {
@@ -293,6 +344,7 @@ func openWAFEventStoreMySQL(dbDSN string, retentionDays int) (*wafEventStore, er
 	}
 	return &wafEventStore{
 		db:            db,
+		rateDB:        db,
 		dbDriver:      logStatsDBDriverMySQL,
 		dbPath:        "",
 		retentionDays: retentionDays,
@@ -347,6 +399,9 @@ func (s *wafEventStore) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
+	if s.rateDB != nil && s.rateDB != s.db {
+		_ = s.rateDB.Close()
+	}
 	return s.db.Close()
 }
 
@@ -427,6 +482,11 @@ func (s *wafEventStore) StatusSnapshot(logPath string) (wafEventStoreStatus, err
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	lagBytes, lagSeconds, err := s.ingestLag(logPath)
+	if err != nil {
+		return wafEventStoreStatus{}, err
+	}
+
 	syncResult, err := s.syncWAFEvents(logPath)
 	if err != nil {
 		return wafEventStoreStatus{}, err
@@ -463,9 +523,41 @@ func (s *wafEventStore) StatusSnapshot(logPath string) (wafEventStoreStatus, err
 		LastIngestOffset:     state.Offset,
 		LastIngestModTime:    modTime,
 		LastSyncScannedLines: syncResult.ScannedLines,
+		SyncLagBytes:         lagBytes,
+		SyncLagSeconds:       lagSeconds,
 	}, nil
 }
 
+// ingestLag reports the bytes of the event file not yet ingested and how
+// much newer the file is than it was at the last ingest.
+func (s *wafEventStore) ingestLag(logPath string) (int64, float64, error) {
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	state, err := s.loadIngestState(logStatsStoreSourceWAF)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset := state.Offset
+	if offset < 0 || offset > fi.Size() {
+		offset = 0
+	}
+	pending := fi.Size() - offset
+	if pending == 0 || state.ModTimeNS == 0 {
+		return pending, 0, nil
+	}
+	lag := time.Duration(fi.ModTime().UTC().UnixNano() - state.ModTimeNS)
+	if lag < 0 {
+		lag = 0
+	}
+	return pending, lag.Seconds(), nil
+}
+
 func (s *wafEventStore) ReadWAFLogs(logPath string, tail int, cursor *int64, dir string, countryFilter string) ([]logLine, *int64, bool, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -667,6 +759,29 @@ func nullString(ns sql.NullString) string {
 	return strings.TrimSpace(ns.String)
 }
 
+// RotateWAFEvents ingests the rest of the event file before rotate
+// replaces it, then restarts ingestion at the start of the new file.
+func (s *wafEventStore) RotateWAFEvents(logPath string, rotate func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.syncWAFEvents(logPath); err != nil {
+		log.Printf("[DB][WARN] sync before event file rotation failed: %v", err)
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.saveIngestState(tx, logStatsStoreSourceWAF, logIngestState{}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *wafEventStore) syncWAFEvents(logPath string) (logSyncResult, error) {
 	fi, err := os.Stat(logPath)
 	if err != nil {
@@ -791,7 +906,7 @@ func ingestWAFEventLine(stmt *sql.Stmt, rawLine []byte) error {
 		tsNorm = ts.Format(time.RFC3339Nano)
 	}
 
-	ruleID := normalizeStatsRuleID(m["rule_id"])
+	ruleID := normalizeStatsRuleID(eventDetectionRuleID(m))
 	pathKey := normalizeStatsPath(m["path"])
 	country := normalizeCountryFromAny(m["country"])
 	status := anyToInt(m["status"])
@@ -987,7 +1102,7 @@ func (s *wafEventStore) estimateDBSizeBytes() (int64, error) {
 			SELECT COALESCE(SUM(data_length + index_length), 0)
 			  FROM information_schema.tables
 			 WHERE table_schema = DATABASE()
-			   AND table_name IN ('waf_events', 'ingest_state', 'config_blobs')`)
+			   AND table_name IN ('waf_events', 'ingest_state', 'config_blobs', 'rate_limit_counters', 'rate_limit_buckets')`)
 		if err := row.Scan(&n); err != nil {
 			return 0, err
 		}
@@ -371,6 +371,112 @@ func TestLogsDownloadUsesSQLiteStoreForWAF(t *testing.T) {
 	}
 }
 
+func TestLogsDownloadFormats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now().UTC()
+	entries := []map[string]any{
+		{
+			"ts":              now.Add(-2 * time.Minute).Format(time.RFC3339Nano),
+			"event":           "waf_block",
+			"req_id":          "req-1",
+			"ip":              "203.0.113.7",
+			"path":            "/a",
+			"rule_id":         949110,
+			"matched_rule_id": 942100,
+			"rules":           "942100,949110",
+			"country":         "JP",
+			"status":          403,
+		},
+		{
+			"ts":          now.Add(-1 * time.Minute).Format(time.RFC3339Nano),
+			"event":       "rate_limited",
+			"req_id":      "req-2",
+			"ip":          "203.0.113.8",
+			"path":        "/b",
+			"policy_id":   "login",
+			"rl_key_hash": "ab12",
+			"country":     "US",
+			"status":      429,
+		},
+	}
+	tmp := t.TempDir()
+	logPath := filepath.Join(tmp, "waf-events.ndjson")
+	writeNDJSONFile(t, logPath, entries)
+	restoreLogPath := setWAFLogPathForTest(t, logPath)
+	defer restoreLogPath()
+
+	download := func(query string) (*httptest.ResponseRecorder, []string) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/mamotama-api/logs/download?"+query, nil)
+		LogsDownload(c)
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+		gr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("new gzip reader: %v", err)
+		}
+		defer gr.Close()
+		raw, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("read gzip payload: %v", err)
+		}
+		return w, strings.Split(strings.TrimSpace(string(raw)), "\n")
+	}
+
+	w, lines := download("src=waf&format=cef")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "CEF:0|mamotama|mamotama|") || !strings.Contains(lines[1], "cs6=ab12 cs6Label=rlKeyHash") {
+		t.Fatalf("cef lines=%q", lines)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("cef content type=%q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, ".cef.gz") {
+		t.Fatalf("cef filename=%q", cd)
+	}
+
+	_, lines = download("src=waf&format=ecs&country=JP")
+	if len(lines) != 1 {
+		t.Fatalf("ecs lines=%q", lines)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+		t.Fatalf("decode ecs: %v", err)
+	}
+	if src, _ := doc["source"].(map[string]any); src["ip"] != "203.0.113.7" {
+		t.Fatalf("ecs source=%v", doc["source"])
+	}
+
+	dbPath := filepath.Join(tmp, "mamotama.db")
+	if err := InitLogsStatsStore(true, dbPath, 30); err != nil {
+		t.Fatalf("init sqlite store: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = InitLogsStatsStore(false, "", 0)
+	})
+	_, lines = download("src=waf&format=ocsf")
+	if len(lines) != 2 {
+		t.Fatalf("ocsf lines=%q", lines)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil {
+		t.Fatalf("decode ocsf: %v", err)
+	}
+	if doc["class_uid"] != 4002.0 {
+		t.Fatalf("ocsf class_uid=%v", doc["class_uid"])
+	}
+	if rule, _ := doc["firewall_rule"].(map[string]any); rule["uid"] != "login" {
+		t.Fatalf("ocsf firewall_rule=%v", doc["firewall_rule"])
+	}
+
+	for _, query := range []string{"src=waf&format=leef", "src=accerr&format=ecs"} {
+		if w, _ := download(query); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s status=%d want=400", query, w.Code)
+		}
+	}
+}
+
 func TestLatestWAFBlockEventUsesSQLiteStoreWhenLogFileMissing(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -506,6 +612,9 @@ func TestWAFEventStoreStatusSnapshot(t *testing.T) {
 	if s1.LastSyncScannedLines != len(entries) {
 		t.Fatalf("first last_sync_scanned_lines=%d want=%d", s1.LastSyncScannedLines, len(entries))
 	}
+	if fi, err := os.Stat(logPath); err != nil || s1.SyncLagBytes != fi.Size() {
+		t.Fatalf("first sync_lag_bytes=%d want whole file (err=%v)", s1.SyncLagBytes, err)
+	}
 
 	s2, err := store.StatusSnapshot(logPath)
 	if err != nil {
@@ -514,6 +623,9 @@ func TestWAFEventStoreStatusSnapshot(t *testing.T) {
 	if s2.LastSyncScannedLines != 0 {
 		t.Fatalf("second last_sync_scanned_lines=%d want=0", s2.LastSyncScannedLines)
 	}
+	if s2.SyncLagBytes != 0 || s2.SyncLagSeconds != 0 {
+		t.Fatalf("second sync lag bytes=%d seconds=%v want=0", s2.SyncLagBytes, s2.SyncLagSeconds)
+	}
 }
 
 func TestInitLogsStatsStoreWithBackend_FileDisablesStore(t *testing.T) {
@@ -566,6 +678,9 @@ func TestWAFEventStoreSQLDialectStatements(t *testing.T) {
 	if !strings.Contains(sqliteStore.upsertConfigBlobStmt(), "ON CONFLICT") {
 		t.Fatalf("sqlite config blob upsert stmt mismatch: %s", sqliteStore.upsertConfigBlobStmt())
 	}
+	if !strings.Contains(sqliteStore.upsertRateCounterStmt(), "ON CONFLICT") {
+		t.Fatalf("sqlite rate counter upsert stmt mismatch: %s", sqliteStore.upsertRateCounterStmt())
+	}
 
 	mysqlStore := &wafEventStore{dbDriver: logStatsDBDriverMySQL}
 	if !strings.Contains(mysqlStore.insertWAFEventStmt(), "INSERT IGNORE") {
@@ -577,6 +692,9 @@ func TestWAFEventStoreSQLDialectStatements(t *testing.T) {
 	if !strings.Contains(mysqlStore.upsertConfigBlobStmt(), "ON DUPLICATE KEY UPDATE") {
 		t.Fatalf("mysql config blob upsert stmt mismatch: %s", mysqlStore.upsertConfigBlobStmt())
 	}
+	if !strings.Contains(mysqlStore.upsertRateCounterStmt(), "ON DUPLICATE KEY UPDATE") {
+		t.Fatalf("mysql rate counter upsert stmt mismatch: %s", mysqlStore.upsertRateCounterStmt())
+	}
 }
 
 func TestConfigBlobSQLiteRoundTrip(t *testing.T) {
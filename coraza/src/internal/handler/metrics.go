@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/metrics"
+)
+
+// Request outcomes, one per way ProxyHandler can finish.
+const (
+	requestOutcomeProxied           = "proxied"
+	requestOutcomeCountryBlock      = "country_block"
+	requestOutcomeBotChallenge      = "bot_challenge"
+	requestOutcomeSemanticChallenge = "semantic_challenge"
+	requestOutcomeSemanticBlock     = "semantic_block"
+	requestOutcomeRateLimited       = "rate_limited"
+	requestOutcomeWAFBlock          = "waf_block"
+	requestOutcomeUpstreamError     = "upstream_error"
+	requestOutcomeClientCanceled    = "client_canceled"
+)
+
+// Label values are bounded: route and upstream names and target URLs come
+// from routes.json, layers, actions and outcomes are constants, and rule
+// ids are capped by the vector, past which they are reported as "other".
+var (
+	httpRequestsTotal = metrics.NewCounterVec(
+		"mamotama_http_requests_total",
+		"Requests handled by the proxy by route and outcome.",
+		"route", "outcome",
+	)
+	httpRequestDuration = metrics.NewHistogramVec(
+		"mamotama_http_request_duration_seconds",
+		"Time to handle a proxied request by route and outcome.",
+		metrics.DefaultBuckets,
+		"route", "outcome",
+	)
+	decisionsTotal = metrics.NewCounterVec(
+		"mamotama_decisions_total",
+		"Decisions of the security layers by route, layer and action.",
+		"route", "layer", "action",
+	)
+	wafRuleHitsTotal = metrics.NewCounterVec(
+		"mamotama_waf_rule_hits_total",
+		"WAF interruptions by detection rule id and action (block or would_block).",
+		"rule_id", "action",
+	).WithMaxSeries(256)
+	upstreamAttemptsTotal = metrics.NewCounterVec(
+		"mamotama_upstream_attempts_total",
+		"Attempts sent to upstream targets by result (status class or error kind).",
+		"upstream", "target", "result",
+	)
+	upstreamAttemptDuration = metrics.NewHistogramVec(
+		"mamotama_upstream_attempt_duration_seconds",
+		"Time until an upstream target answered with headers or failed.",
+		metrics.DefaultBuckets,
+		"upstream", "target",
+	)
+	upstreamErrorsTotal = metrics.NewCounterVec(
+		"mamotama_upstream_errors_total",
+		"Requests answered with 502 or 504 after every attempt failed, by error kind.",
+		"upstream", "kind",
+	)
+)
+
+func init() {
+	metrics.RegisterCollector(wafEventStoreSamples)
+}
+
+// MetricsHandler serves the Prometheus scrape endpoint.
+func MetricsHandler(c *gin.Context) {
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// requestMetrics travels in the request context so that the upstream error
+// handler and response inspection can change the outcome.
+type requestMetrics struct {
+	route   string
+	start   time.Time
+	outcome string
+}
+
+func withRequestMetrics(ctx context.Context, route string, start time.Time) (context.Context, *requestMetrics) {
+	rm := &requestMetrics{route: route, start: start, outcome: requestOutcomeProxied}
+	return context.WithValue(ctx, ctxKeyMetrics, rm), rm
+}
+
+func setRequestOutcome(ctx context.Context, outcome string) {
+	if rm, ok := ctx.Value(ctxKeyMetrics).(*requestMetrics); ok {
+		rm.outcome = outcome
+	}
+}
+
+func (rm *requestMetrics) observe() {
+	httpRequestsTotal.Inc(rm.route, rm.outcome)
+	httpRequestDuration.Observe(time.Since(rm.start).Seconds(), rm.route, rm.outcome)
+}
+
+func observeDecision(ctx context.Context, layer, action string) {
+	route, _ := ctx.Value(ctxKeyRoute).(string)
+	decisionsTotal.Inc(route, layer, action)
+}
+
+// observeWAFDecision counts a WAF interruption under the rule that
+// detected the attack, as LogsStats does.
+func observeWAFDecision(ctx context.Context, evt map[string]any, action string) {
+	observeDecision(ctx, "waf", action)
+	wafRuleHitsTotal.Inc(normalizeStatsRuleID(eventDetectionRuleID(evt)), action)
+}
+
+func observeUpstreamAttempt(up *runtimeUpstream, t *upstreamTarget, start time.Time, statusCode int, err error) {
+	target := t.URL.Redacted()
+	result := ""
+	if err != nil {
+		result = upstreamErrorKind(err)
+	} else {
+		result = strconv.Itoa(statusCode/100) + "xx"
+	}
+	upstreamAttemptsTotal.Inc(up.Name, target, result)
+	upstreamAttemptDuration.Observe(time.Since(start).Seconds(), up.Name, target)
+}
+
+// wafEventStoreSamples reports the DB store status, including how far the
+// DB was behind the event file before the scrape synced it.
+func wafEventStoreSamples() []metrics.Sample {
+	store := getLogsStatsStore()
+	if store == nil {
+		return nil
+	}
+	wafPath, ok := logFiles["waf"]
+	if !ok {
+		return nil
+	}
+	snapshot, err := store.StatusSnapshot(resolveLogPath("waf", wafPath))
+	if err != nil {
+		return []metrics.Sample{{Name: "mamotama_waf_event_db_up", Help: "Whether the last DB status snapshot succeeded.", Value: 0}}
+	}
+	return []metrics.Sample{
+		{Name: "mamotama_waf_event_db_up", Help: "Whether the last DB status snapshot succeeded.", Value: 1},
+		{Name: "mamotama_waf_event_db_rows", Help: "Rows in the waf_events table.", Labels: map[string]string{"event": "all"}, Value: float64(snapshot.TotalRows)},
+		{Name: "mamotama_waf_event_db_rows", Labels: map[string]string{"event": "waf_block"}, Value: float64(snapshot.WAFBlockRows)},
+		{Name: "mamotama_waf_event_db_size_bytes", Help: "Estimated size of the event DB.", Value: float64(snapshot.DBSizeBytes)},
+		{Name: "mamotama_waf_event_db_sync_lag_bytes", Help: "Bytes of the event file not yet ingested when the scrape started.", Value: float64(snapshot.SyncLagBytes)},
+		{Name: "mamotama_waf_event_db_sync_lag_seconds", Help: "How much newer the event file was than at the last ingest when the scrape started.", Value: snapshot.SyncLagSeconds},
+		{Name: "mamotama_waf_event_db_last_sync_scanned_lines", Help: "Lines ingested by the sync the scrape ran.", Value: float64(snapshot.LastSyncScannedLines)},
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProxyHandler_RecordsMetrics(t *testing.T) {
+	restoreRL := saveRateLimitStateForTest()
+	defer restoreRL()
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(t.TempDir(), "events.ndjson"))
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	useAppURLForTest(t, backend.URL)
+	useRoutesForTest(t, fmt.Sprintf(`{
+  "upstreams": [{"name": "metrics-live", "url": %q}, {"name": "metrics-dead", "url": %q}],
+  "routes": [
+    {"name": "metrics-live", "hosts": ["live.metrics.test"], "upstream": "metrics-live", "bypass": ["/"], "rate_limit": %s},
+    {"name": "metrics-dead", "hosts": ["dead.metrics.test"], "upstream": "metrics-dead", "bypass": ["/"]}
+  ]
+}`, backend.URL, deadURL, rateLimitRawForTest(1)))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/metrics", MetricsHandler)
+	engine.NoRoute(ProxyHandler)
+	front := httptest.NewServer(engine)
+	t.Cleanup(front.Close)
+
+	get := func(host, path string, header http.Header) (int, string, http.Header) {
+		req, err := http.NewRequest(http.MethodGet, front.URL+path, nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := front.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body), res.Header
+	}
+
+	proxied := httpRequestsTotal.Value("metrics-live", requestOutcomeProxied)
+	limited := httpRequestsTotal.Value("metrics-live", requestOutcomeRateLimited)
+	failed := httpRequestsTotal.Value("metrics-dead", requestOutcomeUpstreamError)
+	decisions := decisionsTotal.Value("metrics-live", "rate_limited", "block")
+	connectErrors := upstreamErrorsTotal.Value("metrics-dead", "connect")
+	attempts := upstreamAttemptsTotal.Value("metrics-live", backend.URL, "2xx")
+
+	if code, _, _ := get("live.metrics.test", "/a", nil); code != http.StatusOK {
+		t.Fatalf("live status=%d", code)
+	}
+	if code, _, _ := get("live.metrics.test", "/a", nil); code != http.StatusTooManyRequests {
+		t.Fatalf("second live status=%d", code)
+	}
+	if code, _, _ := get("dead.metrics.test", "/a", nil); code != http.StatusBadGateway {
+		t.Fatalf("dead status=%d", code)
+	}
+
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"proxied", httpRequestsTotal.Value("metrics-live", requestOutcomeProxied), proxied + 1},
+		{"rate limited", httpRequestsTotal.Value("metrics-live", requestOutcomeRateLimited), limited + 1},
+		{"upstream error", httpRequestsTotal.Value("metrics-dead", requestOutcomeUpstreamError), failed + 1},
+		{"rate limit decision", decisionsTotal.Value("metrics-live", "rate_limited", "block"), decisions + 1},
+		{"connect error", upstreamErrorsTotal.Value("metrics-dead", "connect"), connectErrors + 1},
+		{"upstream attempt", upstreamAttemptsTotal.Value("metrics-live", backend.URL, "2xx"), attempts + 1},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Fatalf("%s=%v want %v", c.name, c.got, c.want)
+		}
+	}
+	if n := httpRequestDuration.Count("metrics-dead", requestOutcomeUpstreamError); n == 0 {
+		t.Fatal("latency histogram should have observations")
+	}
+
+	code, body, header := get("admin", "/metrics", nil)
+	if code != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("metrics status=%d content-type=%q", code, header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`mamotama_http_requests_total{route="metrics-live",outcome="rate_limited"}`,
+		`mamotama_http_request_duration_seconds_bucket{route="metrics-dead",outcome="upstream_error",le="+Inf"}`,
+		`mamotama_upstream_errors_total{upstream="metrics-dead",kind="connect"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics output missing %s", want)
+		}
+	}
+
+	_, body, header = get("admin", "/metrics", http.Header{"Accept": {"application/openmetrics-text; version=1.0.0"}})
+	if !strings.HasPrefix(header.Get("Content-Type"), "application/openmetrics-text") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatalf("openmetrics content-type=%q", header.Get("Content-Type"))
+	}
+	if !strings.Contains(body, "# TYPE mamotama_http_requests counter\n") {
+		t.Fatal("openmetrics counter family should drop the _total suffix")
+	}
+}
+
+func TestReloadRoutes_RecordsReloadMetrics(t *testing.T) {
+	useAppURLForTest(t, "http://app.internal:3000")
+	useRoutesForTest(t, `{}`)
+
+	metricsBody := func() string {
+		rec := httptest.NewRecorder()
+		MetricsHandler(func() *gin.Context {
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			return c
+		}())
+		return rec.Body.String()
+	}
+	if body := metricsBody(); !strings.Contains(body, `mamotama_config_last_reload_success{subsystem="routes"} 1`) {
+		t.Fatal("successful reload should be recorded")
+	}
+
+	if err := os.WriteFile(GetRoutesPath(), []byte(`{"routes": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadRoutes(); err == nil {
+		t.Fatal("broken routes should fail to reload")
+	}
+	body := metricsBody()
+	if !strings.Contains(body, `mamotama_config_last_reload_success{subsystem="routes"} 0`) ||
+		!strings.Contains(body, `mamotama_config_reloads_total{subsystem="routes",result="failure"}`) {
+		t.Fatal("failed reload should be recorded")
+	}
+}
@@ -0,0 +1,445 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/tracing"
+)
+
+const (
+	challengeTypeCookie = "cookie"
+	challengeTypePoW    = "pow"
+
+	powScopeBotDefense = "bot"
+	powScopeSemantic   = "semantic"
+
+	// PowChallengeVerifyPath receives solved puzzles from challenge pages
+	// and API clients.
+	PowChallengeVerifyPath = "/mamotama-challenge/verify"
+
+	defaultPoWDifficulty    = 16
+	defaultPoWMaxDifficulty = 20
+	maxPoWDifficulty        = 32
+	powChallengeTTL         = 5 * time.Minute
+	maxPoWVerifyBodyBytes   = 4096
+)
+
+// powPuzzle is a stateless hash puzzle. The client must find a decimal
+// solution such that sha256(challenge + ":" + solution) starts with
+// Difficulty zero bits. The challenge string carries its own parameters and
+// is HMAC-bound to the client IP and User-Agent, so the server keeps no state.
+type powPuzzle struct {
+	Scope      string
+	Difficulty int
+	ExpiresAt  int64
+	Nonce      string
+}
+
+func normalizeChallengeType(v string) (string, error) {
+	switch t := strings.ToLower(strings.TrimSpace(v)); t {
+	case "", challengeTypeCookie:
+		return challengeTypeCookie, nil
+	case challengeTypePoW:
+		return challengeTypePoW, nil
+	default:
+		return "", fmt.Errorf("challenge_type must be cookie|pow")
+	}
+}
+
+func normalizePoWDifficulty(base, max int) (int, int, error) {
+	if base == 0 {
+		base = defaultPoWDifficulty
+	}
+	if max == 0 {
+		max = defaultPoWMaxDifficulty
+		if base > max {
+			max = base
+		}
+	}
+	if base < 1 || base > maxPoWDifficulty {
+		return 0, 0, fmt.Errorf("pow_difficulty must be between 1 and %d", maxPoWDifficulty)
+	}
+	if max < base || max > maxPoWDifficulty {
+		return 0, 0, fmt.Errorf("pow_max_difficulty must be between pow_difficulty and %d", maxPoWDifficulty)
+	}
+	return base, max, nil
+}
+
+func clampPoWDifficulty(v, base, max int) int {
+	if v < base {
+		return base
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func issuePoWChallenge(secret []byte, scope string, difficulty int, ip, userAgent string, now time.Time) string {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		nonce = []byte(strconv.FormatInt(now.UnixNano(), 36))
+	}
+	payload := strings.Join([]string{
+		scope,
+		strconv.Itoa(difficulty),
+		strconv.FormatInt(now.Add(powChallengeTTL).Unix(), 10),
+		hex.EncodeToString(nonce),
+	}, ".")
+	return payload + "." + signPoWChallenge(secret, ip, userAgent, payload)
+}
+
+// botDefensePoWScope names the puzzle scope for a bot defense pass scope.
+// Route puzzles carry the route name so the verify endpoint can issue the
+// pass for that route.
+func botDefensePoWScope(passScope string) string {
+	if passScope == "" {
+		return powScopeBotDefense
+	}
+	return powScopeBotDefense + ":" + passScope
+}
+
+// parseBotDefensePoWScope reverses botDefensePoWScope.
+func parseBotDefensePoWScope(scope string) (string, bool) {
+	if scope == powScopeBotDefense {
+		return "", true
+	}
+	return strings.CutPrefix(scope, powScopeBotDefense+":")
+}
+
+func parsePoWChallenge(challenge string) (powPuzzle, string, string, error) {
+	// Route names may contain dots, so the scope is everything before the
+	// last four fields (difficulty, expiry, nonce, signature).
+	parts := strings.Split(strings.TrimSpace(challenge), ".")
+	n := len(parts)
+	if n < 5 {
+		return powPuzzle{}, "", "", fmt.Errorf("malformed challenge")
+	}
+	difficulty, err := strconv.Atoi(parts[n-4])
+	if err != nil || difficulty < 0 || difficulty > maxPoWDifficulty {
+		return powPuzzle{}, "", "", fmt.Errorf("malformed challenge difficulty")
+	}
+	exp, err := strconv.ParseInt(parts[n-3], 10, 64)
+	if err != nil || exp <= 0 {
+		return powPuzzle{}, "", "", fmt.Errorf("malformed challenge expiry")
+	}
+	p := powPuzzle{Scope: strings.Join(parts[:n-4], "."), Difficulty: difficulty, ExpiresAt: exp, Nonce: parts[n-2]}
+	return p, strings.Join(parts[:n-1], "."), parts[n-1], nil
+}
+
+func verifyPoWSolution(secret []byte, challenge, solution, ip, userAgent string, now time.Time) (powPuzzle, error) {
+	p, payload, sig, err := parsePoWChallenge(challenge)
+	if err != nil {
+		return powPuzzle{}, err
+	}
+	if !subtleConstantTimeHexEqual(sig, signPoWChallenge(secret, ip, userAgent, payload)) {
+		return p, fmt.Errorf("challenge signature mismatch")
+	}
+	if now.Unix() > p.ExpiresAt {
+		return p, fmt.Errorf("challenge expired")
+	}
+	if _, err := strconv.ParseUint(solution, 10, 64); err != nil {
+		return p, fmt.Errorf("solution must be a decimal counter")
+	}
+	if powLeadingZeroBits(challenge, solution) < p.Difficulty {
+		return p, fmt.Errorf("solution does not meet difficulty")
+	}
+	return p, nil
+}
+
+func signPoWChallenge(secret []byte, ip, userAgent, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte("pow\n"))
+	_, _ = mac.Write([]byte(strings.TrimSpace(ip)))
+	_, _ = mac.Write([]byte{'\n'})
+	_, _ = mac.Write([]byte(strings.ToLower(strings.TrimSpace(userAgent))))
+	_, _ = mac.Write([]byte{'\n'})
+	_, _ = mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func powLeadingZeroBits(challenge, solution string) int {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	n := 0
+	for _, b := range sum {
+		if b == 0 {
+			n += 8
+			continue
+		}
+		return n + bits.LeadingZeros8(b)
+	}
+	return n
+}
+
+type powVerifyBody struct {
+	Challenge string `json:"challenge"`
+	Solution  string `json:"solution"`
+}
+
+// VerifyPoWChallenge checks a solved puzzle and, on success, issues the same
+// HMAC pass token the cookie challenge would have set for the scope. Bot
+// defense passes are bound to the route named in the scope.
+func VerifyPoWChallenge(c *gin.Context) {
+	ctx, span := tracing.Start(tracing.Extract(c.Request.Context(), c.Request.Header), "pow_verify", tracing.SpanKindServer)
+	defer span.End()
+	c.Header("Cache-Control", "no-store")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxPoWVerifyBodyBytes)
+
+	var in powVerifyBody
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	puzzle, _, _, err := parsePoWChallenge(in.Challenge)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reqID := ensureRequestID(c)
+	clientIP := normalizeClientIP(requestClientIP(c))
+	userAgent := c.Request.UserAgent()
+	now := time.Now().UTC()
+
+	var (
+		secret      []byte
+		cookieName  string
+		tokenHeader string
+		ttl         time.Duration
+		issue       func() string
+	)
+	passScope, isBotDefense := parseBotDefensePoWScope(puzzle.Scope)
+	switch {
+	case isBotDefense:
+		rt := currentBotDefenseRuntime()
+		if rt == nil || (!rt.Raw.Enabled && !routesEnableBotDefense()) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "bot defense is disabled"})
+			return
+		}
+		// The scope is covered by the puzzle signature, so the pass is
+		// issued for the route whose challenge was solved.
+		secret, cookieName, tokenHeader, ttl = rt.Secret, botDefenseCookieName(rt, passScope), rt.TokenHeader, rt.ChallengeTTL
+		issue = func() string { return issueBotDefenseToken(rt, passScope, clientIP, userAgent, now) }
+	case puzzle.Scope == powScopeSemantic:
+		rt := currentSemanticRuntime()
+		if rt == nil || !rt.Raw.Enabled {
+			c.JSON(http.StatusNotFound, gin.H{"error": "semantic challenge is disabled"})
+			return
+		}
+		secret, cookieName, ttl = rt.challengeSecret, rt.challengeCookieName, rt.challengeTTL
+		issue = func() string { return issueSemanticChallengeToken(rt, clientIP, userAgent, now) }
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown challenge scope"})
+		return
+	}
+
+	evt := map[string]any{
+		"ts":         now.Format(time.RFC3339Nano),
+		"service":    "coraza",
+		"level":      "INFO",
+		"event":      "pow_verify",
+		"req_id":     reqID,
+		"trace_id":   tracing.TraceIDFromContext(ctx),
+		"ip":         clientIP,
+		"scope":      puzzle.Scope,
+		"difficulty": puzzle.Difficulty,
+	}
+	if _, err := verifyPoWSolution(secret, in.Challenge, strings.TrimSpace(in.Solution), clientIP, userAgent, now); err != nil {
+		evt["level"] = "WARN"
+		evt["result"] = "rejected"
+		evt["reason"] = err.Error()
+		emitJSONLog(evt)
+		_ = appendEventToFile(evt)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	evt["result"] = "passed"
+	emitJSONLog(evt)
+	_ = appendEventToFile(evt)
+
+	token := issue()
+	maxAge := int(ttl.Seconds())
+	if maxAge < 1 {
+		maxAge = 1
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     cookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	resp := gin.H{
+		"ok":          true,
+		"token":       token,
+		"cookie_name": cookieName,
+		"expires_at":  now.Add(ttl).Format(time.RFC3339),
+	}
+	if tokenHeader != "" {
+		resp["token_header"] = tokenHeader
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func writePoWChallengeJSON(w http.ResponseWriter, r *http.Request, status int, errMsg, challenge string, difficulty int) {
+	writeChallengeDescriptor(w, r, status, powChallengeDescriptor(errMsg, challenge, difficulty))
+}
+
+func powChallengeDescriptor(errMsg, challenge string, difficulty int) map[string]any {
+	return map[string]any{
+		"error":          errMsg,
+		"challenge_type": challengeTypePoW,
+		"challenge":      challenge,
+		"difficulty":     difficulty,
+		"algorithm":      "sha256(challenge + \":\" + solution) with difficulty leading zero bits; solution is a decimal counter",
+		"verify_url":     PowChallengeVerifyPath,
+	}
+}
+
+// writeChallengeDescriptor lays the machine-readable descriptor over the
+// operator's challenge JSON template, so custom fields can be added but the
+// fields clients rely on cannot be changed.
+func writeChallengeDescriptor(w http.ResponseWriter, r *http.Request, status int, desc map[string]any) {
+	out := map[string]any{}
+	errMsg, _ := desc["error"].(string)
+	if body, err := renderResponseTemplate(responseTemplateChallenge, false, responseTemplateVars{
+		Status:  status,
+		ReqID:   r.Header.Get("X-Request-ID"),
+		Message: errMsg,
+		Path:    r.URL.Path,
+	}); err == nil {
+		_ = json.Unmarshal(body, &out)
+	}
+	for k, v := range desc {
+		out[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// writeChallengeHTML renders the challenge page template around script,
+// which does the actual work of obtaining the token.
+func writeChallengeHTML(w http.ResponseWriter, r *http.Request, status int, title, message, script string) {
+	writeResponseTemplateVariant(w, r, responseTemplateChallenge, true, responseTemplateVars{
+		Status:          status,
+		Title:           title,
+		Message:         message,
+		ChallengeScript: script,
+	})
+}
+
+func powChallengeScript(challenge string, difficulty int) string {
+	return fmt.Sprintf(`<script>
+(() => {
+  const challenge = %q;
+  const difficulty = %d;
+  const verifyURL = %q;
+  %s
+  const zeroBits = (words) => {
+    let n = 0;
+    for (const w of words) {
+      if (w === 0) { n += 32; continue; }
+      return n + Math.clz32(w);
+    }
+    return n;
+  };
+  let counter = 0;
+  const step = () => {
+    const until = counter + 5000;
+    for (; counter < until; counter++) {
+      if (zeroBits(sha256(challenge + ":" + counter)) >= difficulty) {
+        fetch(verifyURL, {
+          method: "POST",
+          headers: {"Content-Type": "application/json"},
+          credentials: "same-origin",
+          body: JSON.stringify({challenge: challenge, solution: String(counter)})
+        }).then((res) => {
+          if (res.ok) { window.location.replace(window.location.href); return; }
+          const status = document.getElementById("status");
+          if (status) { status.textContent = "Verification failed. Reload to retry."; }
+        });
+        return;
+      }
+    }
+    setTimeout(step, 0);
+  };
+  step();
+})();
+</script>`, challenge, difficulty, PowChallengeVerifyPath, powSHA256JS)
+}
+
+// cookieChallengeScript sets the signed challenge cookie and reloads.
+func cookieChallengeScript(token, cookieName string, maxAge int) string {
+	if maxAge < 1 {
+		maxAge = 1
+	}
+	return fmt.Sprintf(`<script>
+(() => {
+  const token = %q;
+  const cookieName = %q;
+  document.cookie = cookieName + "=" + token + "; Path=/; Max-Age=%d; SameSite=Lax";
+  window.location.replace(window.location.href);
+})();
+</script>`, token, cookieName, maxAge)
+}
+
+// powSHA256JS returns the digest of an ASCII string as eight 32-bit words.
+// It is inlined because crypto.subtle is unavailable outside secure contexts
+// and is too slow to call once per attempt anyway.
+const powSHA256JS = `const sha256 = (ascii) => {
+    const rotr = (v, n) => (v >>> n) | (v << (32 - n));
+    const K = sha256.K || (sha256.K = (() => {
+      const k = [], h = [];
+      for (let c = 2, n = 0; n < 64; c++) {
+        let prime = true;
+        for (let d = 2; d * d <= c; d++) { if (c % d === 0) { prime = false; break; } }
+        if (!prime) continue;
+        if (n < 8) h[n] = (Math.pow(c, 1 / 2) * 4294967296) | 0;
+        k[n++] = (Math.pow(c, 1 / 3) * 4294967296) | 0;
+      }
+      sha256.H = h;
+      return k;
+    })());
+    const words = [];
+    const bitLen = ascii.length * 8;
+    ascii += "\x80";
+    while (ascii.length % 64 !== 56) ascii += "\x00";
+    for (let i = 0; i < ascii.length; i++) words[i >> 2] |= ascii.charCodeAt(i) << ((3 - i) % 4) * 8;
+    words.push((bitLen / 4294967296) | 0, bitLen | 0);
+    let hash = sha256.H.slice(0);
+    const W = new Array(64);
+    for (let j = 0; j < words.length; j += 16) {
+      let [a, b, c, d, e, f, g, h] = hash;
+      for (let i = 0; i < 64; i++) {
+        if (i < 16) {
+          W[i] = words[j + i] | 0;
+        } else {
+          const w15 = W[i - 15], w2 = W[i - 2];
+          W[i] = (W[i - 16] + (rotr(w15, 7) ^ rotr(w15, 18) ^ (w15 >>> 3)) + W[i - 7] + (rotr(w2, 17) ^ rotr(w2, 19) ^ (w2 >>> 10))) | 0;
+        }
+        const t1 = (h + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + W[i]) | 0;
+        const t2 = ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+        h = g; g = f; f = e; e = (d + t1) | 0; d = c; c = b; b = a; a = (t1 + t2) | 0;
+      }
+      hash = [a, b, c, d, e, f, g, h].map((v, i) => (v + hash[i]) >>> 0);
+    }
+    return hash;
+  };`
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizePoWDifficulty(t *testing.T) {
+	tests := []struct {
+		base, max         int
+		wantBase, wantMax int
+		wantErr           bool
+	}{
+		{base: 0, max: 0, wantBase: defaultPoWDifficulty, wantMax: defaultPoWMaxDifficulty},
+		{base: 24, max: 0, wantBase: 24, wantMax: 24},
+		{base: 8, max: 12, wantBase: 8, wantMax: 12},
+		{base: 12, max: 8, wantErr: true},
+		{base: 33, max: 0, wantErr: true},
+		{base: -1, max: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		base, max, err := normalizePoWDifficulty(tt.base, tt.max)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("normalizePoWDifficulty(%d,%d) expected error", tt.base, tt.max)
+			}
+			continue
+		}
+		if err != nil || base != tt.wantBase || max != tt.wantMax {
+			t.Fatalf("normalizePoWDifficulty(%d,%d)=(%d,%d,%v) want=(%d,%d)", tt.base, tt.max, base, max, err, tt.wantBase, tt.wantMax)
+		}
+	}
+}
+
+func TestVerifyPoWSolution_RejectsTamperedAndWeakSolutions(t *testing.T) {
+	secret := []byte("pow-test-secret")
+	now := time.Unix(1_700_000_000, 0).UTC()
+	challenge := issuePoWChallenge(secret, powScopeBotDefense, 8, "10.0.0.1", "curl/8.0", now)
+	solution := solvePoWForTest(challenge, 8)
+
+	if _, err := verifyPoWSolution(secret, challenge, solution, "10.0.0.1", "curl/8.0", now); err != nil {
+		t.Fatalf("valid solution rejected: %v", err)
+	}
+	if _, err := verifyPoWSolution(secret, challenge, solution, "10.0.0.2", "curl/8.0", now); err == nil {
+		t.Fatal("solution from another IP should be rejected")
+	}
+	if _, err := verifyPoWSolution(secret, challenge, solution, "10.0.0.1", "curl/8.0", now.Add(powChallengeTTL+time.Second)); err == nil {
+		t.Fatal("expired challenge should be rejected")
+	}
+	easier := strings.Replace(challenge, ".8.", ".1.", 1)
+	if _, err := verifyPoWSolution(secret, easier, "0", "10.0.0.1", "curl/8.0", now); err == nil {
+		t.Fatal("challenge with lowered difficulty should fail the signature check")
+	}
+	for i := 0; ; i++ {
+		s := strconv.Itoa(i)
+		if powLeadingZeroBits(challenge, s) < 8 {
+			if _, err := verifyPoWSolution(secret, challenge, s, "10.0.0.1", "curl/8.0", now); err == nil {
+				t.Fatalf("weak solution %s should be rejected", s)
+			}
+			break
+		}
+	}
+}
+
+func TestEvaluateBotDefense_PoWDifficultyScalesWithUserAgent(t *testing.T) {
+	restore := useBotDefensePoWForTest(t, "always")
+	defer restore()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	tests := []struct {
+		ua   string
+		want int
+	}{
+		{ua: "Mozilla/5.0", want: 4},
+		{ua: "curl/8.0", want: 6},
+		{ua: "", want: 7},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		req.Header.Set("User-Agent", tt.ua)
+		d := EvaluateBotDefense(req, "10.0.0.1", now)
+		if d.Allowed || d.ChallengeType != challengeTypePoW {
+			t.Fatalf("ua=%q should get a pow challenge: %+v", tt.ua, d)
+		}
+		if d.Token != "" {
+			t.Fatalf("pow decision must not leak a pass token: %+v", d)
+		}
+		if d.PoWDifficulty != tt.want {
+			t.Fatalf("ua=%q difficulty=%d want=%d", tt.ua, d.PoWDifficulty, tt.want)
+		}
+	}
+}
+
+func TestVerifyPoWChallenge_IssuesBotDefenseCookie(t *testing.T) {
+	restore := useBotDefensePoWForTest(t, "suspicious")
+	defer restore()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("Accept", "text/html")
+	d := EvaluateBotDefense(req, "10.0.0.1", time.Now().UTC())
+	if d.Allowed {
+		t.Fatalf("request should be challenged: %+v", d)
+	}
+
+	page := httptest.NewRecorder()
+	WriteBotDefenseChallenge(page, req, d)
+	if body := page.Body.String(); !strings.Contains(body, d.PoWChallenge) || !strings.Contains(body, PowChallengeVerifyPath) {
+		t.Fatalf("challenge page should embed the puzzle and verify URL: %s", body)
+	}
+
+	solution := solvePoWForTest(d.PoWChallenge, d.PoWDifficulty)
+	w := postPoWVerifyForTest(t, d.PoWChallenge, "0"+solution+"x", "10.0.0.1", "curl/8.0")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("malformed solution status=%d want=403", w.Code)
+	}
+	w = postPoWVerifyForTest(t, d.PoWChallenge, solution, "10.0.0.1", "curl/8.0")
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "__mamotama_bot_ok" || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookies: %+v", cookies)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Token != cookies[0].Value {
+		t.Fatalf("response token=%q cookie=%q err=%v", resp.Token, cookies[0].Value, err)
+	}
+
+	next := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	next.Header.Set("User-Agent", "curl/8.0")
+	next.AddCookie(cookies[0])
+	if d := EvaluateBotDefense(next, "10.0.0.1", time.Now().UTC()); !d.Allowed {
+		t.Fatalf("request with issued cookie should pass: %+v", d)
+	}
+}
+
+func TestWriteSemanticChallenge_PoWScalesWithScoreAndVerifies(t *testing.T) {
+	raw := `{
+  "enabled": true,
+  "mode": "challenge",
+  "log_threshold": 1,
+  "challenge_threshold": 2,
+  "block_threshold": 10,
+  "challenge_type": "pow",
+  "pow_difficulty": 4,
+  "pow_max_difficulty": 6
+}`
+	rt, err := ValidateSemanticRaw(raw)
+	if err != nil {
+		t.Fatalf("ValidateSemanticRaw() unexpected error: %v", err)
+	}
+	restore := saveSemanticStateForTest()
+	defer restore()
+	semanticMu.Lock()
+	semanticRuntime = rt
+	semanticMu.Unlock()
+
+	if got := semanticPoWDifficulty(rt.Raw, 3); got != 5 {
+		t.Fatalf("difficulty(score=3)=%d want=5", got)
+	}
+	if got := semanticPoWDifficulty(rt.Raw, 20); got != 6 {
+		t.Fatalf("difficulty(score=20)=%d want=6 (capped)", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/?q=union+select+1", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	w := httptest.NewRecorder()
+	WriteSemanticChallenge(w, req, "10.0.0.1", 3)
+	var desc struct {
+		ChallengeType string `json:"challenge_type"`
+		Challenge     string `json:"challenge"`
+		Difficulty    int    `json:"difficulty"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("decode descriptor: %v body=%s", err, w.Body.String())
+	}
+	if desc.ChallengeType != challengeTypePoW || desc.Difficulty != 5 {
+		t.Fatalf("descriptor=%+v", desc)
+	}
+
+	vw := postPoWVerifyForTest(t, desc.Challenge, solvePoWForTest(desc.Challenge, desc.Difficulty), "10.0.0.1", "curl/8.0")
+	if vw.Code != http.StatusOK {
+		t.Fatalf("verify status=%d body=%s", vw.Code, vw.Body.String())
+	}
+	next := httptest.NewRequest(http.MethodGet, "http://example.test/?q=union+select+1", nil)
+	next.Header.Set("User-Agent", "curl/8.0")
+	for _, ck := range vw.Result().Cookies() {
+		next.AddCookie(ck)
+	}
+	if !HasValidSemanticChallengeCookie(next, "10.0.0.1", time.Now().UTC()) {
+		t.Fatal("issued semantic cookie should pass")
+	}
+}
+
+func TestValidateBotDefenseRaw_RejectsUnknownChallengeType(t *testing.T) {
+	if _, err := ValidateBotDefenseRaw(`{"enabled": true, "challenge_type": "captcha"}`); err == nil {
+		t.Fatal("expected challenge_type error")
+	}
+	if _, err := ValidateSemanticRaw(`{"enabled": true, "mode": "challenge", "challenge_type": "pow", "pow_difficulty": 40}`); err == nil {
+		t.Fatal("expected pow_difficulty error")
+	}
+}
+
+func useBotDefensePoWForTest(t *testing.T, mode string) func() {
+	t.Helper()
+	rt, err := ValidateBotDefenseRaw(`{
+  "enabled": true,
+  "mode": "` + mode + `",
+  "path_prefixes": ["/"],
+  "suspicious_user_agents": ["curl"],
+  "challenge_secret": "test-bot-defense-secret-12345",
+  "challenge_ttl_seconds": 3600,
+  "challenge_status_code": 429,
+  "challenge_type": "pow",
+  "pow_difficulty": 4,
+  "pow_max_difficulty": 7
+}`)
+	if err != nil {
+		t.Fatalf("ValidateBotDefenseRaw() unexpected error: %v", err)
+	}
+	restore := saveBotDefenseStateForTest()
+	botDefenseMu.Lock()
+	botDefenseRuntime = rt
+	botDefenseMu.Unlock()
+	return restore
+}
+
+func postPoWVerifyForTest(t *testing.T, challenge, solution, ip, userAgent string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(powVerifyBody{Challenge: challenge, Solution: solution})
+	req := httptest.NewRequest(http.MethodPost, PowChallengeVerifyPath, strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.RemoteAddr = net.JoinHostPort(ip, "1234")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	VerifyPoWChallenge(c)
+	return w
+}
+
+// solvePoWForTest brute-forces a puzzle the way the challenge page does.
+func solvePoWForTest(challenge string, difficulty int) string {
+	for i := uint64(0); ; i++ {
+		s := strconv.FormatUint(i, 10)
+		if powLeadingZeroBits(challenge, s) >= difficulty {
+			return s
+		}
+	}
+}
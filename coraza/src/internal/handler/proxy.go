@@ -6,12 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/corazawaf/coraza/v3"
@@ -20,34 +17,30 @@ import (
 	"mamotama/internal/bypassconf"
 	"mamotama/internal/cacheconf"
 	"mamotama/internal/config"
+	"mamotama/internal/tracing"
 	"mamotama/internal/waf"
 )
 
 type ctxKey string
 
 const (
-	ctxKeyReqID   ctxKey = "req_id"
-	ctxKeyWafHit  ctxKey = "waf_hit"
-	ctxKeyWafRule ctxKey = "waf_rules"
-	ctxKeyIP      ctxKey = "client_ip"
-	ctxKeyCountry ctxKey = "country"
+	ctxKeyReqID         ctxKey = "req_id"
+	ctxKeyWafHit        ctxKey = "waf_hit"
+	ctxKeyWafRule       ctxKey = "waf_rules"
+	ctxKeyIP            ctxKey = "client_ip"
+	ctxKeyCountry       ctxKey = "country"
+	ctxKeyCountrySource ctxKey = "country_source"
+	ctxKeyWafTx         ctxKey = "waf_tx"
+	ctxKeyWafMonitor    ctxKey = "waf_monitor"
+	ctxKeyRoute         ctxKey = "route"
+	ctxKeyUpstream      ctxKey = "upstream_attempt"
+	ctxKeyMetrics       ctxKey = "request_metrics"
 )
 
-var proxy *httputil.ReverseProxy
-var proxyInitOnce sync.Once
-
-func ensureProxy() {
-	proxyInitOnce.Do(func() {
-		u, err := url.Parse(config.AppURL)
-		if err != nil {
-			log.Fatalf("Invalid WAF_APP_URL: %v", err)
-		}
-		proxy = httputil.NewSingleHostReverseProxy(u)
-		proxy.ModifyResponse = onProxyResponse
-	})
-}
-
 func onProxyResponse(res *http.Response) error {
+	if inspectWAFResponse(res) {
+		return nil
+	}
 	annotateWAFHit(res)
 	applyCacheHeaders(res)
 
@@ -73,19 +66,22 @@ func annotateWAFHit(res *http.Response) {
 	reqID, _ := ctx.Value(ctxKeyReqID).(string)
 	ip, _ := ctx.Value(ctxKeyIP).(string)
 	country, _ := ctx.Value(ctxKeyCountry).(string)
+	countrySource, _ := ctx.Value(ctxKeyCountrySource).(string)
 	path := res.Request.URL.Path
 	status := res.StatusCode
 	emitJSONLog(map[string]any{
-		"ts":      time.Now().UTC().Format(time.RFC3339Nano),
-		"service": "coraza",
-		"level":   "INFO",
-		"event":   "waf_hit_allow",
-		"req_id":  reqID,
-		"ip":      ip,
-		"country": country,
-		"path":    path,
-		"rules":   res.Header.Get("X-WAF-RuleIDs"),
-		"status":  status,
+		"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+		"service":        "coraza",
+		"level":          "INFO",
+		"event":          "waf_hit_allow",
+		"req_id":         reqID,
+		"trace_id":       tracing.TraceIDFromContext(ctx),
+		"ip":             ip,
+		"country":        country,
+		"country_source": countrySource,
+		"path":           path,
+		"rules":          res.Header.Get("X-WAF-RuleIDs"),
+		"status":         status,
 	})
 }
 
@@ -127,11 +123,12 @@ func ensureRequestID(c *gin.Context) string {
 	return reqID
 }
 
-func selectWAFEngine(reqPath string) coraza.WAF {
+// selectWAFEngine also reports whether the path is in monitor mode.
+func selectWAFEngine(reqPath string, route *runtimeRoute) (coraza.WAF, bool) {
 	wafEngine := waf.GetBaseWAF()
-	switch mr := bypassconf.Match(reqPath); mr.Action {
+	switch mr := route.matchBypass(reqPath); mr.Action {
 	case bypassconf.ACTION_BYPASS:
-		return nil
+		return nil, false
 	case bypassconf.ACTION_RULE:
 		log.Printf("[BYPASS][RULE] %s extra=%s", reqPath, mr.ExtraRule)
 		ruleWAF, err := waf.GetWAFForExtraRule(mr.ExtraRule)
@@ -140,150 +137,266 @@ func selectWAFEngine(reqPath string) coraza.WAF {
 				log.Fatalf("[BYPASS][RULE][STRICT] %v", err)
 			}
 			log.Printf("[BYPASS][RULE][WARN] %v (fallback=default-rules)", err)
-			return wafEngine
+			return wafEngine, mr.Monitor
 		}
 
-		return ruleWAF
+		return ruleWAF, mr.Monitor
 	default:
-		return wafEngine
+		return wafEngine, mr.Monitor
 	}
 }
 
-func setWAFContext(c *gin.Context, reqID, clientIP, country string, wafHit bool, ruleIDs string) {
+func setWAFContext(c *gin.Context, reqID, clientIP, country, countrySource string, wafHit bool, ruleIDs string) {
 	ctx := context.WithValue(c.Request.Context(), ctxKeyReqID, reqID)
 	ctx = context.WithValue(ctx, ctxKeyIP, clientIP)
 	ctx = context.WithValue(ctx, ctxKeyCountry, country)
+	ctx = context.WithValue(ctx, ctxKeyCountrySource, countrySource)
 	ctx = context.WithValue(ctx, ctxKeyWafHit, wafHit)
 	ctx = context.WithValue(ctx, ctxKeyWafRule, ruleIDs)
 	c.Request = c.Request.WithContext(ctx)
 }
 
 func ProxyHandler(c *gin.Context) {
-	ensureProxy()
-
+	start := time.Now()
+	ctx, span := tracing.Start(tracing.Extract(c.Request.Context(), c.Request.Header), c.Request.Method, tracing.SpanKindServer)
 	reqID := ensureRequestID(c)
+	traceID := tracing.TraceIDFromContext(ctx)
+	route := resolveRoute(c.Request)
+	upstream := route.Upstream
 	clientIP := requestClientIP(c)
-	country := normalizeCountryCode(c.GetHeader("X-Country-Code"))
+	ctx, rm := withRequestMetrics(ctx, route.Name, start)
+	defer func() {
+		rm.observe()
+		span.SetAttr("http.response.status_code", c.Writer.Status())
+		span.SetAttr("mamotama.outcome", rm.outcome)
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			span.SetError(rm.outcome)
+		}
+		span.End()
+	}()
+	span.SetAttr("http.request.method", c.Request.Method)
+	span.SetAttr("url.path", c.Request.URL.Path)
+	span.SetAttr("server.address", requestHostname(c.Request))
+	span.SetAttr("client.address", clientIP)
+	span.SetAttr("mamotama.route", route.Name)
+	span.SetAttr("mamotama.req_id", reqID)
+
+	_, stage := tracing.Start(ctx, "country", tracing.SpanKindInternal)
+	country, countrySource := resolveRequestCountry(c.Request, clientIP)
+	countryBlocked := IsCountryBlocked(country)
+	stage.SetAttr("mamotama.country", country)
+	stage.SetAttr("mamotama.blocked", countryBlocked)
+	stage.End()
+
+	ctx = context.WithValue(ctx, ctxKeyRoute, route.Name)
+	ctx = context.WithValue(ctx, ctxKeyIP, clientIP)
+	ctx = context.WithValue(ctx, ctxKeyCountry, country)
+	ctx = context.WithValue(ctx, ctxKeyCountrySource, countrySource)
+	c.Request = c.Request.WithContext(ctx)
 
-	if IsCountryBlocked(country) {
+	if countryBlocked {
 		evt := map[string]any{
-			"ts":      time.Now().UTC().Format(time.RFC3339Nano),
-			"service": "coraza",
-			"level":   "WARN",
-			"event":   "country_block",
-			"req_id":  reqID,
-			"ip":      clientIP,
-			"country": country,
-			"path":    c.Request.URL.Path,
-			"status":  http.StatusForbidden,
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "WARN",
+			"event":          "country_block",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"path":           c.Request.URL.Path,
+			"status":         http.StatusForbidden,
 		}
 		emitJSONLog(evt)
 		_ = appendEventToFile(evt)
-		c.AbortWithStatus(http.StatusForbidden)
+		observeDecision(ctx, "country_block", "block")
+		rm.outcome = requestOutcomeCountryBlock
+		writeResponseTemplate(c.Writer, c.Request, responseTemplateCountryBlock, responseTemplateVars{
+			Status:  http.StatusForbidden,
+			ReqID:   reqID,
+			Message: "Access from your region is not permitted.",
+			Country: country,
+		})
+		c.Abort()
 		return
 	}
 
-	botDecision := EvaluateBotDefense(c.Request, clientIP, time.Now().UTC())
+	_, stage = tracing.Start(ctx, "bot_defense", tracing.SpanKindInternal)
+	botDecision := route.evaluateBotDefense(c.Request, clientIP, time.Now().UTC())
+	stage.SetAttr("mamotama.allowed", botDecision.Allowed)
+	stage.SetAttr("mamotama.score", botDecision.Score)
+	stage.End()
+	if botDecision.LogOnly {
+		evt := map[string]any{
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "INFO",
+			"event":          "bot_challenge",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"path":           c.Request.URL.Path,
+			"mode":           botDecision.Mode,
+			"action":         botBehaviorModeLogOnly,
+			"score":          botDecision.Score,
+			"signals":        strings.Join(botDecision.Signals, ","),
+		}
+		emitJSONLog(evt)
+		_ = appendEventToFile(evt)
+		observeDecision(ctx, "bot_challenge", botBehaviorModeLogOnly)
+	}
 	if !botDecision.Allowed {
 		evt := map[string]any{
-			"ts":      time.Now().UTC().Format(time.RFC3339Nano),
-			"service": "coraza",
-			"level":   "WARN",
-			"event":   "bot_challenge",
-			"req_id":  reqID,
-			"ip":      clientIP,
-			"country": country,
-			"path":    c.Request.URL.Path,
-			"status":  botDecision.Status,
-			"mode":    botDecision.Mode,
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "WARN",
+			"event":          "bot_challenge",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"path":           c.Request.URL.Path,
+			"status":         botDecision.Status,
+			"mode":           botDecision.Mode,
+			"action":         "challenge",
+		}
+		if botDecision.Score > 0 || len(botDecision.Signals) > 0 {
+			evt["score"] = botDecision.Score
+			evt["signals"] = strings.Join(botDecision.Signals, ",")
+		}
+		if botDecision.Crawler != "" {
+			evt["crawler"] = botDecision.Crawler
+			evt["crawler_verified"] = false
+		}
+		if botDecision.ChallengeType == challengeTypePoW {
+			evt["challenge_type"] = botDecision.ChallengeType
+			evt["difficulty"] = botDecision.PoWDifficulty
 		}
 		emitJSONLog(evt)
 		_ = appendEventToFile(evt)
+		observeDecision(ctx, "bot_challenge", "challenge")
+		rm.outcome = requestOutcomeBotChallenge
 
 		WriteBotDefenseChallenge(c.Writer, c.Request, botDecision)
 		c.Abort()
 		return
 	}
 
+	_, stage = tracing.Start(ctx, "semantic", tracing.SpanKindInternal)
 	semanticEval := EvaluateSemantic(c.Request)
+	stage.SetAttr("mamotama.action", semanticEval.Action)
+	stage.SetAttr("mamotama.score", semanticEval.Score)
+	stage.End()
 	if semanticEval.Score > 0 {
 		c.Header("X-Mamotama-Semantic-Score", strconv.Itoa(semanticEval.Score))
 	}
 	if semanticEval.Action != semanticActionNone {
 		evt := map[string]any{
-			"ts":      time.Now().UTC().Format(time.RFC3339Nano),
-			"service": "coraza",
-			"level":   "WARN",
-			"event":   "semantic_anomaly",
-			"req_id":  reqID,
-			"ip":      clientIP,
-			"country": country,
-			"path":    c.Request.URL.Path,
-			"action":  semanticEval.Action,
-			"score":   semanticEval.Score,
-			"reasons": strings.Join(semanticEval.Reasons, ","),
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "WARN",
+			"event":          "semantic_anomaly",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"path":           c.Request.URL.Path,
+			"action":         semanticEval.Action,
+			"score":          semanticEval.Score,
+			"reasons":        strings.Join(semanticEval.Reasons, ","),
 		}
 		emitJSONLog(evt)
 		_ = appendEventToFile(evt)
+		observeDecision(ctx, "semantic", semanticEval.Action)
 
 		switch semanticEval.Action {
 		case semanticActionChallenge:
 			if !HasValidSemanticChallengeCookie(c.Request, clientIP, time.Now().UTC()) {
-				WriteSemanticChallenge(c.Writer, c.Request, clientIP)
+				WriteSemanticChallenge(c.Writer, c.Request, clientIP, semanticEval.Score)
+				rm.outcome = requestOutcomeSemanticChallenge
 				c.Abort()
 				return
 			}
 		case semanticActionBlock:
-			c.AbortWithStatus(http.StatusForbidden)
+			rm.outcome = requestOutcomeSemanticBlock
+			writeResponseTemplate(c.Writer, c.Request, responseTemplateBlock, responseTemplateVars{
+				Status:  http.StatusForbidden,
+				ReqID:   reqID,
+				Message: "The request was blocked by the web application firewall.",
+				Country: country,
+			})
+			c.Abort()
 			return
 		}
 	}
 
-	rateDecision := EvaluateRateLimit(c.Request.Method, c.Request.URL.Path, clientIP, country, time.Now().UTC())
+	_, stage = tracing.Start(ctx, "rate_limit", tracing.SpanKindInternal)
+	rateDecision := route.evaluateRateLimit(c.Request, clientIP, country, time.Now().UTC())
+	stage.SetAttr("mamotama.allowed", rateDecision.Allowed)
+	if rateDecision.PolicyID != "" {
+		stage.SetAttr("mamotama.policy_id", rateDecision.PolicyID)
+	}
+	stage.End()
+	setRateLimitHeaders(c.Writer.Header(), rateDecision)
 	if !rateDecision.Allowed {
 		evt := map[string]any{
-			"ts":          time.Now().UTC().Format(time.RFC3339Nano),
-			"service":     "coraza",
-			"level":       "WARN",
-			"event":       "rate_limited",
-			"req_id":      reqID,
-			"ip":          clientIP,
-			"country":     country,
-			"path":        c.Request.URL.Path,
-			"status":      rateDecision.Status,
-			"policy_id":   rateDecision.PolicyID,
-			"limit":       rateDecision.Limit,
-			"window_sec":  rateDecision.WindowSeconds,
-			"rl_key_hash": rateDecision.Key,
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "WARN",
+			"event":          "rate_limited",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"path":           c.Request.URL.Path,
+			"status":         rateDecision.Status,
+			"policy_id":      rateDecision.PolicyID,
+			"limit":          rateDecision.Limit,
+			"window_sec":     rateDecision.WindowSeconds,
+			"algorithm":      rateDecision.Algorithm,
+			"rl_key_hash":    rateDecision.Key,
 		}
 		emitJSONLog(evt)
 		_ = appendEventToFile(evt)
+		observeDecision(ctx, "rate_limited", "block")
+		rm.outcome = requestOutcomeRateLimited
 		c.Header("Retry-After", strconv.Itoa(rateDecision.RetryAfterSeconds))
-		c.AbortWithStatus(rateDecision.Status)
+		writeResponseTemplate(c.Writer, c.Request, responseTemplateRateLimit, responseTemplateVars{
+			Status:     rateDecision.Status,
+			ReqID:      reqID,
+			Message:    "Too many requests. Retry after the indicated delay.",
+			Country:    country,
+			RetryAfter: rateDecision.RetryAfterSeconds,
+		})
+		c.Abort()
 		return
 	}
 
 	reqPath := c.Request.URL.Path
-	wafEngine := selectWAFEngine(reqPath)
+	wafEngine, pathMonitor := selectWAFEngine(reqPath, route)
 	if wafEngine == nil {
 		log.Printf("[BYPASS][HIT] %s -> skip WAF", reqPath)
-		proxy.ServeHTTP(c.Writer, c.Request)
+		span.SetAttr("mamotama.waf_bypass", true)
+		serveUpstream(c, upstream)
 		return
 	}
 
+	_, stage = tracing.Start(ctx, "waf.request", tracing.SpanKindInternal)
 	tx := wafEngine.NewTransaction()
 	defer func() {
 		tx.ProcessLogging()
 		tx.Close()
 	}()
 
-	tx.ProcessURI(c.Request.URL.String(), c.Request.Method, c.Request.Proto)
-	tx.AddRequestHeader("Host", c.Request.Host)
-	if err := tx.ProcessRequestHeaders(); err != nil {
-		log.Println("Header error:", err)
-	}
-	if _, err := tx.ProcessRequestBody(); err != nil {
-		log.Println("Body error:", err)
+	if err := processWAFRequest(tx, c.Request, clientIP); err != nil {
+		log.Printf("[WAF][WARN] request inspection failed req_id=%s: %v", reqID, err)
+		stage.SetError(err.Error())
 	}
 
 	wafHit := false
@@ -296,24 +409,87 @@ func ProxyHandler(c *gin.Context) {
 		}
 	}
 
-	setWAFContext(c, reqID, clientIP, country, wafHit, strings.Join(unique(ruleIDs), ","))
+	setWAFContext(c, reqID, clientIP, country, countrySource, wafHit, strings.Join(unique(ruleIDs), ","))
+
+	it := tx.Interruption()
+	stage.SetAttr("mamotama.rule_ids", strings.Join(unique(ruleIDs), ","))
+	stage.SetAttr("mamotama.interrupted", it != nil)
+	stage.End()
+
+	if it != nil {
+		if scope := wafMonitorScope(tx, it, pathMonitor); scope != "" {
+			evt := map[string]any{
+				"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+				"service":        "coraza",
+				"level":          "WARN",
+				"event":          "waf_would_block",
+				"phase":          "request",
+				"monitor_scope":  scope,
+				"req_id":         reqID,
+				"trace_id":       traceID,
+				"ip":             clientIP,
+				"country":        country,
+				"country_source": countrySource,
+				"method":         c.Request.Method,
+				"path":           c.Request.URL.Path,
+			}
+			for k, v := range wafInterruptionDetails(tx, it) {
+				evt[k] = v
+			}
+			emitJSONLog(evt)
+			_ = appendEventToFile(evt)
+			observeWAFDecision(ctx, evt, "would_block")
+			// The transaction is already interrupted, so response phases
+			// cannot run for this request.
+			serveUpstream(c, upstream)
+			return
+		}
 
-	if it := tx.Interruption(); it != nil {
 		evt := map[string]any{
-			"ts":      time.Now().UTC().Format(time.RFC3339Nano),
-			"service": "coraza",
-			"level":   "WARN",
-			"event":   "waf_block",
-			"req_id":  reqID, "ip": clientIP, "country": country, "path": c.Request.URL.Path,
-			"rule_id": it.RuleID, "status": it.Status,
+			"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+			"service":        "coraza",
+			"level":          "WARN",
+			"event":          "waf_block",
+			"phase":          "request",
+			"req_id":         reqID,
+			"trace_id":       traceID,
+			"ip":             clientIP,
+			"country":        country,
+			"country_source": countrySource,
+			"method":         c.Request.Method,
+			"path":           c.Request.URL.Path,
+		}
+		for k, v := range wafInterruptionDetails(tx, it) {
+			evt[k] = v
 		}
 		emitJSONLog(evt)
 		_ = appendEventToFile(evt)
-		c.AbortWithStatus(it.Status)
+		observeWAFDecision(ctx, evt, "block")
+		rm.outcome = requestOutcomeWAFBlock
+		writeResponseTemplate(c.Writer, c.Request, responseTemplateBlock, responseTemplateVars{
+			Status:  it.Status,
+			ReqID:   reqID,
+			RuleID:  logFieldString(eventDetectionRuleID(evt)),
+			Message: "The request was blocked by the web application firewall.",
+			Country: country,
+		})
+		c.Abort()
 		return
 	}
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+	ctx = context.WithValue(c.Request.Context(), ctxKeyWafTx, tx)
+	ctx = context.WithValue(ctx, ctxKeyWafMonitor, pathMonitor)
+	c.Request = c.Request.WithContext(ctx)
+	serveUpstream(c, upstream)
+}
+
+// serveUpstream proxies the request under an upstream span. Each attempt
+// gets a child span, whose context is sent as traceparent.
+func serveUpstream(c *gin.Context, upstream *runtimeUpstream) {
+	ctx, span := tracing.Start(c.Request.Context(), "upstream", tracing.SpanKindInternal)
+	span.SetAttr("mamotama.upstream", upstream.Name)
+	defer span.End()
+	upstream.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
 }
 
 func genReqID() string {
@@ -336,16 +512,18 @@ func unique(in []string) []string {
 func emitJSONLog(obj map[string]any) {
 	if b, err := json.Marshal(obj); err == nil {
 		log.Println(string(b))
+		eventHub.publish(obj, b)
 	}
 }
 
+// appendEventToFile queues obj for the event file and the other event
+// sinks. Before InitEventSinks, as in tests, it appends synchronously.
 func appendEventToFile(obj map[string]any) error {
-	path := os.Getenv("WAF_EVENTS_FILE")
-	if path == "" {
-		path = "/app/logs/coraza/waf-events.ndjson"
+	if p := eventSinks.Load(); p != nil {
+		return p.Publish(obj)
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	f, err := os.OpenFile(eventsFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,1001 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateLimitBackendMemory = "memory"
+	rateLimitBackendDB     = "db"
+	rateLimitBackendRedis  = "redis"
+
+	maxDBRateCounterKeyBytes = 255
+	redisMaxIdleConns        = 8
+	redisMaxCASAttempts      = 5
+	redisMaxScanKeys         = 10000
+)
+
+// rateLimitCounterStore keeps windowed hit counters and token-bucket state.
+// Shared backends let every replica enforce one budget per counter key.
+type rateLimitCounterStore interface {
+	Name() string
+	Add(key string, windowID int64, delta int, ttl time.Duration, now time.Time) (int, error)
+	Get(key string, windowID int64) (int, error)
+	// UpdateTokenBucket atomically replaces the bucket state with apply's
+	// result. apply must be free of side effects because shared backends may
+	// call it more than once when they lose a race.
+	UpdateTokenBucket(key string, ttl time.Duration, apply func(prev tokenBucketState, found bool) tokenBucketState) (tokenBucketState, error)
+	// Top lists live window counters with the highest counts and token
+	// buckets with the fewest tokens left, at most limit of each.
+	Top(limit int, now time.Time) ([]rateCounterEntry, []rateBucketEntry, error)
+	Reset()
+}
+
+type tokenBucketState struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+type rateCounterEntry struct {
+	Key      string `json:"key"`
+	WindowID int64  `json:"window_id"`
+	Count    int    `json:"count"`
+}
+
+type rateBucketEntry struct {
+	Key       string    `json:"key"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func sortRateCounterSnapshot(counters []rateCounterEntry, buckets []rateBucketEntry, limit int) ([]rateCounterEntry, []rateBucketEntry) {
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Count != counters[j].Count {
+			return counters[i].Count > counters[j].Count
+		}
+		return counters[i].Key < counters[j].Key
+	})
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Tokens != buckets[j].Tokens {
+			return buckets[i].Tokens < buckets[j].Tokens
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+	if len(counters) > limit {
+		counters = counters[:limit]
+	}
+	if len(buckets) > limit {
+		buckets = buckets[:limit]
+	}
+	return counters, buckets
+}
+
+// splitRateCounterWindowKey reverses rateCounterWindowKey.
+func splitRateCounterWindowKey(k string) (string, int64, bool) {
+	i := strings.LastIndex(k, ":")
+	if i < 0 {
+		return "", 0, false
+	}
+	windowID, err := strconv.ParseInt(k[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return k[:i], windowID, true
+}
+
+var (
+	rateCounterStoreMu  sync.RWMutex
+	rateCounterStore    rateLimitCounterStore = newMemoryRateCounterStore()
+	rateCounterFallback                       = newMemoryRateCounterStore()
+
+	rateCounterErrLogMu    sync.Mutex
+	rateCounterErrLoggedAt time.Time
+)
+
+func InitRateLimitCounterStore(backend, redisAddr, redisPassword string, redisDB int, redisPrefix string, redisTimeout time.Duration) error {
+	var next rateLimitCounterStore
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", rateLimitBackendMemory:
+		next = newMemoryRateCounterStore()
+	case rateLimitBackendDB:
+		if getLogsStatsStore() == nil {
+			return fmt.Errorf("rate limit db backend requires WAF_STORAGE_BACKEND=db")
+		}
+		next = &dbRateCounterStore{}
+	case rateLimitBackendRedis:
+		rs, err := newRedisRateCounterStore(redisAddr, redisPassword, redisDB, redisPrefix, redisTimeout)
+		if err != nil {
+			return err
+		}
+		next = rs
+	default:
+		return fmt.Errorf("unsupported rate limit backend: %s", backend)
+	}
+
+	rateCounterStoreMu.Lock()
+	prev := rateCounterStore
+	rateCounterStore = next
+	rateCounterStoreMu.Unlock()
+
+	if closer, ok := prev.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	return nil
+}
+
+func GetRateLimitBackend() string {
+	return currentRateCounterStore().Name()
+}
+
+func currentRateCounterStore() rateLimitCounterStore {
+	rateCounterStoreMu.RLock()
+	defer rateCounterStoreMu.RUnlock()
+	return rateCounterStore
+}
+
+// The rateCounter* helpers fall back to process-local state while a shared
+// backend is unavailable, so limits degrade to per-replica instead of off.
+
+func rateCounterAdd(key string, windowID int64, delta int, ttl time.Duration, now time.Time) int {
+	store := currentRateCounterStore()
+	n, err := store.Add(key, windowID, delta, ttl, now)
+	if err == nil {
+		return n
+	}
+
+	logRateCounterError(store.Name(), err, now)
+	n, _ = rateCounterFallback.Add(key, windowID, delta, ttl, now)
+	return n
+}
+
+func rateCounterGet(key string, windowID int64, now time.Time) int {
+	store := currentRateCounterStore()
+	n, err := store.Get(key, windowID)
+	if err == nil {
+		return n
+	}
+
+	logRateCounterError(store.Name(), err, now)
+	n, _ = rateCounterFallback.Get(key, windowID)
+	return n
+}
+
+func rateCounterUpdateBucket(key string, ttl time.Duration, now time.Time, apply func(prev tokenBucketState, found bool) tokenBucketState) tokenBucketState {
+	store := currentRateCounterStore()
+	st, err := store.UpdateTokenBucket(key, ttl, apply)
+	if err == nil {
+		return st
+	}
+
+	logRateCounterError(store.Name(), err, now)
+	st, _ = rateCounterFallback.UpdateTokenBucket(key, ttl, apply)
+	return st
+}
+
+func resetRateCounters() {
+	currentRateCounterStore().Reset()
+	rateCounterFallback.Reset()
+}
+
+func logRateCounterError(backend string, err error, now time.Time) {
+	rateCounterErrLogMu.Lock()
+	defer rateCounterErrLogMu.Unlock()
+	if now.Sub(rateCounterErrLoggedAt) < 30*time.Second {
+		return
+	}
+	rateCounterErrLoggedAt = now
+	log.Printf("[RATE_LIMIT][%s][WARN] counter operation failed (fallback=memory): %v", strings.ToUpper(backend), err)
+}
+
+func rateCounterWindowKey(key string, windowID int64) string {
+	return key + ":" + strconv.FormatInt(windowID, 10)
+}
+
+type rateCounter struct {
+	Count   int
+	Updated time.Time
+	Expires time.Time
+}
+
+type memoryRateBucket struct {
+	tokenBucketState
+	Expires time.Time
+}
+
+type memoryRateCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]rateCounter
+	buckets  map[string]memoryRateBucket
+	sweep    int
+}
+
+func newMemoryRateCounterStore() *memoryRateCounterStore {
+	return &memoryRateCounterStore{
+		counters: map[string]rateCounter{},
+		buckets:  map[string]memoryRateBucket{},
+	}
+}
+
+func (s *memoryRateCounterStore) Name() string {
+	return rateLimitBackendMemory
+}
+
+func (s *memoryRateCounterStore) Add(key string, windowID int64, delta int, ttl time.Duration, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := rateCounterWindowKey(key, windowID)
+	c := s.counters[k]
+	c.Count += delta
+	if c.Count < 0 {
+		c.Count = 0
+	}
+	c.Updated = now
+	c.Expires = now.Add(ttl)
+	s.counters[k] = c
+	s.sweepLocked(ttl, now)
+
+	return c.Count, nil
+}
+
+func (s *memoryRateCounterStore) Get(key string, windowID int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[rateCounterWindowKey(key, windowID)].Count, nil
+}
+
+func (s *memoryRateCounterStore) UpdateTokenBucket(key string, ttl time.Duration, apply func(prev tokenBucketState, found bool) tokenBucketState) (tokenBucketState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, found := s.buckets[key]
+	next := apply(prev.tokenBucketState, found)
+	s.buckets[key] = memoryRateBucket{tokenBucketState: next, Expires: next.Updated.Add(ttl)}
+	s.sweepLocked(ttl, next.Updated)
+
+	return next, nil
+}
+
+func (s *memoryRateCounterStore) Top(limit int, now time.Time) ([]rateCounterEntry, []rateBucketEntry, error) {
+	s.mu.Lock()
+	counters := make([]rateCounterEntry, 0, len(s.counters))
+	for k, v := range s.counters {
+		if v.Count <= 0 || !v.Expires.After(now) {
+			continue
+		}
+		key, windowID, ok := splitRateCounterWindowKey(k)
+		if !ok {
+			continue
+		}
+		counters = append(counters, rateCounterEntry{Key: key, WindowID: windowID, Count: v.Count})
+	}
+	buckets := make([]rateBucketEntry, 0, len(s.buckets))
+	for k, v := range s.buckets {
+		if !v.Expires.After(now) {
+			continue
+		}
+		buckets = append(buckets, rateBucketEntry{Key: k, Tokens: v.Tokens, UpdatedAt: v.Updated})
+	}
+	s.mu.Unlock()
+
+	counters, buckets = sortRateCounterSnapshot(counters, buckets, limit)
+	return counters, buckets, nil
+}
+
+func (s *memoryRateCounterStore) sweepLocked(ttl time.Duration, now time.Time) {
+	s.sweep++
+	if s.sweep%1000 != 0 {
+		return
+	}
+
+	keep := 10 * time.Minute
+	if ttl > keep {
+		keep = ttl
+	}
+	cleanupBefore := now.Add(-keep)
+	for k, v := range s.counters {
+		if v.Updated.Before(cleanupBefore) {
+			delete(s.counters, k)
+		}
+	}
+	for k, v := range s.buckets {
+		if v.Updated.Before(cleanupBefore) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func (s *memoryRateCounterStore) Reset() {
+	s.mu.Lock()
+	s.counters = map[string]rateCounter{}
+	s.buckets = map[string]memoryRateBucket{}
+	s.sweep = 0
+	s.mu.Unlock()
+}
+
+// dbRateCounterStore shares counters through the configured log store
+// connection (SQLite for a single host, MySQL across hosts).
+type dbRateCounterStore struct {
+	ops atomic.Uint64
+}
+
+func (s *dbRateCounterStore) Name() string {
+	return rateLimitBackendDB
+}
+
+func (s *dbRateCounterStore) Add(key string, windowID int64, delta int, ttl time.Duration, now time.Time) (int, error) {
+	store := getLogsStatsStore()
+	if store == nil {
+		return 0, fmt.Errorf("db store is not initialized")
+	}
+	return store.AddRateCounter(dbRateCounterKey(key), windowID, delta, now.Add(ttl), s.pruneBefore(now))
+}
+
+func (s *dbRateCounterStore) Get(key string, windowID int64) (int, error) {
+	store := getLogsStatsStore()
+	if store == nil {
+		return 0, fmt.Errorf("db store is not initialized")
+	}
+	return store.GetRateCounter(dbRateCounterKey(key), windowID)
+}
+
+func (s *dbRateCounterStore) UpdateTokenBucket(key string, ttl time.Duration, apply func(prev tokenBucketState, found bool) tokenBucketState) (tokenBucketState, error) {
+	store := getLogsStatsStore()
+	if store == nil {
+		return tokenBucketState{}, fmt.Errorf("db store is not initialized")
+	}
+	return store.UpdateRateTokenBucket(dbRateCounterKey(key), ttl, apply)
+}
+
+func (s *dbRateCounterStore) Top(limit int, now time.Time) ([]rateCounterEntry, []rateBucketEntry, error) {
+	store := getLogsStatsStore()
+	if store == nil {
+		return nil, nil, fmt.Errorf("db store is not initialized")
+	}
+	return store.TopRateCounters(limit, now)
+}
+
+func (s *dbRateCounterStore) pruneBefore(now time.Time) time.Time {
+	if s.ops.Add(1)%512 == 0 {
+		return now
+	}
+	return time.Time{}
+}
+
+// Reset is a no-op: shared counters belong to every replica and expire on
+// their own, so one node reloading its config must not wipe them.
+func (s *dbRateCounterStore) Reset() {}
+
+func dbRateCounterKey(key string) string {
+	if len(key) <= maxDBRateCounterKeyBytes {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// The counter calls below run on rateDB without s.mu; the transaction and
+// the upsert keep each update atomic.
+func (s *wafEventStore) AddRateCounter(key string, windowID int64, delta int, expiresAt, pruneBefore time.Time) (int, error) {
+	if s == nil || s.rateDB == nil {
+		return 0, fmt.Errorf("db store is not initialized")
+	}
+
+	tx, err := s.rateDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(s.upsertRateCounterStmt(), key, windowID, delta, expiresAt.Unix(), delta); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var hits int
+	if err := tx.QueryRow(
+		`SELECT hits FROM rate_limit_counters WHERE counter_key = ? AND window_id = ?`,
+		key,
+		windowID,
+	).Scan(&hits); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if !pruneBefore.IsZero() {
+		if _, err := tx.Exec(`DELETE FROM rate_limit_counters WHERE expires_at_unix < ?`, pruneBefore.Unix()); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM rate_limit_buckets WHERE expires_at_unix < ?`, pruneBefore.Unix()); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if hits < 0 {
+		hits = 0
+	}
+	return hits, nil
+}
+
+func (s *wafEventStore) GetRateCounter(key string, windowID int64) (int, error) {
+	if s == nil || s.rateDB == nil {
+		return 0, fmt.Errorf("db store is not initialized")
+	}
+
+	var hits int
+	row := s.rateDB.QueryRow(`SELECT hits FROM rate_limit_counters WHERE counter_key = ? AND window_id = ?`, key, windowID)
+	switch err := row.Scan(&hits); {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	default:
+		return hits, nil
+	}
+}
+
+func (s *wafEventStore) UpdateRateTokenBucket(key string, ttl time.Duration, apply func(prev tokenBucketState, found bool) tokenBucketState) (tokenBucketState, error) {
+	if s == nil || s.rateDB == nil {
+		return tokenBucketState{}, fmt.Errorf("db store is not initialized")
+	}
+
+	tx, err := s.rateDB.Begin()
+	if err != nil {
+		return tokenBucketState{}, err
+	}
+
+	query := `SELECT tokens, updated_at_ns FROM rate_limit_buckets WHERE bucket_key = ?`
+	if s.dbDriver == logStatsDBDriverMySQL {
+		query += ` FOR UPDATE`
+	}
+	var (
+		prev      tokenBucketState
+		found     bool
+		updatedNS int64
+	)
+	switch err := tx.QueryRow(query, key).Scan(&prev.Tokens, &updatedNS); {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		_ = tx.Rollback()
+		return tokenBucketState{}, err
+	default:
+		found = true
+		prev.Updated = time.Unix(0, updatedNS).UTC()
+	}
+
+	next := apply(prev, found)
+	if _, err := tx.Exec(
+		s.upsertRateBucketStmt(),
+		key,
+		next.Tokens,
+		next.Updated.UnixNano(),
+		next.Updated.Add(ttl).Unix(),
+	); err != nil {
+		_ = tx.Rollback()
+		return tokenBucketState{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return tokenBucketState{}, err
+	}
+	return next, nil
+}
+
+func (s *wafEventStore) TopRateCounters(limit int, now time.Time) ([]rateCounterEntry, []rateBucketEntry, error) {
+	if s == nil || s.rateDB == nil {
+		return nil, nil, fmt.Errorf("db store is not initialized")
+	}
+
+	rows, err := s.rateDB.Query(
+		`SELECT counter_key, window_id, hits FROM rate_limit_counters
+		 WHERE expires_at_unix >= ? AND hits > 0
+		 ORDER BY hits DESC, counter_key ASC
+		 LIMIT ?`,
+		now.Unix(),
+		limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	counters := make([]rateCounterEntry, 0, limit)
+	for rows.Next() {
+		var e rateCounterEntry
+		if err := rows.Scan(&e.Key, &e.WindowID, &e.Count); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+		counters = append(counters, e)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.rateDB.Query(
+		`SELECT bucket_key, tokens, updated_at_ns FROM rate_limit_buckets
+		 WHERE expires_at_unix >= ?
+		 ORDER BY tokens ASC, bucket_key ASC
+		 LIMIT ?`,
+		now.Unix(),
+		limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	buckets := make([]rateBucketEntry, 0, limit)
+	for rows.Next() {
+		var (
+			e         rateBucketEntry
+			updatedNS int64
+		)
+		if err := rows.Scan(&e.Key, &e.Tokens, &updatedNS); err != nil {
+			return nil, nil, err
+		}
+		e.UpdatedAt = time.Unix(0, updatedNS).UTC()
+		buckets = append(buckets, e)
+	}
+	return counters, buckets, rows.Err()
+}
+
+func (s *wafEventStore) upsertRateCounterStmt() string {
+	if s != nil && s.dbDriver == logStatsDBDriverMySQL {
+		return `INSERT INTO rate_limit_counters (counter_key, window_id, hits, expires_at_unix)
+		 VALUES (?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE
+			hits = hits + ?,
+			expires_at_unix = VALUES(expires_at_unix)`
+	}
+	return `INSERT INTO rate_limit_counters (counter_key, window_id, hits, expires_at_unix)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT(counter_key, window_id) DO UPDATE SET
+			hits = rate_limit_counters.hits + ?,
+			expires_at_unix = excluded.expires_at_unix`
+}
+
+func (s *wafEventStore) upsertRateBucketStmt() string {
+	if s != nil && s.dbDriver == logStatsDBDriverMySQL {
+		return `INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at_ns, expires_at_unix)
+		 VALUES (?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE
+			tokens = VALUES(tokens),
+			updated_at_ns = VALUES(updated_at_ns),
+			expires_at_unix = VALUES(expires_at_unix)`
+	}
+	return `INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at_ns, expires_at_unix)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT(bucket_key) DO UPDATE SET
+			tokens = excluded.tokens,
+			updated_at_ns = excluded.updated_at_ns,
+			expires_at_unix = excluded.expires_at_unix`
+}
+
+// redisRateCounterStore speaks the Redis wire protocol (RESP2) directly, so
+// any compatible server (Redis, Valkey, KeyDB, Dragonfly) can back it.
+type redisRateCounterStore struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisRateCounterStore(addr, password string, db int, prefix string, timeout time.Duration) (*redisRateCounterStore, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil, fmt.Errorf("redis backend requires WAF_RATE_LIMIT_REDIS_ADDR")
+	}
+	if timeout <= 0 {
+		timeout = 200 * time.Millisecond
+	}
+	s := &redisRateCounterStore{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		timeout:  timeout,
+	}
+
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.do(s.timeout, "PING"); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	return s, nil
+}
+
+func (s *redisRateCounterStore) Name() string {
+	return rateLimitBackendRedis
+}
+
+func (s *redisRateCounterStore) Add(key string, windowID int64, delta int, ttl time.Duration, _ time.Time) (int, error) {
+	redisKey := s.prefix + rateCounterWindowKey(key, windowID)
+	replies, err := s.pipeline(
+		[]string{"INCRBY", redisKey, strconv.Itoa(delta)},
+		[]string{"EXPIRE", redisKey, strconv.FormatInt(redisTTLSeconds(ttl), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCRBY reply %T", replies[0])
+	}
+	if n < 0 {
+		n = 0
+	}
+	return int(n), nil
+}
+
+func (s *redisRateCounterStore) Get(key string, windowID int64) (int, error) {
+	replies, err := s.pipeline([]string{"GET", s.prefix + rateCounterWindowKey(key, windowID)})
+	if err != nil {
+		return 0, err
+	}
+	raw, _ := replies[0].(string)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("redis: invalid counter value %q", raw)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
+// UpdateTokenBucket uses WATCH/MULTI/EXEC as a compare-and-swap so that no
+// server-side scripting is required.
+func (s *redisRateCounterStore) UpdateTokenBucket(key string, ttl time.Duration, apply func(prev tokenBucketState, found bool) tokenBucketState) (tokenBucketState, error) {
+	redisKey := s.prefix + "tb:" + key
+	ttlMS := strconv.FormatInt(ttl.Milliseconds(), 10)
+	if ttl < time.Millisecond {
+		ttlMS = "1"
+	}
+
+	c, err := s.get()
+	if err != nil {
+		return tokenBucketState{}, err
+	}
+	for attempt := 0; attempt < redisMaxCASAttempts; attempt++ {
+		replies, err := c.pipeline(s.timeout, []string{"WATCH", redisKey}, []string{"GET", redisKey})
+		if err != nil {
+			_ = c.conn.Close()
+			return tokenBucketState{}, err
+		}
+
+		raw, _ := replies[1].(string)
+		prev, found := parseRedisTokenBucket(raw)
+		next := apply(prev, found)
+		value := strconv.FormatFloat(next.Tokens, 'f', -1, 64) + "|" + strconv.FormatInt(next.Updated.UnixNano(), 10)
+
+		replies, err = c.pipeline(s.timeout,
+			[]string{"MULTI"},
+			[]string{"SET", redisKey, value, "PX", ttlMS},
+			[]string{"EXEC"},
+		)
+		if err != nil {
+			_ = c.conn.Close()
+			return tokenBucketState{}, err
+		}
+		if replies[2] != nil {
+			s.put(c)
+			return next, nil
+		}
+	}
+	s.put(c)
+	return tokenBucketState{}, fmt.Errorf("redis: token bucket update lost %d races", redisMaxCASAttempts)
+}
+
+// Top walks the key space under the prefix with SCAN, so it stays cheap for
+// the server but may miss keys beyond redisMaxScanKeys.
+func (s *redisRateCounterStore) Top(limit int, _ time.Time) ([]rateCounterEntry, []rateBucketEntry, error) {
+	pattern := redisGlobEscape(s.prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		replies, err := s.pipeline([]string{"SCAN", cursor, "MATCH", pattern, "COUNT", "500"})
+		if err != nil {
+			return nil, nil, err
+		}
+		page, _ := replies[0].([]any)
+		if len(page) != 2 {
+			return nil, nil, fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		cursor, _ = page[0].(string)
+		batch, _ := page[1].([]any)
+		for _, k := range batch {
+			if ks, ok := k.(string); ok {
+				keys = append(keys, ks)
+			}
+		}
+		if cursor == "0" || cursor == "" || len(keys) >= redisMaxScanKeys {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+
+	cmds := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		cmds = append(cmds, []string{"GET", k})
+	}
+	values, err := s.pipeline(cmds...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		counters []rateCounterEntry
+		buckets  []rateBucketEntry
+	)
+	for i, k := range keys {
+		raw, _ := values[i].(string)
+		if raw == "" {
+			continue
+		}
+		name := strings.TrimPrefix(k, s.prefix)
+		if strings.HasPrefix(name, "tb:") {
+			if st, ok := parseRedisTokenBucket(raw); ok {
+				buckets = append(buckets, rateBucketEntry{Key: strings.TrimPrefix(name, "tb:"), Tokens: st.Tokens, UpdatedAt: st.Updated})
+			}
+			continue
+		}
+		key, windowID, ok := splitRateCounterWindowKey(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			continue
+		}
+		counters = append(counters, rateCounterEntry{Key: key, WindowID: windowID, Count: n})
+	}
+
+	counters, buckets = sortRateCounterSnapshot(counters, buckets, limit)
+	return counters, buckets, nil
+}
+
+func redisGlobEscape(v string) string {
+	var b strings.Builder
+	for _, r := range v {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func parseRedisTokenBucket(raw string) (tokenBucketState, bool) {
+	tokensRaw, updatedRaw, ok := strings.Cut(raw, "|")
+	if !ok {
+		return tokenBucketState{}, false
+	}
+	tokens, err := strconv.ParseFloat(tokensRaw, 64)
+	if err != nil {
+		return tokenBucketState{}, false
+	}
+	updatedNS, err := strconv.ParseInt(updatedRaw, 10, 64)
+	if err != nil {
+		return tokenBucketState{}, false
+	}
+	return tokenBucketState{Tokens: tokens, Updated: time.Unix(0, updatedNS).UTC()}, true
+}
+
+func redisTTLSeconds(ttl time.Duration) int64 {
+	sec := int64(ttl / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+func (s *redisRateCounterStore) pipeline(cmds ...[]string) ([]any, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.pipeline(s.timeout, cmds...)
+	if err != nil {
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			s.put(c)
+		} else {
+			_ = c.conn.Close()
+		}
+		return nil, err
+	}
+	s.put(c)
+	return replies, nil
+}
+
+// Reset is a no-op for the same reason as dbRateCounterStore.Reset.
+func (s *redisRateCounterStore) Reset() {}
+
+func (s *redisRateCounterStore) Close() error {
+	s.mu.Lock()
+	idle := s.idle
+	s.idle = nil
+	s.mu.Unlock()
+	for _, c := range idle {
+		_ = c.conn.Close()
+	}
+	return nil
+}
+
+func (s *redisRateCounterStore) get() (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if s.password != "" {
+		if _, err := c.do(s.timeout, "AUTH", s.password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if s.db > 0 {
+		if _, err := c.do(s.timeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *redisRateCounterStore) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= redisMaxIdleConns {
+		_ = c.conn.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	replies, err := c.pipeline(timeout, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (c *redisConn) pipeline(timeout time.Duration, cmds ...[]string) ([]any, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	var b strings.Builder
+	for _, args := range cmds {
+		b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, a := range args {
+			b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+		}
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	out := make([]any, 0, len(cmds))
+	var firstErr error
+	for range cmds {
+		v, err := readRESPValue(c.rd)
+		if err != nil {
+			var rerr redisError
+			if !errors.As(err, &rerr) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		out = append(out, v)
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return out, nil
+}
+
+func readRESPValue(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readRESPValue(rd)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
@@ -0,0 +1,542 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateCounterStore_ResetsOnNewWindow(t *testing.T) {
+	s := newMemoryRateCounterStore()
+	now := time.Unix(1_700_000_000, 0).UTC()
+
+	for i := 1; i <= 3; i++ {
+		n, err := s.Add("k", 10, 1, time.Minute, now)
+		if err != nil {
+			t.Fatalf("increment: %v", err)
+		}
+		if n != i {
+			t.Fatalf("count=%d want=%d", n, i)
+		}
+	}
+	n, _ := s.Add("k", 11, 1, time.Minute, now)
+	if n != 1 {
+		t.Fatalf("count after window change=%d want=1", n)
+	}
+	if n, _ := s.Get("k", 10); n != 3 {
+		t.Fatalf("previous window count=%d want=3", n)
+	}
+}
+
+func TestDBRateCounterStore_SharedAcrossReplicas(t *testing.T) {
+	tmp := t.TempDir()
+	if err := InitLogsStatsStoreWithBackend("db", "sqlite", filepath.Join(tmp, "mamotama.db"), "", 30); err != nil {
+		t.Fatalf("init sqlite store: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = InitLogsStatsStoreWithBackend("file", "", "", "", 0)
+	})
+
+	replicaA := &dbRateCounterStore{}
+	replicaB := &dbRateCounterStore{}
+	now := time.Unix(1_700_000_000, 0).UTC()
+
+	if n, err := replicaA.Add("default|10.0.0.1", 5, 1, time.Minute, now); err != nil || n != 1 {
+		t.Fatalf("replicaA first increment n=%d err=%v", n, err)
+	}
+	if n, err := replicaB.Add("default|10.0.0.1", 5, 1, time.Minute, now); err != nil || n != 2 {
+		t.Fatalf("replicaB should see shared count n=%d err=%v", n, err)
+	}
+	if n, err := replicaB.Add("default|10.0.0.1", 6, 1, time.Minute, now); err != nil || n != 1 {
+		t.Fatalf("next window should start fresh n=%d err=%v", n, err)
+	}
+
+	if n, err := replicaA.Add("default|10.0.0.1", 5, -1, time.Minute, now); err != nil || n != 1 {
+		t.Fatalf("decrement n=%d err=%v", n, err)
+	}
+	if n, err := replicaA.Get("default|10.0.0.1", 5); err != nil || n != 1 {
+		t.Fatalf("get n=%d err=%v", n, err)
+	}
+
+	take := func(prev tokenBucketState, found bool) tokenBucketState {
+		if !found {
+			return tokenBucketState{Tokens: 4, Updated: now}
+		}
+		return tokenBucketState{Tokens: prev.Tokens - 1, Updated: now}
+	}
+	if _, err := replicaA.UpdateTokenBucket("tb|10.0.0.1", time.Minute, take); err != nil {
+		t.Fatalf("replicaA bucket update: %v", err)
+	}
+	st, err := replicaB.UpdateTokenBucket("tb|10.0.0.1", time.Minute, take)
+	if err != nil || st.Tokens != 3 || !st.Updated.Equal(now) {
+		t.Fatalf("replicaB should see shared bucket state=%+v err=%v", st, err)
+	}
+
+	counters, buckets, err := replicaB.Top(10, now)
+	if err != nil {
+		t.Fatalf("top: %v", err)
+	}
+	if len(counters) != 2 || counters[0].Key != "default|10.0.0.1" || counters[0].Count != 1 {
+		t.Fatalf("top counters=%+v", counters)
+	}
+	if len(buckets) != 1 || buckets[0].Key != "tb|10.0.0.1" || buckets[0].Tokens != 3 {
+		t.Fatalf("top buckets=%+v", buckets)
+	}
+	if counters, _, _ := replicaB.Top(10, now.Add(2*time.Minute)); len(counters) != 0 {
+		t.Fatalf("expired counters should be hidden: %+v", counters)
+	}
+
+	longKey := strings.Repeat("x", maxDBRateCounterKeyBytes+1)
+	if n, err := replicaA.Add(longKey, 5, 1, time.Minute, now); err != nil || n != 1 {
+		t.Fatalf("long key increment n=%d err=%v", n, err)
+	}
+}
+
+func TestDBRateCounterStore_DoesNotWaitForStoreLock(t *testing.T) {
+	tmp := t.TempDir()
+	if err := InitLogsStatsStoreWithBackend("db", "sqlite", filepath.Join(tmp, "mamotama.db"), "", 30); err != nil {
+		t.Fatalf("init sqlite store: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = InitLogsStatsStoreWithBackend("file", "", "", "", 0)
+	})
+	store := getLogsStatsStore()
+
+	// Hold the store lock and an open cursor, as a download streaming to a
+	// slow client does.
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	rows, err := store.db.Query(`SELECT raw_json FROM waf_events`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+
+	counter := &dbRateCounterStore{}
+	now := time.Unix(1_700_000_000, 0).UTC()
+	done := make(chan error, 1)
+	go func() {
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					if _, err := counter.Add("default|10.0.0.1", 5, 1, time.Minute, now); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			done <- err
+			return
+		}
+		_, err := counter.UpdateTokenBucket("tb|10.0.0.1", time.Minute, func(prev tokenBucketState, found bool) tokenBucketState {
+			return tokenBucketState{Tokens: 1, Updated: now}
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("counter call: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("counter calls blocked on the store lock")
+	}
+	if n, err := counter.Get("default|10.0.0.1", 5); err != nil || n != 200 {
+		t.Fatalf("concurrent increments n=%d err=%v want 200", n, err)
+	}
+}
+
+func TestRedisRateCounterStore_EnforcesGlobalBudget(t *testing.T) {
+	srv := startFakeRedisForTest(t, "s3cret")
+
+	replicaA, err := newRedisRateCounterStore(srv.addr, "s3cret", 2, "test:rl:", time.Second)
+	if err != nil {
+		t.Fatalf("replicaA: %v", err)
+	}
+	defer replicaA.Close()
+	replicaB, err := newRedisRateCounterStore(srv.addr, "s3cret", 2, "test:rl:", time.Second)
+	if err != nil {
+		t.Fatalf("replicaB: %v", err)
+	}
+	defer replicaB.Close()
+
+	rt, err := ValidateRateLimitRaw(rateLimitRawForTest(3))
+	if err != nil {
+		t.Fatalf("ValidateRateLimitRaw() unexpected error: %v", err)
+	}
+	restore := saveRateLimitStateForTest()
+	defer restore()
+	rateLimitMu.Lock()
+	rateLimitRuntime = rt
+	rateLimitMu.Unlock()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	replicas := []rateLimitCounterStore{replicaA, replicaB, replicaA, replicaB}
+	var last rateLimitDecision
+	for i, store := range replicas {
+		setRateCounterStoreForTest(store)
+		last = EvaluateRateLimit(httptest.NewRequest("GET", "/items", nil), "10.0.0.1", "JP", now)
+		if i < 3 && !last.Allowed {
+			t.Fatalf("request %d should be allowed: %+v", i+1, last)
+		}
+	}
+	if last.Allowed {
+		t.Fatalf("fourth request across replicas should be blocked: %+v", last)
+	}
+
+	key := "test:rl:default|10.0.0.1:" + strconv.FormatInt(now.Unix()/60, 10)
+	if got := srv.value(2, key); got != "4" {
+		t.Fatalf("redis counter=%q want=4", got)
+	}
+	if ttl := srv.ttl(2, key); ttl != 60 {
+		t.Fatalf("redis ttl=%d want=60", ttl)
+	}
+}
+
+func TestRedisRateCounterStore_TokenBucketSharedAcrossReplicas(t *testing.T) {
+	srv := startFakeRedisForTest(t, "")
+
+	replicaA, err := newRedisRateCounterStore(srv.addr, "", 0, "test:rl:", time.Second)
+	if err != nil {
+		t.Fatalf("replicaA: %v", err)
+	}
+	defer replicaA.Close()
+	replicaB, err := newRedisRateCounterStore(srv.addr, "", 0, "test:rl:", time.Second)
+	if err != nil {
+		t.Fatalf("replicaB: %v", err)
+	}
+	defer replicaB.Close()
+
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 60, "window_seconds": 60, "burst": 2, "algorithm": "token_bucket", "action": {"status": 429, "retry_after_seconds": 0}}`)
+	defer restore()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	replicas := []rateLimitCounterStore{replicaA, replicaB, replicaA}
+	var last rateLimitDecision
+	for i, store := range replicas {
+		setRateCounterStoreForTest(store)
+		last = EvaluateRateLimit(httptest.NewRequest("GET", "/items", nil), "10.0.0.1", "JP", now)
+		if i < 2 && !last.Allowed {
+			t.Fatalf("request %d should be allowed: %+v", i+1, last)
+		}
+	}
+	if last.Allowed || last.RetryAfterSeconds != 1 {
+		t.Fatalf("third request across replicas should be blocked with retry=1: %+v", last)
+	}
+	if got := srv.value(0, "test:rl:tb:default|10.0.0.1"); !strings.HasPrefix(got, "0|") {
+		t.Fatalf("redis bucket=%q want empty bucket", got)
+	}
+
+	if _, err := replicaA.Add("default|10.0.0.9", 7, 5, time.Minute, now); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	counters, buckets, err := replicaB.Top(10, now)
+	if err != nil {
+		t.Fatalf("top: %v", err)
+	}
+	if len(counters) != 1 || counters[0].Key != "default|10.0.0.9" || counters[0].WindowID != 7 || counters[0].Count != 5 {
+		t.Fatalf("top counters=%+v", counters)
+	}
+	if len(buckets) != 1 || buckets[0].Key != "default|10.0.0.1" || buckets[0].Tokens != 0 {
+		t.Fatalf("top buckets=%+v", buckets)
+	}
+}
+
+func TestRedisRateCounterStore_TokenBucketRetriesOnConflict(t *testing.T) {
+	srv := startFakeRedisForTest(t, "")
+	store, err := newRedisRateCounterStore(srv.addr, "", 0, "test:", time.Second)
+	if err != nil {
+		t.Fatalf("new redis store: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	calls := 0
+	st, err := store.UpdateTokenBucket("k", time.Minute, func(prev tokenBucketState, found bool) tokenBucketState {
+		calls++
+		if calls == 1 {
+			// Another replica writes between WATCH and EXEC.
+			srv.set(0, "test:tb:k", "5|"+strconv.FormatInt(now.UnixNano(), 10))
+			return tokenBucketState{Tokens: 9, Updated: now}
+		}
+		if !found || prev.Tokens != 5 {
+			t.Fatalf("retry should observe concurrent write: prev=%+v found=%v", prev, found)
+		}
+		return tokenBucketState{Tokens: prev.Tokens - 1, Updated: now}
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if calls != 2 || st.Tokens != 4 {
+		t.Fatalf("calls=%d tokens=%v want=2/4", calls, st.Tokens)
+	}
+}
+
+func TestRedisRateCounterStore_RejectsBadAuth(t *testing.T) {
+	srv := startFakeRedisForTest(t, "s3cret")
+	if _, err := newRedisRateCounterStore(srv.addr, "wrong", 0, "test:", time.Second); err == nil {
+		t.Fatal("expected auth error")
+	}
+}
+
+func TestRateCounterAdd_FallsBackWhenBackendDown(t *testing.T) {
+	srv := startFakeRedisForTest(t, "")
+	store, err := newRedisRateCounterStore(srv.addr, "", 0, "test:", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new redis store: %v", err)
+	}
+	restore := setRateCounterStoreForTest(store)
+	defer restore()
+	rateCounterFallback.Reset()
+	defer rateCounterFallback.Reset()
+
+	srv.close()
+	_ = store.Close()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	if n := rateCounterAdd("k", 1, 1, time.Minute, now); n != 1 {
+		t.Fatalf("fallback count=%d want=1", n)
+	}
+	if n := rateCounterAdd("k", 1, 1, time.Minute, now); n != 2 {
+		t.Fatalf("fallback count=%d want=2", n)
+	}
+}
+
+// fakeRedis is a minimal RESP2 stand-in covering the commands the rate
+// limiter issues.
+type fakeRedis struct {
+	addr     string
+	password string
+	ln       net.Listener
+
+	mu       sync.Mutex
+	data     map[int]map[string]string
+	ttls     map[int]map[string]int64
+	versions map[string]int64
+}
+
+// fakeRedisSession carries per-connection state such as WATCH and MULTI.
+type fakeRedisSession struct {
+	authed  bool
+	db      int
+	watched map[string]int64
+	queued  [][]string
+	inMulti bool
+}
+
+func startFakeRedisForTest(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &fakeRedis{
+		addr:     ln.Addr().String(),
+		password: password,
+		ln:       ln,
+		data:     map[int]map[string]string{},
+		ttls:     map[int]map[string]int64{},
+		versions: map[string]int64{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(srv.close)
+	return srv
+}
+
+func (s *fakeRedis) close() {
+	_ = s.ln.Close()
+}
+
+func (s *fakeRedis) value(db int, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[db][key]
+}
+
+func (s *fakeRedis) set(db int, key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(db, key, value)
+}
+
+func (s *fakeRedis) writeLocked(db int, key, value string) {
+	if s.data[db] == nil {
+		s.data[db] = map[string]string{}
+		s.ttls[db] = map[string]int64{}
+	}
+	s.data[db][key] = value
+	s.versions[strconv.Itoa(db)+"/"+key]++
+}
+
+func (s *fakeRedis) ttl(db int, key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[db][key]
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	sess := &fakeRedisSession{authed: s.password == ""}
+	for {
+		v, err := readRESPValue(rd)
+		if err != nil {
+			return
+		}
+		items, _ := v.([]any)
+		args := make([]string, 0, len(items))
+		for _, it := range items {
+			str, _ := it.(string)
+			args = append(args, str)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if !sess.authed && cmd != "AUTH" {
+			_, _ = conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		_, _ = conn.Write([]byte(s.handle(sess, cmd, args[1:])))
+	}
+}
+
+func (s *fakeRedis) handle(sess *fakeRedisSession, cmd string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "MULTI":
+		sess.inMulti = true
+		sess.queued = nil
+		return "+OK\r\n"
+	case "EXEC":
+		conflict := false
+		for k, ver := range sess.watched {
+			if s.versions[k] != ver {
+				conflict = true
+			}
+		}
+		queued := sess.queued
+		sess.inMulti, sess.queued, sess.watched = false, nil, nil
+		if conflict {
+			return "*-1\r\n"
+		}
+		out := "*" + strconv.Itoa(len(queued)) + "\r\n"
+		for _, q := range queued {
+			out += s.exec(strings.ToUpper(q[0]), q[1:], sess)
+		}
+		return out
+	case "WATCH":
+		if sess.watched == nil {
+			sess.watched = map[string]int64{}
+		}
+		for _, k := range args {
+			vk := strconv.Itoa(sess.db) + "/" + k
+			sess.watched[vk] = s.versions[vk]
+		}
+		return "+OK\r\n"
+	}
+	if sess.inMulti {
+		sess.queued = append(sess.queued, append([]string{cmd}, args...))
+		return "+QUEUED\r\n"
+	}
+	return s.exec(cmd, args, sess)
+}
+
+func (s *fakeRedis) exec(cmd string, args []string, sess *fakeRedisSession) string {
+	db := sess.db
+	if s.data[db] == nil {
+		s.data[db] = map[string]string{}
+		s.ttls[db] = map[string]int64{}
+	}
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH":
+		if len(args) != 1 || args[0] != s.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		sess.authed = true
+		return "+OK\r\n"
+	case "SELECT":
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "-ERR invalid DB index\r\n"
+		}
+		sess.db = n
+		return "+OK\r\n"
+	case "INCRBY":
+		n, _ := strconv.ParseInt(s.data[db][args[0]], 10, 64)
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		n += delta
+		s.writeLocked(db, args[0], strconv.FormatInt(n, 10))
+		return ":" + strconv.FormatInt(n, 10) + "\r\n"
+	case "GET":
+		v, ok := s.data[db][args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+	case "SET":
+		s.writeLocked(db, args[0], args[1])
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.ParseInt(args[3], 10, 64)
+			s.ttls[db][args[0]] = (ms + 999) / 1000
+		}
+		return "+OK\r\n"
+	case "SCAN":
+		// Single-page SCAN; only trailing-"*" MATCH patterns are supported.
+		prefix := ""
+		if len(args) >= 3 && strings.EqualFold(args[1], "MATCH") {
+			prefix = strings.ReplaceAll(strings.TrimSuffix(args[2], "*"), "\\", "")
+		}
+		keys := make([]string, 0, len(s.data[db]))
+		for k := range s.data[db] {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		out := "*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, k := range keys {
+			out += "$" + strconv.Itoa(len(k)) + "\r\n" + k + "\r\n"
+		}
+		return out
+	case "EXPIRE":
+		sec, _ := strconv.ParseInt(args[1], 10, 64)
+		if _, ok := s.data[db][args[0]]; !ok {
+			return ":0\r\n"
+		}
+		s.ttls[db][args[0]] = sec
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command '" + cmd + "'\r\n"
+	}
+}
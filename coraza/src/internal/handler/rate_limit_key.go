@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	rateLimitKeyPartIP      = "ip"
+	rateLimitKeyPartCountry = "country"
+	rateLimitKeyPartPath    = "path"
+	rateLimitKeyPartMethod  = "method"
+	rateLimitKeyPartHost    = "host"
+	rateLimitKeyPartHeader  = "header"
+	rateLimitKeyPartCookie  = "cookie"
+	rateLimitKeyPartQuery   = "query"
+	rateLimitKeyPartAPIKey  = "api_key"
+	rateLimitKeyPartJWTSub  = "jwt_sub"
+
+	rateLimitAPIKeyHeader = "X-API-Key"
+)
+
+// rateLimitKeyPart is one term of a key_by expression such as
+// "ip+path" or "header:X-Tenant-ID".
+type rateLimitKeyPart struct {
+	Kind string
+	Name string
+}
+
+// parseRateLimitKeyExpr compiles a key_by expression. Terms are joined with
+// "+"; header, cookie and query terms take a name after ":". The legacy
+// "ip_country" value is accepted as an alias of "ip+country".
+func parseRateLimitKeyExpr(expr string) ([]rateLimitKeyPart, string, error) {
+	v := strings.TrimSpace(expr)
+	if v == "" {
+		v = rateLimitKeyByIP
+	}
+	if strings.EqualFold(v, rateLimitKeyByIPCountry) {
+		v = rateLimitKeyPartIP + "+" + rateLimitKeyPartCountry
+	}
+
+	terms := strings.Split(v, "+")
+	parts := make([]rateLimitKeyPart, 0, len(terms))
+	canonical := make([]string, 0, len(terms))
+	seen := map[rateLimitKeyPart]struct{}{}
+	for _, term := range terms {
+		kind, name, hasName := strings.Cut(strings.TrimSpace(term), ":")
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		name = strings.TrimSpace(name)
+
+		switch kind {
+		case rateLimitKeyPartIP, rateLimitKeyPartCountry, rateLimitKeyPartPath, rateLimitKeyPartMethod,
+			rateLimitKeyPartHost, rateLimitKeyPartAPIKey, rateLimitKeyPartJWTSub:
+			if hasName {
+				return nil, "", fmt.Errorf("key term %q does not take a name", kind)
+			}
+		case rateLimitKeyPartHeader, rateLimitKeyPartCookie, rateLimitKeyPartQuery:
+			if name == "" {
+				return nil, "", fmt.Errorf("key term %q requires a name (e.g. %s:X-Tenant-ID)", kind, kind)
+			}
+			if kind == rateLimitKeyPartHeader {
+				name = http.CanonicalHeaderKey(name)
+			}
+		case "":
+			return nil, "", fmt.Errorf("empty key term in %q", expr)
+		default:
+			return nil, "", fmt.Errorf("unknown key term %q", kind)
+		}
+
+		part := rateLimitKeyPart{Kind: kind, Name: name}
+		if _, ok := seen[part]; ok {
+			continue
+		}
+		seen[part] = struct{}{}
+		parts = append(parts, part)
+		if part.Name != "" {
+			canonical = append(canonical, part.Kind+":"+part.Name)
+		} else {
+			canonical = append(canonical, part.Kind)
+		}
+	}
+
+	return parts, strings.Join(canonical, "+"), nil
+}
+
+// buildRateLimitKey resolves each term against the request and joins them
+// with "|". Client-supplied credentials are hashed so that counter keys and
+// rl_key_hash never carry raw tokens. When no term resolves (for example an
+// anonymous request against an API key policy) the client IP is used so the
+// request is still limited.
+func buildRateLimitKey(parts []rateLimitKeyPart, r *http.Request, ip, country string) string {
+	values := make([]string, 0, len(parts))
+	resolved := false
+	for _, part := range parts {
+		v := rateLimitKeyPartValue(part, r, ip, country)
+		if v == "" {
+			values = append(values, "-")
+			continue
+		}
+		resolved = true
+		values = append(values, v)
+	}
+	if !resolved {
+		return ip
+	}
+	return strings.Join(values, "|")
+}
+
+func rateLimitKeyPartValue(part rateLimitKeyPart, r *http.Request, ip, country string) string {
+	switch part.Kind {
+	case rateLimitKeyPartIP:
+		return ip
+	case rateLimitKeyPartCountry:
+		return country
+	}
+	if r == nil {
+		return ""
+	}
+
+	switch part.Kind {
+	case rateLimitKeyPartPath:
+		if r.URL == nil {
+			return ""
+		}
+		return r.URL.Path
+	case rateLimitKeyPartMethod:
+		return strings.ToUpper(r.Method)
+	case rateLimitKeyPartHost:
+		return strings.ToLower(r.Host)
+	case rateLimitKeyPartHeader:
+		return hashRateLimitKeyValue("header", strings.TrimSpace(r.Header.Get(part.Name)))
+	case rateLimitKeyPartCookie:
+		ck, err := r.Cookie(part.Name)
+		if err != nil {
+			return ""
+		}
+		return hashRateLimitKeyValue("cookie", strings.TrimSpace(ck.Value))
+	case rateLimitKeyPartQuery:
+		if r.URL == nil {
+			return ""
+		}
+		return hashRateLimitKeyValue("query", strings.TrimSpace(r.URL.Query().Get(part.Name)))
+	case rateLimitKeyPartAPIKey:
+		return hashRateLimitKeyValue("api-key", strings.TrimSpace(r.Header.Get(rateLimitAPIKeyHeader)))
+	case rateLimitKeyPartJWTSub:
+		return hashRateLimitKeyValue("jwt-sub", bearerJWTSubject(r.Header.Get("Authorization")))
+	default:
+		return ""
+	}
+}
+
+func hashRateLimitKeyValue(label, v string) string {
+	if v == "" {
+		return ""
+	}
+	return label + ":sha256:" + shortSHA256Hex(v)
+}
+
+// shortSHA256Hex is the truncated digest used wherever a client secret needs
+// a stable, non-reversible identifier in logs.
+func shortSHA256Hex(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return fmt.Sprintf("%x", sum[:6])
+}
+
+// bearerJWTSubject extracts the "sub" claim from a bearer JWT. The signature
+// is not verified here, so a client can mint new subjects to get fresh
+// budgets; combine with "ip" unless the token is checked in front of us.
+func bearerJWTSubject(authorization string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	segments := strings.Split(strings.TrimSpace(token), ".")
+	if len(segments) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Sub any `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch sub := claims.Sub.(type) {
+	case string:
+		return strings.TrimSpace(sub)
+	case float64:
+		return fmt.Sprintf("%.0f", sub)
+	default:
+		return ""
+	}
+}
@@ -160,6 +160,69 @@ func PutRateLimitRules(c *gin.Context) {
 	})
 }
 
+const (
+	defaultRateLimitCountersTop = 50
+	maxRateLimitCountersTop     = 500
+)
+
+type rateLimitCounterView struct {
+	PolicyID string `json:"policy_id"`
+	Key      string `json:"key"`
+	WindowID int64  `json:"window_id"`
+	Count    int    `json:"count"`
+}
+
+type rateLimitBucketView struct {
+	PolicyID  string    `json:"policy_id"`
+	Key       string    `json:"key"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetRateLimitCounters lists the busiest keys in the active counter store so
+// operators can see who is close to being throttled.
+func GetRateLimitCounters(c *gin.Context) {
+	limit := clampInt(mustAtoiDefault(c.Query("limit"), defaultRateLimitCountersTop), 1, maxRateLimitCountersTop)
+	store := currentRateCounterStore()
+	counters, buckets, err := store.Top(limit, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   err.Error(),
+			"backend": store.Name(),
+		})
+		return
+	}
+
+	counterViews := make([]rateLimitCounterView, 0, len(counters))
+	for _, e := range counters {
+		policyID, key := splitRateLimitCounterKey(e.Key)
+		counterViews = append(counterViews, rateLimitCounterView{PolicyID: policyID, Key: key, WindowID: e.WindowID, Count: e.Count})
+	}
+	bucketViews := make([]rateLimitBucketView, 0, len(buckets))
+	for _, e := range buckets {
+		policyID, key := splitRateLimitCounterKey(e.Key)
+		bucketViews = append(bucketViews, rateLimitBucketView{PolicyID: policyID, Key: key, Tokens: e.Tokens, UpdatedAt: e.UpdatedAt})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"backend":  store.Name(),
+		"limit":    limit,
+		"counters": counterViews,
+		"buckets":  bucketViews,
+	})
+}
+
+// splitRateLimitCounterKey separates the policy ID that EvaluateRateLimit
+// prepends to every counter key. Keys the db backend had to hash keep no
+// policy ID.
+func splitRateLimitCounterKey(counterKey string) (string, string) {
+	policyID, key, ok := strings.Cut(counterKey, "|")
+	if !ok {
+		return "", counterKey
+	}
+	return policyID, key
+}
+
 func SyncRateLimitStorage() error {
 	return syncConfigBlobFilePath(configBlobSyncOptions{
 		ConfigKey: rateLimitConfigBlobKey,
@@ -3,20 +3,28 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"mamotama/internal/metrics"
 )
 
 const (
 	rateLimitKeyByIP        = "ip"
-	rateLimitKeyByCountry   = "country"
 	rateLimitKeyByIPCountry = "ip_country"
+
+	rateLimitAlgorithmFixedWindow   = "fixed_window"
+	rateLimitAlgorithmSlidingWindow = "sliding_window"
+	rateLimitAlgorithmTokenBucket   = "token_bucket"
 )
 
 type rateLimitAction struct {
@@ -25,12 +33,14 @@ type rateLimitAction struct {
 }
 
 type rateLimitPolicy struct {
-	Enabled       bool            `json:"enabled"`
-	Limit         int             `json:"limit"`
-	WindowSeconds int             `json:"window_seconds"`
-	Burst         int             `json:"burst"`
-	KeyBy         string          `json:"key_by"`
-	Action        rateLimitAction `json:"action"`
+	Enabled        bool            `json:"enabled"`
+	Limit          int             `json:"limit"`
+	WindowSeconds  int             `json:"window_seconds"`
+	Burst          int             `json:"burst"`
+	Algorithm      string          `json:"algorithm,omitempty"`
+	KeyBy          string          `json:"key_by"`
+	DisableHeaders bool            `json:"disable_headers,omitempty"`
+	Action         rateLimitAction `json:"action"`
 }
 
 type rateLimitRule struct {
@@ -52,6 +62,7 @@ type rateLimitConfig struct {
 type compiledRateLimitRule struct {
 	Raw      rateLimitRule
 	Policy   rateLimitPolicy
+	KeyParts []rateLimitKeyPart
 	Methods  map[string]struct{}
 	Regex    *regexp.Regexp
 	PolicyID string
@@ -63,12 +74,10 @@ type runtimeRateLimitConfig struct {
 	AllowCountries    map[string]struct{}
 	Rules             []compiledRateLimitRule
 	DefaultPolicy     rateLimitPolicy
-}
-
-type rateCounter struct {
-	WindowID int64
-	Count    int
-	Updated  time.Time
+	DefaultKeyParts   []rateLimitKeyPart
+	// PolicyScope prefixes policy IDs, and so counter keys, for runtimes
+	// that belong to a route override.
+	PolicyScope string
 }
 
 type rateLimitDecision struct {
@@ -79,16 +88,16 @@ type rateLimitDecision struct {
 	Key               string
 	Limit             int
 	WindowSeconds     int
+	Algorithm         string
+	Remaining         int
+	ResetSeconds      int
+	EmitQuotaHeaders  bool
 }
 
 var (
 	rateLimitMu      sync.RWMutex
 	rateLimitPath    string
 	rateLimitRuntime *runtimeRateLimitConfig
-
-	rateCounterMu    sync.Mutex
-	rateCounters     = map[string]rateCounter{}
-	rateCounterSweep int
 )
 
 func InitRateLimit(path string) error {
@@ -122,7 +131,9 @@ func GetRateLimitConfig() rateLimitConfig {
 	return rateLimitRuntime.Raw
 }
 
-func ReloadRateLimit() error {
+func ReloadRateLimit() (err error) {
+	defer func() { metrics.ObserveReload("rate_limit", err) }()
+
 	path := GetRateLimitPath()
 	if path == "" {
 		return fmt.Errorf("rate limit path is empty")
@@ -142,10 +153,7 @@ func ReloadRateLimit() error {
 	rateLimitMu.Unlock()
 
 	// Start counters from clean state whenever settings are reloaded.
-	rateCounterMu.Lock()
-	rateCounters = map[string]rateCounter{}
-	rateCounterSweep = 0
-	rateCounterMu.Unlock()
+	resetRateCounters()
 
 	return nil
 }
@@ -154,8 +162,11 @@ func ValidateRateLimitRaw(raw string) (*runtimeRateLimitConfig, error) {
 	return buildRateLimitRuntimeFromRaw([]byte(raw))
 }
 
-func EvaluateRateLimit(method, path, clientIP, country string, now time.Time) rateLimitDecision {
-	rt := currentRateLimitRuntime()
+func EvaluateRateLimit(r *http.Request, clientIP, country string, now time.Time) rateLimitDecision {
+	return evaluateRateLimit(currentRateLimitRuntime(), r, clientIP, country, now)
+}
+
+func evaluateRateLimit(rt *runtimeRateLimitConfig, r *http.Request, clientIP, country string, now time.Time) rateLimitDecision {
 	if rt == nil || !rt.Raw.Enabled {
 		return rateLimitDecision{Allowed: true}
 	}
@@ -166,76 +177,201 @@ func EvaluateRateLimit(method, path, clientIP, country string, now time.Time) ra
 		return rateLimitDecision{Allowed: true}
 	}
 
-	policy, policyID := pickRateLimitPolicy(rt, method, path)
+	method, path := "", ""
+	if r != nil {
+		method = r.Method
+		if r.URL != nil {
+			path = r.URL.Path
+		}
+	}
+	policy, policyID, keyParts := pickRateLimitPolicy(rt, method, path)
 	if !policy.Enabled {
 		return rateLimitDecision{Allowed: true}
 	}
+	policyID = rt.PolicyScope + policyID
 
-	key := buildRateLimitKey(policy.KeyBy, ip, cc)
+	key := buildRateLimitKey(keyParts, r, ip, cc)
 	if key == "" {
 		return rateLimitDecision{Allowed: true}
 	}
 
-	maxHits := policy.Limit + policy.Burst
-	if maxHits <= 0 || policy.WindowSeconds <= 0 {
+	if policy.Limit <= 0 || policy.WindowSeconds <= 0 {
 		return rateLimitDecision{Allowed: true}
 	}
 
-	windowID := now.Unix() / int64(policy.WindowSeconds)
 	counterKey := policyID + "|" + key
+	var (
+		q       rateLimitQuota
+		maxHits int
+	)
+	switch policy.Algorithm {
+	case rateLimitAlgorithmSlidingWindow:
+		maxHits = policy.Limit + policy.Burst
+		q = evaluateSlidingWindow(counterKey, maxHits, policy.WindowSeconds, now)
+	case rateLimitAlgorithmTokenBucket:
+		maxHits = policy.Burst
+		q = evaluateTokenBucket(counterKey, policy, now)
+	default:
+		maxHits = policy.Limit + policy.Burst
+		q = evaluateFixedWindow(counterKey, maxHits, policy.WindowSeconds, now)
+	}
 
-	rateCounterMu.Lock()
-	rateCounterSweep++
-	c := rateCounters[counterKey]
-	if c.WindowID != windowID {
-		c.WindowID = windowID
-		c.Count = 0
+	decision := rateLimitDecision{
+		Allowed:          q.allowed,
+		PolicyID:         policyID,
+		Key:              key,
+		Limit:            maxHits,
+		WindowSeconds:    policy.WindowSeconds,
+		Algorithm:        policy.Algorithm,
+		Remaining:        q.remaining,
+		ResetSeconds:     q.reset,
+		EmitQuotaHeaders: !policy.DisableHeaders,
+	}
+	if q.allowed {
+		return decision
 	}
 
-	allowed := c.Count < maxHits
-	if allowed {
-		c.Count++
+	retryAfter := q.retryAfter
+	if policy.Action.RetryAfterSeconds > 0 {
+		retryAfter = policy.Action.RetryAfterSeconds
+	}
+	if retryAfter < 1 {
+		retryAfter = 1
 	}
-	c.Updated = now
-	rateCounters[counterKey] = c
 
-	if rateCounterSweep%1000 == 0 {
-		cleanupBefore := now.Add(-10 * time.Minute)
-		for k, v := range rateCounters {
-			if v.Updated.Before(cleanupBefore) {
-				delete(rateCounters, k)
-			}
-		}
+	status := policy.Action.Status
+	if status == 0 {
+		status = 429
 	}
-	rateCounterMu.Unlock()
 
-	if allowed {
-		return rateLimitDecision{Allowed: true}
+	decision.Status = status
+	decision.RetryAfterSeconds = retryAfter
+	decision.Remaining = 0
+	if decision.ResetSeconds < retryAfter {
+		decision.ResetSeconds = retryAfter
+	}
+	return decision
+}
+
+// setRateLimitHeaders writes the RateLimit-* fields from
+// draft-ietf-httpapi-ratelimit-headers so clients can pace themselves.
+func setRateLimitHeaders(h http.Header, d rateLimitDecision) {
+	if !d.EmitQuotaHeaders || d.Limit <= 0 {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(d.ResetSeconds))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.Limit, d.WindowSeconds))
+}
+
+// rateLimitQuota is one algorithm's verdict plus what is left of the budget,
+// in the units of the RateLimit-* response headers.
+type rateLimitQuota struct {
+	allowed    bool
+	retryAfter int
+	remaining  int
+	reset      int
+}
+
+// evaluateFixedWindow counts hits per aligned window; the budget resets at
+// each window boundary.
+func evaluateFixedWindow(counterKey string, maxHits, windowSeconds int, now time.Time) rateLimitQuota {
+	window := int64(windowSeconds)
+	windowID := now.Unix() / window
+	untilNext := int((windowID+1)*window - now.Unix())
+
+	count := rateCounterAdd(counterKey, windowID, 1, time.Duration(windowSeconds)*time.Second, now)
+	if count <= maxHits {
+		return rateLimitQuota{allowed: true, remaining: maxHits - count, reset: untilNext}
 	}
 
-	retryAfter := policy.Action.RetryAfterSeconds
-	if retryAfter <= 0 {
-		nextWindowUnix := (windowID + 1) * int64(policy.WindowSeconds)
-		retryAfter = int(nextWindowUnix - now.Unix())
-		if retryAfter < 1 {
-			retryAfter = 1
+	return rateLimitQuota{retryAfter: untilNext, reset: untilNext}
+}
+
+// evaluateSlidingWindow weights the previous window's count by how much of it
+// still overlaps the trailing window, which avoids the double burst a fixed
+// window allows around its boundary.
+func evaluateSlidingWindow(counterKey string, maxHits, windowSeconds int, now time.Time) rateLimitQuota {
+	window := time.Duration(windowSeconds) * time.Second
+	windowID := now.Unix() / int64(windowSeconds)
+	elapsed := now.Sub(time.Unix(windowID*int64(windowSeconds), 0))
+
+	// Keep counters for two windows so the previous one is still readable.
+	prev := rateCounterGet(counterKey, windowID-1, now)
+	curr := rateCounterAdd(counterKey, windowID, 1, 2*window, now)
+
+	w := window.Seconds()
+	e := elapsed.Seconds()
+	untilNext := int(math.Ceil(w - e))
+	if estimate := float64(prev)*(w-e)/w + float64(curr); estimate <= float64(maxHits) {
+		return rateLimitQuota{
+			allowed:   true,
+			remaining: int(math.Floor(float64(maxHits) - estimate)),
+			reset:     untilNext,
 		}
 	}
 
-	status := policy.Action.Status
-	if status == 0 {
-		status = 429
+	// Rejected requests do not consume budget, otherwise a client retrying
+	// at Retry-After would still find the window full.
+	curr = rateCounterAdd(counterKey, windowID, -1, 2*window, now)
+	retryAfter := slidingWindowRetryAfter(prev, curr, maxHits, w, e)
+	return rateLimitQuota{retryAfter: retryAfter, reset: retryAfter}
+}
+
+// slidingWindowRetryAfter returns the seconds until one more request fits
+// under maxHits, assuming no other traffic arrives meanwhile.
+func slidingWindowRetryAfter(prev, curr, maxHits int, w, e float64) int {
+	var wait float64
+	switch {
+	case prev > 0 && curr+1 <= maxHits:
+		// The previous window's weight decays enough before this one ends.
+		wait = w*(1-float64(maxHits-curr-1)/float64(prev)) - e
+	default:
+		// Wait for the next window, where the current count becomes the
+		// decaying previous one.
+		wait = w - e
+		if curr > 0 && maxHits-1 < curr {
+			wait += w * (1 - float64(maxHits-1)/float64(curr))
+		}
 	}
+	return int(math.Ceil(wait))
+}
+
+// evaluateTokenBucket lets up to burst requests through at once and refills
+// limit tokens per window_seconds.
+func evaluateTokenBucket(counterKey string, policy rateLimitPolicy, now time.Time) rateLimitQuota {
+	capacity := float64(policy.Burst)
+	rate := float64(policy.Limit) / float64(policy.WindowSeconds)
+	refillFull := time.Duration(capacity / rate * float64(time.Second))
+	ttl := time.Duration(policy.WindowSeconds)*time.Second + refillFull
+
+	var allowed bool
+	state := rateCounterUpdateBucket(counterKey, ttl, now, func(prev tokenBucketState, found bool) tokenBucketState {
+		tokens := capacity
+		if found {
+			tokens = prev.Tokens
+			if elapsed := now.Sub(prev.Updated); elapsed > 0 {
+				tokens += elapsed.Seconds() * rate
+			}
+			if tokens > capacity {
+				tokens = capacity
+			}
+		}
+		allowed = tokens >= 1
+		if allowed {
+			tokens--
+		}
+		return tokenBucketState{Tokens: tokens, Updated: now}
+	})
 
-	return rateLimitDecision{
-		Allowed:           false,
-		Status:            status,
-		RetryAfterSeconds: retryAfter,
-		PolicyID:          policyID,
-		Key:               key,
-		Limit:             maxHits,
-		WindowSeconds:     policy.WindowSeconds,
+	// The bucket is back to full capacity after this many seconds.
+	reset := int(math.Ceil((capacity - state.Tokens) / rate))
+	if allowed {
+		return rateLimitQuota{allowed: true, remaining: int(math.Floor(state.Tokens)), reset: reset}
 	}
+
+	return rateLimitQuota{retryAfter: int(math.Ceil((1 - state.Tokens) / rate)), reset: reset}
 }
 
 func currentRateLimitRuntime() *runtimeRateLimitConfig {
@@ -244,7 +380,7 @@ func currentRateLimitRuntime() *runtimeRateLimitConfig {
 	return rateLimitRuntime
 }
 
-func pickRateLimitPolicy(rt *runtimeRateLimitConfig, method, path string) (rateLimitPolicy, string) {
+func pickRateLimitPolicy(rt *runtimeRateLimitConfig, method, path string) (rateLimitPolicy, string, []rateLimitKeyPart) {
 	for _, rule := range rt.Rules {
 		if !rule.Policy.Enabled {
 			continue
@@ -256,10 +392,10 @@ func pickRateLimitPolicy(rt *runtimeRateLimitConfig, method, path string) (rateL
 			continue
 		}
 
-		return rule.Policy, rule.PolicyID
+		return rule.Policy, rule.PolicyID, rule.KeyParts
 	}
 
-	return rt.DefaultPolicy, "default"
+	return rt.DefaultPolicy, "default", rt.DefaultKeyParts
 }
 
 func matchesPathRule(rule compiledRateLimitRule, path string) bool {
@@ -283,20 +419,6 @@ func matchesMethod(methods map[string]struct{}, method string) bool {
 	return ok
 }
 
-func buildRateLimitKey(kind, ip, country string) string {
-	switch kind {
-	case rateLimitKeyByCountry:
-		return country
-	case rateLimitKeyByIPCountry:
-		if ip == "" {
-			return country
-		}
-		return ip + "|" + country
-	default:
-		return ip
-	}
-}
-
 func isAllowlistedCountry(rt *runtimeRateLimitConfig, country string) bool {
 	_, ok := rt.AllowCountries[country]
 	return ok
@@ -343,8 +465,7 @@ func buildRateLimitRuntimeFromRaw(raw []byte) (*runtimeRateLimitConfig, error) {
 			Burst:         20,
 			KeyBy:         rateLimitKeyByIP,
 			Action: rateLimitAction{
-				Status:            429,
-				RetryAfterSeconds: 60,
+				Status: 429,
 			},
 		}
 	}
@@ -353,6 +474,10 @@ func buildRateLimitRuntimeFromRaw(raw []byte) (*runtimeRateLimitConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	defaultKeyParts, _, err := parseRateLimitKeyExpr(defaultPolicy.KeyBy)
+	if err != nil {
+		return nil, err
+	}
 
 	allowCountries := map[string]struct{}{}
 	for _, c := range cfg.AllowlistCountries {
@@ -413,9 +538,15 @@ func buildRateLimitRuntimeFromRaw(raw []byte) (*runtimeRateLimitConfig, error) {
 			methods[mv] = struct{}{}
 		}
 
+		keyParts, _, err := parseRateLimitKeyExpr(policy.KeyBy)
+		if err != nil {
+			return nil, err
+		}
+
 		compiled := compiledRateLimitRule{
 			Raw:      rule,
 			Policy:   policy,
+			KeyParts: keyParts,
 			Methods:  methods,
 			PolicyID: fmt.Sprintf("rule:%d:%s", i, strings.TrimSpace(rule.Name)),
 		}
@@ -438,6 +569,7 @@ func buildRateLimitRuntimeFromRaw(raw []byte) (*runtimeRateLimitConfig, error) {
 		AllowCountries:    allowCountries,
 		Rules:             compiledRules,
 		DefaultPolicy:     defaultPolicy,
+		DefaultKeyParts:   defaultKeyParts,
 	}, nil
 }
 
@@ -455,15 +587,25 @@ func normalizeRateLimitPolicy(p rateLimitPolicy, field string) (rateLimitPolicy,
 		return p, fmt.Errorf("%s.burst must be >= 0", field)
 	}
 
-	p.KeyBy = strings.ToLower(strings.TrimSpace(p.KeyBy))
-	if p.KeyBy == "" {
-		p.KeyBy = rateLimitKeyByIP
+	p.Algorithm = strings.ToLower(strings.TrimSpace(p.Algorithm))
+	if p.Algorithm == "" {
+		p.Algorithm = rateLimitAlgorithmFixedWindow
 	}
-	switch p.KeyBy {
-	case rateLimitKeyByIP, rateLimitKeyByCountry, rateLimitKeyByIPCountry:
+	switch p.Algorithm {
+	case rateLimitAlgorithmFixedWindow, rateLimitAlgorithmSlidingWindow:
+	case rateLimitAlgorithmTokenBucket:
+		if p.Burst < 1 {
+			return p, fmt.Errorf("%s.burst must be >= 1 when algorithm=token_bucket (bucket capacity)", field)
+		}
 	default:
-		return p, fmt.Errorf("%s.key_by must be ip|country|ip_country", field)
+		return p, fmt.Errorf("%s.algorithm must be fixed_window|sliding_window|token_bucket", field)
+	}
+
+	_, keyBy, err := parseRateLimitKeyExpr(p.KeyBy)
+	if err != nil {
+		return p, fmt.Errorf("%s.key_by: %v", field, err)
 	}
+	p.KeyBy = keyBy
 
 	if p.Enabled {
 		if p.Limit <= 0 {
@@ -497,10 +639,11 @@ func ensureRateLimitFile(path string) error {
     "limit": 120,
     "window_seconds": 60,
     "burst": 20,
+    "algorithm": "fixed_window",
     "key_by": "ip",
     "action": {
       "status": 429,
-      "retry_after_seconds": 60
+      "retry_after_seconds": 0
     }
   },
   "rules": [
@@ -514,10 +657,11 @@ func ensureRateLimitFile(path string) error {
         "limit": 10,
         "window_seconds": 60,
         "burst": 0,
+        "algorithm": "sliding_window",
         "key_by": "ip",
         "action": {
           "status": 429,
-          "retry_after_seconds": 60
+          "retry_after_seconds": 0
         }
       }
     }
@@ -1,12 +1,17 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestValidateRateLimitRaw(t *testing.T) {
@@ -82,15 +87,13 @@ func TestEvaluateRateLimit_BlocksAfterLimit(t *testing.T) {
 		rateLimitMu.Unlock()
 	}()
 
-	rateCounterMu.Lock()
-	rateCounters = map[string]rateCounter{}
-	rateCounterSweep = 0
-	rateCounterMu.Unlock()
+	restoreCounters := setRateCounterStoreForTest(newMemoryRateCounterStore())
+	defer restoreCounters()
 
 	now := time.Unix(1_700_000_000, 0).UTC()
-	d1 := EvaluateRateLimit("GET", "/items", "10.0.0.1", "JP", now)
-	d2 := EvaluateRateLimit("GET", "/items", "10.0.0.1", "JP", now.Add(1*time.Second))
-	d3 := EvaluateRateLimit("GET", "/items", "10.0.0.1", "JP", now.Add(2*time.Second))
+	d1 := EvaluateRateLimit(httptest.NewRequest("GET", "/items", nil), "10.0.0.1", "JP", now)
+	d2 := EvaluateRateLimit(httptest.NewRequest("GET", "/items", nil), "10.0.0.1", "JP", now.Add(1*time.Second))
+	d3 := EvaluateRateLimit(httptest.NewRequest("GET", "/items", nil), "10.0.0.1", "JP", now.Add(2*time.Second))
 
 	if !d1.Allowed || !d2.Allowed {
 		t.Fatalf("first two requests should be allowed: d1=%+v d2=%+v", d1, d2)
@@ -103,6 +106,240 @@ func TestEvaluateRateLimit_BlocksAfterLimit(t *testing.T) {
 	}
 }
 
+func TestValidateRateLimitRaw_RejectsBadAlgorithmCombinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{
+			name:   "unknown algorithm",
+			policy: `{"enabled": true, "limit": 10, "window_seconds": 60, "algorithm": "leaky"}`,
+			want:   "algorithm must be",
+		},
+		{
+			name:   "token bucket without burst",
+			policy: `{"enabled": true, "limit": 10, "window_seconds": 60, "burst": 0, "algorithm": "token_bucket"}`,
+			want:   "burst must be >= 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateRateLimitRaw(rateLimitPolicyRawForTest(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err=%v want substring %q", err, tt.want)
+			}
+		})
+	}
+
+	rt, err := ValidateRateLimitRaw(rateLimitPolicyRawForTest(`{"enabled": true, "limit": 10, "window_seconds": 60}`))
+	if err != nil {
+		t.Fatalf("ValidateRateLimitRaw() unexpected error: %v", err)
+	}
+	if rt.DefaultPolicy.Algorithm != rateLimitAlgorithmFixedWindow {
+		t.Fatalf("default algorithm=%q want=%q", rt.DefaultPolicy.Algorithm, rateLimitAlgorithmFixedWindow)
+	}
+}
+
+func TestEvaluateRateLimit_SlidingWindowWeighsPreviousWindow(t *testing.T) {
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 10, "window_seconds": 60, "algorithm": "sliding_window", "action": {"status": 429, "retry_after_seconds": 0}}`)
+	defer restore()
+
+	// Ten hits at the end of one window leave no budget right after the
+	// boundary, unlike a fixed window which would allow ten more.
+	windowStart := time.Unix(1_700_000_040, 0).UTC()
+	for i := 0; i < 10; i++ {
+		if d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", windowStart.Add(-time.Second)); !d.Allowed {
+			t.Fatalf("request %d in previous window should be allowed: %+v", i+1, d)
+		}
+	}
+
+	d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", windowStart.Add(3*time.Second))
+	if d.Allowed {
+		t.Fatalf("request after boundary should be blocked: %+v", d)
+	}
+	if d.Algorithm != rateLimitAlgorithmSlidingWindow {
+		t.Fatalf("algorithm=%q want=%q", d.Algorithm, rateLimitAlgorithmSlidingWindow)
+	}
+	// prev weight must drop to 9/10: 60*(1-9/10) = 6s into the window.
+	if d.RetryAfterSeconds != 3 {
+		t.Fatalf("retry_after=%d want=3", d.RetryAfterSeconds)
+	}
+
+	if d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", windowStart.Add(3*time.Second+time.Duration(d.RetryAfterSeconds)*time.Second)); !d.Allowed {
+		t.Fatalf("request at Retry-After should be allowed: %+v", d)
+	}
+}
+
+func TestEvaluateRateLimit_TokenBucketHonorsBurst(t *testing.T) {
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 60, "window_seconds": 60, "burst": 3, "algorithm": "token_bucket", "action": {"status": 429, "retry_after_seconds": 0}}`)
+	defer restore()
+
+	now := time.Unix(1_700_000_000, 0).UTC()
+	for i := 0; i < 3; i++ {
+		if d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", now); !d.Allowed {
+			t.Fatalf("burst request %d should be allowed: %+v", i+1, d)
+		}
+	}
+
+	d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", now.Add(500*time.Millisecond))
+	if d.Allowed {
+		t.Fatalf("request beyond burst should be blocked: %+v", d)
+	}
+	if d.Limit != 3 || d.RetryAfterSeconds != 1 {
+		t.Fatalf("limit=%d retry_after=%d want=3/1", d.Limit, d.RetryAfterSeconds)
+	}
+
+	// One token per second refills; the rejected request did not spend one.
+	if d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", now.Add(time.Second)); !d.Allowed {
+		t.Fatalf("request after refill should be allowed: %+v", d)
+	}
+	if d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", now.Add(time.Second)); d.Allowed {
+		t.Fatalf("second request after a single refill should be blocked: %+v", d)
+	}
+}
+
+func TestEvaluateRateLimit_SeededFileComputesRetryAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limit.conf")
+	if err := ensureRateLimitFile(path); err != nil {
+		t.Fatalf("ensureRateLimitFile: %v", err)
+	}
+	seeded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read seeded file: %v", err)
+	}
+	windowStart := time.Unix(1_700_000_040, 0).UTC()
+
+	tests := []struct {
+		name   string
+		raw    string
+		method string
+		path   string
+		hits   int
+		hitAt  time.Time
+		at     time.Time
+		want   int
+	}{
+		// Default policy: 120+20 hits, then the rest of the window.
+		{"fixed_window", string(seeded), "GET", "/", 140, windowStart.Add(15 * time.Second), windowStart.Add(15 * time.Second), 45},
+		// Login rule: ten hits just before the boundary weigh 9/10 after 6s.
+		{"sliding_window", string(seeded), "POST", "/login", 10, windowStart.Add(-time.Second), windowStart.Add(3 * time.Second), 3},
+		// 120/60s refills one token every 500ms once the burst is spent.
+		{"token_bucket", strings.Replace(string(seeded), `"fixed_window"`, `"token_bucket"`, 1), "GET", "/", 20, windowStart, windowStart, 1},
+		{"override", strings.Replace(string(seeded), `"retry_after_seconds": 0`, `"retry_after_seconds": 30`, 1), "GET", "/", 140, windowStart, windowStart, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := ValidateRateLimitRaw(tt.raw)
+			if err != nil {
+				t.Fatalf("ValidateRateLimitRaw: %v", err)
+			}
+			restore := saveRateLimitStateForTest()
+			defer restore()
+			rateLimitMu.Lock()
+			rateLimitRuntime = rt
+			rateLimitMu.Unlock()
+
+			for i := 0; i < tt.hits; i++ {
+				if d := EvaluateRateLimit(httptest.NewRequest(tt.method, tt.path, nil), "10.0.0.1", "JP", tt.hitAt); !d.Allowed {
+					t.Fatalf("request %d should be allowed: %+v", i+1, d)
+				}
+			}
+			d := EvaluateRateLimit(httptest.NewRequest(tt.method, tt.path, nil), "10.0.0.1", "JP", tt.at)
+			if d.Allowed || d.RetryAfterSeconds != tt.want {
+				t.Fatalf("allowed=%v retry_after=%d want=false/%d", d.Allowed, d.RetryAfterSeconds, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateRateLimit_ReportsQuotaHeaders(t *testing.T) {
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 2, "window_seconds": 60, "burst": 1, "action": {"status": 429, "retry_after_seconds": 0}}`)
+	defer restore()
+
+	windowStart := time.Unix(1_700_000_040, 0).UTC()
+	req := httptest.NewRequest("GET", "/items", nil)
+	wantRemaining := []int{2, 1, 0}
+	for i, want := range wantRemaining {
+		d := EvaluateRateLimit(req, "10.0.0.1", "JP", windowStart.Add(15*time.Second))
+		if !d.Allowed || d.Remaining != want || d.ResetSeconds != 45 {
+			t.Fatalf("request %d: allowed=%v remaining=%d reset=%d want=true/%d/45", i+1, d.Allowed, d.Remaining, d.ResetSeconds, want)
+		}
+	}
+
+	d := EvaluateRateLimit(req, "10.0.0.1", "JP", windowStart.Add(15*time.Second))
+	if d.Allowed {
+		t.Fatalf("request beyond limit+burst should be blocked: %+v", d)
+	}
+	h := http.Header{}
+	setRateLimitHeaders(h, d)
+	want := map[string]string{
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "45",
+		"RateLimit-Policy":    "3;w=60",
+	}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Fatalf("%s=%q want=%q", k, got, v)
+		}
+	}
+}
+
+func TestEvaluateRateLimit_DisableHeadersPerPolicy(t *testing.T) {
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 5, "window_seconds": 60, "disable_headers": true}`)
+	defer restore()
+
+	d := EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), "10.0.0.1", "JP", time.Unix(1_700_000_000, 0).UTC())
+	h := http.Header{}
+	setRateLimitHeaders(h, d)
+	if len(h) != 0 {
+		t.Fatalf("headers should be suppressed: %v", h)
+	}
+}
+
+func TestGetRateLimitCounters_ListsHottestKeys(t *testing.T) {
+	restore := useRateLimitPolicyForTest(t, `{"enabled": true, "limit": 100, "window_seconds": 60}`)
+	defer restore()
+
+	now := time.Now().UTC()
+	for ip, hits := range map[string]int{"10.0.0.1": 3, "10.0.0.2": 7, "10.0.0.3": 1} {
+		for i := 0; i < hits; i++ {
+			EvaluateRateLimit(httptest.NewRequest("GET", "/", nil), ip, "JP", now)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/mamotama-api/rate-limit/counters?limit=2", nil)
+	GetRateLimitCounters(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Backend  string                 `json:"backend"`
+		Counters []rateLimitCounterView `json:"counters"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Backend != rateLimitBackendMemory {
+		t.Fatalf("backend=%q want=memory", resp.Backend)
+	}
+	if len(resp.Counters) != 2 {
+		t.Fatalf("len(counters)=%d want=2: %+v", len(resp.Counters), resp.Counters)
+	}
+	top := resp.Counters[0]
+	if top.PolicyID != "default" || top.Key != "10.0.0.2" || top.Count != 7 {
+		t.Fatalf("top counter=%+v want default/10.0.0.2/7", top)
+	}
+	if resp.Counters[1].Key != "10.0.0.1" {
+		t.Fatalf("second counter=%+v want 10.0.0.1", resp.Counters[1])
+	}
+}
+
 func TestSyncRateLimitStorage_SeedsDBFromFileWhenMissingBlob(t *testing.T) {
 	restore := saveRateLimitStateForTest()
 	defer restore()
@@ -199,26 +436,51 @@ func saveRateLimitStateForTest() func() {
 	oldPath := rateLimitPath
 	oldRuntime := rateLimitRuntime
 	rateLimitMu.RUnlock()
-
-	rateCounterMu.Lock()
-	oldCounters := make(map[string]rateCounter, len(rateCounters))
-	for k, v := range rateCounters {
-		oldCounters[k] = v
-	}
-	oldSweep := rateCounterSweep
-	rateCounterMu.Unlock()
+	restoreCounters := setRateCounterStoreForTest(newMemoryRateCounterStore())
 
 	return func() {
 		rateLimitMu.Lock()
 		rateLimitPath = oldPath
 		rateLimitRuntime = oldRuntime
 		rateLimitMu.Unlock()
+		restoreCounters()
+	}
+}
+
+func setRateCounterStoreForTest(store rateLimitCounterStore) func() {
+	rateCounterStoreMu.Lock()
+	prev := rateCounterStore
+	rateCounterStore = store
+	rateCounterStoreMu.Unlock()
 
-		rateCounterMu.Lock()
-		rateCounters = oldCounters
-		rateCounterSweep = oldSweep
-		rateCounterMu.Unlock()
+	return func() {
+		rateCounterStoreMu.Lock()
+		rateCounterStore = prev
+		rateCounterStoreMu.Unlock()
+	}
+}
+
+func useRateLimitPolicyForTest(t *testing.T, policy string) func() {
+	t.Helper()
+	rt, err := ValidateRateLimitRaw(rateLimitPolicyRawForTest(policy))
+	if err != nil {
+		t.Fatalf("ValidateRateLimitRaw() unexpected error: %v", err)
 	}
+	restore := saveRateLimitStateForTest()
+	rateLimitMu.Lock()
+	rateLimitRuntime = rt
+	rateLimitMu.Unlock()
+	return restore
+}
+
+func rateLimitPolicyRawForTest(policy string) string {
+	return fmt.Sprintf(`{
+  "enabled": true,
+  "allowlist_ips": [],
+  "allowlist_countries": [],
+  "default_policy": %s,
+  "rules": []
+}`, policy)
 }
 
 func rateLimitRawForTest(limit int) string {
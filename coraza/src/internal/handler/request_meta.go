@@ -1,25 +1,17 @@
 package handler
 
 import (
-	"strings"
-
 	"github.com/gin-gonic/gin"
 )
 
+// requestClientIP returns the client address after walking the trusted
+// proxy chain. Forwarding headers from untrusted peers are ignored.
 func requestClientIP(c *gin.Context) string {
 	if c == nil || c.Request == nil {
 		return ""
 	}
 
-	if v := strings.TrimSpace(c.GetHeader("X-Real-IP")); v != "" {
-		return v
-	}
-	if v := strings.TrimSpace(c.GetHeader("X-Forwarded-For")); v != "" {
-		if i := strings.Index(v, ","); i >= 0 {
-			return strings.TrimSpace(v[:i])
-		}
-		return v
-	}
-
-	return strings.TrimSpace(c.ClientIP())
+	ip, chain := resolveClientIP(c.Request)
+	logClientIPResolution(c.GetHeader("X-Request-ID"), c.Request, ip, chain)
+	return ip
 }
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mamotama/internal/bypassconf"
+)
+
+const responseTemplatesConfigBlobKey = "response_templates"
+
+// responseTemplateVariables documents what templates may reference; it is
+// returned by the admin API so editors do not have to guess.
+var responseTemplateVariables = []string{
+	"status",
+	"status_text",
+	"req_id",
+	"rule_id",
+	"message",
+	"title",
+	"path",
+	"country",
+	"retry_after",
+	"support_contact",
+	"challenge_script",
+}
+
+type responseTemplatesPutBody struct {
+	Raw string `json:"raw"`
+}
+
+func bindResponseTemplatesPutBody(c *gin.Context) (responseTemplatesPutBody, bool) {
+	var in responseTemplatesPutBody
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return responseTemplatesPutBody{}, false
+	}
+
+	return in, true
+}
+
+func GetResponseTemplates(c *gin.Context) {
+	path := GetResponseTemplatesPath()
+	raw, _ := os.ReadFile(path)
+	if store := getLogsStatsStore(); store != nil {
+		dbRaw, dbETag, found, err := store.GetConfigBlob(responseTemplatesConfigBlobKey)
+		if err != nil {
+			log.Printf("[RESPONSE_TEMPLATES][DB][WARN] get config blob failed: %v", err)
+		} else if found {
+			rt, parseErr := ValidateResponseTemplatesRaw(string(dbRaw))
+			if parseErr != nil {
+				log.Printf("[RESPONSE_TEMPLATES][DB][WARN] cached blob parse failed (fallback=file): %v", parseErr)
+			} else {
+				if strings.TrimSpace(dbETag) == "" {
+					dbETag = bypassconf.ComputeETag(dbRaw)
+				}
+				c.JSON(http.StatusOK, responseTemplatesResponse(gin.H{
+					"etag": dbETag,
+					"raw":  string(dbRaw),
+				}, rt))
+				return
+			}
+		} else if len(raw) > 0 {
+			if err := store.UpsertConfigBlob(responseTemplatesConfigBlobKey, raw, bypassconf.ComputeETag(raw), time.Now().UTC()); err != nil {
+				log.Printf("[RESPONSE_TEMPLATES][DB][WARN] seed config blob failed: %v", err)
+			}
+		}
+	}
+	rt := currentResponseTemplatesRuntime()
+	if rt == nil {
+		rt = builtinResponseTemplates()
+	}
+
+	c.JSON(http.StatusOK, responseTemplatesResponse(gin.H{
+		"etag": bypassconf.ComputeETag(raw),
+		"raw":  string(raw),
+	}, rt))
+}
+
+func ValidateResponseTemplates(c *gin.Context) {
+	in, ok := bindResponseTemplatesPutBody(c)
+	if !ok {
+		return
+	}
+
+	rt, err := ValidateResponseTemplatesRaw(in.Raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "messages": []string{err.Error()}})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":              true,
+		"messages":        []string{},
+		"support_contact": rt.Raw.SupportContact,
+		"customized":      rt.customizedKinds(),
+	})
+}
+
+func PutResponseTemplates(c *gin.Context) {
+	path := GetResponseTemplatesPath()
+	store := getLogsStatsStore()
+	ifMatch := c.GetHeader("If-Match")
+	curRaw, _ := os.ReadFile(path)
+	curETag := bypassconf.ComputeETag(curRaw)
+	if store != nil {
+		dbRaw, dbETag, found, err := store.GetConfigBlob(responseTemplatesConfigBlobKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if found {
+			if _, parseErr := ValidateResponseTemplatesRaw(string(dbRaw)); parseErr == nil {
+				curRaw = dbRaw
+				if strings.TrimSpace(dbETag) == "" {
+					dbETag = bypassconf.ComputeETag(dbRaw)
+				}
+				curETag = dbETag
+			} else {
+				log.Printf("[RESPONSE_TEMPLATES][DB][WARN] cached blob parse failed for conflict check (fallback=file): %v", parseErr)
+			}
+		}
+	}
+	if ifMatch != "" && ifMatch != curETag {
+		c.JSON(http.StatusConflict, gin.H{"error": "conflict", "currentETag": curETag})
+		return
+	}
+
+	in, ok := bindResponseTemplatesPutBody(c)
+	if !ok {
+		return
+	}
+
+	rt, err := ValidateResponseTemplatesRaw(in.Raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "messages": []string{err.Error()}})
+		return
+	}
+
+	if err := bypassconf.AtomicWriteWithBackup(path, []byte(in.Raw)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ReloadResponseTemplates(); err != nil {
+		_ = bypassconf.AtomicWriteWithBackup(path, curRaw)
+		_ = ReloadResponseTemplates()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	newETag := bypassconf.ComputeETag([]byte(in.Raw))
+	if store != nil {
+		if err := store.UpsertConfigBlob(responseTemplatesConfigBlobKey, []byte(in.Raw), newETag, time.Now().UTC()); err != nil {
+			_ = bypassconf.AtomicWriteWithBackup(path, curRaw)
+			_ = ReloadResponseTemplates()
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":    "response templates db sync failed and rollback applied",
+				"db_error": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":              true,
+		"etag":            newETag,
+		"support_contact": rt.Raw.SupportContact,
+		"customized":      rt.customizedKinds(),
+	})
+}
+
+func responseTemplatesResponse(out gin.H, rt *runtimeResponseTemplatesConfig) gin.H {
+	out["support_contact"] = rt.Raw.SupportContact
+	out["customized"] = rt.customizedKinds()
+	out["kinds"] = responseTemplateKinds
+	out["variables"] = responseTemplateVariables
+	out["defaults"] = defaultResponseTemplates
+	return out
+}
+
+func SyncResponseTemplatesStorage() error {
+	return syncConfigBlobFilePath(configBlobSyncOptions{
+		ConfigKey: responseTemplatesConfigBlobKey,
+		Path:      GetResponseTemplatesPath(),
+		ValidateRaw: func(raw string) error {
+			_, err := ValidateResponseTemplatesRaw(raw)
+			return err
+		},
+		Reload:           ReloadResponseTemplates,
+		SkipWriteIfEqual: true,
+	})
+}
@@ -0,0 +1,404 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"mamotama/internal/metrics"
+)
+
+const (
+	responseTemplateBlock        = "block"
+	responseTemplateRateLimit    = "rate_limit"
+	responseTemplateCountryBlock = "country_block"
+	responseTemplateChallenge    = "challenge"
+)
+
+// maxResponseTemplateBytes keeps a single template small enough to render on
+// every blocked request without thinking about it.
+const maxResponseTemplateBytes = 64 * 1024
+
+var responseTemplateKinds = []string{
+	responseTemplateBlock,
+	responseTemplateRateLimit,
+	responseTemplateCountryBlock,
+	responseTemplateChallenge,
+}
+
+type responseTemplateVariant struct {
+	HTML string `json:"html,omitempty"`
+	JSON string `json:"json,omitempty"`
+}
+
+type responseTemplatesConfig struct {
+	SupportContact string                             `json:"support_contact,omitempty"`
+	Templates      map[string]responseTemplateVariant `json:"templates,omitempty"`
+}
+
+type compiledResponseTemplate struct {
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+type runtimeResponseTemplatesConfig struct {
+	Raw       responseTemplatesConfig
+	templates map[string]compiledResponseTemplate
+}
+
+// responseTemplateVars is what a blocking layer knows about the request it
+// is refusing. Every field is exposed to every template so that a template
+// validated once renders for any kind.
+type responseTemplateVars struct {
+	Status          int
+	ReqID           string
+	RuleID          string
+	Message         string
+	Title           string
+	Path            string
+	Country         string
+	RetryAfter      int
+	ChallengeScript string
+}
+
+var (
+	responseTemplatesMu      sync.RWMutex
+	responseTemplatesPath    string
+	responseTemplatesRuntime *runtimeResponseTemplatesConfig
+)
+
+var defaultResponseTemplates = map[string]responseTemplateVariant{
+	responseTemplateBlock: {
+		HTML: defaultBlockTemplateHTML,
+		JSON: defaultBlockTemplateJSON,
+	},
+	responseTemplateRateLimit: {
+		HTML: defaultBlockTemplateHTML,
+		JSON: `{"error":"{{.message}}","status":{{.status}},"req_id":"{{.req_id}}","retry_after":{{.retry_after}}{{if .support_contact}},"support_contact":"{{.support_contact}}"{{end}}}`,
+	},
+	responseTemplateCountryBlock: {
+		HTML: defaultBlockTemplateHTML,
+		JSON: defaultBlockTemplateJSON,
+	},
+	responseTemplateChallenge: {
+		HTML: `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>{{.title}}</title></head>
+<body>
+<p id="status">{{.message}}</p>
+{{.challenge_script}}
+<noscript>JavaScript is required to continue.</noscript>
+</body></html>
+`,
+		JSON: `{"req_id":"{{.req_id}}"{{if .support_contact}},"support_contact":"{{.support_contact}}"{{end}}}`,
+	},
+}
+
+const defaultBlockTemplateHTML = `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>{{.status}} {{.status_text}}</title></head>
+<body>
+<h1>{{.status}} {{.status_text}}</h1>
+<p>{{.message}}</p>
+<p>Request ID: {{.req_id}}</p>
+{{if .support_contact}}<p>If you believe this is a mistake, contact {{.support_contact}} and quote the request ID.</p>
+{{end}}</body></html>
+`
+
+const defaultBlockTemplateJSON = `{"error":"{{.message}}","status":{{.status}},"req_id":"{{.req_id}}"{{if .support_contact}},"support_contact":"{{.support_contact}}"{{end}}}`
+
+func InitResponseTemplates(path string) error {
+	target := strings.TrimSpace(path)
+	if target == "" {
+		return fmt.Errorf("response templates path is empty")
+	}
+	if err := ensureResponseTemplatesFile(target); err != nil {
+		return err
+	}
+
+	responseTemplatesMu.Lock()
+	responseTemplatesPath = target
+	responseTemplatesMu.Unlock()
+
+	return ReloadResponseTemplates()
+}
+
+func GetResponseTemplatesPath() string {
+	responseTemplatesMu.RLock()
+	defer responseTemplatesMu.RUnlock()
+	return responseTemplatesPath
+}
+
+func ReloadResponseTemplates() (err error) {
+	defer func() { metrics.ObserveReload("response_templates", err) }()
+
+	path := GetResponseTemplatesPath()
+	if path == "" {
+		return fmt.Errorf("response templates path is empty")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rt, err := buildResponseTemplatesRuntimeFromRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	responseTemplatesMu.Lock()
+	responseTemplatesRuntime = rt
+	responseTemplatesMu.Unlock()
+
+	return nil
+}
+
+func ValidateResponseTemplatesRaw(raw string) (*runtimeResponseTemplatesConfig, error) {
+	return buildResponseTemplatesRuntimeFromRaw([]byte(raw))
+}
+
+// customizedKinds lists the kinds the operator overrides, for the admin API.
+func (rt *runtimeResponseTemplatesConfig) customizedKinds() []string {
+	out := make([]string, 0, len(rt.Raw.Templates))
+	for kind := range rt.Raw.Templates {
+		out = append(out, kind)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func currentResponseTemplatesRuntime() *runtimeResponseTemplatesConfig {
+	responseTemplatesMu.RLock()
+	defer responseTemplatesMu.RUnlock()
+	return responseTemplatesRuntime
+}
+
+func buildResponseTemplatesRuntimeFromRaw(raw []byte) (*runtimeResponseTemplatesConfig, error) {
+	var cfg responseTemplatesConfig
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	cfg.SupportContact = strings.TrimSpace(cfg.SupportContact)
+
+	known := make(map[string]bool, len(responseTemplateKinds))
+	for _, kind := range responseTemplateKinds {
+		known[kind] = true
+	}
+	for kind := range cfg.Templates {
+		if !known[kind] {
+			return nil, fmt.Errorf("templates.%s: unknown kind (want %s)", kind, strings.Join(responseTemplateKinds, "|"))
+		}
+	}
+
+	rt := &runtimeResponseTemplatesConfig{
+		Raw:       cfg,
+		templates: make(map[string]compiledResponseTemplate, len(responseTemplateKinds)),
+	}
+	for _, kind := range responseTemplateKinds {
+		// A kind or variant left empty falls back to the built-in page, so
+		// operators can override only what they care about.
+		src := defaultResponseTemplates[kind]
+		if custom, ok := cfg.Templates[kind]; ok {
+			if strings.TrimSpace(custom.HTML) != "" {
+				src.HTML = custom.HTML
+			}
+			if strings.TrimSpace(custom.JSON) != "" {
+				src.JSON = custom.JSON
+			}
+		}
+		compiled, err := compileResponseTemplate(kind, src)
+		if err != nil {
+			return nil, err
+		}
+		rt.templates[kind] = compiled
+	}
+
+	// Render every template once so that references to unknown variables
+	// and JSON that does not parse are rejected here instead of on the
+	// first blocked request.
+	sample := responseTemplateVars{
+		Status:          http.StatusForbidden,
+		ReqID:           `sample-"req"-<id>`,
+		RuleID:          "942100",
+		Message:         "sample message",
+		Title:           "Sample",
+		Path:            "/sample",
+		Country:         "JP",
+		RetryAfter:      30,
+		ChallengeScript: "<script></script>",
+	}
+	for _, kind := range responseTemplateKinds {
+		if _, err := rt.render(kind, true, sample); err != nil {
+			return nil, fmt.Errorf("templates.%s.html: %w", kind, err)
+		}
+		if _, err := rt.render(kind, false, sample); err != nil {
+			return nil, fmt.Errorf("templates.%s.json: %w", kind, err)
+		}
+	}
+
+	return rt, nil
+}
+
+func compileResponseTemplate(kind string, src responseTemplateVariant) (compiledResponseTemplate, error) {
+	if len(src.HTML) > maxResponseTemplateBytes {
+		return compiledResponseTemplate{}, fmt.Errorf("templates.%s.html: exceeds %d bytes", kind, maxResponseTemplateBytes)
+	}
+	if len(src.JSON) > maxResponseTemplateBytes {
+		return compiledResponseTemplate{}, fmt.Errorf("templates.%s.json: exceeds %d bytes", kind, maxResponseTemplateBytes)
+	}
+	htmlTmpl, err := htmltemplate.New(kind).Option("missingkey=error").Parse(src.HTML)
+	if err != nil {
+		return compiledResponseTemplate{}, fmt.Errorf("templates.%s.html: %w", kind, err)
+	}
+	jsonTmpl, err := texttemplate.New(kind).Option("missingkey=error").Parse(src.JSON)
+	if err != nil {
+		return compiledResponseTemplate{}, fmt.Errorf("templates.%s.json: %w", kind, err)
+	}
+	return compiledResponseTemplate{html: htmlTmpl, json: jsonTmpl}, nil
+}
+
+// render executes one variant. html/template escapes for HTML on its own;
+// the JSON variant is plain text/template, so string values are passed
+// already escaped for use inside a JSON string literal and the result must
+// be a JSON object.
+func (rt *runtimeResponseTemplatesConfig) render(kind string, asHTML bool, vars responseTemplateVars) ([]byte, error) {
+	compiled, ok := rt.templates[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown response template %q", kind)
+	}
+
+	data := map[string]any{
+		"status":          vars.Status,
+		"status_text":     http.StatusText(vars.Status),
+		"req_id":          vars.ReqID,
+		"rule_id":         vars.RuleID,
+		"message":         vars.Message,
+		"title":           vars.Title,
+		"path":            vars.Path,
+		"country":         vars.Country,
+		"retry_after":     vars.RetryAfter,
+		"support_contact": rt.Raw.SupportContact,
+	}
+
+	var buf bytes.Buffer
+	if asHTML {
+		data["challenge_script"] = htmltemplate.HTML(vars.ChallengeScript)
+		if err := compiled.html.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			data[k] = jsonStringContent(s)
+		}
+	}
+	if err := compiled.json.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		return nil, fmt.Errorf("rendered output is not a JSON object: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func jsonStringContent(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// renderResponseTemplate falls back to the built-in templates when nothing
+// has been loaded, so callers always get a body.
+func renderResponseTemplate(kind string, asHTML bool, vars responseTemplateVars) ([]byte, error) {
+	rt := currentResponseTemplatesRuntime()
+	if rt == nil {
+		rt = builtinResponseTemplates()
+	}
+	return rt.render(kind, asHTML, vars)
+}
+
+var (
+	builtinResponseTemplatesOnce sync.Once
+	builtinResponseTemplatesRT   *runtimeResponseTemplatesConfig
+)
+
+func builtinResponseTemplates() *runtimeResponseTemplatesConfig {
+	builtinResponseTemplatesOnce.Do(func() {
+		rt, err := buildResponseTemplatesRuntimeFromRaw([]byte(`{}`))
+		if err != nil {
+			panic(fmt.Sprintf("built-in response templates: %v", err))
+		}
+		builtinResponseTemplatesRT = rt
+	})
+	return builtinResponseTemplatesRT
+}
+
+// writeResponseTemplate answers a refused request with the operator's page
+// for kind, picking the HTML or JSON variant from the Accept header. The
+// request ID is taken from X-Request-ID when the caller left it empty.
+func writeResponseTemplate(w http.ResponseWriter, r *http.Request, kind string, vars responseTemplateVars) {
+	writeResponseTemplateVariant(w, r, kind, acceptsHTML(r.Header.Get("Accept")), vars)
+}
+
+func writeResponseTemplateVariant(w http.ResponseWriter, r *http.Request, kind string, asHTML bool, vars responseTemplateVars) {
+	if vars.ReqID == "" {
+		vars.ReqID = r.Header.Get("X-Request-ID")
+	}
+	if vars.Path == "" && r.URL != nil {
+		vars.Path = r.URL.Path
+	}
+	body, err := renderResponseTemplate(kind, asHTML, vars)
+	if err != nil {
+		w.WriteHeader(vars.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", responseTemplateContentType(asHTML))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(vars.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+func responseTemplateContentType(asHTML bool) string {
+	if asHTML {
+		return "text/html; charset=utf-8"
+	}
+	return "application/json; charset=utf-8"
+}
+
+func ensureResponseTemplatesFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Kinds not listed under "templates" use the built-in pages, which the
+	// admin API returns as "defaults".
+	const defaultRaw = `{
+  "support_contact": "",
+  "templates": {}
+}
+`
+	return os.WriteFile(path, []byte(defaultRaw), 0o644)
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useResponseTemplatesForTest(t *testing.T, raw string) {
+	t.Helper()
+	responseTemplatesMu.RLock()
+	oldPath := responseTemplatesPath
+	oldRuntime := responseTemplatesRuntime
+	responseTemplatesMu.RUnlock()
+	t.Cleanup(func() {
+		responseTemplatesMu.Lock()
+		responseTemplatesPath = oldPath
+		responseTemplatesRuntime = oldRuntime
+		responseTemplatesMu.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "response-templates.conf")
+	if err := os.WriteFile(path, []byte(raw), 0o644); err != nil {
+		t.Fatalf("write response templates: %v", err)
+	}
+	if err := InitResponseTemplates(path); err != nil {
+		t.Fatalf("InitResponseTemplates() unexpected error: %v", err)
+	}
+}
+
+func TestValidateResponseTemplatesRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "empty uses defaults", raw: `{}`},
+		{name: "html only override", raw: `{"templates":{"block":{"html":"<p>{{.req_id}} {{.rule_id}} {{.support_contact}}</p>"}}}`},
+		{name: "unknown kind", raw: `{"templates":{"teapot":{"html":"x"}}}`, wantErr: "unknown kind"},
+		{name: "unknown field", raw: `{"contact":"x"}`, wantErr: "unknown field"},
+		{name: "unknown variable", raw: `{"templates":{"block":{"html":"{{.request_id}}"}}}`, wantErr: "templates.block.html"},
+		{name: "parse error", raw: `{"templates":{"rate_limit":{"html":"{{if .req_id}}"}}}`, wantErr: "templates.rate_limit.html"},
+		{name: "json not an object", raw: `{"templates":{"country_block":{"json":"\"{{.req_id}}\""}}}`, wantErr: "templates.country_block.json"},
+		{name: "broken json", raw: `{"templates":{"block":{"json":"{\"id\":{{.req_id}}}"}}}`, wantErr: "not a JSON object"},
+		{name: "script only in html", raw: `{"templates":{"challenge":{"json":"{\"s\":\"{{.challenge_script}}\"}"}}}`, wantErr: "templates.challenge.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateResponseTemplatesRaw(tt.raw)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err=%v want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteResponseTemplate_NegotiatesAndEscapes(t *testing.T) {
+	useResponseTemplatesForTest(t, `{
+  "support_contact": "soc@example.com",
+  "templates": {
+    "block": {
+      "html": "<p>{{.req_id}}|{{.rule_id}}|{{.support_contact}}</p>",
+      "json": "{\"id\":\"{{.req_id}}\",\"rule\":\"{{.rule_id}}\",\"contact\":\"{{.support_contact}}\",\"status\":{{.status}}}"
+    }
+  }
+}`)
+	reqID := `x"<script>`
+	vars := responseTemplateVars{Status: http.StatusForbidden, ReqID: reqID, RuleID: "942100"}
+
+	tests := []struct {
+		accept   string
+		wantHTML bool
+	}{
+		{accept: "text/html,application/xhtml+xml", wantHTML: true},
+		{accept: "*/*", wantHTML: true},
+		{accept: "application/json, text/plain, */*", wantHTML: false},
+		{accept: "", wantHTML: false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		req.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		writeResponseTemplate(w, req, responseTemplateBlock, vars)
+
+		if w.Code != http.StatusForbidden || w.Header().Get("Cache-Control") != "no-store" {
+			t.Fatalf("accept=%q status=%d headers=%v", tt.accept, w.Code, w.Header())
+		}
+		body := w.Body.String()
+		if tt.wantHTML {
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+				t.Fatalf("accept=%q content-type=%q", tt.accept, w.Header().Get("Content-Type"))
+			}
+			if strings.Contains(body, "<script>") || !strings.Contains(body, "942100|soc@example.com") {
+				t.Fatalf("accept=%q unexpected html body: %s", tt.accept, body)
+			}
+			continue
+		}
+		var got struct {
+			ID      string `json:"id"`
+			Rule    string `json:"rule"`
+			Contact string `json:"contact"`
+			Status  int    `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("accept=%q body is not JSON: %v body=%s", tt.accept, err, body)
+		}
+		if got.ID != reqID || got.Rule != "942100" || got.Contact != "soc@example.com" || got.Status != http.StatusForbidden {
+			t.Fatalf("accept=%q unexpected json: %+v", tt.accept, got)
+		}
+	}
+}
+
+func TestWriteChallengeDescriptor_KeepsMachineFields(t *testing.T) {
+	useResponseTemplatesForTest(t, `{
+  "support_contact": "soc@example.com",
+  "templates": {
+    "challenge": {"json": "{\"help\":\"{{.support_contact}}\",\"verify_url\":\"/elsewhere\",\"req_id\":\"{{.req_id}}\"}"}
+  }
+}`)
+	req := httptest.NewRequest(http.MethodPost, "http://example.test/api", nil)
+	req.Header.Set("X-Request-ID", "req-9")
+	w := httptest.NewRecorder()
+	writeChallengeDescriptor(w, req, http.StatusTooManyRequests, powChallengeDescriptor("bot challenge required", "abc", 4))
+
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("descriptor is not JSON: %v", err)
+	}
+	if got["help"] != "soc@example.com" || got["req_id"] != "req-9" {
+		t.Fatalf("template fields missing: %v", got)
+	}
+	if got["verify_url"] != PowChallengeVerifyPath || got["challenge"] != "abc" {
+		t.Fatalf("template must not override descriptor fields: %v", got)
+	}
+}
+
+func TestWriteChallengeHTML_EmbedsScriptInCustomPage(t *testing.T) {
+	useResponseTemplatesForTest(t, `{
+  "templates": {
+    "challenge": {"html": "<main class=\"brand\"><h1>{{.title}}</h1>{{.challenge_script}}</main>"}
+  }
+}`)
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	w := httptest.NewRecorder()
+	writeChallengeHTML(w, req, http.StatusTooManyRequests, "Checking", "", cookieChallengeScript("tok", "__c", 60))
+
+	body := w.Body.String()
+	if !strings.Contains(body, `<main class="brand"><h1>Checking</h1><script>`) || !strings.Contains(body, `const token = "tok";`) {
+		t.Fatalf("unexpected challenge page: %s", body)
+	}
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mamotama/internal/bypassconf"
+)
+
+const routesConfigBlobKey = "routes"
+
+type routesPutBody struct {
+	Raw string `json:"raw"`
+}
+
+func bindRoutesPutBody(c *gin.Context) (routesPutBody, bool) {
+	var in routesPutBody
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return routesPutBody{}, false
+	}
+
+	return in, true
+}
+
+func GetRoutes(c *gin.Context) {
+	path := GetRoutesPath()
+	raw, _ := os.ReadFile(path)
+	if store := getLogsStatsStore(); store != nil {
+		dbRaw, dbETag, found, err := store.GetConfigBlob(routesConfigBlobKey)
+		if err != nil {
+			log.Printf("[ROUTES][DB][WARN] get config blob failed: %v", err)
+		} else if found {
+			rt, parseErr := ValidateRoutesRaw(string(dbRaw))
+			if parseErr != nil {
+				log.Printf("[ROUTES][DB][WARN] cached blob parse failed (fallback=file): %v", parseErr)
+			} else {
+				if strings.TrimSpace(dbETag) == "" {
+					dbETag = bypassconf.ComputeETag(dbRaw)
+				}
+				c.JSON(http.StatusOK, routesResponse(gin.H{
+					"etag": dbETag,
+					"raw":  string(dbRaw),
+				}, rt))
+				return
+			}
+		} else if len(raw) > 0 {
+			if err := store.UpsertConfigBlob(routesConfigBlobKey, raw, bypassconf.ComputeETag(raw), time.Now().UTC()); err != nil {
+				log.Printf("[ROUTES][DB][WARN] seed config blob failed: %v", err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, routesResponse(gin.H{
+		"etag": bypassconf.ComputeETag(raw),
+		"raw":  string(raw),
+	}, currentRoutesRuntime()))
+}
+
+func ValidateRoutes(c *gin.Context) {
+	in, ok := bindRoutesPutBody(c)
+	if !ok {
+		return
+	}
+
+	rt, err := ValidateRoutesRaw(in.Raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "messages": []string{err.Error()}})
+		return
+	}
+
+	c.JSON(http.StatusOK, routesResponse(gin.H{
+		"ok":       true,
+		"messages": []string{},
+	}, rt))
+}
+
+func PutRoutes(c *gin.Context) {
+	path := GetRoutesPath()
+	store := getLogsStatsStore()
+	ifMatch := c.GetHeader("If-Match")
+	curRaw, _ := os.ReadFile(path)
+	curETag := bypassconf.ComputeETag(curRaw)
+	if store != nil {
+		dbRaw, dbETag, found, err := store.GetConfigBlob(routesConfigBlobKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if found {
+			if _, parseErr := ValidateRoutesRaw(string(dbRaw)); parseErr == nil {
+				curRaw = dbRaw
+				if strings.TrimSpace(dbETag) == "" {
+					dbETag = bypassconf.ComputeETag(dbRaw)
+				}
+				curETag = dbETag
+			} else {
+				log.Printf("[ROUTES][DB][WARN] cached blob parse failed for conflict check (fallback=file): %v", parseErr)
+			}
+		}
+	}
+	if ifMatch != "" && ifMatch != curETag {
+		c.JSON(http.StatusConflict, gin.H{"error": "conflict", "currentETag": curETag})
+		return
+	}
+
+	in, ok := bindRoutesPutBody(c)
+	if !ok {
+		return
+	}
+
+	rt, err := ValidateRoutesRaw(in.Raw)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "messages": []string{err.Error()}})
+		return
+	}
+
+	if err := bypassconf.AtomicWriteWithBackup(path, []byte(in.Raw)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ReloadRoutes(); err != nil {
+		_ = bypassconf.AtomicWriteWithBackup(path, curRaw)
+		_ = ReloadRoutes()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	newETag := bypassconf.ComputeETag([]byte(in.Raw))
+	if store != nil {
+		if err := store.UpsertConfigBlob(routesConfigBlobKey, []byte(in.Raw), newETag, time.Now().UTC()); err != nil {
+			_ = bypassconf.AtomicWriteWithBackup(path, curRaw)
+			_ = ReloadRoutes()
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":    "routes db sync failed and rollback applied",
+				"db_error": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, routesResponse(gin.H{
+		"ok":   true,
+		"etag": newETag,
+	}, rt))
+}
+
+func routesResponse(out gin.H, rt *runtimeRoutesConfig) gin.H {
+	if rt == nil {
+		out["default_upstream"] = defaultRouteName
+		out["upstreams"] = []gin.H{}
+		out["routes"] = []gin.H{}
+		return out
+	}
+	out["default_upstream"] = rt.DefaultRoute.Upstream.Name
+	out["upstreams"] = rt.upstreamSummaries()
+	out["routes"] = rt.routeSummaries()
+	return out
+}
+
+func (rt *runtimeRoutesConfig) upstreamSummaries() []gin.H {
+	names := make([]string, 0, len(rt.Upstreams))
+	for name := range rt.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		up := rt.Upstreams[name]
+		targets := make([]string, 0, len(up.targets))
+		for _, t := range up.targets {
+			targets = append(targets, t.URL.String())
+		}
+		out = append(out, gin.H{
+			"name":              name,
+			"url":               up.URL.String(),
+			"targets":           targets,
+			"balance":           up.Balance,
+			"health_check":      up.health != nil,
+			"outlier_detection": up.outlier != nil,
+		})
+	}
+	return out
+}
+
+func (rt *runtimeRoutesConfig) routeSummaries() []gin.H {
+	out := make([]gin.H, 0, len(rt.Routes))
+	for _, route := range rt.Routes {
+		overrides := []string{}
+		if route.hasBypass {
+			overrides = append(overrides, "bypass")
+		}
+		if route.rateLimit != nil {
+			overrides = append(overrides, "rate_limit")
+		}
+		if route.botDefense != nil {
+			overrides = append(overrides, "bot_defense")
+		}
+		out = append(out, gin.H{
+			"name":          route.Name,
+			"hosts":         route.Hosts,
+			"path_prefixes": route.PathPrefixes,
+			"upstream":      route.Upstream.Name,
+			"overrides":     overrides,
+		})
+	}
+	return out
+}
+
+func SyncRoutesStorage() error {
+	return syncConfigBlobFilePath(configBlobSyncOptions{
+		ConfigKey: routesConfigBlobKey,
+		Path:      GetRoutesPath(),
+		ValidateRaw: func(raw string) error {
+			_, err := ValidateRoutesRaw(raw)
+			return err
+		},
+		Reload:           ReloadRoutes,
+		SkipWriteIfEqual: true,
+	})
+}
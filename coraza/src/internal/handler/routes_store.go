@@ -0,0 +1,524 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mamotama/internal/bypassconf"
+	"mamotama/internal/config"
+	"mamotama/internal/metrics"
+)
+
+// defaultRouteName names the fallback route and, when default_upstream is
+// not set, the WAF_APP_URL upstream behind it.
+const defaultRouteName = "default"
+
+// Route overrides share the global challenge secret and settings, so these
+// keys are rejected in bot_defense. The pass itself is bound to the route:
+// it gets its own cookie (challenge_cookie_name + "_" + route) and token.
+var routeBotDefenseSharedKeys = []string{
+	"challenge_secret",
+	"challenge_cookie_name",
+	"challenge_token_header",
+	"challenge_ttl_seconds",
+}
+
+var routeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+type routeUpstreamConfig struct {
+	Name string `json:"name"`
+	// URL is shorthand for a single target; use Targets to balance.
+	URL     string   `json:"url,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	Balance string   `json:"balance,omitempty"`
+	// HashKey is a rate-limit style key_by expression for consistent_hash.
+	HashKey     string                     `json:"hash_key,omitempty"`
+	HealthCheck *upstreamHealthCheckConfig `json:"health_check,omitempty"`
+	Outlier     *upstreamOutlierConfig     `json:"outlier_detection,omitempty"`
+	Transport   *upstreamTransportConfig   `json:"transport,omitempty"`
+	Retry       *upstreamRetryConfig       `json:"retry,omitempty"`
+}
+
+type routeConfig struct {
+	Name         string   `json:"name"`
+	Hosts        []string `json:"hosts,omitempty"`
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+	Upstream     string   `json:"upstream"`
+	// Overrides replace the global file for requests on this route when
+	// present; an empty bypass list means "no bypass here".
+	Bypass     []string        `json:"bypass,omitempty"`
+	RateLimit  json.RawMessage `json:"rate_limit,omitempty"`
+	BotDefense json.RawMessage `json:"bot_defense,omitempty"`
+}
+
+type routesConfig struct {
+	DefaultUpstream string                `json:"default_upstream,omitempty"`
+	Upstreams       []routeUpstreamConfig `json:"upstreams,omitempty"`
+	Routes          []routeConfig         `json:"routes,omitempty"`
+}
+
+type runtimeUpstream struct {
+	Name string
+	// URL is the first target, kept for summaries and single-target setups.
+	URL     *url.URL
+	Balance string
+
+	targets []*upstreamTarget
+	ring    []hashRingPoint
+	hashKey []rateLimitKeyPart
+	rr      atomic.Uint64
+	health  *upstreamHealthCheckConfig
+	outlier *upstreamOutlierConfig
+	retry   *upstreamRetryConfig
+
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type runtimeRoute struct {
+	Name         string
+	Hosts        []string
+	PathPrefixes []string
+	Upstream     *runtimeUpstream
+
+	hasBypass  bool
+	bypass     []bypassconf.Entry
+	rateLimit  *runtimeRateLimitConfig
+	botDefense *runtimeBotDefenseConfig
+}
+
+type runtimeRoutesConfig struct {
+	Raw          routesConfig
+	Upstreams    map[string]*runtimeUpstream
+	Routes       []*runtimeRoute
+	DefaultRoute *runtimeRoute
+}
+
+var (
+	routesMu      sync.RWMutex
+	routesPath    string
+	routesRuntime *runtimeRoutesConfig
+)
+
+func InitRoutes(path string) error {
+	target := strings.TrimSpace(path)
+	if target == "" {
+		return fmt.Errorf("routes path is empty")
+	}
+	if err := ensureRoutesFile(target); err != nil {
+		return err
+	}
+
+	routesMu.Lock()
+	routesPath = target
+	routesMu.Unlock()
+
+	return ReloadRoutes()
+}
+
+func GetRoutesPath() string {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return routesPath
+}
+
+func ReloadRoutes() (err error) {
+	defer func() { metrics.ObserveReload("routes", err) }()
+
+	path := GetRoutesPath()
+	if path == "" {
+		return fmt.Errorf("routes path is empty")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rt, err := buildRoutesRuntimeFromRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	routesMu.Lock()
+	prev := routesRuntime
+	routesRuntime = rt
+	routesMu.Unlock()
+
+	// Target state starts fresh with each reload; the old probes stop here.
+	rt.startHealthChecks()
+	if prev != nil {
+		prev.release()
+	}
+
+	return nil
+}
+
+func ValidateRoutesRaw(raw string) (*runtimeRoutesConfig, error) {
+	return buildRoutesRuntimeFromRaw([]byte(raw))
+}
+
+func currentRoutesRuntime() *runtimeRoutesConfig {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return routesRuntime
+}
+
+var (
+	legacyRouteOnce sync.Once
+	legacyRoute     *runtimeRoute
+)
+
+// resolveRoute picks the first route whose hosts and path prefixes match,
+// falling back to the default route. Without a routes file every request
+// goes to WAF_APP_URL as before.
+func resolveRoute(r *http.Request) *runtimeRoute {
+	rt := currentRoutesRuntime()
+	if rt == nil {
+		legacyRouteOnce.Do(func() {
+			up, err := newRuntimeUpstream(routeUpstreamConfig{Name: defaultRouteName, URL: config.AppURL})
+			if err != nil {
+				up = &runtimeUpstream{Name: defaultRouteName, URL: &url.URL{}, Balance: upstreamBalanceRoundRobin}
+				up.targets = []*upstreamTarget{newUpstreamTarget(up.URL)}
+				up.transport, _ = buildUpstreamTransport(nil)
+				up.proxy = newUpstreamProxy(up)
+			}
+			legacyRoute = &runtimeRoute{Name: defaultRouteName, Upstream: up}
+		})
+		return legacyRoute
+	}
+
+	host := requestHostname(r)
+	path := "/"
+	if r != nil && r.URL != nil && r.URL.Path != "" {
+		path = r.URL.Path
+	}
+	for _, route := range rt.Routes {
+		if route.matches(host, path) {
+			return route
+		}
+	}
+	return rt.DefaultRoute
+}
+
+func (route *runtimeRoute) matches(host, path string) bool {
+	if len(route.Hosts) > 0 && !hostMatchesAny(route.Hosts, host) {
+		return false
+	}
+	if len(route.PathPrefixes) > 0 && !pathMatchesAnyPrefix(route.PathPrefixes, path) {
+		return false
+	}
+	return true
+}
+
+// matchBypass applies the route's bypass list, or the global bypass file
+// when the route does not override it.
+func (route *runtimeRoute) matchBypass(reqPath string) bypassconf.MatchResult {
+	if route == nil || !route.hasBypass {
+		return bypassconf.Match(reqPath)
+	}
+	return bypassconf.MatchEntries(route.bypass, reqPath)
+}
+
+func (route *runtimeRoute) evaluateRateLimit(r *http.Request, clientIP, country string, now time.Time) rateLimitDecision {
+	if route == nil || route.rateLimit == nil {
+		return EvaluateRateLimit(r, clientIP, country, now)
+	}
+	return evaluateRateLimit(route.rateLimit, r, clientIP, country, now)
+}
+
+func (route *runtimeRoute) evaluateBotDefense(r *http.Request, clientIP string, now time.Time) botDefenseDecision {
+	if route == nil || route.botDefense == nil {
+		return EvaluateBotDefense(r, clientIP, now)
+	}
+	return evaluateBotDefense(route.botDefense, currentBotDefenseRuntime(), r, clientIP, now)
+}
+
+// routesEnableBotDefense reports whether any route turns bot defense on, so
+// the verify endpoint stays available when the global file disables it.
+func routesEnableBotDefense() bool {
+	rt := currentRoutesRuntime()
+	if rt == nil {
+		return false
+	}
+	for _, route := range rt.Routes {
+		if route.botDefense != nil && route.botDefense.Raw.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+func hostMatchesAny(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) && len(host) > len(p)-1 {
+				return true
+			}
+			continue
+		}
+		if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+func requestHostname(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	host := strings.TrimSpace(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+}
+
+func buildRoutesRuntimeFromRaw(raw []byte) (*runtimeRoutesConfig, error) {
+	var cfg routesConfig
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	rt := &runtimeRoutesConfig{
+		Raw:       cfg,
+		Upstreams: make(map[string]*runtimeUpstream, len(cfg.Upstreams)+1),
+	}
+	for i, uc := range cfg.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		name := strings.TrimSpace(uc.Name)
+		if !routeNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s.name is invalid", field)
+		}
+		if name == defaultRouteName {
+			return nil, fmt.Errorf("%s.name %q is reserved for WAF_APP_URL", field, name)
+		}
+		if _, dup := rt.Upstreams[name]; dup {
+			return nil, fmt.Errorf("%s.name %q is duplicated", field, name)
+		}
+		uc.Name = name
+		up, err := newRuntimeUpstream(uc)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%w", field, err)
+		}
+		rt.Upstreams[name] = up
+	}
+
+	defaultUpstream := strings.TrimSpace(cfg.DefaultUpstream)
+	if defaultUpstream == "" {
+		up, err := newRuntimeUpstream(routeUpstreamConfig{Name: defaultRouteName, URL: config.AppURL})
+		if err != nil {
+			return nil, fmt.Errorf("WAF_APP_URL: %w (set default_upstream)", err)
+		}
+		rt.Upstreams[defaultRouteName] = up
+		defaultUpstream = defaultRouteName
+	}
+	up, ok := rt.Upstreams[defaultUpstream]
+	if !ok {
+		return nil, fmt.Errorf("default_upstream %q is not defined in upstreams", defaultUpstream)
+	}
+	rt.DefaultRoute = &runtimeRoute{Name: defaultRouteName, Upstream: up}
+
+	seen := map[string]bool{defaultRouteName: true}
+	for i, rc := range cfg.Routes {
+		route, err := buildRuntimeRoute(rt, rc)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		if seen[route.Name] {
+			return nil, fmt.Errorf("routes[%d]: name %q is duplicated or reserved", i, route.Name)
+		}
+		seen[route.Name] = true
+		rt.Routes = append(rt.Routes, route)
+	}
+
+	return rt, nil
+}
+
+func buildRuntimeRoute(rt *runtimeRoutesConfig, rc routeConfig) (*runtimeRoute, error) {
+	route := &runtimeRoute{Name: strings.TrimSpace(rc.Name)}
+	if !routeNamePattern.MatchString(route.Name) {
+		return nil, fmt.Errorf("name is invalid")
+	}
+
+	for _, h := range rc.Hosts {
+		h = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(h), "."))
+		if h == "" {
+			continue
+		}
+		if strings.ContainsAny(h, "/: ") || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+			return nil, fmt.Errorf("hosts: %q must be a hostname or *.domain", h)
+		}
+		route.Hosts = append(route.Hosts, h)
+	}
+	for _, p := range rc.PathPrefixes {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path_prefixes: %q must start with '/'", p)
+		}
+		route.PathPrefixes = append(route.PathPrefixes, p)
+	}
+	if len(route.Hosts) == 0 && len(route.PathPrefixes) == 0 {
+		return nil, fmt.Errorf("hosts or path_prefixes is required")
+	}
+
+	up, ok := rt.Upstreams[strings.TrimSpace(rc.Upstream)]
+	if !ok {
+		return nil, fmt.Errorf("upstream %q is not defined in upstreams", rc.Upstream)
+	}
+	route.Upstream = up
+
+	if rc.Bypass != nil {
+		entries, err := bypassconf.Parse(strings.Join(rc.Bypass, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("bypass: %w", err)
+		}
+		route.hasBypass = true
+		route.bypass = entries
+	}
+	if len(rc.RateLimit) > 0 {
+		rl, err := buildRateLimitRuntimeFromRaw(rc.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("rate_limit: %w", err)
+		}
+		rl.PolicyScope = "route:" + route.Name + ":"
+		route.rateLimit = rl
+	}
+	if len(rc.BotDefense) > 0 {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(rc.BotDefense, &keys); err != nil {
+			return nil, fmt.Errorf("bot_defense: %w", err)
+		}
+		for _, k := range routeBotDefenseSharedKeys {
+			if _, ok := keys[k]; ok {
+				return nil, fmt.Errorf("bot_defense: %s is shared with the global bot-defense file and cannot be overridden", k)
+			}
+		}
+		bd, err := buildBotDefenseRuntimeFromRaw(rc.BotDefense)
+		if err != nil {
+			return nil, fmt.Errorf("bot_defense: %w", err)
+		}
+		bd.PassScope = route.Name
+		route.botDefense = bd
+	}
+
+	return route, nil
+}
+
+// newRuntimeUpstream builds an upstream from either url or targets. Errors
+// are prefixed with the offending field name.
+func newRuntimeUpstream(uc routeUpstreamConfig) (*runtimeUpstream, error) {
+	rawTargets := uc.Targets
+	if strings.TrimSpace(uc.URL) != "" {
+		if len(rawTargets) > 0 {
+			return nil, fmt.Errorf("url: use either url or targets, not both")
+		}
+		rawTargets = []string{uc.URL}
+	}
+	if len(rawTargets) == 0 {
+		return nil, fmt.Errorf("targets: url or targets is required")
+	}
+
+	up := &runtimeUpstream{Name: uc.Name, Balance: strings.ToLower(strings.TrimSpace(uc.Balance))}
+	switch up.Balance {
+	case "":
+		up.Balance = upstreamBalanceRoundRobin
+	case upstreamBalanceRoundRobin, upstreamBalanceLeastConn, upstreamBalanceConsistentHash:
+	default:
+		return nil, fmt.Errorf("balance: %q must be round_robin, least_conn or consistent_hash", uc.Balance)
+	}
+	if strings.TrimSpace(uc.HashKey) != "" && up.Balance != upstreamBalanceConsistentHash {
+		return nil, fmt.Errorf("hash_key: only applies to consistent_hash")
+	}
+	hashKey, _, err := parseRateLimitKeyExpr(uc.HashKey)
+	if err != nil {
+		return nil, fmt.Errorf("hash_key: %w", err)
+	}
+	up.hashKey = hashKey
+	if up.health, err = normalizeHealthCheck(uc.HealthCheck); err != nil {
+		return nil, err
+	}
+	if up.outlier, err = normalizeOutlier(uc.Outlier); err != nil {
+		return nil, err
+	}
+	if up.retry, err = normalizeRetry(uc.Retry); err != nil {
+		return nil, err
+	}
+	if up.transport, err = buildUpstreamTransport(uc.Transport); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for i, raw := range rawTargets {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			if strings.TrimSpace(uc.URL) != "" {
+				return nil, fmt.Errorf("url: %w", err)
+			}
+			return nil, fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		if seen[u.String()] {
+			return nil, fmt.Errorf("targets[%d]: %q is duplicated", i, u.Redacted())
+		}
+		seen[u.String()] = true
+		up.targets = append(up.targets, newUpstreamTarget(u))
+	}
+	up.URL = up.targets[0].URL
+	up.buildHashRing()
+	up.proxy = newUpstreamProxy(up)
+
+	return up, nil
+}
+
+func parseUpstreamURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("host is empty")
+	}
+	return u, nil
+}
+
+func ensureRoutesFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// With no routes, everything goes to WAF_APP_URL.
+	const defaultRaw = `{
+  "upstreams": [],
+  "routes": []
+}
+`
+	return os.WriteFile(path, []byte(defaultRaw), 0o644)
+}
@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/config"
+)
+
+func useRoutesForTest(t *testing.T, raw string) {
+	t.Helper()
+	routesMu.RLock()
+	oldPath := routesPath
+	oldRuntime := routesRuntime
+	routesMu.RUnlock()
+	t.Cleanup(func() {
+		routesMu.Lock()
+		if routesRuntime != nil && routesRuntime != oldRuntime {
+			routesRuntime.release()
+		}
+		routesPath = oldPath
+		routesRuntime = oldRuntime
+		routesMu.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "routes.conf")
+	if err := os.WriteFile(path, []byte(raw), 0o644); err != nil {
+		t.Fatalf("write routes: %v", err)
+	}
+	if err := InitRoutes(path); err != nil {
+		t.Fatalf("InitRoutes() unexpected error: %v", err)
+	}
+}
+
+func useAppURLForTest(t *testing.T, appURL string) {
+	t.Helper()
+	prev := config.AppURL
+	config.AppURL = appURL
+	t.Cleanup(func() { config.AppURL = prev })
+}
+
+func TestValidateRoutesRaw(t *testing.T) {
+	useAppURLForTest(t, "http://app.internal:3000")
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "empty falls back to app url", raw: `{}`},
+		{name: "full", raw: `{
+  "default_upstream": "web",
+  "upstreams": [
+    {"name": "web", "url": "http://web:3000"},
+    {"name": "api", "targets": ["https://api-1:8443", "https://api-2:8443"], "balance": "consistent_hash", "hash_key": "header:X-Tenant-ID",
+     "health_check": {"path": "/healthz", "expect_status": [200, 204]}, "outlier_detection": {"consecutive_failures": 3, "eject_seconds": 10}}
+  ],
+  "routes": [{
+    "name": "api",
+    "hosts": ["api.example.com", "*.api.example.com"],
+    "path_prefixes": ["/v1/"],
+    "upstream": "api",
+    "bypass": ["/v1/health", "/v1/upload monitor"],
+    "rate_limit": {"enabled": true, "default_policy": {"enabled": true, "limit": 5, "window_seconds": 1, "key_by": "ip", "action": {"status": 429}}},
+    "bot_defense": {"enabled": false, "mode": "suspicious"}
+  }]
+}`},
+		{name: "unknown upstream", raw: `{"routes":[{"name":"a","hosts":["a.test"],"upstream":"missing"}]}`, wantErr: "upstream \"missing\""},
+		{name: "unknown default", raw: `{"default_upstream":"missing"}`, wantErr: "default_upstream"},
+		{name: "reserved upstream", raw: `{"upstreams":[{"name":"default","url":"http://x"}]}`, wantErr: "reserved"},
+		{name: "bad scheme", raw: `{"upstreams":[{"name":"a","url":"ftp://x"}]}`, wantErr: "scheme"},
+		{name: "no matcher", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","upstream":"a"}]}`, wantErr: "hosts or path_prefixes"},
+		{name: "bad host", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","hosts":["a.test:8080"],"upstream":"a"}]}`, wantErr: "hostname"},
+		{name: "duplicate route", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","hosts":["a.test"],"upstream":"a"},{"name":"a","hosts":["b.test"],"upstream":"a"}]}`, wantErr: "duplicated"},
+		{name: "bad bypass", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","hosts":["a.test"],"upstream":"a","bypass":["nope"]}]}`, wantErr: "bypass"},
+		{name: "bad rate limit", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","hosts":["a.test"],"upstream":"a","rate_limit":{"limit":1}}]}`, wantErr: "rate_limit"},
+		{name: "url and targets", raw: `{"upstreams":[{"name":"a","url":"http://x","targets":["http://y"]}]}`, wantErr: "either url or targets"},
+		{name: "no targets", raw: `{"upstreams":[{"name":"a"}]}`, wantErr: "upstreams[0].targets"},
+		{name: "bad target", raw: `{"upstreams":[{"name":"a","targets":["http://x","ftp://y"]}]}`, wantErr: "targets[1]"},
+		{name: "duplicate target", raw: `{"upstreams":[{"name":"a","targets":["http://x","http://x"]}]}`, wantErr: "duplicated"},
+		{name: "bad balance", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"balance":"random"}]}`, wantErr: "balance"},
+		{name: "hash key without hash", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"hash_key":"ip"}]}`, wantErr: "hash_key"},
+		{name: "bad hash key", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"balance":"consistent_hash","hash_key":"header"}]}`, wantErr: "hash_key"},
+		{name: "bad health path", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"health_check":{"path":"healthz"}}]}`, wantErr: "health_check.path"},
+		{name: "health timeout", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"health_check":{"path":"/healthz","interval_seconds":1,"timeout_seconds":5}}]}`, wantErr: "timeout_seconds"},
+		{name: "bad outlier", raw: `{"upstreams":[{"name":"a","targets":["http://x"],"outlier_detection":{"consecutive_failures":-1}}]}`, wantErr: "outlier_detection"},
+		{name: "shared bot key", raw: `{"upstreams":[{"name":"a","url":"http://x"}],"routes":[{"name":"a","hosts":["a.test"],"upstream":"a","bot_defense":{"enabled":true,"challenge_secret":"x"}}]}`, wantErr: "challenge_secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateRoutesRaw(tt.raw)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err=%v want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveRoute(t *testing.T) {
+	useAppURLForTest(t, "http://app.internal:3000")
+	useRoutesForTest(t, `{
+  "upstreams": [{"name": "api", "url": "http://api:8080"}, {"name": "assets", "url": "http://assets:8080"}],
+  "routes": [
+    {"name": "api-v1", "hosts": ["api.example.com", "*.api.example.com"], "path_prefixes": ["/v1/"], "upstream": "api"},
+    {"name": "assets", "path_prefixes": ["/static/"], "upstream": "assets"}
+  ]
+}`)
+
+	tests := []struct {
+		host, path, want string
+	}{
+		{host: "api.example.com", path: "/v1/users", want: "api-v1"},
+		{host: "API.Example.com:8443", path: "/v1/users", want: "api-v1"},
+		{host: "eu.api.example.com", path: "/v1/", want: "api-v1"},
+		{host: "api.example.com", path: "/v2/users", want: "default"},
+		{host: "evilapi.example.com", path: "/v1/users", want: "default"},
+		{host: "api.example.com", path: "/static/app.js", want: "assets"},
+		{host: "www.example.com", path: "/static/app.js", want: "assets"},
+		{host: "www.example.com", path: "/", want: "default"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://placeholder"+tt.path, nil)
+		req.Host = tt.host
+		if got := resolveRoute(req); got.Name != tt.want {
+			t.Fatalf("host=%s path=%s route=%s want=%s", tt.host, tt.path, got.Name, tt.want)
+		}
+	}
+	if up := resolveRoute(httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)).Upstream; up.URL.String() != "http://app.internal:3000" {
+		t.Fatalf("default route should use WAF_APP_URL, got %s", up.URL)
+	}
+}
+
+func TestProxyHandler_RoutesToUpstreamWithOverrides(t *testing.T) {
+	restoreRL := saveRateLimitStateForTest()
+	defer restoreRL()
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(t.TempDir(), "events.ndjson"))
+
+	newBackend := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	web := newBackend("web")
+	api := newBackend("api")
+
+	useAppURLForTest(t, web.URL)
+	// Both routes bypass the WAF so that no engine is needed; the API route
+	// also gets its own one-request budget.
+	useRoutesForTest(t, fmt.Sprintf(`{
+  "upstreams": [{"name": "api", "url": %q}],
+  "routes": [
+    {"name": "api", "hosts": ["api.example.test"], "upstream": "api", "bypass": ["/"], "rate_limit": %s},
+    {"name": "web", "path_prefixes": ["/"], "upstream": "default", "bypass": ["/"]}
+  ]
+}`, api.URL, rateLimitRawForTest(1)))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(ProxyHandler)
+	front := httptest.NewServer(engine)
+	t.Cleanup(front.Close)
+
+	type result struct {
+		Code int
+		Body string
+	}
+	serve := func(host string) result {
+		req, err := http.NewRequest(http.MethodGet, front.URL+"/orders", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = host
+		res, err := front.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request via %s: %v", host, err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return result{Code: res.StatusCode, Body: string(body)}
+	}
+
+	if w := serve("api.example.test"); w.Code != http.StatusOK || w.Body != "api /orders" {
+		t.Fatalf("api route status=%d body=%q", w.Code, w.Body)
+	}
+	if w := serve("api.example.test"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("api route override should rate-limit the second request, status=%d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := serve("www.example.test"); w.Code != http.StatusOK || w.Body != "web /orders" {
+			t.Fatalf("web route status=%d body=%q", w.Code, w.Body)
+		}
+	}
+}
+
+func TestRouteBotDefense_PassIsBoundToRoute(t *testing.T) {
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(t.TempDir(), "events.ndjson"))
+	restore := useBotDefensePoWForTest(t, "always")
+	defer restore()
+	useAppURLForTest(t, "http://app.internal:3000")
+	useRoutesForTest(t, `{
+  "routes": [
+    {"name": "shop", "hosts": ["shop.test"], "upstream": "default",
+     "bot_defense": {"enabled": true, "mode": "always", "path_prefixes": ["/"], "challenge_type": "cookie"}},
+    {"name": "api.v1", "hosts": ["api.test"], "upstream": "default",
+     "bot_defense": {"enabled": true, "mode": "always", "path_prefixes": ["/"], "challenge_type": "pow", "pow_difficulty": 8}}
+  ]
+}`)
+
+	const ip, ua = "10.0.0.1", "Mozilla/5.0"
+	now := time.Now().UTC()
+	evaluate := func(host string, cookie *http.Cookie, token string) botDefenseDecision {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("User-Agent", ua)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set("X-Mamotama-Bot-Token", token)
+		}
+		return resolveRoute(req).evaluateBotDefense(req, ip, now)
+	}
+
+	// The cookie-mode route hands out a pass and a zero-difficulty puzzle.
+	shop := evaluate("shop.test", nil, "")
+	if shop.Allowed || shop.Token == "" || shop.CookieName != "__mamotama_bot_ok_shop" {
+		t.Fatalf("shop should issue a cookie pass: %+v", shop)
+	}
+	w := postPoWVerifyForTest(t, shop.PoWChallenge, "0", ip, ua)
+	if w.Code != http.StatusOK {
+		t.Fatalf("shop verify status=%d body=%s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token      string `json:"token"`
+		CookieName string `json:"cookie_name"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.CookieName != shop.CookieName {
+		t.Fatalf("shop verify resp=%s err=%v", w.Body.String(), err)
+	}
+	if d := evaluate("shop.test", &http.Cookie{Name: shop.CookieName, Value: shop.Token}, ""); !d.Allowed {
+		t.Fatalf("shop pass should work on shop: %+v", d)
+	}
+
+	api := evaluate("api.test", nil, "")
+	if api.Allowed || api.ChallengeType != challengeTypePoW || api.CookieName != "__mamotama_bot_ok_api.v1" {
+		t.Fatalf("api should issue a pow challenge: %+v", api)
+	}
+	global := issueBotDefenseToken(currentBotDefenseRuntime(), "", ip, ua, now)
+	for name, token := range map[string]string{"shop cookie pass": shop.Token, "shop puzzle pass": resp.Token, "global pass": global} {
+		if d := evaluate("api.test", nil, token); d.Allowed {
+			t.Fatalf("%s accepted on the pow route via header", name)
+		}
+		if d := evaluate("api.test", &http.Cookie{Name: api.CookieName, Value: token}, ""); d.Allowed {
+			t.Fatalf("%s accepted on the pow route via cookie", name)
+		}
+	}
+
+	solution := solvePoWForTest(api.PoWChallenge, api.PoWDifficulty)
+	w = postPoWVerifyForTest(t, api.PoWChallenge, solution, ip, ua)
+	if w.Code != http.StatusOK {
+		t.Fatalf("api verify status=%d body=%s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != api.CookieName {
+		t.Fatalf("api verify cookies=%+v", cookies)
+	}
+	if d := evaluate("api.test", cookies[0], ""); !d.Allowed {
+		t.Fatalf("solved api pass should work on api: %+v", d)
+	}
+	if d := evaluate("shop.test", nil, cookies[0].Value); d.Allowed {
+		t.Fatal("api pass should not be accepted on shop")
+	}
+}
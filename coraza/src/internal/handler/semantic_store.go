@@ -18,6 +18,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"mamotama/internal/metrics"
 )
 
 const (
@@ -53,6 +55,9 @@ type semanticConfig struct {
 	ChallengeThreshold int      `json:"challenge_threshold"`
 	BlockThreshold     int      `json:"block_threshold"`
 	MaxInspectBody     int64    `json:"max_inspect_body"`
+	ChallengeType      string   `json:"challenge_type,omitempty"`
+	PoWDifficulty      int      `json:"pow_difficulty,omitempty"`
+	PoWMaxDifficulty   int      `json:"pow_max_difficulty,omitempty"`
 }
 
 type semanticStats struct {
@@ -135,7 +140,9 @@ func GetSemanticStats() semanticStats {
 	}
 }
 
-func ReloadSemantic() error {
+func ReloadSemantic() (err error) {
+	defer func() { metrics.ObserveReload("semantic", err) }()
+
 	path := GetSemanticPath()
 	if path == "" {
 		return fmt.Errorf("semantic path is empty")
@@ -241,46 +248,44 @@ func HasValidSemanticChallengeCookie(r *http.Request, clientIP string, now time.
 	return verifySemanticChallengeToken(rt, c.Value, clientIP, r.UserAgent(), now.UTC())
 }
 
-func WriteSemanticChallenge(w http.ResponseWriter, r *http.Request, clientIP string) {
+func WriteSemanticChallenge(w http.ResponseWriter, r *http.Request, clientIP string, score int) {
 	rt := currentSemanticRuntime()
 	if rt == nil {
 		w.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
 
-	token := issueSemanticChallengeToken(rt, clientIP, r.UserAgent(), time.Now().UTC())
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("X-Mamotama-Semantic-Challenge", "required")
 
+	if rt.Raw.ChallengeType == challengeTypePoW {
+		difficulty := semanticPoWDifficulty(rt.Raw, score)
+		challenge := issuePoWChallenge(rt.challengeSecret, powScopeSemantic, difficulty, clientIP, r.UserAgent(), time.Now().UTC())
+		if !acceptsHTML(r.Header.Get("Accept")) {
+			writePoWChallengeJSON(w, r, rt.challengeStatusCode, "semantic challenge required", challenge, difficulty)
+			return
+		}
+		writeChallengeHTML(w, r, rt.challengeStatusCode, "Semantic Challenge", "Verifying request safety...", powChallengeScript(challenge, difficulty))
+		return
+	}
+
+	token := issueSemanticChallengeToken(rt, clientIP, r.UserAgent(), time.Now().UTC())
+
 	if !acceptsHTML(r.Header.Get("Accept")) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(rt.challengeStatusCode)
-		_, _ = w.Write([]byte(`{"error":"semantic challenge required"}`))
+		writeChallengeDescriptor(w, r, rt.challengeStatusCode, map[string]any{"error": "semantic challenge required"})
 		return
 	}
+	writeChallengeHTML(w, r, rt.challengeStatusCode, "Semantic Challenge", "Verifying request safety...", cookieChallengeScript(token, rt.challengeCookieName, int(rt.challengeTTL.Seconds())))
+}
 
-	maxAge := int(rt.challengeTTL.Seconds())
-	if maxAge < 1 {
-		maxAge = 1
-	}
-	body := fmt.Sprintf(`<!doctype html>
-<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
-<title>Semantic Challenge</title></head>
-<body>
-<p>Verifying request safety...</p>
-<script>
-(() => {
-  const token = %q;
-  const cookieName = %q;
-  document.cookie = cookieName + "=" + token + "; Path=/; Max-Age=%d; SameSite=Lax";
-  window.location.replace(window.location.href);
-})();
-</script>
-<noscript>JavaScript is required to continue.</noscript>
-</body></html>`, token, rt.challengeCookieName, maxAge)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(rt.challengeStatusCode)
-	_, _ = w.Write([]byte(body))
+// semanticPoWDifficulty adds one bit of work per score point above the
+// challenge threshold, so riskier payloads cost more to retry.
+func semanticPoWDifficulty(cfg semanticConfig, score int) int {
+	extra := score - cfg.ChallengeThreshold
+	if extra < 0 {
+		extra = 0
+	}
+	return clampPoWDifficulty(cfg.PoWDifficulty+extra, cfg.PoWDifficulty, cfg.PoWMaxDifficulty)
 }
 
 func currentSemanticRuntime() *runtimeSemanticConfig {
@@ -352,6 +357,17 @@ func normalizeSemanticConfig(cfg semanticConfig) (semanticConfig, error) {
 	if cfg.MaxInspectBody <= 0 {
 		cfg.MaxInspectBody = 16 * 1024
 	}
+	challengeType, err := normalizeChallengeType(cfg.ChallengeType)
+	if err != nil {
+		return semanticConfig{}, err
+	}
+	cfg.ChallengeType = challengeType
+	if cfg.ChallengeType == challengeTypePoW {
+		cfg.PoWDifficulty, cfg.PoWMaxDifficulty, err = normalizePoWDifficulty(cfg.PoWDifficulty, cfg.PoWMaxDifficulty)
+		if err != nil {
+			return semanticConfig{}, err
+		}
+	}
 	if !cfg.Enabled {
 		cfg.Mode = semanticModeOff
 		return cfg, nil
@@ -529,7 +545,10 @@ func ensureSemanticFile(path string) error {
   "log_threshold": 7,
   "challenge_threshold": 10,
   "block_threshold": 13,
-  "max_inspect_body": 8192
+  "max_inspect_body": 8192,
+  "challenge_type": "cookie",
+  "pow_difficulty": 16,
+  "pow_max_difficulty": 20
 }
 `
 	return os.WriteFile(path, []byte(defaultRaw), 0o644)
@@ -26,6 +26,8 @@ func SyncAllStorageFromDB() error {
 		{name: "rate-limit", run: SyncRateLimitStorage},
 		{name: "bot-defense", run: SyncBotDefenseStorage},
 		{name: "semantic", run: SyncSemanticStorage},
+		{name: "response-templates", run: SyncResponseTemplatesStorage},
+		{name: "routes", run: SyncRoutesStorage},
 		{name: "cache-rules", run: SyncCacheRulesStorage},
 	}
 
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/tracing"
+)
+
+type syncBufferForTest struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBufferForTest) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBufferForTest) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestProxyHandler_TracesStagesAndPropagates(t *testing.T) {
+	restoreRL := saveRateLimitStateForTest()
+	defer restoreRL()
+	eventsPath := filepath.Join(t.TempDir(), "events.ndjson")
+	t.Setenv("WAF_EVENTS_FILE", eventsPath)
+
+	var spans syncBufferForTest
+	stop, err := tracing.Configure(tracing.Config{Exporter: tracing.ExporterStdout, SampleRatio: 1, Stdout: &spans})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	t.Cleanup(func() { _ = stop() })
+
+	upstreamTraceparent := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent <- r.Header.Get("Traceparent")
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+
+	useAppURLForTest(t, backend.URL)
+	useRoutesForTest(t, fmt.Sprintf(`{
+  "upstreams": [{"name": "tracing", "url": %q}],
+  "routes": [{"name": "tracing", "hosts": ["tracing.test"], "upstream": "tracing", "bypass": ["/"], "rate_limit": %s}]
+}`, backend.URL, rateLimitRawForTest(1)))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(ProxyHandler)
+	front := httptest.NewServer(engine)
+	t.Cleanup(front.Close)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	get := func() int {
+		req, err := http.NewRequest(http.MethodGet, front.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = "tracing.test"
+		req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		res, err := front.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		defer res.Body.Close()
+		_, _ = io.Copy(io.Discard, res.Body)
+		return res.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("first status=%d", code)
+	}
+	tp := <-upstreamTraceparent
+	if !strings.HasPrefix(tp, "00-"+traceID+"-") || strings.Contains(tp, "00f067aa0ba902b7") {
+		t.Fatalf("upstream traceparent=%q", tp)
+	}
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Fatalf("second status=%d", code)
+	}
+
+	var limited map[string]any
+	for _, evt := range readEventsForTest(t, eventsPath) {
+		if evt["event"] == "rate_limited" {
+			limited = evt
+		}
+	}
+	if limited == nil || limited["trace_id"] != traceID || limited["req_id"] == "" {
+		t.Fatalf("rate_limited event without trace_id: %v", limited)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	names := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		var s struct {
+			TraceID string `json:"trace_id"`
+			Name    string `json:"name"`
+		}
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatalf("decode span %q: %v", line, err)
+		}
+		if s.TraceID != traceID {
+			t.Fatalf("span %s has trace id %s", s.Name, s.TraceID)
+		}
+		names[s.Name]++
+	}
+	for name, want := range map[string]int{"GET": 2, "country": 2, "rate_limit": 2, "upstream": 1, "upstream.attempt": 1} {
+		if names[name] != want {
+			t.Fatalf("span %s count=%d want=%d (all=%v)", name, names[name], want, names)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upstreamBalanceRoundRobin     = "round_robin"
+	upstreamBalanceLeastConn      = "least_conn"
+	upstreamBalanceConsistentHash = "consistent_hash"
+
+	defaultHealthCheckInterval      = 10
+	defaultHealthCheckTimeout       = 2
+	defaultHealthCheckHealthyThresh = 2
+	defaultHealthCheckUnhealthyTh   = 3
+	defaultOutlierFailures          = 5
+	defaultOutlierEjectSeconds      = 30
+
+	// hashRingReplicas is the number of virtual nodes per target; enough to
+	// keep the spread even for a handful of targets.
+	hashRingReplicas = 64
+)
+
+type upstreamHealthCheckConfig struct {
+	Path               string `json:"path"`
+	IntervalSeconds    int    `json:"interval_seconds,omitempty"`
+	TimeoutSeconds     int    `json:"timeout_seconds,omitempty"`
+	HealthyThreshold   int    `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold,omitempty"`
+	// ExpectStatus lists accepted probe statuses; empty means 200-399.
+	ExpectStatus []int `json:"expect_status,omitempty"`
+}
+
+type upstreamOutlierConfig struct {
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	EjectSeconds        int `json:"eject_seconds,omitempty"`
+}
+
+type upstreamTarget struct {
+	URL      *url.URL
+	director func(*http.Request)
+
+	active atomic.Int64
+
+	mu                  sync.Mutex
+	probeHealthy        bool
+	probeSuccesses      int
+	probeFailures       int
+	lastProbeAt         time.Time
+	lastProbeError      string
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	ejections           int
+	requests            uint64
+	failures            uint64
+}
+
+type hashRingPoint struct {
+	hash   uint32
+	index  int
+	target *upstreamTarget
+}
+
+// normalizeHealthCheck fills defaults and validates a health_check block.
+func normalizeHealthCheck(in *upstreamHealthCheckConfig) (*upstreamHealthCheckConfig, error) {
+	if in == nil {
+		return nil, nil
+	}
+	hc := *in
+	hc.Path = strings.TrimSpace(hc.Path)
+	if !strings.HasPrefix(hc.Path, "/") {
+		return nil, fmt.Errorf("health_check.path must start with '/'")
+	}
+	if hc.IntervalSeconds == 0 {
+		hc.IntervalSeconds = defaultHealthCheckInterval
+	}
+	if hc.TimeoutSeconds == 0 {
+		hc.TimeoutSeconds = defaultHealthCheckTimeout
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = defaultHealthCheckHealthyThresh
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = defaultHealthCheckUnhealthyTh
+	}
+	if hc.IntervalSeconds < 1 || hc.TimeoutSeconds < 1 || hc.HealthyThreshold < 1 || hc.UnhealthyThreshold < 1 {
+		return nil, fmt.Errorf("health_check intervals and thresholds must be positive")
+	}
+	if hc.TimeoutSeconds > hc.IntervalSeconds {
+		return nil, fmt.Errorf("health_check.timeout_seconds must not exceed interval_seconds")
+	}
+	for _, code := range hc.ExpectStatus {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("health_check.expect_status: %d is not an HTTP status", code)
+		}
+	}
+	return &hc, nil
+}
+
+func normalizeOutlier(in *upstreamOutlierConfig) (*upstreamOutlierConfig, error) {
+	if in == nil {
+		return nil, nil
+	}
+	oc := *in
+	if oc.ConsecutiveFailures == 0 {
+		oc.ConsecutiveFailures = defaultOutlierFailures
+	}
+	if oc.EjectSeconds == 0 {
+		oc.EjectSeconds = defaultOutlierEjectSeconds
+	}
+	if oc.ConsecutiveFailures < 1 || oc.EjectSeconds < 1 {
+		return nil, fmt.Errorf("outlier_detection values must be positive")
+	}
+	return &oc, nil
+}
+
+func newUpstreamTarget(u *url.URL) *upstreamTarget {
+	return &upstreamTarget{
+		URL:          u,
+		director:     httputil.NewSingleHostReverseProxy(u).Director,
+		probeHealthy: true,
+	}
+}
+
+func (up *runtimeUpstream) buildHashRing() {
+	up.ring = make([]hashRingPoint, 0, len(up.targets)*hashRingReplicas)
+	for idx, t := range up.targets {
+		for i := 0; i < hashRingReplicas; i++ {
+			up.ring = append(up.ring, hashRingPoint{hash: hash32(t.URL.String() + "#" + strconv.Itoa(i)), index: idx, target: t})
+		}
+	}
+	sort.Slice(up.ring, func(i, j int) bool { return up.ring[i].hash < up.ring[j].hash })
+}
+
+// hash32 is FNV-1a with a murmur3 finalizer; plain FNV spreads keys that
+// differ only in their last byte (such as neighbouring IPs) poorly.
+func hash32(s string) uint32 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+// ServeHTTP forwards to one target picked by the balancing strategy; the
+// transport reports each attempt to passive outlier detection.
+func (up *runtimeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := &upstreamAttempt{target: up.pick(r, time.Now())}
+	if r.URL != nil {
+		a.origURL = *r.URL
+	}
+	up.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyUpstream, a)))
+}
+
+func (up *runtimeUpstream) pick(r *http.Request, now time.Time) *upstreamTarget {
+	return up.pickExcluding(r, now, nil)
+}
+
+// pickExcluding never returns nil. Targets in skip are avoided while others
+// remain, and when every target is down traffic is spread over all of them
+// rather than failing outright.
+func (up *runtimeUpstream) pickExcluding(r *http.Request, now time.Time, skip map[*upstreamTarget]bool) *upstreamTarget {
+	if len(up.targets) == 1 {
+		return up.targets[0]
+	}
+	avail := make([]bool, len(up.targets))
+	anyAvailable := false
+	for i, t := range up.targets {
+		avail[i] = !skip[t] && t.available(now)
+		anyAvailable = anyAvailable || avail[i]
+	}
+	if !anyAvailable {
+		for i, t := range up.targets {
+			avail[i] = !skip[t]
+			anyAvailable = anyAvailable || avail[i]
+		}
+	}
+	if !anyAvailable {
+		for i := range avail {
+			avail[i] = true
+		}
+	}
+
+	switch up.Balance {
+	case upstreamBalanceConsistentHash:
+		return up.pickHash(r, avail)
+	case upstreamBalanceLeastConn:
+		start := int(up.rr.Add(1))
+		var best *upstreamTarget
+		var bestActive int64
+		for i := range up.targets {
+			idx := (start + i) % len(up.targets)
+			if !avail[idx] {
+				continue
+			}
+			t := up.targets[idx]
+			if n := t.active.Load(); best == nil || n < bestActive {
+				best, bestActive = t, n
+			}
+		}
+		return best
+	default:
+		start := int(up.rr.Add(1) - 1)
+		for i := range up.targets {
+			idx := (start + i) % len(up.targets)
+			if avail[idx] {
+				return up.targets[idx]
+			}
+		}
+		return up.targets[start%len(up.targets)]
+	}
+}
+
+func (up *runtimeUpstream) pickHash(r *http.Request, avail []bool) *upstreamTarget {
+	ip, _ := r.Context().Value(ctxKeyIP).(string)
+	country, _ := r.Context().Value(ctxKeyCountry).(string)
+	h := hash32(buildRateLimitKey(up.hashKey, r, ip, country))
+	start := sort.Search(len(up.ring), func(i int) bool { return up.ring[i].hash >= h })
+	for i := 0; i < len(up.ring); i++ {
+		p := up.ring[(start+i)%len(up.ring)]
+		if avail[p.index] {
+			return p.target
+		}
+	}
+	return up.ring[start%len(up.ring)].target
+}
+
+func (t *upstreamTarget) available(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.probeHealthy && !now.Before(t.ejectedUntil)
+}
+
+// observe records a proxied request outcome. Consecutive 5xx responses or
+// transport errors eject the target for eject_seconds.
+func (up *runtimeUpstream) observe(t *upstreamTarget, failed bool, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	if !failed {
+		t.consecutiveFailures = 0
+		return
+	}
+	t.failures++
+	t.consecutiveFailures++
+	if up.outlier == nil || t.consecutiveFailures < up.outlier.ConsecutiveFailures {
+		return
+	}
+	now := time.Now()
+	if now.Before(t.ejectedUntil) {
+		return
+	}
+	t.ejectedUntil = now.Add(time.Duration(up.outlier.EjectSeconds) * time.Second)
+	t.ejections++
+	t.consecutiveFailures = 0
+	if reason == "" {
+		reason = "5xx"
+	}
+	log.Printf("[UPSTREAM][EJECT] upstream=%s target=%s for=%ds reason=%s", up.Name, t.URL.Redacted(), up.outlier.EjectSeconds, reason)
+}
+
+func (up *runtimeUpstream) startHealthChecks() {
+	if up.health == nil || up.stop != nil {
+		return
+	}
+	up.stop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(up.health.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			up.probeOnce()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(up.stop)
+}
+
+// release stops health probes and drops idle pooled connections once the
+// upstream has been replaced; in-flight requests finish normally.
+func (up *runtimeUpstream) release() {
+	up.stopOnce.Do(func() {
+		if up.stop != nil {
+			close(up.stop)
+		}
+		if up.transport != nil {
+			up.transport.CloseIdleConnections()
+		}
+	})
+}
+
+// probeOnce checks every target concurrently and waits for the results.
+func (up *runtimeUpstream) probeOnce() {
+	if up.health == nil {
+		return
+	}
+	client := &http.Client{
+		Transport: up.transport,
+		Timeout:   time.Duration(up.health.TimeoutSeconds) * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var wg sync.WaitGroup
+	for _, t := range up.targets {
+		wg.Add(1)
+		go func(t *upstreamTarget) {
+			defer wg.Done()
+			up.recordProbe(t, up.probeTarget(client, t))
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (up *runtimeUpstream) probeTarget(client *http.Client, t *upstreamTarget) error {
+	probeURL := *t.URL
+	probeURL.Path = strings.TrimSuffix(probeURL.Path, "/") + up.health.Path
+	probeURL.RawPath = ""
+	probeURL.RawQuery = ""
+	req, err := http.NewRequest(http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "mamotama-health-check")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if len(up.health.ExpectStatus) == 0 {
+		if res.StatusCode >= 200 && res.StatusCode < 400 {
+			return nil
+		}
+	} else {
+		for _, code := range up.health.ExpectStatus {
+			if res.StatusCode == code {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unexpected status %d", res.StatusCode)
+}
+
+func (up *runtimeUpstream) recordProbe(t *upstreamTarget, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastProbeAt = time.Now()
+	if err == nil {
+		t.lastProbeError = ""
+		t.probeFailures = 0
+		t.probeSuccesses++
+		if !t.probeHealthy && t.probeSuccesses >= up.health.HealthyThreshold {
+			t.probeHealthy = true
+			log.Printf("[UPSTREAM][HEALTH] upstream=%s target=%s healthy=true", up.Name, t.URL.Redacted())
+		}
+		return
+	}
+	t.lastProbeError = err.Error()
+	t.probeSuccesses = 0
+	t.probeFailures++
+	if t.probeHealthy && t.probeFailures >= up.health.UnhealthyThreshold {
+		t.probeHealthy = false
+		log.Printf("[UPSTREAM][HEALTH] upstream=%s target=%s healthy=false reason=%s", up.Name, t.URL.Redacted(), t.lastProbeError)
+	}
+}
+
+func (rt *runtimeRoutesConfig) startHealthChecks() {
+	for _, up := range rt.Upstreams {
+		up.startHealthChecks()
+	}
+}
+
+func (rt *runtimeRoutesConfig) release() {
+	for _, up := range rt.Upstreams {
+		up.release()
+	}
+}
+
+// upstreamStatus reports per-target balancing and health state for
+// StatusHandler.
+func upstreamStatus() []map[string]any {
+	var ups []*runtimeUpstream
+	if rt := currentRoutesRuntime(); rt != nil {
+		names := make([]string, 0, len(rt.Upstreams))
+		for name := range rt.Upstreams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ups = append(ups, rt.Upstreams[name])
+		}
+	} else {
+		ups = append(ups, resolveRoute(nil).Upstream)
+	}
+
+	now := time.Now()
+	out := make([]map[string]any, 0, len(ups))
+	for _, up := range ups {
+		targets := make([]map[string]any, 0, len(up.targets))
+		for _, t := range up.targets {
+			targets = append(targets, t.status(now))
+		}
+		out = append(out, map[string]any{
+			"name":              up.Name,
+			"balance":           up.Balance,
+			"health_check":      up.health != nil,
+			"outlier_detection": up.outlier != nil,
+			"targets":           targets,
+		})
+	}
+	return out
+}
+
+func (t *upstreamTarget) status(now time.Time) map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ejected := now.Before(t.ejectedUntil)
+	out := map[string]any{
+		"url":                  t.URL.Redacted(),
+		"available":            t.probeHealthy && !ejected,
+		"healthy":              t.probeHealthy,
+		"ejected":              ejected,
+		"ejected_until":        "",
+		"ejections":            t.ejections,
+		"active_requests":      t.active.Load(),
+		"requests":             t.requests,
+		"failures":             t.failures,
+		"consecutive_failures": t.consecutiveFailures,
+		"last_probe_at":        "",
+		"last_probe_error":     t.lastProbeError,
+	}
+	if ejected {
+		out["ejected_until"] = t.ejectedUntil.UTC().Format(time.RFC3339)
+	}
+	if !t.lastProbeAt.IsZero() {
+		out["last_probe_at"] = t.lastProbeAt.UTC().Format(time.RFC3339)
+	}
+	return out
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newUpstreamForTest(t *testing.T, uc routeUpstreamConfig) *runtimeUpstream {
+	t.Helper()
+	if uc.Name == "" {
+		uc.Name = "test"
+	}
+	up, err := newRuntimeUpstream(uc)
+	if err != nil {
+		t.Fatalf("newRuntimeUpstream() unexpected error: %v", err)
+	}
+	t.Cleanup(up.release)
+	return up
+}
+
+func requestFromIP(ip string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	return req.WithContext(context.WithValue(req.Context(), ctxKeyIP, ip))
+}
+
+func TestRuntimeUpstream_RoundRobinSkipsUnavailable(t *testing.T) {
+	up := newUpstreamForTest(t, routeUpstreamConfig{Targets: []string{"http://a:1", "http://b:1", "http://c:1"}})
+	now := time.Now()
+
+	got := ""
+	for i := 0; i < 6; i++ {
+		got += up.pick(requestFromIP("10.0.0.1"), now).URL.Host[:1]
+	}
+	if got != "abcabc" {
+		t.Fatalf("round robin order=%q", got)
+	}
+
+	up.targets[1].ejectedUntil = now.Add(time.Minute)
+	for i := 0; i < 6; i++ {
+		if h := up.pick(requestFromIP("10.0.0.1"), now).URL.Host; h == "b:1" {
+			t.Fatal("ejected target must not be picked")
+		}
+	}
+
+	for _, tg := range up.targets {
+		tg.ejectedUntil = now.Add(time.Minute)
+	}
+	if up.pick(requestFromIP("10.0.0.1"), now) == nil {
+		t.Fatal("all targets down should still pick one")
+	}
+}
+
+func TestRuntimeUpstream_LeastConn(t *testing.T) {
+	up := newUpstreamForTest(t, routeUpstreamConfig{Targets: []string{"http://a:1", "http://b:1", "http://c:1"}, Balance: "least_conn"})
+	up.targets[0].active.Store(3)
+	up.targets[1].active.Store(1)
+	up.targets[2].active.Store(2)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if h := up.pick(requestFromIP("10.0.0.1"), now).URL.Host; h != "b:1" {
+			t.Fatalf("least_conn picked %s", h)
+		}
+	}
+	up.targets[1].probeHealthy = false
+	if h := up.pick(requestFromIP("10.0.0.1"), now).URL.Host; h != "c:1" {
+		t.Fatalf("least_conn should skip unhealthy target, picked %s", h)
+	}
+}
+
+func TestRuntimeUpstream_ConsistentHashIsSticky(t *testing.T) {
+	up := newUpstreamForTest(t, routeUpstreamConfig{Targets: []string{"http://a:1", "http://b:1", "http://c:1"}, Balance: "consistent_hash"})
+	now := time.Now()
+
+	first := map[string]*upstreamTarget{}
+	used := map[*upstreamTarget]bool{}
+	for i := 0; i < 50; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		tg := up.pick(requestFromIP(ip), now)
+		if again := up.pick(requestFromIP(ip), now); again != tg {
+			t.Fatalf("ip %s moved from %s to %s", ip, tg.URL.Host, again.URL.Host)
+		}
+		first[ip] = tg
+		used[tg] = true
+	}
+	if len(used) != 3 {
+		t.Fatalf("keys should spread over all targets, used=%d", len(used))
+	}
+
+	ejected := up.targets[0]
+	ejected.ejectedUntil = now.Add(time.Minute)
+	for ip, tg := range first {
+		got := up.pick(requestFromIP(ip), now)
+		if got == ejected {
+			t.Fatalf("ip %s still on ejected target", ip)
+		}
+		if tg != ejected && got != tg {
+			t.Fatalf("ip %s moved although its target is healthy", ip)
+		}
+	}
+}
+
+func TestRuntimeUpstream_PassiveEjection(t *testing.T) {
+	var goodHits, badHits atomic.Int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits.Add(1)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(good.Close)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(bad.Close)
+
+	up := newUpstreamForTest(t, routeUpstreamConfig{
+		Targets: []string{bad.URL, good.URL},
+		Outlier: &upstreamOutlierConfig{ConsecutiveFailures: 2, EjectSeconds: 60},
+	})
+	front := httptest.NewServer(up)
+	t.Cleanup(front.Close)
+
+	for i := 0; i < 10; i++ {
+		res, err := front.Client().Get(front.URL + "/")
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		res.Body.Close()
+	}
+	if badHits.Load() != 2 || goodHits.Load() != 8 {
+		t.Fatalf("bad=%d good=%d, want bad target ejected after 2 failures", badHits.Load(), goodHits.Load())
+	}
+
+	st := up.targets[0].status(time.Now())
+	if st["ejected"] != true || st["available"] != false || st["ejections"] != 1 || st["failures"] != uint64(2) {
+		t.Fatalf("unexpected bad target status: %v", st)
+	}
+}
+
+func TestRuntimeUpstream_ActiveHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(flaky.Close)
+	steady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(steady.Close)
+
+	up := newUpstreamForTest(t, routeUpstreamConfig{
+		Targets:     []string{flaky.URL, steady.URL},
+		HealthCheck: &upstreamHealthCheckConfig{Path: "/healthz", HealthyThreshold: 2, UnhealthyThreshold: 1},
+	})
+
+	up.probeOnce()
+	if !up.targets[0].available(time.Now()) {
+		t.Fatal("target should start healthy")
+	}
+
+	healthy.Store(false)
+	up.probeOnce()
+	st := up.targets[0].status(time.Now())
+	if st["healthy"] != false || st["last_probe_error"] != "unexpected status 503" {
+		t.Fatalf("unexpected status after failed probe: %v", st)
+	}
+	for i := 0; i < 4; i++ {
+		if tg := up.pick(requestFromIP("10.0.0.1"), time.Now()); tg != up.targets[1] {
+			t.Fatal("unhealthy target must not be picked")
+		}
+	}
+
+	healthy.Store(true)
+	up.probeOnce()
+	if up.targets[0].available(time.Now()) {
+		t.Fatal("one success should not restore a target with healthy_threshold=2")
+	}
+	up.probeOnce()
+	if !up.targets[0].available(time.Now()) {
+		t.Fatal("target should recover after healthy_threshold successes")
+	}
+}
+
+func TestUpstreamStatus_ListsTargets(t *testing.T) {
+	useAppURLForTest(t, "http://app.internal:3000")
+	useRoutesForTest(t, `{
+  "upstreams": [{"name": "api", "targets": ["http://api-1:8080", "http://api-2:8080"], "balance": "least_conn"}],
+  "routes": [{"name": "api", "path_prefixes": ["/api/"], "upstream": "api"}]
+}`)
+
+	got := upstreamStatus()
+	if len(got) != 2 || got[0]["name"] != "api" || got[1]["name"] != defaultRouteName {
+		t.Fatalf("unexpected upstreams: %v", got)
+	}
+	if got[0]["balance"] != upstreamBalanceLeastConn {
+		t.Fatalf("balance=%v", got[0]["balance"])
+	}
+	targets, _ := got[0]["targets"].([]map[string]any)
+	if len(targets) != 2 || targets[1]["url"] != "http://api-2:8080" || targets[1]["available"] != true {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+}
@@ -0,0 +1,374 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"mamotama/internal/tracing"
+)
+
+const (
+	defaultUpstreamDialTimeoutMS     = 5000
+	defaultUpstreamTLSHandshakeMS    = 10000
+	defaultUpstreamIdleConnTimeoutMS = 90000
+	defaultUpstreamMaxIdleConns      = 256
+	defaultUpstreamMaxIdlePerHost    = 64
+	maxUpstreamTimeoutMS             = 600000
+	maxUpstreamRetryAttempts         = 5
+)
+
+var defaultUpstreamRetryStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// upstreamTransportConfig tunes the connection pool shared by all targets of
+// an upstream. Zero values take the defaults above; response_header_timeout_ms
+// of 0 means no limit.
+type upstreamTransportConfig struct {
+	DialTimeoutMS           int                `json:"dial_timeout_ms,omitempty"`
+	TLSHandshakeTimeoutMS   int                `json:"tls_handshake_timeout_ms,omitempty"`
+	ResponseHeaderTimeoutMS int                `json:"response_header_timeout_ms,omitempty"`
+	IdleConnTimeoutMS       int                `json:"idle_conn_timeout_ms,omitempty"`
+	MaxIdleConns            int                `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost     int                `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost         int                `json:"max_conns_per_host,omitempty"`
+	TLS                     *upstreamTLSConfig `json:"tls,omitempty"`
+}
+
+type upstreamTLSConfig struct {
+	CAFile     string `json:"ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify is meant for staging backends with self-signed
+	// certificates only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// upstreamRetryConfig retries bodyless idempotent requests on transport
+// errors and on_status responses, preferring a different target each time.
+type upstreamRetryConfig struct {
+	Attempts int   `json:"attempts"`
+	OnStatus []int `json:"on_status,omitempty"`
+}
+
+// upstreamAttempt travels in the request context so that the transport can
+// re-target retries and the error handler can report what was tried.
+type upstreamAttempt struct {
+	target   *upstreamTarget
+	origURL  url.URL
+	attempts int
+}
+
+func buildUpstreamTransport(cfg *upstreamTransportConfig) (*http.Transport, error) {
+	var c upstreamTransportConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	for _, v := range []struct {
+		name string
+		val  *int
+		def  int
+	}{
+		{"dial_timeout_ms", &c.DialTimeoutMS, defaultUpstreamDialTimeoutMS},
+		{"tls_handshake_timeout_ms", &c.TLSHandshakeTimeoutMS, defaultUpstreamTLSHandshakeMS},
+		{"response_header_timeout_ms", &c.ResponseHeaderTimeoutMS, 0},
+		{"idle_conn_timeout_ms", &c.IdleConnTimeoutMS, defaultUpstreamIdleConnTimeoutMS},
+	} {
+		if *v.val == 0 {
+			*v.val = v.def
+		}
+		if *v.val < 0 || *v.val > maxUpstreamTimeoutMS {
+			return nil, fmt.Errorf("transport.%s must be between 0 and %d", v.name, maxUpstreamTimeoutMS)
+		}
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = defaultUpstreamMaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = defaultUpstreamMaxIdlePerHost
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("transport connection limits must not be negative")
+	}
+
+	tlsConfig, err := buildUpstreamTLSConfig(c.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("transport.tls: %w", err)
+	}
+
+	ms := func(v int) time.Duration { return time.Duration(v) * time.Millisecond }
+	dialer := &net.Dialer{Timeout: ms(c.DialTimeoutMS), KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   ms(c.TLSHandshakeTimeoutMS),
+		ResponseHeaderTimeout: ms(c.ResponseHeaderTimeoutMS),
+		IdleConnTimeout:       ms(c.IdleConnTimeoutMS),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+	}, nil
+}
+
+func buildUpstreamTLSConfig(c *upstreamTLSConfig) (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+	out := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         strings.TrimSpace(c.ServerName),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if path := strings.TrimSpace(c.CAFile); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no PEM certificates in %s", path)
+		}
+		out.RootCAs = pool
+	}
+	certFile, keyFile := strings.TrimSpace(c.CertFile), strings.TrimSpace(c.KeyFile)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		out.Certificates = []tls.Certificate{cert}
+	}
+	return out, nil
+}
+
+func normalizeRetry(in *upstreamRetryConfig) (*upstreamRetryConfig, error) {
+	if in == nil || in.Attempts == 0 {
+		return nil, nil
+	}
+	rc := *in
+	if rc.Attempts < 0 || rc.Attempts > maxUpstreamRetryAttempts {
+		return nil, fmt.Errorf("retry.attempts must be between 0 and %d", maxUpstreamRetryAttempts)
+	}
+	if len(rc.OnStatus) == 0 {
+		rc.OnStatus = defaultUpstreamRetryStatus
+	}
+	for _, code := range rc.OnStatus {
+		if code < 500 || code > 599 {
+			return nil, fmt.Errorf("retry.on_status: %d is not a 5xx status", code)
+		}
+	}
+	return &rc, nil
+}
+
+func newUpstreamProxy(up *runtimeUpstream) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if a, ok := req.Context().Value(ctxKeyUpstream).(*upstreamAttempt); ok {
+				a.target.director(req)
+			}
+		},
+		Transport:      &upstreamRoundTripper{up: up},
+		ModifyResponse: onProxyResponse,
+		ErrorHandler:   up.handleProxyError,
+	}
+}
+
+type upstreamRoundTripper struct {
+	up *runtimeUpstream
+}
+
+// RoundTrip sends the request to the target chosen in ServeHTTP. Every
+// attempt feeds passive outlier detection; retries go to the next
+// available target when there is one.
+func (rtp *upstreamRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	up := rtp.up
+	a, _ := req.Context().Value(ctxKeyUpstream).(*upstreamAttempt)
+	if a == nil {
+		return up.transport.RoundTrip(req)
+	}
+
+	tried := map[*upstreamTarget]bool{}
+	for {
+		a.attempts++
+		tried[a.target] = true
+		res, err := rtp.roundTripTarget(a.target, req)
+		if !up.shouldRetry(req, a.attempts, res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		next := up.pickExcluding(req, time.Now(), tried)
+		log.Printf("[UPSTREAM][RETRY] upstream=%s attempt=%d from=%s to=%s", up.Name, a.attempts+1, a.target.URL.Redacted(), next.URL.Redacted())
+		a.target = next
+		retry := req.Clone(req.Context())
+		u := a.origURL
+		retry.URL = &u
+		next.director(retry)
+		req = retry
+	}
+}
+
+func (rtp *upstreamRoundTripper) roundTripTarget(t *upstreamTarget, req *http.Request) (*http.Response, error) {
+	t.active.Add(1)
+	defer t.active.Add(-1)
+
+	// The attempt span is only propagated: the response keeps the request
+	// context, so response inspection stays under the upstream span.
+	actx, span := tracing.Start(req.Context(), "upstream.attempt", tracing.SpanKindClient)
+	span.SetAttr("mamotama.upstream", rtp.up.Name)
+	span.SetAttr("url.full", t.URL.Redacted())
+	out := req.Clone(req.Context())
+	tracing.Inject(actx, out.Header)
+
+	start := time.Now()
+	res, err := rtp.up.transport.RoundTrip(out)
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+		span.SetAttr("http.response.status_code", statusCode)
+		if statusCode >= http.StatusInternalServerError {
+			span.SetError(res.Status)
+		}
+	}
+	if err != nil {
+		span.SetAttr("error.type", upstreamErrorKind(err))
+		span.SetError(err.Error())
+	}
+	span.End()
+	observeUpstreamAttempt(rtp.up, t, start, statusCode, err)
+	switch {
+	case err != nil:
+		if !errors.Is(err, context.Canceled) {
+			rtp.up.observe(t, true, err.Error())
+		}
+	default:
+		rtp.up.observe(t, res.StatusCode >= http.StatusInternalServerError, "")
+	}
+	return res, err
+}
+
+func (up *runtimeUpstream) shouldRetry(req *http.Request, attempts int, res *http.Response, err error) bool {
+	if up.retry == nil || attempts > up.retry.Attempts {
+		return false
+	}
+	if req.Context().Err() != nil || !isRetryableRequest(req) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, code := range up.retry.OnStatus {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableRequest allows idempotent methods whose body does not need to
+// be replayed.
+func isRetryableRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// handleProxyError replaces the default ErrorHandler: it answers 502, or
+// 504 on timeouts, and records an upstream_error event.
+func (up *runtimeUpstream) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+	target := ""
+	attempts := 0
+	if a, ok := ctx.Value(ctxKeyUpstream).(*upstreamAttempt); ok {
+		target = a.target.URL.Redacted()
+		attempts = a.attempts
+	}
+	kind := upstreamErrorKind(err)
+	upstreamErrorsTotal.Inc(up.Name, kind)
+	if kind == "client_canceled" {
+		setRequestOutcome(ctx, requestOutcomeClientCanceled)
+		log.Printf("[PROXY][INFO] client canceled upstream=%s target=%s", up.Name, target)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	setRequestOutcome(ctx, requestOutcomeUpstreamError)
+	status := http.StatusBadGateway
+	if kind == "timeout" {
+		status = http.StatusGatewayTimeout
+	}
+	reqID, _ := ctx.Value(ctxKeyReqID).(string)
+	if reqID == "" {
+		reqID = r.Header.Get("X-Request-ID")
+	}
+	ip, _ := ctx.Value(ctxKeyIP).(string)
+	country, _ := ctx.Value(ctxKeyCountry).(string)
+	countrySource, _ := ctx.Value(ctxKeyCountrySource).(string)
+	route, _ := ctx.Value(ctxKeyRoute).(string)
+	evt := map[string]any{
+		"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+		"service":        "coraza",
+		"level":          "ERROR",
+		"event":          "upstream_error",
+		"req_id":         reqID,
+		"trace_id":       tracing.TraceIDFromContext(ctx),
+		"ip":             ip,
+		"country":        country,
+		"country_source": countrySource,
+		"method":         r.Method,
+		"path":           r.URL.Path,
+		"route":          route,
+		"upstream":       up.Name,
+		"target":         target,
+		"attempts":       attempts,
+		"error_kind":     kind,
+		"error":          err.Error(),
+		"status":         status,
+	}
+	emitJSONLog(evt)
+	_ = appendEventToFile(evt)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintln(w, http.StatusText(status))
+}
+
+func upstreamErrorKind(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	var recErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "client_canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &certErr), errors.As(err, &recErr), strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	default:
+		return "transport"
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readEventsForTest(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatalf("open events: %v", err)
+	}
+	defer f.Close()
+	var out []map[string]any
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var evt map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &evt); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		out = append(out, evt)
+	}
+	return out
+}
+
+func serveUpstreamForTest(t *testing.T, up *runtimeUpstream, method, body string) (int, string) {
+	t.Helper()
+	front := httptest.NewServer(up)
+	defer front.Close()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, front.URL+"/orders", rd)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	res, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+func TestNewRuntimeUpstream_TransportValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		uc      routeUpstreamConfig
+		wantErr string
+	}{
+		{name: "negative timeout", uc: routeUpstreamConfig{Transport: &upstreamTransportConfig{DialTimeoutMS: -1}}, wantErr: "transport.dial_timeout_ms"},
+		{name: "negative pool", uc: routeUpstreamConfig{Transport: &upstreamTransportConfig{MaxConnsPerHost: -1}}, wantErr: "connection limits"},
+		{name: "missing ca", uc: routeUpstreamConfig{Transport: &upstreamTransportConfig{TLS: &upstreamTLSConfig{CAFile: "/nonexistent/ca.pem"}}}, wantErr: "transport.tls: ca_file"},
+		{name: "cert without key", uc: routeUpstreamConfig{Transport: &upstreamTransportConfig{TLS: &upstreamTLSConfig{CertFile: "client.pem"}}}, wantErr: "set together"},
+		{name: "too many retries", uc: routeUpstreamConfig{Retry: &upstreamRetryConfig{Attempts: 9}}, wantErr: "retry.attempts"},
+		{name: "retry on 404", uc: routeUpstreamConfig{Retry: &upstreamRetryConfig{Attempts: 1, OnStatus: []int{404}}}, wantErr: "retry.on_status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.uc.Name = "test"
+			tt.uc.URL = "https://backend:8443"
+			_, err := newRuntimeUpstream(tt.uc)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err=%v want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuntimeUpstream_RetriesIdempotentRequestsOnAnotherTarget(t *testing.T) {
+	eventsPath := filepath.Join(t.TempDir(), "events.ndjson")
+	t.Setenv("WAF_EVENTS_FILE", eventsPath)
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+	var liveHits atomic.Int64
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		liveHits.Add(1)
+		_, _ = io.WriteString(w, "live "+r.Method)
+	}))
+	t.Cleanup(live.Close)
+
+	up := newUpstreamForTest(t, routeUpstreamConfig{
+		Targets: []string{deadURL, live.URL},
+		Retry:   &upstreamRetryConfig{Attempts: 1},
+	})
+
+	// Round robin starts on the dead target, so the GET needs its retry.
+	if code, body := serveUpstreamForTest(t, up, http.MethodGet, ""); code != http.StatusOK || body != "live GET" {
+		t.Fatalf("GET status=%d body=%q", code, body)
+	}
+	if up.targets[0].status(time.Now())["failures"] != uint64(1) {
+		t.Fatal("failed attempt should count against the dead target")
+	}
+
+	// A POST with a body is never replayed.
+	up.rr.Store(0)
+	code, body := serveUpstreamForTest(t, up, http.MethodPost, `{"id":1}`)
+	if code != http.StatusBadGateway || body != "Bad Gateway\n" {
+		t.Fatalf("POST status=%d body=%q", code, body)
+	}
+	if liveHits.Load() != 1 {
+		t.Fatalf("live hits=%d, POST must not be retried", liveHits.Load())
+	}
+
+	events := readEventsForTest(t, eventsPath)
+	if len(events) != 1 {
+		t.Fatalf("events=%d want 1 upstream_error", len(events))
+	}
+	evt := events[0]
+	if evt["event"] != "upstream_error" || evt["error_kind"] != "connect" || evt["upstream"] != "test" ||
+		evt["target"] != deadURL || evt["attempts"] != float64(1) || evt["method"] != http.MethodPost || evt["status"] != float64(http.StatusBadGateway) {
+		t.Fatalf("unexpected event: %v", evt)
+	}
+}
+
+func TestRuntimeUpstream_ResponseHeaderTimeout(t *testing.T) {
+	eventsPath := filepath.Join(t.TempDir(), "events.ndjson")
+	t.Setenv("WAF_EVENTS_FILE", eventsPath)
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	up := newUpstreamForTest(t, routeUpstreamConfig{
+		URL:       slow.URL,
+		Transport: &upstreamTransportConfig{ResponseHeaderTimeoutMS: 50},
+	})
+	if code, _ := serveUpstreamForTest(t, up, http.MethodGet, ""); code != http.StatusGatewayTimeout {
+		t.Fatalf("status=%d want 504", code)
+	}
+	events := readEventsForTest(t, eventsPath)
+	if len(events) != 1 || events[0]["error_kind"] != "timeout" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
+
+func TestRuntimeUpstream_TLSOptions(t *testing.T) {
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(t.TempDir(), "events.ndjson"))
+	dir := t.TempDir()
+
+	clientCertPEM, clientKeyPEM := newClientCertForTest(t)
+	clientCertPath := filepath.Join(dir, "client.pem")
+	clientKeyPath := filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(clientCertPath, clientCertPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(clientKeyPath, clientKeyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCertPEM)
+
+	var gotSNI atomic.Value
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "tls ok")
+	}))
+	backend.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			gotSNI.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		tls      *upstreamTLSConfig
+		wantCode int
+	}{
+		{name: "unknown ca", tls: &upstreamTLSConfig{CertFile: clientCertPath, KeyFile: clientKeyPath}, wantCode: http.StatusBadGateway},
+		{name: "no client cert", tls: &upstreamTLSConfig{CAFile: caPath}, wantCode: http.StatusBadGateway},
+		{name: "ca, mtls and sni", tls: &upstreamTLSConfig{CAFile: caPath, CertFile: clientCertPath, KeyFile: clientKeyPath, ServerName: "api.example.com"}, wantCode: http.StatusOK},
+		{name: "skip verify", tls: &upstreamTLSConfig{InsecureSkipVerify: true, CertFile: clientCertPath, KeyFile: clientKeyPath}, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newUpstreamForTest(t, routeUpstreamConfig{URL: backend.URL, Transport: &upstreamTransportConfig{TLS: tt.tls}})
+			code, body := serveUpstreamForTest(t, up, http.MethodGet, "")
+			if code != tt.wantCode {
+				t.Fatalf("status=%d body=%q want %d", code, body, tt.wantCode)
+			}
+			if tt.tls.ServerName != "" && gotSNI.Load() != tt.tls.ServerName {
+				t.Fatalf("sni=%v want %s", gotSNI.Load(), tt.tls.ServerName)
+			}
+		})
+	}
+}
+
+func newClientCertForTest(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mamotama-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	maxEventMatchedRules      = 20
+	maxEventMatchedValueBytes = 256
+)
+
+// crsAnomalyScoreVars are the CRS 4 TX variables copied into events. Only
+// the ones a rule actually set are recorded.
+var crsAnomalyScoreVars = []string{
+	"blocking_inbound_anomaly_score",
+	"detection_inbound_anomaly_score",
+	"inbound_anomaly_score_threshold",
+	"blocking_outbound_anomaly_score",
+	"detection_outbound_anomaly_score",
+	"outbound_anomaly_score_threshold",
+}
+
+// wafInterruptionDetails describes the interrupting rule and every rule
+// that matched so far, for waf_block and waf_would_block events.
+//
+// The top-level matched_* fields come from the primary detection. That is
+// the interrupting rule itself, except under CRS anomaly scoring, where
+// the blocking rule only matched a TX score. In that case the first
+// detection rule that raised the score is used instead.
+func wafInterruptionDetails(tx types.Transaction, it *types.Interruption) map[string]any {
+	out := map[string]any{
+		"rule_id": it.RuleID,
+		"status":  it.Status,
+		"action":  it.Action,
+	}
+	if tx == nil {
+		return out
+	}
+
+	var interrupting, firstDetection types.MatchedRule
+	ids := make([]string, 0, 4)
+	rules := make([]map[string]any, 0, 4)
+	for _, mr := range tx.MatchedRules() {
+		rule := mr.Rule()
+		if rule == nil {
+			continue
+		}
+		ids = append(ids, strconv.Itoa(rule.ID()))
+		if rule.ID() == it.RuleID {
+			interrupting = mr
+		} else if firstDetection == nil && mr.Message() != "" && !isBlockingEvaluationFile(rule.File()) {
+			firstDetection = mr
+		}
+		if len(rules) < maxEventMatchedRules {
+			rules = append(rules, matchedRuleDetails(mr))
+		}
+	}
+	out["rules"] = strings.Join(unique(ids), ",")
+	if len(rules) > 0 {
+		out["matched_rules"] = rules
+	}
+	if len(ids) > maxEventMatchedRules {
+		out["matched_rules_truncated"] = true
+	}
+
+	if interrupting != nil {
+		if msg := interrupting.Message(); msg != "" {
+			out["msg"] = msg
+		}
+		if f := interrupting.Rule().File(); f != "" {
+			out["rule_file"] = f
+		}
+	}
+
+	primary := interrupting
+	if primary == nil || (firstDetection != nil && isBlockingEvaluationFile(primary.Rule().File())) {
+		primary = firstDetection
+	}
+	if primary != nil {
+		d := matchedRuleDetails(primary)
+		out["matched_rule_id"] = d["id"]
+		for _, k := range []string{"severity", "tags", "matched_variable", "matched_value"} {
+			if v, ok := d[k]; ok {
+				out[k] = v
+			}
+		}
+	}
+
+	if scores := crsAnomalyScores(tx); len(scores) > 0 {
+		out["anomaly_scores"] = scores
+	}
+	return out
+}
+
+func matchedRuleDetails(mr types.MatchedRule) map[string]any {
+	rule := mr.Rule()
+	out := map[string]any{"id": rule.ID()}
+	if msg := mr.Message(); msg != "" {
+		out["msg"] = msg
+	}
+	if sev := rule.Severity().String(); sev != "" {
+		out["severity"] = sev
+	}
+	if tags := rule.Tags(); len(tags) > 0 {
+		out["tags"] = append([]string(nil), tags...)
+	}
+	for _, md := range mr.MatchedDatas() {
+		if md == nil {
+			continue
+		}
+		name := md.Variable().Name()
+		if key := md.Key(); key != "" {
+			name += ":" + key
+		}
+		out["matched_variable"] = name
+		if v := maskMatchedValue(md.Value()); v != "" {
+			out["matched_value"] = v
+		}
+		break
+	}
+	return out
+}
+
+// maskMatchedValue redacts tokens, e-mail addresses and other secrets, then
+// truncates on a rune boundary so events stay small and valid UTF-8.
+func maskMatchedValue(v string) string {
+	out := maskSensitiveText(v)
+	if len(out) <= maxEventMatchedValueBytes {
+		return out
+	}
+	cut := maxEventMatchedValueBytes
+	for cut > 0 && !utf8.RuneStart(out[cut]) {
+		cut--
+	}
+	return out[:cut] + "...(truncated)"
+}
+
+func crsAnomalyScores(tx types.Transaction) map[string]int {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return nil
+	}
+	txVars := state.Variables().TX()
+	out := map[string]int{}
+	for _, name := range crsAnomalyScoreVars {
+		values := txVars.Get(name)
+		if len(values) == 0 {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(values[0])); err == nil {
+			out[name] = n
+		}
+	}
+	return out
+}
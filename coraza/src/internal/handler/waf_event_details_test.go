@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+)
+
+func TestWAFInterruptionDetails_AnomalyScoring(t *testing.T) {
+	dir := t.TempDir()
+	detection := filepath.Join(dir, "REQUEST-942-APPLICATION-ATTACK-SQLI.conf")
+	blocking := filepath.Join(dir, "REQUEST-949-BLOCKING-EVALUATION.conf")
+	if err := os.WriteFile(detection, []byte("SecRuleEngine On\n"+
+		`SecRule ARGS "@contains union" "id:942100,phase:2,pass,log,severity:CRITICAL,tag:'attack-sqli',tag:'paranoia-level/1',msg:'SQL Injection Attack Detected',setvar:tx.blocking_inbound_anomaly_score=+5"`+"\n"), 0o644); err != nil {
+		t.Fatalf("write detection rules: %v", err)
+	}
+	if err := os.WriteFile(blocking, []byte(
+		`SecRule TX:BLOCKING_INBOUND_ANOMALY_SCORE "@ge 5" "id:949110,phase:2,deny,status:403,log,msg:'Inbound Anomaly Score Exceeded'"`+"\n"), 0o644); err != nil {
+		t.Fatalf("write blocking rules: %v", err)
+	}
+	w, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectivesFromFile(detection).WithDirectivesFromFile(blocking))
+	if err != nil {
+		t.Fatalf("coraza.NewWAF: %v", err)
+	}
+
+	payload := "admin@example.com union select " + strings.Repeat("é", 300)
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/search?q="+url.QueryEscape(payload), nil)
+	tx := w.NewTransaction()
+	defer tx.Close()
+	if err := processWAFRequest(tx, req, "198.51.100.1"); err != nil {
+		t.Fatalf("processWAFRequest() unexpected error: %v", err)
+	}
+	it := tx.Interruption()
+	if it == nil {
+		t.Fatal("expected interruption")
+	}
+
+	got := wafInterruptionDetails(tx, it)
+	if got["rule_id"] != 949110 || got["matched_rule_id"] != 942100 {
+		t.Fatalf("rule_id=%v matched_rule_id=%v", got["rule_id"], got["matched_rule_id"])
+	}
+	if got["msg"] != "Inbound Anomaly Score Exceeded" || got["severity"] != "critical" {
+		t.Fatalf("msg=%v severity=%v", got["msg"], got["severity"])
+	}
+	if tags, _ := got["tags"].([]string); len(tags) != 2 || tags[0] != "attack-sqli" {
+		t.Fatalf("tags=%v", got["tags"])
+	}
+	if got["matched_variable"] != "ARGS:q" {
+		t.Fatalf("matched_variable=%v", got["matched_variable"])
+	}
+	value, _ := got["matched_value"].(string)
+	if strings.Contains(value, "admin@example.com") || !strings.Contains(value, "[redacted-email]") {
+		t.Fatalf("matched_value should be masked: %q", value)
+	}
+	if !strings.HasSuffix(value, "...(truncated)") || len(value) > maxEventMatchedValueBytes+len("...(truncated)") {
+		t.Fatalf("matched_value should be truncated: len=%d", len(value))
+	}
+	if strings.ContainsRune(value, '�') {
+		t.Fatalf("truncation must keep valid UTF-8: %q", value)
+	}
+	if scores, _ := got["anomaly_scores"].(map[string]int); scores["blocking_inbound_anomaly_score"] != 5 {
+		t.Fatalf("anomaly_scores=%v", got["anomaly_scores"])
+	}
+	if rules, _ := got["matched_rules"].([]map[string]any); len(rules) != 2 {
+		t.Fatalf("matched_rules=%v", got["matched_rules"])
+	}
+
+	ev := map[string]any{"rule_id": got["rule_id"], "matched_rule_id": got["matched_rule_id"]}
+	if normalizeStatsRuleID(eventDetectionRuleID(ev)) != "942100" {
+		t.Fatalf("stats should count the detection rule, got %v", eventDetectionRuleID(ev))
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/types"
+
+	"mamotama/internal/config"
+	"mamotama/internal/waf"
+)
+
+const (
+	wafMonitorScopeGlobal  = "global"
+	wafMonitorScopePath    = "path"
+	wafMonitorScopeCRSFile = "crs_file"
+)
+
+// wafMonitorScope decides whether an interruption is only logged. It
+// returns the reason (global switch, monitored bypass path, or monitored
+// CRS file) or "" when the interruption must be enforced.
+//
+// With CRS anomaly scoring the blocking rule lives in a *-BLOCKING-
+// EVALUATION file, so for those the detections that raised the score are
+// checked instead: the block is monitored only if every one of them comes
+// from a monitored file.
+func wafMonitorScope(tx types.Transaction, it *types.Interruption, pathMonitor bool) string {
+	if config.MonitorMode {
+		return wafMonitorScopeGlobal
+	}
+	if pathMonitor {
+		return wafMonitorScopePath
+	}
+	if tx == nil || it == nil {
+		return ""
+	}
+
+	interruptingFile := ""
+	detectionFiles := make([]string, 0, 4)
+	for _, mr := range tx.MatchedRules() {
+		rule := mr.Rule()
+		if rule == nil {
+			continue
+		}
+		if rule.ID() == it.RuleID {
+			interruptingFile = rule.File()
+			continue
+		}
+		if mr.Message() == "" || isBlockingEvaluationFile(rule.File()) {
+			continue
+		}
+		detectionFiles = append(detectionFiles, rule.File())
+	}
+
+	if waf.IsMonitoredRuleFile(interruptingFile) {
+		return wafMonitorScopeCRSFile
+	}
+	if !isBlockingEvaluationFile(interruptingFile) || len(detectionFiles) == 0 {
+		return ""
+	}
+	for _, f := range detectionFiles {
+		if !waf.IsMonitoredRuleFile(f) {
+			return ""
+		}
+	}
+	return wafMonitorScopeCRSFile
+}
+
+func isBlockingEvaluationFile(file string) bool {
+	return strings.Contains(strings.ToUpper(file), "BLOCKING-EVALUATION")
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+
+	"mamotama/internal/config"
+	"mamotama/internal/waf"
+)
+
+func TestWAFMonitorScope(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.conf": "SecRuleEngine On\nSecRequestBodyAccess On\n" +
+			`SecRule ARGS:x "@streq bad" "id:100,phase:2,deny,status:403,log,msg:'direct'"` + "\n",
+		"REQUEST-942-APPLICATION-ATTACK-SQLI.conf": `SecRule ARGS:q "@contains attack" "id:942001,phase:2,pass,log,msg:'sqli',setvar:tx.score=+5"` + "\n",
+		"REQUEST-949-BLOCKING-EVALUATION.conf":     `SecRule TX:score "@ge 5" "id:949110,phase:2,deny,status:403,log,msg:'Anomaly score exceeded'"` + "\n",
+	}
+	cfg := coraza.NewWAFConfig()
+	for _, name := range []string{"base.conf", "REQUEST-942-APPLICATION-ATTACK-SQLI.conf", "REQUEST-949-BLOCKING-EVALUATION.conf"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		cfg = cfg.WithDirectivesFromFile(path)
+	}
+	w, err := coraza.NewWAF(cfg)
+	if err != nil {
+		t.Fatalf("coraza.NewWAF: %v", err)
+	}
+
+	prevMonitor := config.MonitorMode
+	t.Cleanup(func() {
+		config.MonitorMode = prevMonitor
+		waf.SetMonitoredRuleFiles(nil)
+	})
+
+	scope := func(query string, pathMonitor bool) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://example.test/?"+query, nil)
+		tx := w.NewTransaction()
+		defer tx.Close()
+		if err := processWAFRequest(tx, req, "198.51.100.1"); err != nil {
+			t.Fatalf("processWAFRequest() unexpected error: %v", err)
+		}
+		it := tx.Interruption()
+		if it == nil {
+			t.Fatalf("query %q should be interrupted", query)
+		}
+		return wafMonitorScope(tx, it, pathMonitor)
+	}
+
+	config.MonitorMode = false
+	waf.SetMonitoredRuleFiles(nil)
+	if got := scope("q=attack", false); got != "" {
+		t.Fatalf("no monitor config: scope=%q want enforce", got)
+	}
+	if got := scope("x=bad", true); got != wafMonitorScopePath {
+		t.Fatalf("monitored path: scope=%q", got)
+	}
+
+	waf.SetMonitoredRuleFiles([]string{"REQUEST-942-APPLICATION-ATTACK-SQLI.conf"})
+	if got := scope("q=attack", false); got != wafMonitorScopeCRSFile {
+		t.Fatalf("anomaly block from monitored file: scope=%q", got)
+	}
+	if got := scope("x=bad", false); got != "" {
+		t.Fatalf("rule outside monitored files must enforce: scope=%q", got)
+	}
+
+	waf.SetMonitoredRuleFiles([]string{"base.conf"})
+	if got := scope("x=bad", false); got != wafMonitorScopeCRSFile {
+		t.Fatalf("direct block from monitored file: scope=%q", got)
+	}
+
+	waf.SetMonitoredRuleFiles(nil)
+	config.MonitorMode = true
+	if got := scope("q=attack", false); got != wafMonitorScopeGlobal {
+		t.Fatalf("global monitor: scope=%q", got)
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/types"
+)
+
+// processWAFRequest runs phases 1 and 2 with the full request: connection
+// details, every header (cookies included) and the body. The transaction
+// buffers at most SecRequestBodyLimit bytes; r.Body is replaced with the
+// buffered copy followed by whatever was not read, so the upstream still
+// receives the original body, also after an interruption or read error.
+// Interruptions are left on the transaction for the caller to inspect with
+// tx.Interruption().
+func processWAFRequest(tx types.Transaction, r *http.Request, clientIP string) error {
+	_, clientPort := splitHostPortNumber(r.RemoteAddr)
+	serverIP, serverPort := "", 0
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr != nil {
+		serverIP, serverPort = splitHostPortNumber(addr.String())
+	}
+	tx.ProcessConnection(clientIP, clientPort, serverIP, serverPort)
+	tx.ProcessURI(r.URL.String(), r.Method, r.Proto)
+
+	for name, values := range r.Header {
+		for _, v := range values {
+			tx.AddRequestHeader(name, v)
+		}
+	}
+	// net/http moves Host and Transfer-Encoding out of the header map.
+	if r.Host != "" {
+		tx.AddRequestHeader("Host", r.Host)
+		tx.SetServerName(r.Host)
+	}
+	if len(r.TransferEncoding) > 0 {
+		tx.AddRequestHeader("Transfer-Encoding", r.TransferEncoding[0])
+	}
+
+	if it := tx.ProcessRequestHeaders(); it != nil {
+		return nil
+	}
+
+	if tx.IsRequestBodyAccessible() && r.Body != nil && r.Body != http.NoBody {
+		it, _, readErr := tx.ReadRequestBodyFrom(r.Body)
+		// The buffered prefix goes back even when reading hit the limit or
+		// failed: monitor mode and a failed inspection still proxy r.Body.
+		buffered, err := tx.RequestBodyReader()
+		if err != nil {
+			return fmt.Errorf("replay request body: %w", err)
+		}
+		r.Body = replayBody{Reader: io.MultiReader(buffered, r.Body), Closer: r.Body}
+		if readErr != nil {
+			return fmt.Errorf("read request body: %w", readErr)
+		}
+		if it != nil {
+			return nil
+		}
+	}
+
+	if _, err := tx.ProcessRequestBody(); err != nil {
+		return fmt.Errorf("process request body: %w", err)
+	}
+	return nil
+}
+
+// replayBody keeps the original Close so the connection is released
+// normally once the upstream has consumed the body.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+func splitHostPortNumber(hostport string) (string, int) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/gin-gonic/gin"
+
+	"mamotama/internal/config"
+	"mamotama/internal/waf"
+)
+
+func newWAFForTest(t *testing.T, directives string) coraza.WAF {
+	t.Helper()
+	w, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(directives))
+	if err != nil {
+		t.Fatalf("coraza.NewWAF: %v", err)
+	}
+	return w
+}
+
+func TestProcessWAFRequest_InspectsHeadersCookiesAndBody(t *testing.T) {
+	w := newWAFForTest(t, `
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRule REQUEST_HEADERS:X-Probe "@detectSQLi" "id:1,phase:1,deny,status:403"
+SecRule REQUEST_COOKIES:session "@streq evil" "id:2,phase:1,deny,status:403"
+SecRule ARGS_POST:q "@detectSQLi" "id:3,phase:2,deny,status:403"
+SecRule REMOTE_ADDR "@ipMatch 203.0.113.66" "id:4,phase:1,deny,status:403"
+`)
+
+	tests := []struct {
+		name   string
+		setup  func(r *http.Request)
+		body   string
+		wantID int
+	}{
+		{name: "header", setup: func(r *http.Request) { r.Header.Set("X-Probe", "1' OR '1'='1") }, wantID: 1},
+		{name: "cookie", setup: func(r *http.Request) { r.Header.Set("Cookie", "session=evil") }, wantID: 2},
+		{name: "form body", body: "q=1' OR '1'='1", wantID: 3},
+		{name: "clean request", body: "q=hello", wantID: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.test/search", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.setup != nil {
+				tt.setup(req)
+			}
+			tx := w.NewTransaction()
+			defer tx.Close()
+			if err := processWAFRequest(tx, req, "198.51.100.1"); err != nil {
+				t.Fatalf("processWAFRequest() unexpected error: %v", err)
+			}
+			it := tx.Interruption()
+			if tt.wantID == 0 {
+				if it != nil {
+					t.Fatalf("unexpected interruption by rule %d", it.RuleID)
+				}
+				return
+			}
+			if it == nil || it.RuleID != tt.wantID {
+				t.Fatalf("interruption=%+v want rule %d", it, tt.wantID)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	tx := w.NewTransaction()
+	defer tx.Close()
+	if err := processWAFRequest(tx, req, "203.0.113.66"); err != nil {
+		t.Fatalf("processWAFRequest() unexpected error: %v", err)
+	}
+	if it := tx.Interruption(); it == nil || it.RuleID != 4 {
+		t.Fatalf("REMOTE_ADDR should be the resolved client IP: %+v", it)
+	}
+}
+
+func TestProcessWAFRequest_ReplaysBodyBeyondLimit(t *testing.T) {
+	w := newWAFForTest(t, `
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRequestBodyLimit 16
+SecRequestBodyLimitAction ProcessPartial
+`)
+	body := "a=" + strings.Repeat("x", 64) + "&b=2"
+	req := httptest.NewRequest(http.MethodPost, "http://example.test/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tx := w.NewTransaction()
+	defer tx.Close()
+	if err := processWAFRequest(tx, req, "198.51.100.1"); err != nil {
+		t.Fatalf("processWAFRequest() unexpected error: %v", err)
+	}
+	got, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("read replayed body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("upstream body=%q want=%q", got, body)
+	}
+
+	w = newWAFForTest(t, `
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRequestBodyLimit 16
+SecRequestBodyLimitAction Reject
+`)
+	req = httptest.NewRequest(http.MethodPost, "http://example.test/upload", strings.NewReader(body))
+	tx2 := w.NewTransaction()
+	defer tx2.Close()
+	if err := processWAFRequest(tx2, req, "198.51.100.1"); err != nil {
+		t.Fatalf("processWAFRequest() unexpected error: %v", err)
+	}
+	if it := tx2.Interruption(); it == nil || it.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body should be rejected with 413: %+v", it)
+	}
+	if got, err := io.ReadAll(req.Body); err != nil || string(got) != body {
+		t.Fatalf("rejected body=%q err=%v want=%q", got, err, body)
+	}
+}
+
+func TestProcessWAFRequest_RestoresBodyOnReadError(t *testing.T) {
+	w := newWAFForTest(t, `
+SecRuleEngine On
+SecRequestBodyAccess On
+`)
+	boom := errors.New("client went away")
+	req := httptest.NewRequest(http.MethodPost, "http://example.test/upload", io.MultiReader(strings.NewReader("q=abc"), iotest.ErrReader(boom)))
+	tx := w.NewTransaction()
+	defer tx.Close()
+	if err := processWAFRequest(tx, req, "198.51.100.1"); !errors.Is(err, boom) {
+		t.Fatalf("processWAFRequest() err=%v want %v", err, boom)
+	}
+	got, err := io.ReadAll(req.Body)
+	if string(got) != "q=abc" || !errors.Is(err, boom) {
+		t.Fatalf("body=%q err=%v want the read prefix followed by the read error", got, err)
+	}
+}
+
+func TestProxyHandler_MonitorModeProxiesOversizedBodyUnchanged(t *testing.T) {
+	restoreRL := saveRateLimitStateForTest()
+	defer restoreRL()
+	t.Setenv("WAF_EVENTS_FILE", filepath.Join(t.TempDir(), "events.ndjson"))
+	prevMonitor, prevWAF := config.MonitorMode, waf.WAF
+	t.Cleanup(func() { config.MonitorMode, waf.WAF = prevMonitor, prevWAF })
+	config.MonitorMode = true
+	waf.WAF = newWAFForTest(t, `
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRequestBodyLimit 16
+SecRequestBodyLimitAction Reject
+`)
+
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+	useAppURLForTest(t, backend.URL)
+	useRoutesForTest(t, fmt.Sprintf(`{
+  "upstreams": [{"name": "monitor-body", "url": %q}],
+  "routes": [{"name": "monitor-body", "hosts": ["monitor.test"], "upstream": "monitor-body"}]
+}`, backend.URL))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(ProxyHandler)
+	front := httptest.NewServer(engine)
+	t.Cleanup(front.Close)
+
+	body := strings.Repeat("A", 16) + "TAIL"
+	req, err := http.NewRequest(http.MethodPost, front.URL+"/upload", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Host = "monitor.test"
+	res, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("monitor mode status=%d want=200", res.StatusCode)
+	}
+	if got := <-received; got != body {
+		t.Fatalf("upstream body=%q want=%q", got, body)
+	}
+}
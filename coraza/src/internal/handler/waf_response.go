@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/types"
+
+	"mamotama/internal/config"
+	"mamotama/internal/tracing"
+)
+
+// inspectWAFResponse runs phases 3 and 4 for the transaction that inspected
+// the request. It reports whether the upstream response was replaced with
+// a block page.
+//
+// Only bodies that Coraza would process are read: SecResponseBodyAccess
+// must be on, the Content-Type must be listed in SecResponseBodyMimeType
+// and the body must not be compressed. At most
+// WAF_RESPONSE_INSPECT_MAX_BYTES are buffered; the rest streams through
+// uninspected.
+func inspectWAFResponse(res *http.Response) bool {
+	if res == nil || res.Request == nil {
+		return false
+	}
+	tx, _ := res.Request.Context().Value(ctxKeyWafTx).(types.Transaction)
+	if tx == nil || tx.IsRuleEngineOff() {
+		return false
+	}
+	_, span := tracing.Start(res.Request.Context(), "waf.response", tracing.SpanKindInternal)
+	defer span.End()
+	pathMonitor, _ := res.Request.Context().Value(ctxKeyWafMonitor).(bool)
+
+	// block enforces the interruption, or only logs it in monitor mode.
+	block := func(it *types.Interruption) bool {
+		if scope := wafMonitorScope(tx, it, pathMonitor); scope != "" {
+			evt := responseEventBase(res, "waf_would_block")
+			evt["monitor_scope"] = scope
+			for k, v := range wafInterruptionDetails(tx, it) {
+				evt[k] = v
+			}
+			emitJSONLog(evt)
+			_ = appendEventToFile(evt)
+			observeWAFDecision(res.Request.Context(), evt, "would_block")
+			span.SetAttr("mamotama.would_block", true)
+			return false
+		}
+		replaceWithBlockPage(res, tx, it)
+		span.SetAttr("mamotama.interrupted", true)
+		return true
+	}
+
+	for name, values := range res.Header {
+		for _, v := range values {
+			tx.AddResponseHeader(name, v)
+		}
+	}
+	if it := tx.ProcessResponseHeaders(res.StatusCode, res.Proto); it != nil {
+		return block(it)
+	}
+
+	if shouldBufferResponseBody(tx, res) {
+		limit := config.ResponseInspectMaxBytes
+		it, _, err := tx.ReadResponseBodyFrom(io.LimitReader(res.Body, limit))
+		if err != nil {
+			log.Printf("[WAF][WARN] response body read failed: %v", err)
+			replaceWithUpstreamError(res)
+			return true
+		}
+		if it != nil && block(it) {
+			return true
+		}
+		buffered, err := tx.ResponseBodyReader()
+		if err != nil {
+			log.Printf("[WAF][WARN] response body replay failed: %v", err)
+			replaceWithUpstreamError(res)
+			return true
+		}
+		res.Body = replayBody{Reader: io.MultiReader(buffered, res.Body), Closer: res.Body}
+		if it != nil {
+			return false
+		}
+	}
+
+	it, err := tx.ProcessResponseBody()
+	if err != nil {
+		log.Printf("[WAF][WARN] response body inspection failed: %v", err)
+	}
+	if it != nil {
+		return block(it)
+	}
+	return false
+}
+
+func shouldBufferResponseBody(tx types.Transaction, res *http.Response) bool {
+	if config.ResponseInspectMaxBytes <= 0 {
+		return false
+	}
+	if res.Body == nil || res.Body == http.NoBody || res.ContentLength == 0 {
+		return false
+	}
+	if ce := strings.TrimSpace(res.Header.Get("Content-Encoding")); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	return tx.IsResponseBodyAccessible() && tx.IsResponseBodyProcessable()
+}
+
+func replaceWithBlockPage(res *http.Response, tx types.Transaction, it *types.Interruption) {
+	status := it.Status
+	if status <= 0 {
+		status = http.StatusForbidden
+	}
+	evt := responseEventBase(res, "waf_block")
+	for k, v := range wafInterruptionDetails(tx, it) {
+		evt[k] = v
+	}
+	evt["status"] = status
+	evt["upstream_status"] = res.StatusCode
+	emitJSONLog(evt)
+	_ = appendEventToFile(evt)
+	observeWAFDecision(res.Request.Context(), evt, "block")
+	setRequestOutcome(res.Request.Context(), requestOutcomeWAFBlock)
+
+	reqID, _ := evt["req_id"].(string)
+	country, _ := evt["country"].(string)
+	asHTML := acceptsHTML(res.Request.Header.Get("Accept"))
+	body, err := renderResponseTemplate(responseTemplateBlock, asHTML, responseTemplateVars{
+		Status:  status,
+		ReqID:   reqID,
+		RuleID:  logFieldString(eventDetectionRuleID(evt)),
+		Message: "The response was blocked by the web application firewall.",
+		Path:    res.Request.URL.Path,
+		Country: country,
+	})
+	if err != nil {
+		body = nil
+	}
+	closeResponseBody(res.Body)
+	res.StatusCode = status
+	res.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	res.Header = http.Header{}
+	res.Header.Set("Content-Type", responseTemplateContentType(asHTML))
+	res.Header.Set("Cache-Control", "no-store")
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	res.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+func responseEventBase(res *http.Response, event string) map[string]any {
+	ctx := res.Request.Context()
+	reqID, _ := ctx.Value(ctxKeyReqID).(string)
+	ip, _ := ctx.Value(ctxKeyIP).(string)
+	country, _ := ctx.Value(ctxKeyCountry).(string)
+	countrySource, _ := ctx.Value(ctxKeyCountrySource).(string)
+	return map[string]any{
+		"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+		"service":        "coraza",
+		"level":          "WARN",
+		"event":          event,
+		"phase":          "response",
+		"req_id":         reqID,
+		"trace_id":       tracing.TraceIDFromContext(ctx),
+		"ip":             ip,
+		"country":        country,
+		"country_source": countrySource,
+		"method":         res.Request.Method,
+		"path":           res.Request.URL.Path,
+	}
+}
+
+func replaceWithUpstreamError(res *http.Response) {
+	setRequestOutcome(res.Request.Context(), requestOutcomeUpstreamError)
+	closeResponseBody(res.Body)
+	res.StatusCode = http.StatusBadGateway
+	res.Status = "502 " + http.StatusText(http.StatusBadGateway)
+	res.Header = http.Header{}
+	res.ContentLength = 0
+	res.TransferEncoding = nil
+	res.Body = http.NoBody
+}
+
+func closeResponseBody(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	_ = body.Close()
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mamotama/internal/config"
+)
+
+const responseInspectionDirectives = `
+SecRuleEngine On
+SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain text/html application/json
+SecRule RESPONSE_HEADERS:X-Debug-Token "@rx ." "id:9001,phase:3,deny,status:403"
+SecRule RESPONSE_BODY "@contains ORA-00933" "id:9002,phase:4,deny,status:403"
+`
+
+func responseForTest(t *testing.T, contentType, body string, extra http.Header, pathMonitor bool) *http.Response {
+	t.Helper()
+	w := newWAFForTest(t, responseInspectionDirectives)
+	tx := w.NewTransaction()
+	t.Cleanup(func() { tx.Close() })
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/report", nil)
+	if err := processWAFRequest(tx, req, "198.51.100.1"); err != nil {
+		t.Fatalf("processWAFRequest() unexpected error: %v", err)
+	}
+	ctx := context.WithValue(req.Context(), ctxKeyWafTx, tx)
+	ctx = context.WithValue(ctx, ctxKeyReqID, "req-123")
+	ctx = context.WithValue(ctx, ctxKeyWafMonitor, pathMonitor)
+	req = req.WithContext(ctx)
+
+	h := http.Header{}
+	h.Set("Content-Type", contentType)
+	for k, v := range extra {
+		h[k] = v
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func TestInspectWAFResponse(t *testing.T) {
+	prevLimit := config.ResponseInspectMaxBytes
+	config.ResponseInspectMaxBytes = 1024
+	t.Cleanup(func() { config.ResponseInspectMaxBytes = prevLimit })
+	t.Setenv("WAF_EVENTS_FILE", t.TempDir()+"/events.ndjson")
+
+	leak := "error: ORA-00933: SQL command not properly ended"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		header      http.Header
+		monitor     bool
+		wantBlocked bool
+	}{
+		{name: "clean body", contentType: "text/html", body: "<p>ok</p>"},
+		{name: "leak in body", contentType: "text/html; charset=utf-8", body: leak, wantBlocked: true},
+		{name: "leaky header", contentType: "text/html", body: "ok", header: http.Header{"X-Debug-Token": {"abc"}}, wantBlocked: true},
+		{name: "non-inspectable type", contentType: "image/png", body: leak},
+		{name: "compressed body", contentType: "text/html", body: leak, header: http.Header{"Content-Encoding": {"gzip"}}},
+		{name: "monitored path", contentType: "text/html", body: leak, monitor: true},
+		{name: "leak beyond limit", contentType: "text/plain", body: strings.Repeat("a", 2048) + leak},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := responseForTest(t, tt.contentType, tt.body, tt.header, tt.monitor)
+			if err := onProxyResponse(res); err != nil {
+				t.Fatalf("onProxyResponse() unexpected error: %v", err)
+			}
+			got, _ := io.ReadAll(res.Body)
+			if tt.wantBlocked {
+				if res.StatusCode != http.StatusForbidden || !strings.Contains(string(got), "req-123") {
+					t.Fatalf("expected block page, status=%d body=%q", res.StatusCode, got)
+				}
+				if res.Header.Get("X-Debug-Token") != "" {
+					t.Fatal("upstream headers must not leak through the block page")
+				}
+				return
+			}
+			if res.StatusCode != http.StatusOK || string(got) != tt.body {
+				t.Fatalf("response should pass through unchanged, status=%d body=%q", res.StatusCode, got)
+			}
+		})
+	}
+}
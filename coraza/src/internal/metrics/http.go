@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Handler serves the registry, in OpenMetrics when the scraper asks for it.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		contentType := contentTypeText
+		if openMetrics {
+			contentType = contentTypeOpenMetrics
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(Render(openMetrics)))
+	})
+}
@@ -0,0 +1,398 @@
+// Package metrics is a small Prometheus registry. It supports counters,
+// gauges and histograms with fixed label names, plus collectors that
+// report gauges at scrape time, and renders the Prometheus text format or
+// OpenMetrics.
+//
+// Every vector caps its number of series. Once the cap is reached, new
+// label combinations are folded into one series whose labels are all
+// "other", so an unexpected label value cannot grow memory without bound.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultMaxSeries is the series cap of a vector unless WithMaxSeries
+	// changes it.
+	DefaultMaxSeries = 500
+	// OverflowValue replaces every label value of a series past the cap.
+	OverflowValue = "other"
+)
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Sample is one gauge value reported by a Collector.
+type Sample struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Collector reports gauges computed at scrape time.
+type Collector func() []Sample
+
+type family interface {
+	name() string
+	write(b *strings.Builder, openMetrics bool)
+}
+
+var (
+	registryMu sync.RWMutex
+	families   []family
+	collectors []Collector
+)
+
+func register(f family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, existing := range families {
+		if existing.name() == f.name() {
+			panic("metrics: duplicate metric " + f.name())
+		}
+	}
+	families = append(families, f)
+}
+
+// RegisterCollector adds a collector to every scrape.
+func RegisterCollector(c Collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	collectors = append(collectors, c)
+}
+
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+	maxSeries  int
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		maxSeries:  DefaultMaxSeries,
+		series:     map[string][]string{},
+	}
+}
+
+func (v *vec) name() string { return v.metricName }
+
+// key returns the series key for values, folding it into the overflow
+// series when the vector is full. The caller holds v.mu.
+func (v *vec) key(values []string) (string, bool) {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.metricName + " expects labels " + strings.Join(v.labels, ","))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := v.series[k]; ok {
+		return k, false
+	}
+	// One slot stays free for the overflow series.
+	if len(v.series) >= v.maxSeries-1 {
+		overflow := make([]string, len(values))
+		for i := range overflow {
+			overflow[i] = OverflowValue
+		}
+		values = overflow
+		k = strings.Join(values, "\xff")
+		if _, ok := v.series[k]; ok {
+			return k, false
+		}
+	}
+	v.series[k] = append([]string(nil), values...)
+	return k, true
+}
+
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a monotonically increasing value per label set. Names
+// should end in _total.
+type CounterVec struct {
+	vec
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, labels), values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// WithMaxSeries changes the series cap. Call it before the first update.
+func (c *CounterVec) WithMaxSeries(n int) *CounterVec {
+	c.maxSeries = n
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	k, _ := c.key(values)
+	c.values[k] += delta
+	c.mu.Unlock()
+}
+
+// Value returns the current value, mainly for tests.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(values, "\xff")]
+}
+
+func (c *CounterVec) write(b *strings.Builder, openMetrics bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	familyName := c.metricName
+	if openMetrics {
+		familyName = strings.TrimSuffix(familyName, "_total")
+	}
+	writeHeader(b, familyName, c.help, typeCounter)
+	for _, k := range c.sortedKeys() {
+		writeSample(b, c.metricName, c.labels, c.series[k], "", "", c.values[k])
+	}
+}
+
+// GaugeVec is a value per label set that can go up and down.
+type GaugeVec struct {
+	vec
+	values map[string]float64
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, labels), values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) WithMaxSeries(n int) *GaugeVec {
+	g.maxSeries = n
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.mu.Lock()
+	k, _ := g.key(values)
+	g.values[k] = value
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) Value(values ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[strings.Join(values, "\xff")]
+}
+
+func (g *GaugeVec) write(b *strings.Builder, _ bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(b, g.metricName, g.help, typeGauge)
+	for _, k := range g.sortedKeys() {
+		writeSample(b, g.metricName, g.labels, g.series[k], "", "", g.values[k])
+	}
+}
+
+// HistogramVec counts observations into cumulative buckets per label set.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bs := append([]float64(nil), buckets...)
+	sort.Float64s(bs)
+	h := &HistogramVec{vec: newVec(name, help, labels), buckets: bs, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) WithMaxSeries(n int) *HistogramVec {
+	h.maxSeries = n
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k, created := h.key(values)
+	hv := h.values[k]
+	if created || hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += value
+}
+
+// Count returns the number of observations, mainly for tests.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv := h.values[strings.Join(values, "\xff")]; hv != nil {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(b *strings.Builder, _ bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(b, h.metricName, h.help, typeHistogram)
+	for _, k := range h.sortedKeys() {
+		values := h.series[k]
+		hv := h.values[k]
+		for i, upper := range h.buckets {
+			writeSample(b, h.metricName+"_bucket", h.labels, values, "le", formatFloat(upper), float64(hv.counts[i]))
+		}
+		writeSample(b, h.metricName+"_bucket", h.labels, values, "le", "+Inf", float64(hv.count))
+		writeSample(b, h.metricName+"_sum", h.labels, values, "", "", hv.sum)
+		writeSample(b, h.metricName+"_count", h.labels, values, "", "", float64(hv.count))
+	}
+}
+
+// Render returns every registered metric in the Prometheus text format,
+// or in OpenMetrics when openMetrics is set.
+func Render(openMetrics bool) string {
+	registryMu.RLock()
+	fs := append([]family(nil), families...)
+	cs := append([]Collector(nil), collectors...)
+	registryMu.RUnlock()
+
+	var b strings.Builder
+	for _, f := range fs {
+		f.write(&b, openMetrics)
+	}
+
+	// Collector samples sharing a name form one family.
+	var order []string
+	grouped := map[string][]Sample{}
+	for _, c := range cs {
+		for _, s := range c() {
+			if _, ok := grouped[s.Name]; !ok {
+				order = append(order, s.Name)
+			}
+			grouped[s.Name] = append(grouped[s.Name], s)
+		}
+	}
+	for _, name := range order {
+		samples := grouped[name]
+		writeHeader(&b, name, samples[0].Help, typeGauge)
+		for _, s := range samples {
+			names := make([]string, 0, len(s.Labels))
+			for k := range s.Labels {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			values := make([]string, len(names))
+			for i, k := range names {
+				values[i] = s.Labels[k]
+			}
+			writeSample(&b, name, names, values, "", "", s.Value)
+		}
+	}
+
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return b.String()
+}
+
+func writeHeader(b *strings.Builder, name, help, typ string) {
+	b.WriteString("# HELP ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(escapeHelp(help))
+	b.WriteString("\n# TYPE ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(typ)
+	b.WriteByte('\n')
+}
+
+func writeSample(b *strings.Builder, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteByte('{')
+		sep := ""
+		for i, l := range labels {
+			b.WriteString(sep)
+			b.WriteString(l)
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(values[i]))
+			b.WriteByte('"')
+			sep = ","
+		}
+		if extraLabel != "" {
+			b.WriteString(sep)
+			b.WriteString(extraLabel)
+			b.WriteString(`="`)
+			b.WriteString(extraValue)
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
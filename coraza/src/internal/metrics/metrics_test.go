@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRender_TextFormat(t *testing.T) {
+	c := NewCounterVec("test_render_requests_total", "Requests.", "route", "outcome")
+	c.Inc("web", "proxied")
+	c.Add(2, "api", "waf_block")
+	c.Add(-1, "api", "waf_block")
+	h := NewHistogramVec("test_render_duration_seconds", "Latency.", []float64{0.5, 0.1}, "route")
+	h.Observe(0.05, "web")
+	h.Observe(0.3, "web")
+	g := NewGaugeVec("test_render_info", "Escaping \\ and\nnewlines.", "value")
+	g.Set(1, "a\"b\\c\nd")
+
+	out := Render(false)
+	for _, want := range []string{
+		"# HELP test_render_requests_total Requests.\n# TYPE test_render_requests_total counter\n" +
+			"test_render_requests_total{route=\"api\",outcome=\"waf_block\"} 2\n" +
+			"test_render_requests_total{route=\"web\",outcome=\"proxied\"} 1\n",
+		"test_render_duration_seconds_bucket{route=\"web\",le=\"0.1\"} 1\n" +
+			"test_render_duration_seconds_bucket{route=\"web\",le=\"0.5\"} 2\n" +
+			"test_render_duration_seconds_bucket{route=\"web\",le=\"+Inf\"} 2\n" +
+			"test_render_duration_seconds_sum{route=\"web\"} 0.35\n" +
+			"test_render_duration_seconds_count{route=\"web\"} 2\n",
+		"# HELP test_render_info Escaping \\\\ and\\nnewlines.\n",
+		"test_render_info{value=\"a\\\"b\\\\c\\nd\"} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output missing:\n%s\ngot:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "# EOF") {
+		t.Fatal("text format must not end with # EOF")
+	}
+}
+
+func TestCounterVec_OverflowBoundsSeries(t *testing.T) {
+	c := NewCounterVec("test_overflow_hits_total", "Hits.", "rule_id").WithMaxSeries(3)
+	for _, id := range []string{"1", "2", "3", "4", "5", "1"} {
+		c.Inc(id)
+	}
+	if got := c.Value("1"); got != 2 {
+		t.Fatalf("known series=%v want 2", got)
+	}
+	// Two series fit, the third slot goes to the overflow series.
+	if got := c.Value("3"); got != 0 {
+		t.Fatalf("series past the cap=%v want 0", got)
+	}
+	if got := c.Value(OverflowValue); got != 3 {
+		t.Fatalf("overflow=%v want 3", got)
+	}
+	if n := strings.Count(Render(false), "test_overflow_hits_total{"); n != 3 {
+		t.Fatalf("rendered series=%d want 3", n)
+	}
+}
+
+func TestCollectorAndOpenMetrics(t *testing.T) {
+	NewCounterVec("test_om_events_total", "Events.").Inc()
+	RegisterCollector(func() []Sample {
+		return []Sample{
+			{Name: "test_om_rows", Help: "Rows.", Labels: map[string]string{"event": "all"}, Value: 4},
+			{Name: "test_om_rows", Labels: map[string]string{"event": "waf_block"}, Value: 1},
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	Handler().ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != contentTypeOpenMetrics {
+		t.Fatalf("content-type=%q", ct)
+	}
+	out := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE test_om_events counter\ntest_om_events_total 1\n",
+		"# TYPE test_om_rows gauge\ntest_om_rows{event=\"all\"} 4\ntest_om_rows{event=\"waf_block\"} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output missing:\n%s\ngot:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Fatal("openmetrics output must end with # EOF")
+	}
+}
+
+func TestObserveReload(t *testing.T) {
+	ObserveReload("test_subsystem", nil)
+	ObserveReload("test_subsystem", errors.New("broken"))
+	if configReloads.Value("test_subsystem", "success") != 1 || configReloads.Value("test_subsystem", "failure") != 1 {
+		t.Fatal("both results should be counted")
+	}
+	if configLastReloadSuccess.Value("test_subsystem") != 0 {
+		t.Fatal("last reload failed")
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import "time"
+
+var (
+	configReloads = NewCounterVec(
+		"mamotama_config_reloads_total",
+		"Configuration reloads by subsystem and result (success or failure).",
+		"subsystem", "result",
+	).WithMaxSeries(64)
+	configLastReloadSuccess = NewGaugeVec(
+		"mamotama_config_last_reload_success",
+		"Whether the last reload of the subsystem succeeded (1) or failed (0).",
+		"subsystem",
+	).WithMaxSeries(32)
+	configLastReloadTimestamp = NewGaugeVec(
+		"mamotama_config_last_reload_timestamp_seconds",
+		"Unix time of the last reload attempt of the subsystem.",
+		"subsystem",
+	).WithMaxSeries(32)
+)
+
+// ObserveReload records a reload attempt of a configuration subsystem such
+// as routes, rate_limit or tls. err is the reload result.
+func ObserveReload(subsystem string, err error) {
+	result, ok := "success", 1.0
+	if err != nil {
+		result, ok = "failure", 0
+	}
+	configReloads.Inc(subsystem, result)
+	configLastReloadSuccess.Set(ok, subsystem)
+	configLastReloadTimestamp.Set(float64(time.Now().Unix()), subsystem)
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"mamotama/internal/config"
+)
+
+// AdminClientCert requires a client certificate verified against
+// WAF_TLS_ADMIN_CLIENT_CA_FILE. It is a no-op when no client CA is set.
+func AdminClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.TLSAdminClientCAFile == "" {
+			c.Next()
+			return
+		}
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
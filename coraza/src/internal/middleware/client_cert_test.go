@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"mamotama/internal/config"
+)
+
+func TestAdminClientCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	old := config.TLSAdminClientCAFile
+	defer func() { config.TLSAdminClientCAFile = old }()
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+	tests := []struct {
+		name         string
+		clientCA     string
+		state        *tls.ConnectionState
+		expectedCode int
+	}{
+		{name: "no client CA configured", clientCA: "", state: nil, expectedCode: http.StatusOK},
+		{name: "plain http rejected", clientCA: "ca.pem", state: nil, expectedCode: http.StatusForbidden},
+		{name: "tls without client cert rejected", clientCA: "ca.pem", state: &tls.ConnectionState{}, expectedCode: http.StatusForbidden},
+		{name: "verified client cert accepted", clientCA: "ca.pem", state: verified, expectedCode: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			config.TLSAdminClientCAFile = tc.clientCA
+
+			r := gin.New()
+			r.Use(AdminClientCert())
+			r.GET("/protected", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+			req.TLS = tc.state
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expectedCode {
+				t.Fatalf("status=%d want=%d", w.Code, tc.expectedCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Package proxyproto accepts HAProxy PROXY protocol v1 and v2 headers on a
+// listener so that the original client address survives a TCP load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// v1 headers are at most 107 bytes including CRLF.
+	maxV1HeaderLen = 107
+	// v2 address blocks larger than this are rejected; TLVs are skipped.
+	maxV2PayloadLen = 1024
+	defaultTimeout  = 5 * time.Second
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener wraps accepted connections. Only peers for which Trusted
+// returns true may supply a header; everyone else is passed through as is,
+// so a client talking directly to the listener cannot spoof its address.
+// A trusted peer that sends no header is also passed through.
+type Listener struct {
+	net.Listener
+	Trusted       func(netip.Addr) bool
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Conn{Conn: c, trusted: l.Trusted, timeout: timeout}, nil
+}
+
+// Conn reads the PROXY header lazily, on the first Read or RemoteAddr call,
+// so a slow peer only blocks its own connection goroutine and not Accept.
+type Conn struct {
+	net.Conn
+	trusted func(netip.Addr) bool
+	timeout time.Duration
+
+	once   sync.Once
+	br     *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.br != nil {
+		return c.br.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	peer := c.Conn.RemoteAddr()
+	if c.trusted == nil || !c.trusted(addrOf(peer)) {
+		return
+	}
+
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.br = bufio.NewReader(c.Conn)
+	remote, err := Parse(c.br)
+	if err != nil {
+		c.err = fmt.Errorf("proxyproto: %w", err)
+		_ = c.Conn.Close()
+		return
+	}
+	c.remote = remote
+}
+
+// Parse consumes a PROXY header from br if one is present. It returns a nil
+// address when there is no header, or when the header carries no usable
+// source (v1 UNKNOWN, v2 LOCAL, non-IP families).
+func Parse(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := br.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return parseV1(br)
+	case '\r':
+		sig, err := br.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(sig, v2Signature) {
+			return nil, nil
+		}
+		return parseV2(br)
+	default:
+		return nil, nil
+	}
+}
+
+func parseV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, errors.New("v1 header missing protocol")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("v1 unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("v1 header has wrong field count")
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("v1 invalid source address: %w", err)
+	}
+	if _, err := netip.ParseAddr(fields[3]); err != nil {
+		return nil, fmt.Errorf("v1 invalid destination address: %w", err)
+	}
+	if (fields[1] == "TCP4") != src.Is4() {
+		return nil, errors.New("v1 address family mismatch")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("v1 invalid source port: %w", err)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("v1 invalid destination port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+func parseV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("v2 unsupported version %d", hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0f
+	family := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > maxV2PayloadLen {
+		return nil, fmt.Errorf("v2 payload too large (%d bytes)", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("v2 unsupported command %d", cmd)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP over IPv4, UDP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("v2 short IPv4 address block")
+		}
+		src := netip.AddrFrom4([4]byte(payload[0:4]))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+	case 0x21, 0x22: // TCP over IPv6, UDP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("v2 short IPv6 address block")
+		}
+		src := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+	default:
+		// UNSPEC or UNIX sockets: keep the real peer.
+		return nil, nil
+	}
+}
+
+func addrOf(a net.Addr) netip.Addr {
+	if a == nil {
+		return netip.Addr{}
+	}
+	if ap, err := netip.ParseAddrPort(a.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	if addr, err := netip.ParseAddr(a.String()); err == nil {
+		return addr.Unmap()
+	}
+	return netip.Addr{}
+}
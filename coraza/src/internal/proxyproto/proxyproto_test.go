@@ -0,0 +1,107 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func v2Header(family byte, addrs []byte) []byte {
+	out := append([]byte{}, v2Signature...)
+	out = append(out, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(out[14:16], uint16(len(addrs)))
+	return append(out, addrs...)
+}
+
+func TestParse(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	binary.BigEndian.PutUint16(v6[32:34], 4711)
+	local := append(append([]byte{}, v2Signature...), 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", in: "PROXY TCP4 198.51.100.22 10.0.0.1 35646 80\r\nGET / HTTP/1.1\r\n", want: "198.51.100.22:35646"},
+		{name: "v1 tcp6", in: "PROXY TCP6 2001:db8::2 2001:db8::1 4711 443\r\nGET /", want: "[2001:db8::2]:4711"},
+		{name: "v1 unknown", in: "PROXY UNKNOWN\r\nGET /", want: ""},
+		{name: "v1 family mismatch", in: "PROXY TCP4 2001:db8::2 10.0.0.1 1 80\r\n", wantErr: true},
+		{name: "v1 no crlf", in: "PROXY TCP4 198.51.100.22 10.0.0.1 35646 80" + strings.Repeat(" ", 80), wantErr: true},
+		{name: "v2 tcp4", in: string(v2Header(0x11, v4)) + "GET /", want: "203.0.113.7:12345"},
+		{name: "v2 tcp6", in: string(v2Header(0x21, v6)) + "GET /", want: "[2001:db8::1]:4711"},
+		{name: "v2 local", in: string(local) + "GET /", want: ""},
+		{name: "v2 short", in: string(v2Header(0x11, v4[:6])), wantErr: true},
+		{name: "plain http", in: "GET / HTTP/1.1\r\n", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.in))
+			got, err := Parse(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse() expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			gotStr := ""
+			if got != nil {
+				gotStr = got.String()
+			}
+			if gotStr != tt.want {
+				t.Fatalf("Parse()=%q want=%q", gotStr, tt.want)
+			}
+			if rest, _ := io.ReadAll(br); !strings.HasPrefix(string(rest), "GET /") && tt.name != "v1 no crlf" {
+				t.Fatalf("remaining stream=%q should start with the request", rest)
+			}
+		})
+	}
+}
+
+func TestListener_OnlyTrustedPeersMaySendHeader(t *testing.T) {
+	for _, trusted := range []bool{true, false} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		pl := &Listener{Listener: ln, Trusted: func(netip.Addr) bool { return trusted }}
+
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			_, _ = c.Write([]byte("PROXY TCP4 198.51.100.22 10.0.0.1 35646 80\r\nping"))
+		}()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		remote := conn.RemoteAddr().String()
+		body, _ := io.ReadAll(conn)
+		_ = conn.Close()
+		_ = ln.Close()
+
+		if trusted {
+			if remote != "198.51.100.22:35646" || string(body) != "ping" {
+				t.Fatalf("trusted peer: remote=%s body=%q", remote, body)
+			}
+			continue
+		}
+		if strings.HasPrefix(remote, "198.51.100.22") || !strings.HasPrefix(string(body), "PROXY ") {
+			t.Fatalf("untrusted peer must not override address: remote=%s body=%q", remote, body)
+		}
+	}
+}
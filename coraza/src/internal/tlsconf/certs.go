@@ -0,0 +1,131 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultCertName is the pair served when SNI is missing or matches no
+// certificate. Without it the first pair by file name is the default.
+const DefaultCertName = "default"
+
+// CertSet maps SNI names to certificates loaded from one directory.
+type CertSet struct {
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate
+	fallback *tls.Certificate
+	names    []string
+}
+
+// LoadDir loads every "<name>.crt" / "<name>.key" pair in dir. Certificates
+// are indexed by their DNS SANs (or CN when there are none); a "*.domain"
+// SAN covers one label below domain.
+func LoadDir(dir string) (*CertSet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &CertSet{
+		exact:    map[string]*tls.Certificate{},
+		wildcard: map[string]*tls.Certificate{},
+	}
+	var first *tls.Certificate
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".crt" {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".crt")
+		certFile := filepath.Join(dir, e.Name())
+		keyFile := filepath.Join(dir, name+".key")
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		cert.Leaf = leaf
+
+		hosts := leaf.DNSNames
+		if len(hosts) == 0 && leaf.Subject.CommonName != "" {
+			hosts = []string{leaf.Subject.CommonName}
+		}
+		for _, h := range hosts {
+			h = strings.ToLower(strings.TrimSuffix(h, "."))
+			if strings.HasPrefix(h, "*.") {
+				if _, ok := cs.wildcard[h[2:]]; !ok {
+					cs.wildcard[h[2:]] = &cert
+				}
+				continue
+			}
+			if _, ok := cs.exact[h]; !ok {
+				cs.exact[h] = &cert
+			}
+		}
+
+		if first == nil {
+			first = &cert
+		}
+		if name == DefaultCertName {
+			cs.fallback = &cert
+		}
+		cs.names = append(cs.names, name)
+	}
+	if first == nil {
+		return nil, fmt.Errorf("no <name>.crt/<name>.key pairs in %s", dir)
+	}
+	if cs.fallback == nil {
+		cs.fallback = first
+	}
+	sort.Strings(cs.names)
+
+	return cs, nil
+}
+
+// Lookup returns the certificate for serverName, falling back to the
+// default pair.
+func (cs *CertSet) Lookup(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := cs.exact[name]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := cs.wildcard[parent]; ok {
+			return cert
+		}
+	}
+	return cs.fallback
+}
+
+// Names lists the loaded pairs by file name.
+func (cs *CertSet) Names() []string {
+	return append([]string(nil), cs.names...)
+}
+
+var current atomic.Pointer[CertSet]
+
+func Set(cs *CertSet) {
+	current.Store(cs)
+}
+
+func Get() *CertSet {
+	return current.Load()
+}
+
+// GetCertificate is the tls.Config hook; it always reads the latest set so
+// reloads apply to new handshakes immediately.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs := Get()
+	if cs == nil {
+		return nil, fmt.Errorf("tls: no certificates loaded")
+	}
+	return cs.Lookup(hello.ServerName), nil
+}
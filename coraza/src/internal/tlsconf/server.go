@@ -0,0 +1,78 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ServerConfig builds the listener TLS config. Certificates come from the
+// watched set via GetCertificate. cipherNames use Go's names (for example
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) and only affect TLS 1.2; insecure
+// suites are rejected. When clientCAFile is set, client certificates signed
+// by it are verified if offered; the admin API then requires one.
+func ServerConfig(minVersion string, cipherNames []string, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	switch strings.TrimSpace(minVersion) {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q (use 1.2 or 1.3)", minVersion)
+	}
+
+	if len(cipherNames) > 0 {
+		suites, err := ParseCipherSuites(cipherNames)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = suites
+	}
+
+	if path := strings.TrimSpace(clientCAFile); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA: no PEM certificates in %s", path)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	insecure := map[string]bool{}
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.Name] = true
+	}
+
+	out := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
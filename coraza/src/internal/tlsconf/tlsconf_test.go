@@ -0,0 +1,256 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, name, cn string, dnsNames ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the key first so a watcher never sees a new cert with an old key.
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDir_SelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "api", "api", "api.example.test")
+	writeTestCert(t, dir, "shop", "shop", "*.shop.example.test", "shop.example.test")
+	writeTestCert(t, dir, "default", "fallback")
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("LoadDir: %v", err)
+	}
+	if got := strings.Join(cs.Names(), ","); got != "api,default,shop" {
+		t.Fatalf("Names()=%s", got)
+	}
+
+	tests := []struct{ sni, want string }{
+		{sni: "api.example.test", want: "api"},
+		{sni: "API.Example.Test.", want: "api"},
+		{sni: "shop.example.test", want: "shop"},
+		{sni: "eu.shop.example.test", want: "shop"},
+		{sni: "a.eu.shop.example.test", want: "fallback"},
+		{sni: "", want: "fallback"},
+		{sni: "fallback", want: "fallback"},
+	}
+	for _, tt := range tests {
+		if got := cs.Lookup(tt.sni).Leaf.Subject.CommonName; got != tt.want {
+			t.Fatalf("Lookup(%q)=%s want %s", tt.sni, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDir_Errors(t *testing.T) {
+	if _, err := LoadDir(t.TempDir()); err == nil || !strings.Contains(err.Error(), "no <name>.crt") {
+		t.Fatalf("empty dir err=%v", err)
+	}
+
+	dir := t.TempDir()
+	writeTestCert(t, dir, "api", "api", "api.example.test")
+	if err := os.Remove(filepath.Join(dir, "api.key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDir(dir); err == nil || !strings.Contains(err.Error(), "api.crt") {
+		t.Fatalf("missing key err=%v", err)
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	cfg, err := ServerConfig("1.3", nil, "")
+	if err != nil || cfg.MinVersion != tls.VersionTLS13 || cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("cfg=%+v err=%v", cfg, err)
+	}
+	cfg, err = ServerConfig("", []string{"tls_ecdhe_ecdsa_with_aes_128_gcm_sha256"}, "")
+	if err != nil || cfg.MinVersion != tls.VersionTLS12 || len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("cfg=%+v err=%v", cfg, err)
+	}
+
+	for _, tt := range []struct {
+		min     string
+		ciphers []string
+		ca      string
+		wantErr string
+	}{
+		{min: "1.1", wantErr: "minimum TLS version"},
+		{ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}, wantErr: "insecure"},
+		{ciphers: []string{"TLS_FAKE"}, wantErr: "unknown cipher"},
+		{ca: filepath.Join(t.TempDir(), "missing.pem"), wantErr: "client CA"},
+	} {
+		if _, err := ServerConfig(tt.min, tt.ciphers, tt.ca); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("min=%q ciphers=%v ca=%q err=%v want %q", tt.min, tt.ciphers, tt.ca, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWatch_ReloadsChangedCertificates(t *testing.T) {
+	prev := Get()
+	t.Cleanup(func() { Set(prev) })
+
+	dir := t.TempDir()
+	writeTestCert(t, dir, "api", "api-v1", "api.example.test")
+
+	stop, err := Watch(dir)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer stop()
+
+	cfg, err := ServerConfig("1.2", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	servedCN := func(sni string) string {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", ln.Addr().String(), &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := servedCN("api.example.test"); got != "api-v1" {
+		t.Fatalf("initial cert=%s", got)
+	}
+
+	writeTestCert(t, dir, "www", "www", "www.example.test")
+	writeTestCert(t, dir, "api", "api-v2", "api.example.test")
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCN("api.example.test") != "api-v2" || servedCN("www.example.test") != "www" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificates were not reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// A broken pair keeps the previous set.
+	if err := os.WriteFile(filepath.Join(dir, "broken.crt"), []byte("not a cert"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(800 * time.Millisecond)
+	if got := servedCN("www.example.test"); got != "www" {
+		t.Fatalf("after failed reload cert=%s", got)
+	}
+}
+
+func TestWatch_ReloadsSwappedSymlinkDirectory(t *testing.T) {
+	prev := Get()
+	t.Cleanup(func() { Set(prev) })
+
+	// Lay the directory out like a Kubernetes secret mount: the visible
+	// files point through ..data, which is swapped to renew them.
+	dir := t.TempDir()
+	writeTestCert(t, mkdirForTest(t, filepath.Join(dir, "..v1")), "api", "api-v1", "api.example.test")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"api.crt", "api.key"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop, err := Watch(dir)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer stop()
+
+	servedCN := func() string {
+		cert := Get().Lookup("api.example.test")
+		if cert == nil {
+			t.Fatal("no certificate for api.example.test")
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := servedCN(); got != "api-v1" {
+		t.Fatalf("initial cert=%s", got)
+	}
+
+	writeTestCert(t, mkdirForTest(t, filepath.Join(dir, "..v2")), "api", "api-v2", "api.example.test")
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "..v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCN() != "api-v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificates were not reloaded after the symlink swap")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func mkdirForTest(t *testing.T, dir string) string {
+	t.Helper()
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,98 @@
+package tlsconf
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"mamotama/internal/metrics"
+)
+
+// Watch loads the certificate directory, installs it with Set and reloads
+// it whenever anything in the directory changes. Kubernetes secret mounts
+// renew by swapping the ..data symlink, so events are not filtered by
+// extension; LoadDir ignores the extra entries. Unlike the cache and GeoIP
+// watchers the initial load must succeed, since the listener cannot serve
+// without a certificate. A failed reload keeps the previous set.
+func Watch(dir string) (func() error, error) {
+	abs, _ := filepath.Abs(dir)
+
+	cs, err := LoadDir(abs)
+	if err != nil {
+		return nil, err
+	}
+	Set(cs)
+	log.Printf("[TLS] loaded certificates %s (initial)", strings.Join(cs.Names(), ","))
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(abs); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		var timer *time.Timer
+		defer func() {
+			// A pending reload must not swap the certificates after stop.
+			if timer != nil {
+				timer.Stop()
+			}
+			close(done)
+		}()
+
+		fire := func() {
+			cs, err := LoadDir(abs)
+			metrics.ObserveReload("tls", err)
+			if err != nil {
+				log.Printf("[TLS][WARN] reload failed: %v (keeping previous certificates)", err)
+				return
+			}
+
+			Set(cs)
+			log.Printf("[TLS] reloaded certificates %s", strings.Join(cs.Names(), ","))
+		}
+
+		schedule := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			// A renewal rewrites the certificate and the key separately,
+			// or touches several entries at once; wait until it settles.
+			timer = time.AfterFunc(500*time.Millisecond, fire)
+		}
+
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					schedule()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[TLS][WARN] watcher error: %v", err)
+			}
+		}
+	}()
+
+	stop := func() error {
+		_ = w.Close()
+		<-done
+		return nil
+	}
+
+	return stop, nil
+}
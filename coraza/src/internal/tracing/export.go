@@ -0,0 +1,369 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mamotama/internal/metrics"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+
+	queueSize      = 2048
+	maxBatchSize   = 512
+	exportInterval = 2 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+var spansTotal = metrics.NewCounterVec(
+	"mamotama_tracing_spans_total",
+	"Finished spans by result (exported, dropped when the queue is full, or failed to export).",
+	"result",
+)
+
+// Config selects the exporter. Endpoint is the full OTLP/HTTP traces URL,
+// for example http://collector:4318/v1/traces. Stdout is where the stdout
+// exporter writes; nil means os.Stdout.
+type Config struct {
+	Exporter    string
+	Endpoint    string
+	Headers     map[string]string
+	SampleRatio float64
+	ServiceName string
+	Stdout      io.Writer
+}
+
+type exporter interface {
+	export(ctx context.Context, serviceName string, spans []*Span) error
+}
+
+type provider struct {
+	exp         exporter
+	serviceName string
+	threshold   uint64
+	always      bool
+
+	queue    chan *Span
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var current atomic.Pointer[provider]
+
+func currentProvider() *provider { return current.Load() }
+
+// Configure installs the exporter and returns a function that flushes
+// pending spans and stops it. With ExporterNone spans are still created
+// for propagation but nothing is recorded.
+func Configure(cfg Config) (func() error, error) {
+	var exp exporter
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		if prev := current.Swap(nil); prev != nil {
+			prev.shutdown()
+		}
+		return func() error { return nil }, nil
+	case ExporterOTLP:
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid OTLP endpoint %q", cfg.Endpoint)
+		}
+		exp = &otlpExporter{
+			endpoint: u.String(),
+			headers:  cfg.Headers,
+			client:   &http.Client{Timeout: exportTimeout},
+		}
+	case ExporterStdout:
+		w := cfg.Stdout
+		if w == nil {
+			w = os.Stdout
+		}
+		exp = &stdoutExporter{w: w}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "mamotama"
+	}
+	p := &provider{
+		exp:         exp,
+		serviceName: serviceName,
+		queue:       make(chan *Span, queueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	switch {
+	case cfg.SampleRatio >= 1:
+		p.always = true
+	case cfg.SampleRatio > 0:
+		p.threshold = uint64(cfg.SampleRatio * (1 << 63))
+	}
+	go p.run()
+
+	if prev := current.Swap(p); prev != nil {
+		prev.shutdown()
+	}
+	return func() error {
+		current.CompareAndSwap(p, nil)
+		p.shutdown()
+		return nil
+	}, nil
+}
+
+// sampleRoot decides for new traces by trace id, so every service using
+// the same ratio keeps the same traces.
+func (p *provider) sampleRoot(t TraceID) bool {
+	if p.always {
+		return true
+	}
+	return binary.BigEndian.Uint64(t[8:])>>1 < p.threshold
+}
+
+func (p *provider) enqueue(s *Span) {
+	select {
+	case p.queue <- s:
+	default:
+		spansTotal.Inc("dropped")
+	}
+}
+
+func (p *provider) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		err := p.exp.export(ctx, p.serviceName, batch)
+		cancel()
+		if err != nil {
+			log.Printf("[TRACING][WARN] export of %d spans failed: %v", len(batch), err)
+			spansTotal.Add(float64(len(batch)), "failed")
+		} else {
+			spansTotal.Add(float64(len(batch)), "exported")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-p.queue:
+			batch = append(batch, s)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.stop:
+			for {
+				select {
+				case s := <-p.queue:
+					batch = append(batch, s)
+					if len(batch) >= maxBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *provider) shutdown() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// otlpExporter posts ExportTraceServiceRequest messages in the OTLP/HTTP
+// JSON encoding.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, serviceName string, spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(serviceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", res.Status)
+	}
+	return nil
+}
+
+// stdoutExporter writes one JSON object per span and line.
+type stdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type stdoutSpan struct {
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	Service      string         `json:"service"`
+	Name         string         `json:"name"`
+	Kind         SpanKind       `json:"kind"`
+	Start        string         `json:"start"`
+	DurationMS   float64        `json:"duration_ms"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+func (e *stdoutExporter) export(_ context.Context, serviceName string, spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		s.mu.Lock()
+		out := stdoutSpan{
+			TraceID:    s.sc.TraceID.String(),
+			SpanID:     s.sc.SpanID.String(),
+			Service:    serviceName,
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      s.start.UTC().Format(time.RFC3339Nano),
+			DurationMS: float64(s.end.Sub(s.start).Microseconds()) / 1000,
+		}
+		if s.parent.IsValid() {
+			out.ParentSpanID = s.parent.String()
+		}
+		if len(s.attrs) > 0 {
+			out.Attributes = make(map[string]any, len(s.attrs))
+			for _, a := range s.attrs {
+				out.Attributes[a.Key] = a.Value
+			}
+		}
+		if s.statusCode == statusError {
+			out.Error = s.statusMessage
+			if out.Error == "" {
+				out.Error = "error"
+			}
+		}
+		s.mu.Unlock()
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpRequest(serviceName string, spans []*Span) map[string]any {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+		}
+		if s.parent.IsValid() {
+			o.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpKeyValue{Key: a.Key, Value: otlpAnyValue(a.Value)})
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue(serviceName)}},
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "mamotama"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+// otlpAnyValue encodes an attribute value. 64-bit integers are strings in
+// the OTLP JSON encoding.
+func otlpAnyValue(v any) map[string]any {
+	switch x := v.(type) {
+	case string:
+		return map[string]any{"stringValue": x}
+	case bool:
+		return map[string]any{"boolValue": x}
+	case int:
+		return map[string]any{"intValue": strconv.FormatInt(int64(x), 10)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(x, 10)}
+	case uint64:
+		return map[string]any{"intValue": strconv.FormatUint(x, 10)}
+	case float64:
+		return map[string]any{"doubleValue": x}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(x)}
+	}
+}
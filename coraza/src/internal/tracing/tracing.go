@@ -0,0 +1,195 @@
+// Package tracing is a small OpenTelemetry-compatible tracer. It creates
+// spans with W3C trace context, propagates traceparent and exports
+// finished spans over OTLP/HTTP (JSON encoding) or to stdout.
+//
+// Span contexts are created even when no exporter is configured, so trace
+// ids in events and the traceparent sent upstream stay consistent; only
+// sampled spans of a configured exporter are recorded.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// Remote marks a span context extracted from an incoming request.
+	Remote bool
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// SpanKind follows the OTLP enum values.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Status codes follow the OTLP enum values.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+// Span is one timed operation. Its methods are safe on a nil span and do
+// nothing when the span is not recorded.
+type Span struct {
+	sc        SpanContext
+	parent    SpanID
+	name      string
+	kind      SpanKind
+	start     time.Time
+	recording bool
+
+	mu            sync.Mutex
+	end           time.Time
+	attrs         []Attr
+	statusCode    int
+	statusMessage string
+	ended         atomic.Bool
+}
+
+// Attr is a span attribute. Value is a string, bool, integer or float.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) IsRecording() bool { return s != nil && s.recording }
+
+func (s *Span) SetAttr(key string, value any) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, Attr{Key: key, Value: value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = statusError
+	s.statusMessage = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter. Only the first call
+// has an effect.
+func (s *Span) End() {
+	if !s.IsRecording() || !s.ended.CompareAndSwap(false, true) {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if p := currentProvider(); p != nil {
+		p.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns ctx carrying span as the current span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// TraceIDFromContext returns the hex trace id of the current span, or ""
+// when ctx has none.
+func TraceIDFromContext(ctx context.Context) string {
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		return sc.TraceID.String()
+	}
+	return ""
+}
+
+// Start begins a span as a child of the current span in ctx, or of a
+// remote parent set by Extract, or as a new root.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.sc
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	p := currentProvider()
+	sc := SpanContext{SpanID: newSpanID()}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = p != nil && p.sampleRoot(sc.TraceID)
+	}
+
+	span := &Span{
+		sc:        sc,
+		parent:    parent.SpanID,
+		name:      name,
+		kind:      kind,
+		start:     time.Now(),
+		recording: p != nil && sc.Sampled,
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func newTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		binary.BigEndian.PutUint64(t[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(t[8:], rand.Uint64())
+	}
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		binary.BigEndian.PutUint64(s[:], rand.Uint64())
+	}
+	return s
+}
@@ -0,0 +1,245 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{name: "not sampled", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{name: "future version with extra field", in: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz", ok: true, sampled: true},
+		{name: "version 00 with extra field", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz"},
+		{name: "invalid version", in: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "upper case", in: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{name: "zero trace id", in: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span id", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-01"},
+		{name: "empty", in: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("ok=%v want=%v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.Sampled != tt.sampled || !sc.Remote {
+				t.Fatalf("unexpected span context: %+v", sc)
+			}
+			if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+				t.Fatalf("unexpected ids: %s %s", sc.TraceID, sc.SpanID)
+			}
+		})
+	}
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("round trip=%q", got)
+	}
+}
+
+func TestStart_ParentAndPropagation(t *testing.T) {
+	h := http.Header{}
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := Start(Extract(context.Background(), h), "GET", SpanKindServer)
+	if got := TraceIDFromContext(ctx); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace id=%q", got)
+	}
+	if root.parent.String() != "00f067aa0ba902b7" || !root.SpanContext().Sampled {
+		t.Fatalf("root did not continue the remote trace: %+v parent=%s", root.SpanContext(), root.parent)
+	}
+
+	cctx, child := Start(ctx, "country", SpanKindInternal)
+	if child.parent != root.sc.SpanID || child.sc.TraceID != root.sc.TraceID {
+		t.Fatal("child is not linked to the root span")
+	}
+	out := http.Header{}
+	Inject(cctx, out)
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.sc.SpanID.String() + "-01"
+	if got := out.Get("traceparent"); got != want {
+		t.Fatalf("traceparent=%q want=%q", got, want)
+	}
+
+	_, fresh := Start(context.Background(), "GET", SpanKindServer)
+	if !fresh.sc.TraceID.IsValid() || fresh.parent.IsValid() {
+		t.Fatalf("expected a new root span: %+v", fresh.sc)
+	}
+	if fresh.IsRecording() {
+		t.Fatal("span must not record without an exporter")
+	}
+	fresh.SetAttr("k", "v")
+	fresh.End()
+
+	var nilSpan *Span
+	nilSpan.SetAttr("k", "v")
+	nilSpan.SetError("x")
+	nilSpan.End()
+}
+
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestConfigure_StdoutExporter(t *testing.T) {
+	var out lockedBuffer
+	stop, err := Configure(Config{Exporter: ExporterStdout, SampleRatio: 1, ServiceName: "test", Stdout: &out})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+
+	ctx, root := Start(context.Background(), "GET", SpanKindServer)
+	_, child := Start(ctx, "waf.request", SpanKindInternal)
+	child.SetAttr("mamotama.waf.rule_id", 942100)
+	child.SetError("blocked")
+	child.End()
+	child.End()
+	root.End()
+	if err := stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got %d: %s", len(lines), out.String())
+	}
+	var first stdoutSpan
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if first.Name != "waf.request" || first.Service != "test" || first.Error != "blocked" ||
+		first.TraceID != root.sc.TraceID.String() || first.ParentSpanID != root.sc.SpanID.String() {
+		t.Fatalf("unexpected span: %+v", first)
+	}
+	if first.Attributes["mamotama.waf.rule_id"] != float64(942100) {
+		t.Fatalf("unexpected attributes: %#v", first.Attributes)
+	}
+
+	// After stop nothing records any more.
+	_, after := Start(context.Background(), "GET", SpanKindServer)
+	if after.IsRecording() {
+		t.Fatal("span recorded after the exporter was stopped")
+	}
+}
+
+func TestConfigure_OTLPExporter(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{header: r.Header.Clone(), body: body}
+	}))
+	defer collector.Close()
+
+	stop, err := Configure(Config{
+		Exporter:    ExporterOTLP,
+		Endpoint:    collector.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer t"},
+		SampleRatio: 1,
+		ServiceName: "edge",
+	})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	_, span := Start(context.Background(), "upstream.attempt", SpanKindClient)
+	span.SetAttr("http.response.status_code", 200)
+	span.SetAttr("url.full", "http://app:8080/")
+	span.End()
+	_ = stop()
+
+	var r received
+	select {
+	case r = <-got:
+	default:
+		t.Fatal("collector received nothing")
+	}
+	if r.header.Get("Authorization") != "Bearer t" || r.header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected headers: %v", r.header)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string         `json:"traceId"`
+					Name       string         `json:"name"`
+					Kind       int            `json:"kind"`
+					Attributes []otlpKeyValue `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(r.body, &req); err != nil {
+		t.Fatalf("decode: %v body=%s", err, r.body)
+	}
+	rs := req.ResourceSpans[0]
+	if rs.Resource.Attributes[0].Key != "service.name" || rs.Resource.Attributes[0].Value["stringValue"] != "edge" {
+		t.Fatalf("unexpected resource: %+v", rs.Resource)
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	if s.Name != "upstream.attempt" || s.Kind != int(SpanKindClient) || s.TraceID != span.sc.TraceID.String() {
+		t.Fatalf("unexpected span: %+v", s)
+	}
+	if s.Attributes[0].Value["intValue"] != "200" || s.Attributes[1].Value["stringValue"] != "http://app:8080/" {
+		t.Fatalf("unexpected attributes: %+v", s.Attributes)
+	}
+}
+
+func TestConfigure_SampleRatioZero(t *testing.T) {
+	var out lockedBuffer
+	stop, err := Configure(Config{Exporter: ExporterStdout, SampleRatio: 0, Stdout: &out})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	_, span := Start(context.Background(), "GET", SpanKindServer)
+	if span.IsRecording() || span.SpanContext().Sampled {
+		t.Fatal("root span sampled with ratio 0")
+	}
+	span.End()
+	_ = stop()
+	if out.String() != "" {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+}
+
+func TestConfigure_Invalid(t *testing.T) {
+	if _, err := Configure(Config{Exporter: ExporterOTLP, Endpoint: "collector:4318"}); err == nil {
+		t.Fatal("expected an error for an endpoint without scheme")
+	}
+	if _, err := Configure(Config{Exporter: "zipkin"}); err == nil {
+		t.Fatal("expected an error for an unknown exporter")
+	}
+}
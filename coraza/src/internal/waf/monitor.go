@@ -0,0 +1,54 @@
+package waf
+
+import (
+	"log"
+	"sync"
+
+	"mamotama/internal/config"
+	"mamotama/internal/crsselection"
+)
+
+var (
+	monitorMu       sync.RWMutex
+	monitorCRSFiles = map[string]struct{}{}
+)
+
+// loadCRSMonitorSet re-reads WAF_CRS_MONITOR_FILE. A read error keeps the
+// previous set so a bad edit cannot silently switch files to enforcing.
+func loadCRSMonitorSet() {
+	set, err := crsselection.LoadMonitorFile(config.CRSMonitorFile)
+	if err != nil {
+		log.Printf("[WAF][MONITOR][WARN] failed to load %s: %v (keeping previous list)", config.CRSMonitorFile, err)
+		return
+	}
+	monitorMu.Lock()
+	monitorCRSFiles = set
+	monitorMu.Unlock()
+	if len(set) > 0 {
+		log.Printf("[WAF][MONITOR] %d CRS rule files in monitor mode", len(set))
+	}
+}
+
+// IsMonitoredRuleFile reports whether rules loaded from file only log.
+func IsMonitoredRuleFile(file string) bool {
+	name := crsselection.NormalizeName(file)
+	if name == "" || name == "." {
+		return false
+	}
+	monitorMu.RLock()
+	defer monitorMu.RUnlock()
+	_, ok := monitorCRSFiles[name]
+	return ok
+}
+
+func SetMonitoredRuleFiles(names []string) {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		if name := crsselection.NormalizeName(n); name != "" {
+			set[name] = struct{}{}
+		}
+	}
+	monitorMu.Lock()
+	monitorCRSFiles = set
+	monitorMu.Unlock()
+}
@@ -17,6 +17,7 @@ import (
 	"mamotama/internal/bypassconf"
 	"mamotama/internal/config"
 	"mamotama/internal/crsselection"
+	"mamotama/internal/metrics"
 )
 
 var WAF coraza.WAF
@@ -202,6 +203,7 @@ func InitWAF() {
 		log.Fatalf("failed to initialize WAF: %v", err)
 	}
 	setBaseWAF(base)
+	loadCRSMonitorSet()
 
 	if err := bypassconf.Init(config.BypassFile); err != nil {
 		log.Printf("[BYPASS][INIT][ERR] %v (path=%s)", err, config.BypassFile)
@@ -309,7 +311,9 @@ func ValidateWithRuleOverride(targetPath string, raw []byte) error {
 	return err
 }
 
-func ReloadBaseWAF() error {
+func ReloadBaseWAF() (err error) {
+	defer func() { metrics.ObserveReload("rules", err) }()
+
 	files, err := PrepareInitialRuleFiles()
 	if err != nil {
 		return err
@@ -319,6 +323,7 @@ func ReloadBaseWAF() error {
 		return err
 	}
 	setBaseWAF(base)
+	loadCRSMonitorSet()
 	log.Printf("[WAF] Reloaded base rules (%d files)", len(files))
 	return nil
 }